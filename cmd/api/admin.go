@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/xenitane/todo-app-be-oe/internals/config"
+	"github.com/xenitane/todo-app-be-oe/internals/database"
+	"github.com/xenitane/todo-app-be-oe/internals/logging"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+	"golang.org/x/term"
+)
+
+// The commands working on the database directly, for administering it
+// without going through the api.
+
+const (
+	// seedPassword is the password of the sample users
+	seedPassword = "seedpassword"
+
+	// seedUsername is the prefix of the usernames of the sample users
+	seedUsername = "seeduser"
+)
+
+// seedTodos are the titles and descriptions the sample todos cycle through
+var seedTodos = [][2]string{
+	{"Buy groceries", "milk, eggs, bread and coffee"},
+	{"Write the weekly report", "sum up the progress for monday"},
+	{"Call the bank", ""},
+	{"Book the dentist", "a checkup before the end of the month"},
+	{"Plan the trip", "trains, hotels and the museum tickets"},
+	{"Fix the bike", "the rear brake squeaks"},
+	{"Read the new book", ""},
+}
+
+// newFlagSet returns the flags of a command working on the database, those
+// it defines on the set and those of the config, and the function reading
+// the config once they are parsed.
+func newFlagSet(name, args string) (*flag.FlagSet, func(lookupEnv func(string) (string, bool)) (*config.Config, error)) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s %s\n\nflags:\n", os.Args[0], name, args)
+		fs.PrintDefaults()
+	}
+	return fs, config.Flags(fs)
+}
+
+// parseArgs parses the flags of fs and checks n arguments follow them.
+func parseArgs(fs *flag.FlagSet, args []string, n int) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		// reported by fs along with its usage
+		return usageError{}
+	}
+	if fs.NArg() != n {
+		return usageError{fmt.Errorf("%s: wrong number of arguments, -h shows its usage", fs.Name())}
+	}
+	return nil
+}
+
+// openDB opens the database of the config. Only warnings and errors are
+// logged, the output is the command's.
+func openDB(read func(lookupEnv func(string) (string, bool)) (*config.Config, error)) (database.Service, error) {
+	cfg, err := readConfig(read)
+	if err != nil {
+		return nil, err
+	}
+	return connect(cfg), nil
+}
+
+// readConfig reads the config and checks its database settings.
+func readConfig(read func(lookupEnv func(string) (string, bool)) (*config.Config, error)) (*config.Config, error) {
+	cfg, err := read(os.LookupEnv)
+	if err != nil {
+		return nil, usageError{err}
+	}
+	if err := cfg.ValidateDB(); err != nil {
+		return nil, usageError{err}
+	}
+	return cfg, nil
+}
+
+// connect opens the database of cfg, read by readConfig.
+func connect(cfg *config.Config) database.Service {
+	slog.SetDefault(logging.New(config.Log{Level: "warn", Format: cfg.Log.Format}, os.Stderr))
+	return database.New(cfg.DB)
+}
+
+// migrate opens the database, which runs the migrations it lacks, and checks
+// it is up to date.
+func migrate(args []string) error {
+	fs, read := newFlagSet("migrate", "[flags]")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	db, err := openDB(read)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.Migrated(context.Background()); err != nil {
+		return fmt.Errorf("the database is not migrated: %w", err)
+	}
+	fmt.Println("the database is up to date")
+	return nil
+}
+
+// createUser creates a user the way signing up does, with the password read
+// from stdin.
+func createUser(args []string) error {
+	fs, read := newFlagSet("user create", "[flags] <username>")
+	admin := fs.Bool("admin", false, "make the user an admin")
+	firstName := fs.String("first-name", "", "first name of the user")
+	lastName := fs.String("last-name", "", "last name of the user")
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	req := &user.UserSignUpReq{
+		Username:  fs.Arg(0),
+		Password:  password,
+		FirstName: *firstName,
+		LastName:  *lastName,
+	}
+	req.Trim()
+	if err := validator.New().Struct(req); err != nil {
+		return usageError{fmt.Errorf("invalid user: %w", err)}
+	}
+
+	db, err := openDB(read)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	u, err := user.NewFromReg(ctx, req)
+	if err != nil {
+		return err
+	}
+	u.IsAdmin = *admin
+	if err := db.InsertUser(ctx, u); err != nil {
+		if errors.Is(err, database.ErrUsernameTaken) {
+			return fmt.Errorf("the username %q is taken", u.Username)
+		}
+		return err
+	}
+	fmt.Printf("created the user %s\n", u.Username)
+	return nil
+}
+
+// setPassword sets the password of a user to the one read from stdin, which
+// revokes the tokens issued before.
+func setPassword(args []string) error {
+	fs, read := newFlagSet("user set-password", "[flags] <username>")
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	// the password follows the rules of signing up
+	if err := validator.New().StructPartial(&user.UserSignUpReq{Password: password}, "Password"); err != nil {
+		return usageError{fmt.Errorf("invalid password: %w", err)}
+	}
+	return updateUser(read, fs.Arg(0), "set the password of", func(ctx context.Context, u *user.User) error {
+		return u.UpdatePassword(ctx, password)
+	})
+}
+
+func listUsers(args []string) error {
+	fs, read := newFlagSet("user list", "[flags]")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	db, err := openDB(read)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	users, err := db.GetAllUsers(context.Background())
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USERNAME\tFIRST NAME\tLAST NAME\tADMIN\tDISABLED\tCREATED")
+	for _, u := range users {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%t\t%s\n", u.Username, u.FirstName, u.LastName, u.IsAdmin, u.Disabled, u.CreatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// disableUser stops a user from signing in and revokes its tokens, the user
+// and its todos are kept.
+func disableUser(args []string) error {
+	fs, read := newFlagSet("user disable", "[flags] <username>")
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+	return updateUser(read, fs.Arg(0), "disabled", func(_ context.Context, u *user.User) error {
+		u.Disabled = true
+		u.TokenVersion++
+		return nil
+	})
+}
+
+func enableUser(args []string) error {
+	fs, read := newFlagSet("user enable", "[flags] <username>")
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+	return updateUser(read, fs.Arg(0), "enabled", func(_ context.Context, u *user.User) error {
+		u.Disabled = false
+		return nil
+	})
+}
+
+// revokeTokens bumps the token version of a user, which the tokens issued
+// before no longer match.
+func revokeTokens(args []string) error {
+	fs, read := newFlagSet("token revoke", "[flags] <username>")
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+	return updateUser(read, fs.Arg(0), "revoked the tokens of", func(_ context.Context, u *user.User) error {
+		u.TokenVersion++
+		return nil
+	})
+}
+
+// updateUser applies change to the user and stores it, then reports done.
+func updateUser(read func(lookupEnv func(string) (string, bool)) (*config.Config, error), username, done string, change func(ctx context.Context, u *user.User) error) error {
+	db, err := openDB(read)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	u, err := db.GetUserByUserName(ctx, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("there is no user %q", username)
+	}
+	if err != nil {
+		return err
+	}
+	if err := change(ctx, u); err != nil {
+		return err
+	}
+	if err := db.UpadteUser(ctx, u); err != nil {
+		if errors.Is(err, database.ErrVersionConflict) {
+			return fmt.Errorf("the user %q changed meanwhile, try again", username)
+		}
+		return err
+	}
+	fmt.Printf("%s the user %s\n", done, username)
+	return nil
+}
+
+// seed creates sample users, named seeduser1 and on, with sample todos.
+// Users that exist already are skipped, so seeding twice adds nothing. The
+// sample users share a known password, so production databases are only
+// seeded with -force.
+func seed(args []string) error {
+	fs, read := newFlagSet("seed", "[flags]")
+	users := fs.Int("users", 3, "number of sample users")
+	todos := fs.Int("todos", 5, "number of todos of every sample user")
+	force := fs.Bool("force", false, "seed a production database too")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	cfg, err := readConfig(read)
+	if err != nil {
+		return err
+	}
+	if cfg.Env == config.EnvProduction && !*force {
+		return usageError{fmt.Errorf("seed: refusing to add users with the password %q to a production database, set APP_ENV=development or pass -force", seedPassword)}
+	}
+	db := connect(cfg)
+	defer db.Close()
+
+	ctx := context.Background()
+	created := 0
+	for i := 1; i <= *users; i++ {
+		u, err := user.NewFromReg(ctx, &user.UserSignUpReq{
+			Username:  fmt.Sprintf("%s%d", seedUsername, i),
+			Password:  seedPassword,
+			FirstName: "Seed",
+			LastName:  "User",
+		})
+		if err != nil {
+			return err
+		}
+		err = db.WithTx(ctx, func(tx database.Store) error {
+			if err := tx.InsertUser(ctx, u); err != nil {
+				return err
+			}
+			for j := range *todos {
+				sample := seedTodos[j%len(seedTodos)]
+				t := todo.NewFromAdd(&todo.TodoAddReq{
+					Title:       sample[0],
+					Description: sample[1],
+					DueDate:     time.Now().Add(time.Duration(j+1) * 24 * time.Hour).Truncate(time.Hour),
+				}, u.UserId)
+				t.Status = int16(j % 3)
+				if err := tx.InsertTodo(ctx, t); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, database.ErrUsernameTaken) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		created++
+	}
+	fmt.Printf("created %d sample users with %d todos each, their password is %q\n", created, *todos, seedPassword)
+	return nil
+}
+
+// readPassword reads the password from the first line of stdin, without
+// echoing it when stdin is a terminal.
+func readPassword() (string, error) {
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "password: ")
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("reading the password: %w", err)
+		}
+		return string(password), nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", fmt.Errorf("reading the password from stdin: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -1,19 +1,176 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/xenitane/todo-app-be-oe/internals/config"
+	"github.com/xenitane/todo-app-be-oe/internals/logging"
 	"github.com/xenitane/todo-app-be-oe/internals/server"
+	"github.com/xenitane/todo-app-be-oe/internals/tracing"
 )
 
+// tracingFlushTimeout bounds how long exiting waits for the trace exporter
+const tracingFlushTimeout = 5 * time.Second
+
+// command is a command of the binary, such as "user create".
+type command struct {
+	name  string
+	args  string
+	about string
+	run   func(args []string) error
+}
+
+func commands() []command {
+	return []command{
+		{"serve", "[flags]", "serve the api, the command run when none is given", serve},
+		{"config print", "[flags]", "print the config the server would run with, secrets redacted, and check it", printConfig},
+		{"migrate", "[flags]", "migrate the database and check it is up to date", migrate},
+		{"user create", "[flags] <username>", "create a user, -admin makes it an admin; the password is read from stdin", createUser},
+		{"user set-password", "[flags] <username>", "set the password of a user, read from stdin", setPassword},
+		{"user list", "[flags]", "list the users", listUsers},
+		{"user disable", "[flags] <username>", "stop a user from signing in and revoke its tokens", disableUser},
+		{"user enable", "[flags] <username>", "let a disabled user sign in again", enableUser},
+		{"token revoke", "[flags] <username>", "revoke every token issued to a user", revokeTokens},
+		{"seed", "[flags]", "fill the database with sample users and todos", seed},
+	}
+}
+
+// usageError is a command called wrongly, which exits with status 2. Its
+// err is nil when it was reported already.
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string {
+	if e.err == nil {
+		return "usage error"
+	}
+	return e.err.Error()
+}
+
+func (e usageError) Unwrap() error {
+	return e.err
+}
+
 func main() {
+	cmd, args := lookup(os.Args[1:])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(args)
+	var ue usageError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+	case errors.As(err, &ue):
+		if ue.err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(2)
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
-	server := server.New()
+// lookup finds the command args start with, serve when they start with a
+// flag, and returns the args that follow its name.
+func lookup(args []string) (*command, []string) {
+	cmds := commands()
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return &cmds[0], args
+	}
+	for i, c := range cmds {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && slices.Equal(args[:len(words)], words) {
+			return &cmds[i], args[len(words):]
+		}
+	}
+	return nil, args
+}
 
-	fmt.Printf("starting server at port %v\n", os.Getenv("PORT"))
+func serve(args []string) error {
+	cfg, err := config.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		usage()
+		return nil
+	}
+	if err != nil {
+		return usageError{err}
+	}
+
+	logger := logging.New(cfg.Log, os.Stdout)
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		logger.Error("failed to set up tracing", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+
+	server := server.New(cfg)
+
+	// the first signal starts a graceful shutdown, stop restores the default
+	// handling so a second one kills the process
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	logger.Info("starting server", slog.Int("port", cfg.Port))
+
+	err = server.Run(ctx)
+
+	// flush the spans of the last requests
+	flushCtx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+	if ferr := shutdownTracing(flushCtx); ferr != nil {
+		logger.Error("failed to flush traces", slog.String("err", ferr.Error()))
+	}
+	cancel()
+
+	if err != nil {
+		logger.Error("server stopped", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+	logger.Info("server stopped")
+	return nil
+}
+
+// printConfig prints the config the server would run with, secrets
+// redacted, and reports whether it is valid.
+func printConfig(args []string) error {
+	cfg, err := config.Read(args, os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		usage()
+		return nil
+	}
+	if err != nil {
+		return usageError{err}
+	}
+	if err := cfg.Print(os.Stdout); err != nil {
+		return err
+	}
+	return cfg.Validate()
+}
 
-	if err := server.ListenAndServe(); err != nil {
-		panic(fmt.Sprintf("Cannot start the server: %s", err.Error()))
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [flags] [args]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands() {
+		fmt.Fprintf(os.Stderr, "  %s %s\n\t%s\n", c.name, c.args, c.about)
 	}
+	fmt.Fprintf(os.Stderr, "\n%s <command> -h lists the flags of a command. Every command takes the flags of the config:\n", os.Args[0])
+	config.Usage(os.Stderr)
 }
@@ -0,0 +1,170 @@
+package archive
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+// Version is the version of the archives written. Archives of other
+// versions cannot be imported; a version adding what users own keeps
+// reading the earlier ones.
+const Version = 1
+
+// Archive is everything a user owns, as exported and imported.
+type Archive struct {
+	Version    int       `json:"version" validate:"required"`
+	ExportedAt time.Time `json:"exportedAt"`
+	// Source names the exported account. Importing archives of the same
+	// source again skips the todos imported before.
+	Source  string  `json:"source" validate:"required,max=200"`
+	Profile Profile `json:"profile"`
+	Todos   []Todo  `json:"todos" validate:"max=10000,unique=ID,dive"`
+}
+
+// Profile is the account the archive was exported from. Importing leaves the
+// profile of the importing account as it is.
+type Profile struct {
+	Username  string    `json:"username"`
+	FirstName string    `json:"firstName"`
+	LastName  string    `json:"lastName"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Todo is a todo as archived, with the id it has in the exported account.
+// Trashed todos have their deletion time and are imported into the trash.
+type Todo struct {
+	ID          int64      `json:"id" validate:"required,min=1"`
+	Title       string     `json:"title" validate:"required,min=4,max=50"`
+	Description string     `json:"description" validate:"max=320"`
+	Status      int16      `json:"status" validate:"min=0,max=2"`
+	DueDate     time.Time  `json:"dueDate" validate:"required"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	DeletedAt   *time.Time `json:"deletedAt,omitempty"`
+}
+
+// ImportResult tells what importing an archive did, or would do for a dry
+// run, to each of its todos.
+type ImportResult struct {
+	DryRun   bool           `json:"dryRun"`
+	Imported int            `json:"imported"`
+	Skipped  int            `json:"skipped"`
+	Todos    []ImportedTodo `json:"todos"`
+}
+
+// ImportedTodo maps the id of a todo of the archive to the one it got,
+// which imports skipping it had given it before. Dry runs give no new ids.
+type ImportedTodo struct {
+	ID      int64 `json:"id"`
+	TodoID  int64 `json:"todoId,omitempty"`
+	Skipped bool  `json:"skipped"`
+}
+
+// New archives the user and its todos, trashed ones included.
+func New(u *user.User, todos []*todo.Todo, now time.Time) *Archive {
+	a := &Archive{
+		Version:    Version,
+		ExportedAt: now,
+		Source:     Source(u),
+		Profile: Profile{
+			Username:  u.Username,
+			FirstName: u.FirstName,
+			LastName:  u.LastName,
+			CreatedAt: u.CreatedAt,
+		},
+		Todos: make([]Todo, len(todos)),
+	}
+	for i, t := range todos {
+		a.Todos[i] = Todo{
+			ID:          t.TodoId,
+			Title:       t.Title,
+			Description: t.Description,
+			Status:      t.Status,
+			DueDate:     t.DueDate,
+			CreatedAt:   t.CreatedAt,
+			UpdatedAt:   t.UpdatedAt,
+			DeletedAt:   t.DeletedAt,
+		}
+	}
+	return a
+}
+
+// Source names the account of u in archives. Usernames are reused once
+// their account is gone, the creation time tells the accounts apart.
+func Source(u *user.User) string {
+	return u.Username + "@" + u.CreatedAt.UTC().Format(time.RFC3339Nano)
+}
+
+// Todo is the todo to store for the owner, with the times it was archived
+// with. Archives lacking the creation or update time get now instead.
+func (t *Todo) Todo(ownerID int64, now time.Time) *todo.Todo {
+	td := &todo.Todo{
+		OwnerId:     ownerID,
+		Title:       t.Title,
+		Description: t.Description,
+		Status:      t.Status,
+		DueDate:     t.DueDate,
+		CreatedAt:   t.CreatedAt,
+		UpdatedAt:   t.UpdatedAt,
+	}
+	if td.CreatedAt.IsZero() {
+		td.CreatedAt = now
+	}
+	if td.UpdatedAt.IsZero() {
+		td.UpdatedAt = td.CreatedAt
+	}
+	if t.DeletedAt != nil {
+		deletedAt := *t.DeletedAt
+		td.DeletedAt = &deletedAt
+	}
+	return td
+}
+
+// csvHeader names the columns of the csv export
+var csvHeader = []string{"id", "title", "description", "status", "dueDate", "createdAt", "updatedAt", "deletedAt"}
+
+// WriteCSV writes the todos as csv, one per row after a header. Times are
+// RFC 3339, the deletion time is empty for todos out of the trash. Texts
+// that spreadsheets would run as formulas are quoted by csvText.
+func WriteCSV(w io.Writer, todos []*todo.Todo) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, t := range todos {
+		deletedAt := ""
+		if t.DeletedAt != nil {
+			deletedAt = t.DeletedAt.Format(time.RFC3339)
+		}
+		err := cw.Write([]string{
+			strconv.FormatInt(t.TodoId, 10),
+			csvText(t.Title),
+			csvText(t.Description),
+			strconv.Itoa(int(t.Status)),
+			t.DueDate.Format(time.RFC3339),
+			t.CreatedAt.Format(time.RFC3339),
+			t.UpdatedAt.Format(time.RFC3339),
+			deletedAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvText prefixes a text starting like a formula with a quote, so
+// spreadsheets opening the export show it instead of running it.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,461 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+)
+
+// Settings are read, in increasing order of precedence, from their defaults,
+// the json config file, the environment and the command line flags. Every
+// setting has an env tag naming its variable; its flag is the lowercase name
+// with dashes, e.g. DB_HOST is -db-host. Any variable may be given as a file
+// holding the value instead, with the _FILE suffix, e.g. JWT_SIGNING_KEY_FILE.
+
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+
+	TracingNone   = "none"
+	TracingOTLP   = "otlp"
+	TracingStdout = "stdout"
+
+	LogJSON = "json"
+	LogText = "text"
+
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+
+	IdempotencyDatabase = "database"
+	IdempotencyMemory   = "memory"
+
+	// configFileEnv and configFileFlag name the config file
+	configFileEnv  = "CONFIG_FILE"
+	configFileFlag = "config"
+
+	redacted = "[redacted]"
+)
+
+type Config struct {
+	Env  string `json:"env" env:"APP_ENV" usage:"development exposes internal error details and validates traffic against the api specification" validate:"oneof=development production"`
+	Port int    `json:"port" env:"PORT" usage:"port of the http and grpc api" validate:"min=1,max=65535"`
+
+	JWT     JWT     `json:"jwt"`
+	DB      DB      `json:"db"`
+	Metrics Metrics `json:"metrics"`
+	Tracing Tracing `json:"tracing"`
+	Log     Log     `json:"log"`
+
+	TrashRetention time.Duration `json:"trashRetention" env:"TRASH_RETENTION" usage:"how long deleted todos stay in the trash" validate:"gt=0"`
+	IdempotencyTTL time.Duration `json:"idempotencyTTL" env:"IDEMPOTENCY_TTL" usage:"how long responses to requests with an Idempotency-Key are replayed" validate:"gt=0"`
+	// IdempotencyLease is how long a request holds its key while running,
+	// it outlasts the requests of a replica that is still up
+	IdempotencyLease time.Duration `json:"idempotencyLease" env:"IDEMPOTENCY_LEASE" usage:"how long a running request with an Idempotency-Key holds the key, retries get 409 meanwhile" validate:"gt=0"`
+	// IdempotencyStore is where those responses are kept, the database
+	// shares them between the replicas
+	IdempotencyStore    string `json:"idempotencyStore" env:"IDEMPOTENCY_STORE" usage:"where responses to requests with an Idempotency-Key are kept: database, shared by the replicas, or memory, for a single one" validate:"oneof=database memory"`
+	IdempotencyMaxBytes int    `json:"idempotencyMaxBytes" env:"IDEMPOTENCY_MAX_BYTES" usage:"bytes of responses the memory idempotency store keeps at most, the oldest are dropped first" validate:"gt=0"`
+
+	ShutdownDelay   time.Duration `json:"shutdownDelay" env:"SHUTDOWN_DELAY" usage:"how long the server reports itself not ready before it stops accepting connections" validate:"gte=0"`
+	ShutdownTimeout time.Duration `json:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT" usage:"how long in-flight requests may take to finish on shutdown" validate:"gt=0"`
+}
+
+type JWT struct {
+	SigningKey string `json:"signingKey" env:"JWT_SIGNING_KEY" usage:"key signing the jwts" secret:"true" validate:"required"`
+}
+
+// Metrics are served at /metrics/ on a port of their own when Port is set,
+// on the api port to requests bearing Token otherwise, and not at all when
+// neither is.
+type Metrics struct {
+	Port  int    `json:"port" env:"METRICS_PORT" usage:"port serving only the metrics, 0 serves them on the api port" validate:"omitempty,min=1,max=65535"`
+	Token string `json:"token" env:"METRICS_TOKEN" usage:"bearer token required to read the metrics" secret:"true"`
+}
+
+type Tracing struct {
+	Exporter    string  `json:"exporter" env:"TRACING_EXPORTER" usage:"where spans are sent: none, otlp over http or stdout" validate:"oneof=none otlp stdout"`
+	Endpoint    string  `json:"endpoint" env:"TRACING_ENDPOINT" usage:"url of the otlp collector, the OTEL_EXPORTER_OTLP_ENDPOINT variable or localhost:4318 when empty" validate:"omitempty,url"`
+	SampleRatio float64 `json:"sampleRatio" env:"TRACING_SAMPLE_RATIO" usage:"share of the traces started here that are sampled" validate:"min=0,max=1"`
+}
+
+type Log struct {
+	Level  string `json:"level" env:"LOG_LEVEL" usage:"least severe level logged: debug, info, warn or error" validate:"oneof=debug info warn error"`
+	Format string `json:"format" env:"LOG_FORMAT" usage:"json or text" validate:"oneof=json text"`
+}
+
+// DB is the database, postgres or a sqlite file. The connection settings
+// only apply to postgres, the pool sizes and lifetimes to both.
+type DB struct {
+	Driver string `json:"driver" env:"DB_DRIVER" usage:"database the data is kept in: postgres or sqlite" validate:"oneof=postgres sqlite"`
+	Path   string `json:"path" env:"DB_PATH" usage:"file of the sqlite database, created when missing" validate:"required_if=Driver sqlite"`
+
+	Host     string `json:"host" env:"DB_HOST" usage:"postgres host" validate:"required_if=Driver postgres"`
+	Port     int    `json:"port" env:"DB_PORT" usage:"postgres port" validate:"min=1,max=65535"`
+	Database string `json:"database" env:"DB_DATABASE" usage:"postgres database" validate:"required_if=Driver postgres"`
+	Username string `json:"username" env:"DB_USERNAME" usage:"postgres user" validate:"required_if=Driver postgres"`
+	Password string `json:"password" env:"DB_PASSWORD" usage:"password of the postgres user" secret:"true"`
+	Schema   string `json:"schema" env:"DB_SCHEMA" usage:"postgres schema" validate:"required_if=Driver postgres"`
+
+	SSLMode     string `json:"sslMode" env:"DB_SSLMODE" usage:"tls mode of the connections: disable, allow, prefer, require, verify-ca or verify-full" validate:"oneof=disable allow prefer require verify-ca verify-full"`
+	SSLRootCert string `json:"sslRootCert" env:"DB_SSLROOTCERT" usage:"file of the certificate authorities verify-ca and verify-full trust, the system ones when empty"`
+
+	MinConns          int           `json:"minConns" env:"DB_MIN_CONNS" usage:"connections the pool keeps open when idle" validate:"gte=0"`
+	MaxConns          int           `json:"maxConns" env:"DB_MAX_CONNS" usage:"connections the pool opens at most" validate:"gt=0"`
+	MaxConnLifetime   time.Duration `json:"maxConnLifetime" env:"DB_MAX_CONN_LIFETIME" usage:"age at which connections are replaced" validate:"gt=0"`
+	MaxConnIdleTime   time.Duration `json:"maxConnIdleTime" env:"DB_MAX_CONN_IDLE_TIME" usage:"how long connections above DB_MIN_CONNS stay open unused" validate:"gt=0"`
+	HealthCheckPeriod time.Duration `json:"healthCheckPeriod" env:"DB_HEALTH_CHECK_PERIOD" usage:"how often idle connections are checked" validate:"gt=0"`
+	// StatementCacheSize is how many prepared statements each connection
+	// keeps, 0 prepares none, which poolers in transaction mode require
+	StatementCacheSize int `json:"statementCacheSize" env:"DB_STATEMENT_CACHE_SIZE" usage:"prepared statements cached per connection, 0 disables them for poolers such as pgbouncer" validate:"gte=0"`
+
+	QueryTimeout time.Duration `json:"queryTimeout" env:"DB_QUERY_TIMEOUT" usage:"how long a database call may take, 0 for no limit" validate:"gte=0"`
+	TxTimeout    time.Duration `json:"txTimeout" env:"DB_TX_TIMEOUT" usage:"how long a transaction may take, its retries included, 0 for no limit; each of its queries gets DB_QUERY_TIMEOUT" validate:"gte=0"`
+}
+
+func Default() *Config {
+	return &Config{
+		Env:  EnvProduction,
+		Port: 8080,
+		DB: DB{
+			Driver:  DriverPostgres,
+			Port:    5432,
+			Schema:  "public",
+			SSLMode: "prefer",
+
+			MaxConns:           10,
+			MaxConnLifetime:    time.Hour,
+			MaxConnIdleTime:    30 * time.Minute,
+			HealthCheckPeriod:  time.Minute,
+			StatementCacheSize: 512,
+
+			QueryTimeout: 5 * time.Second,
+			TxTimeout:    30 * time.Second,
+		},
+		TrashRetention: 30 * 24 * time.Hour,
+		IdempotencyTTL: 24 * time.Hour,
+
+		IdempotencyLease:    time.Minute,
+		IdempotencyStore:    IdempotencyDatabase,
+		IdempotencyMaxBytes: 64 << 20,
+
+		Tracing: Tracing{
+			Exporter:    TracingNone,
+			SampleRatio: 1,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: LogJSON,
+		},
+
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// Development reports whether internal details may be exposed.
+func (c *Config) Development() bool {
+	return c.Env == EnvDevelopment
+}
+
+// Load reads the config from every source and validates it. args are the
+// command line arguments, without the program name.
+func Load(args []string) (*Config, error) {
+	c, err := Read(args, os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Read reads the config from every source, without validating it.
+func Read(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	fs := flag.NewFlagSet("todo-app", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	read := Flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("config: unexpected argument %q", fs.Arg(0))
+	}
+	return read(lookupEnv)
+}
+
+// Flags defines the flags of every setting on fs, for commands having flags
+// of their own. Once fs is parsed, read reads the config from every source,
+// without validating it.
+func Flags(fs *flag.FlagSet) (read func(lookupEnv func(string) (string, bool)) (*Config, error)) {
+	c := Default()
+	settings := c.settings()
+
+	configFile := fs.String(configFileFlag, "", "json config file, also "+configFileEnv)
+	flags := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flags[s.flag] = fs.String(s.flag, "", s.usage+", also "+s.env)
+	}
+	return func(lookupEnv func(string) (string, bool)) (*Config, error) {
+		var errs []error
+		if *configFile == "" {
+			*configFile, _ = lookupEnv(configFileEnv)
+		}
+		if *configFile != "" {
+			if err := c.readFile(*configFile); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		for _, s := range settings {
+			value, ok := lookupEnv(s.env)
+			if path, fromFile := lookupEnv(s.env + "_FILE"); fromFile {
+				if ok {
+					errs = append(errs, fmt.Errorf("%s and %s_FILE are both set", s.env, s.env))
+					continue
+				}
+				b, err := os.ReadFile(path)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s_FILE: %w", s.env, err))
+					continue
+				}
+				value, ok = strings.TrimRight(string(b), "\r\n"), true
+			}
+			if ok {
+				if err := s.set(value); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+				}
+			}
+		}
+
+		fs.Visit(func(f *flag.Flag) {
+			for _, s := range settings {
+				if s.flag == f.Name {
+					if err := s.set(*flags[f.Name]); err != nil {
+						errs = append(errs, fmt.Errorf("-%s: %w", s.flag, err))
+					}
+				}
+			}
+		})
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("config: %w", errors.Join(errs...))
+		}
+		return c, nil
+	}
+}
+
+// Usage describes the flags and variables of every setting.
+func Usage(w io.Writer) {
+	fmt.Fprintf(w, "  -%s, %s\n\tjson config file\n", configFileFlag, configFileEnv)
+	for _, s := range Default().settings() {
+		fmt.Fprintf(w, "  -%s, %s\n\t%s\n", s.flag, s.env, s.usage)
+	}
+}
+
+// readFile applies the json config file at path, whose keys follow the json
+// names of the fields.
+func (c *Config) readFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var doc map[string]any
+	if err := d.Decode(&doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	byPath := make(map[string]setting)
+	for _, s := range c.settings() {
+		byPath[s.path] = s
+	}
+
+	var errs []error
+	var walk func(prefix string, m map[string]any)
+	walk = func(prefix string, m map[string]any) {
+		for k, v := range m {
+			key := prefix + k
+			if sub, ok := v.(map[string]any); ok {
+				walk(key+".", sub)
+				continue
+			}
+			s, ok := byPath[key]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown setting %q", path, key))
+				continue
+			}
+			if err := s.set(fmt.Sprint(v)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %w", path, key, err))
+			}
+		}
+	}
+	walk("", doc)
+	return errors.Join(errs...)
+}
+
+// Validate checks every setting and reports all the invalid ones.
+func (c *Config) Validate() error {
+	var msgs []string
+	if c.Metrics.Port == c.Port {
+		msgs = append(msgs, "METRICS_PORT must differ from PORT")
+	}
+	return validate(c, append(msgs, c.DB.check()...))
+}
+
+// ValidateDB checks the database settings only, all the commands that work
+// on the database without serving need.
+func (c *Config) ValidateDB() error {
+	return validate(&c.DB, c.DB.check())
+}
+
+// check reports the invalid combinations of the database settings.
+func (d *DB) check() []string {
+	if d.MinConns > d.MaxConns {
+		return []string{"DB_MIN_CONNS must not exceed DB_MAX_CONNS"}
+	}
+	return nil
+}
+
+// validate checks the validate tags of the settings in s, and reports the
+// invalid ones along with the failed checks.
+func validate(s any, checks []string) error {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		return f.Tag.Get("env")
+	})
+	english := en.New()
+	trans, _ := ut.New(english, english).GetTranslator("en")
+	if err := en_translations.RegisterDefaultTranslations(v, trans); err != nil {
+		return err
+	}
+
+	err := v.Struct(s)
+	var ves validator.ValidationErrors
+	if err != nil && !errors.As(err, &ves) {
+		return err
+	}
+	msgs := make([]string, 0, len(ves)+len(checks))
+	for _, fe := range ves {
+		msgs = append(msgs, fe.Translate(trans))
+	}
+	msgs = append(msgs, checks...)
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("config: invalid settings:\n\t%s", strings.Join(msgs, "\n\t"))
+}
+
+// Print writes the config as a json config file with the secrets redacted.
+func (c *Config) Print(w io.Writer) error {
+	doc := make(map[string]any)
+	for _, s := range c.settings() {
+		value := s.value.Interface()
+		switch {
+		case s.secret && !s.value.IsZero():
+			value = redacted
+		case s.value.Type() == durationType:
+			value = s.value.Interface().(time.Duration).String()
+		}
+		m := doc
+		keys := strings.Split(s.path, ".")
+		for _, k := range keys[:len(keys)-1] {
+			if _, ok := m[k]; !ok {
+				m[k] = make(map[string]any)
+			}
+			m = m[k].(map[string]any)
+		}
+		m[keys[len(keys)-1]] = value
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setting is a field of the config that can be set.
+type setting struct {
+	path   string
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  reflect.Value
+}
+
+func (c *Config) settings() []setting {
+	var settings []setting
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			path := prefix + f.Tag.Get("json")
+			env := f.Tag.Get("env")
+			if env == "" {
+				walk(path+".", v.Field(i))
+				continue
+			}
+			settings = append(settings, setting{
+				path:   path,
+				env:    env,
+				flag:   strings.ReplaceAll(strings.ToLower(env), "_", "-"),
+				usage:  f.Tag.Get("usage"),
+				secret: f.Tag.Get("secret") == "true",
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk("", reflect.ValueOf(c).Elem())
+	return settings
+}
+
+func (s setting) set(value string) error {
+	if s.value.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		s.value.SetInt(int64(d))
+		return nil
+	}
+	switch s.value.Kind() {
+	case reflect.String:
+		s.value.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		s.value.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		s.value.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		s.value.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", s.value.Type())
+	}
+	return nil
+}
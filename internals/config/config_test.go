@@ -0,0 +1,181 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env looks the variables up in vars instead of the environment.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadPrecedence(t *testing.T) {
+	file := writeFile(t, "config.json", `{
+		"port": 1000,
+		"log": {"level": "debug"},
+		"db": {"host": "file", "username": "file", "maxConns": 20},
+		"trashRetention": "1h"
+	}`)
+	c, err := Read([]string{"-port", "3000", "-db-username", "flag"}, env(map[string]string{
+		configFileEnv: file,
+		"PORT":        "2000",
+		"DB_HOST":     "env",
+		"DB_USERNAME": "env",
+	}))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	for _, tt := range []struct {
+		setting   string
+		got, want any
+	}{
+		{"PORT", c.Port, 3000},
+		{"DB_USERNAME", c.DB.Username, "flag"},
+		{"DB_HOST", c.DB.Host, "env"},
+		{"LOG_LEVEL", c.Log.Level, "debug"},
+		{"DB_MAX_CONNS", c.DB.MaxConns, 20},
+		{"TRASH_RETENTION", c.TrashRetention, time.Hour},
+		{"DB_SCHEMA", c.DB.Schema, "public"},
+		{"DB_QUERY_TIMEOUT", c.DB.QueryTimeout, 5 * time.Second},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.setting, tt.got, tt.want)
+		}
+	}
+
+	// the flag names the file over the variable
+	other := writeFile(t, "other.json", `{"db": {"host": "other"}}`)
+	c, err = Read([]string{"-config", other}, env(map[string]string{configFileEnv: file}))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if c.DB.Host != "other" || c.Port != Default().Port {
+		t.Errorf("DB_HOST = %q and PORT = %d, want those of -config", c.DB.Host, c.Port)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		args []string
+		vars map[string]string
+		want []string
+	}{
+		{"invalid values", []string{"-db-max-conns", "many"}, map[string]string{"PORT": "http", "TRASH_RETENTION": "30"}, []string{"PORT", "TRASH_RETENTION", "-db-max-conns"}},
+		{"unknown file setting", nil, map[string]string{configFileEnv: writeFile(t, "config.json", `{"db": {"hots": "x"}}`)}, []string{`unknown setting "db.hots"`}},
+		{"unknown flag", []string{"-db-hots", "x"}, nil, []string{"db-hots"}},
+		{"extra argument", []string{"serve"}, nil, []string{`unexpected argument "serve"`}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Read(tt.args, env(tt.vars))
+			if err == nil {
+				t.Fatal("Read succeeded")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("the error %q does not name %s", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadSecretFiles(t *testing.T) {
+	key := writeFile(t, "jwt-key", "s3cret\r\n")
+	c, err := Read(nil, env(map[string]string{"JWT_SIGNING_KEY_FILE": key, "DB_PORT_FILE": writeFile(t, "port", "6432\n")}))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if c.JWT.SigningKey != "s3cret" || c.DB.Port != 6432 {
+		t.Errorf("JWT_SIGNING_KEY = %q and DB_PORT = %d, want those of the files", c.JWT.SigningKey, c.DB.Port)
+	}
+
+	if _, err := Read(nil, env(map[string]string{"JWT_SIGNING_KEY_FILE": key, "JWT_SIGNING_KEY": "other"})); err == nil || !strings.Contains(err.Error(), "are both set") {
+		t.Errorf("a variable set along with its file = %v, want an error", err)
+	}
+	if _, err := Read(nil, env(map[string]string{"JWT_SIGNING_KEY_FILE": filepath.Join(t.TempDir(), "missing")})); err == nil || !strings.Contains(err.Error(), "JWT_SIGNING_KEY_FILE") {
+		t.Errorf("a missing file = %v, want an error", err)
+	}
+}
+
+// valid is a config that passes validation.
+func valid() *Config {
+	c := Default()
+	c.JWT.SigningKey = "key"
+	c.DB.Host, c.DB.Database, c.DB.Username = "localhost", "todos", "todos"
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Validate of a valid config: %v", err)
+	}
+
+	c := valid()
+	c.JWT.SigningKey = ""
+	c.Log.Level = "loud"
+	c.DB.MinConns = c.DB.MaxConns + 1
+	c.Metrics.Port = c.Port
+	c.DB.Driver = DriverSQLite
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("Validate of an invalid config succeeded")
+	}
+	// every invalid setting is reported at once
+	for _, want := range []string{"JWT_SIGNING_KEY", "LOG_LEVEL", "DB_PATH", "DB_MIN_CONNS must not exceed DB_MAX_CONNS", "METRICS_PORT must differ from PORT"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("the error %q does not name %s", err, want)
+		}
+	}
+
+	c = valid()
+	c.JWT.SigningKey = ""
+	c.DB.MaxConns = 0
+	if err := c.ValidateDB(); err == nil || strings.Contains(err.Error(), "JWT_SIGNING_KEY") || !strings.Contains(err.Error(), "DB_MAX_CONNS") {
+		t.Errorf("ValidateDB = %v, want the database settings only", err)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	c := valid()
+	c.JWT.SigningKey = "s3cret"
+	c.Metrics.Token = "metrics-s3cret"
+	var b strings.Builder
+	if err := c.Print(&b); err != nil {
+		t.Fatalf("Print: %v", err)
+	}
+	out := b.String()
+	if strings.Contains(out, "s3cret") {
+		t.Errorf("Print wrote a secret:\n%s", out)
+	}
+	for _, want := range []string{`"signingKey": "[redacted]"`, `"token": "[redacted]"`, `"password": ""`, `"host": "localhost"`, `"trashRetention": "720h0m0s"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Print did not write %s:\n%s", want, out)
+		}
+	}
+
+	// the output reads back as a config file
+	c2, err := Read([]string{"-config", writeFile(t, "config.json", out)}, env(nil))
+	if err != nil {
+		t.Fatalf("Read of the printed config: %v", err)
+	}
+	if c2.DB != c.DB || c2.TrashRetention != c.TrashRetention || c2.JWT.SigningKey != redacted {
+		t.Errorf("the printed config read back as %+v, want %+v", c2, c)
+	}
+}
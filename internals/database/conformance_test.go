@@ -0,0 +1,717 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+// testConformance checks that a Service has the semantics the server relies
+// on. The database may hold rows of earlier runs, so every test works on
+// users of its own and only looks at their rows.
+func testConformance(t *testing.T, db Service) {
+	tests := []struct {
+		name string
+		test func(*testing.T, Service)
+	}{
+		{"Health", testHealth},
+		{"Users", testUsers},
+		{"UserVersions", testUserVersions},
+		{"Todos", testTodos},
+		{"TodoVersions", testTodoVersions},
+		{"TodosForUsers", testTodosForUsers},
+		{"Trash", testTrash},
+		{"TrashRetention", testTrashRetention},
+		{"Changes", testChanges},
+		{"Search", testSearch},
+		{"Imports", testImports},
+		{"ClientIDs", testClientIDs},
+		{"IdempotencyKeys", testIdempotencyKeys},
+		{"Tx", testTx},
+		{"Notify", testNotify},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, db)
+		})
+	}
+}
+
+// newUser stores a user with a username no other test uses.
+func newUser(t *testing.T, st Store) *user.User {
+	t.Helper()
+	u := &user.User{
+		Username:  fmt.Sprintf("conf%d", rand.N(1_000_000_000)),
+		FirstName: "First",
+		LastName:  "Last",
+		Password:  "hash",
+	}
+	if err := st.InsertUser(context.Background(), u); err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+	return u
+}
+
+func newTodo(t *testing.T, st Store, u *user.User, title, description string) *todo.Todo {
+	t.Helper()
+	td := &todo.Todo{
+		OwnerId:     u.UserId,
+		Title:       title,
+		Description: description,
+		DueDate:     time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second),
+	}
+	if err := st.InsertTodo(context.Background(), td); err != nil {
+		t.Fatalf("InsertTodo: %v", err)
+	}
+	return td
+}
+
+func todoIDs(todos []*todo.Todo) []int64 {
+	ids := make([]int64, len(todos))
+	for i, t := range todos {
+		ids[i] = t.TodoId
+	}
+	return ids
+}
+
+func testHealth(t *testing.T, db Service) {
+	ctx := context.Background()
+	if err := db.Ping(ctx); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+	if err := db.Migrated(ctx); err != nil {
+		t.Errorf("Migrated: %v", err)
+	}
+	if db.Stats()["message"] == "" {
+		t.Errorf("Stats has no message: %v", db.Stats())
+	}
+}
+
+func testUsers(t *testing.T, db Service) {
+	ctx := context.Background()
+	u := newUser(t, db)
+	if u.UserId == 0 || u.Version != 1 || u.CreatedAt.IsZero() {
+		t.Fatalf("InsertUser did not set the id, version and creation time: %+v", u)
+	}
+
+	err := db.InsertUser(ctx, &user.User{Username: u.Username, FirstName: "Other", LastName: "Other", Password: "hash"})
+	if !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("InsertUser of a taken username = %v, want ErrUsernameTaken", err)
+	}
+
+	got, err := db.GetUserByUserName(ctx, u.Username)
+	if err != nil {
+		t.Fatalf("GetUserByUserName: %v", err)
+	}
+	if got.UserId != u.UserId || got.FirstName != u.FirstName || got.Password != u.Password || !got.CreatedAt.Equal(u.CreatedAt) {
+		t.Errorf("GetUserByUserName = %+v, want %+v", got, u)
+	}
+	if _, err := db.GetUserByUserName(ctx, "nobody"+u.Username); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetUserByUserName of a missing user = %v, want sql.ErrNoRows", err)
+	}
+
+	other := newUser(t, db)
+	users, err := db.GetUsersByIDs(ctx, []int64{u.UserId, other.UserId})
+	if err != nil {
+		t.Fatalf("GetUsersByIDs: %v", err)
+	}
+	if len(users) != 2 {
+		t.Errorf("GetUsersByIDs returned %d users, want 2", len(users))
+	}
+
+	all, err := db.GetAllUsers(ctx)
+	if err != nil {
+		t.Fatalf("GetAllUsers: %v", err)
+	}
+	for _, want := range []*user.User{u, other} {
+		if !slices.ContainsFunc(all, func(u *user.User) bool { return u.UserId == want.UserId }) {
+			t.Errorf("GetAllUsers is missing %s", want.Username)
+		}
+	}
+}
+
+func testUserVersions(t *testing.T, db Service) {
+	ctx := context.Background()
+	u := newUser(t, db)
+
+	stale := *u
+	u.FirstName, u.IsAdmin, u.Disabled, u.TokenVersion = "Changed", true, true, 3
+	if err := db.UpadteUser(ctx, u); err != nil {
+		t.Fatalf("UpadteUser: %v", err)
+	}
+	if u.Version != 2 {
+		t.Errorf("UpadteUser set the version to %d, want 2", u.Version)
+	}
+	got, err := db.GetUserByUserName(ctx, u.Username)
+	if err != nil {
+		t.Fatalf("GetUserByUserName: %v", err)
+	}
+	if got.FirstName != "Changed" || !got.IsAdmin || !got.Disabled || got.TokenVersion != 3 || got.Version != 2 {
+		t.Errorf("the update was not stored: %+v", got)
+	}
+
+	if err := db.UpadteUser(ctx, &stale); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("UpadteUser of a stale version = %v, want ErrVersionConflict", err)
+	}
+	missing := stale
+	missing.Username = "nobody" + u.Username
+	if err := db.UpadteUser(ctx, &missing); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("UpadteUser of a missing user = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func testTodos(t *testing.T, db Service) {
+	ctx := context.Background()
+	u, other := newUser(t, db), newUser(t, db)
+	td := newTodo(t, db, u, "Write the report", "for monday")
+	if td.TodoId == 0 || td.Version != 1 || td.CreatedAt.IsZero() || td.UpdatedAt.IsZero() {
+		t.Fatalf("InsertTodo did not set the id, version and timestamps: %+v", td)
+	}
+
+	got, err := db.GetTodoByIDForUser(ctx, td.TodoId, u.UserId)
+	if err != nil {
+		t.Fatalf("GetTodoByIDForUser: %v", err)
+	}
+	if got.Title != td.Title || got.Description != td.Description || !got.DueDate.Equal(td.DueDate) || got.DeletedAt != nil {
+		t.Errorf("GetTodoByIDForUser = %+v, want %+v", got, td)
+	}
+	if _, err := db.GetTodoByIDForUser(ctx, td.TodoId, other.UserId); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetTodoByIDForUser of another user = %v, want sql.ErrNoRows", err)
+	}
+
+	second := newTodo(t, db, u, "Call the bank", "")
+	todos, err := db.GetAllTodosForUser(ctx, u.UserId)
+	if err != nil {
+		t.Fatalf("GetAllTodosForUser: %v", err)
+	}
+	ids := todoIDs(todos)
+	slices.Sort(ids)
+	if !slices.Equal(ids, []int64{td.TodoId, second.TodoId}) {
+		t.Errorf("GetAllTodosForUser = %v, want %v", ids, []int64{td.TodoId, second.TodoId})
+	}
+
+	if err := db.DeleteTodoByIDForUser(ctx, td.TodoId, u.UserId, 0); err != nil {
+		t.Fatalf("DeleteTodoByIDForUser: %v", err)
+	}
+	if _, err := db.GetTodoByIDForUser(ctx, td.TodoId, u.UserId); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetTodoByIDForUser of a deleted todo = %v, want sql.ErrNoRows", err)
+	}
+	todos, err = db.GetAllTodosForUser(ctx, u.UserId)
+	if err != nil {
+		t.Fatalf("GetAllTodosForUser: %v", err)
+	}
+	if ids := todoIDs(todos); !slices.Equal(ids, []int64{second.TodoId}) {
+		t.Errorf("GetAllTodosForUser after a delete = %v, want %v", ids, []int64{second.TodoId})
+	}
+	if err := db.DeleteTodoByIDForUser(ctx, td.TodoId, u.UserId, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("DeleteTodoByIDForUser of a deleted todo = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func testTodoVersions(t *testing.T, db Service) {
+	ctx := context.Background()
+	u := newUser(t, db)
+	td := newTodo(t, db, u, "Water the plants", "")
+
+	stale := *td
+	td.Status = todo.StatusCompleted
+	if err := db.UpdateTodoByIdForUser(ctx, td); err != nil {
+		t.Fatalf("UpdateTodoByIdForUser: %v", err)
+	}
+	if td.Version != 2 {
+		t.Errorf("UpdateTodoByIdForUser set the version to %d, want 2", td.Version)
+	}
+	if err := db.UpdateTodoByIdForUser(ctx, &stale); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("UpdateTodoByIdForUser of a stale version = %v, want ErrVersionConflict", err)
+	}
+	if err := db.DeleteTodoByIDForUser(ctx, td.TodoId, u.UserId, 1); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("DeleteTodoByIDForUser of a stale version = %v, want ErrVersionConflict", err)
+	}
+	if err := db.DeleteTodoByIDForUser(ctx, td.TodoId, u.UserId, 2); err != nil {
+		t.Errorf("DeleteTodoByIDForUser of the current version: %v", err)
+	}
+	missing := *td
+	missing.TodoId = 0
+	if err := db.UpdateTodoByIdForUser(ctx, &missing); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("UpdateTodoByIdForUser of a missing todo = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func testTodosForUsers(t *testing.T, db Service) {
+	ctx := context.Background()
+	first, second := newUser(t, db), newUser(t, db)
+	b := newTodo(t, db, second, "Second user todo", "")
+	a := newTodo(t, db, first, "First user todo", "")
+	done := newTodo(t, db, first, "Finished todo", "")
+	done.Status = todo.StatusCompleted
+	if err := db.UpdateTodoByIdForUser(ctx, done); err != nil {
+		t.Fatalf("UpdateTodoByIdForUser: %v", err)
+	}
+
+	todos, err := db.GetTodosForUsers(ctx, []int64{first.UserId, second.UserId})
+	if err != nil {
+		t.Fatalf("GetTodosForUsers: %v", err)
+	}
+	if ids, want := todoIDs(todos), []int64{a.TodoId, done.TodoId, b.TodoId}; !slices.Equal(ids, want) {
+		t.Errorf("GetTodosForUsers = %v, want %v", ids, want)
+	}
+
+	counts, err := db.CountTodosForUsers(ctx, []int64{first.UserId, second.UserId})
+	if err != nil {
+		t.Fatalf("CountTodosForUsers: %v", err)
+	}
+	byOwner := map[int64]todo.TodoCount{}
+	for _, c := range counts {
+		byOwner[c.OwnerId] = *c
+	}
+	if got, want := byOwner[first.UserId], (todo.TodoCount{OwnerId: first.UserId, Total: 2, Pending: 1, Completed: 1}); got != want {
+		t.Errorf("counts of the first user = %+v, want %+v", got, want)
+	}
+	if got, want := byOwner[second.UserId], (todo.TodoCount{OwnerId: second.UserId, Total: 1, Pending: 1}); got != want {
+		t.Errorf("counts of the second user = %+v, want %+v", got, want)
+	}
+}
+
+func testTrash(t *testing.T, db Service) {
+	ctx := context.Background()
+	u := newUser(t, db)
+	first := newTodo(t, db, u, "First trashed", "")
+	second := newTodo(t, db, u, "Second trashed", "")
+	kept := newTodo(t, db, u, "Kept todo", "")
+	for _, td := range []*todo.Todo{first, second} {
+		if err := db.DeleteTodoByIDForUser(ctx, td.TodoId, u.UserId, 0); err != nil {
+			t.Fatalf("DeleteTodoByIDForUser: %v", err)
+		}
+		// trashed todos are listed by deletion time
+		time.Sleep(time.Millisecond)
+	}
+
+	trash, err := db.GetTrashedTodosForUser(ctx, u.UserId)
+	if err != nil {
+		t.Fatalf("GetTrashedTodosForUser: %v", err)
+	}
+	if ids, want := todoIDs(trash), []int64{second.TodoId, first.TodoId}; !slices.Equal(ids, want) {
+		t.Errorf("GetTrashedTodosForUser = %v, want %v", ids, want)
+	}
+	for _, td := range trash {
+		if td.DeletedAt == nil {
+			t.Errorf("trashed todo %d has no deletion time", td.TodoId)
+		}
+	}
+
+	restored, err := db.RestoreTodoByIDForUser(ctx, first.TodoId, u.UserId)
+	if err != nil {
+		t.Fatalf("RestoreTodoByIDForUser: %v", err)
+	}
+	if restored.DeletedAt != nil || restored.Version != 3 {
+		t.Errorf("RestoreTodoByIDForUser = %+v, want it untrashed at version 3", restored)
+	}
+	if _, err := db.RestoreTodoByIDForUser(ctx, kept.TodoId, u.UserId); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RestoreTodoByIDForUser of a todo not in the trash = %v, want sql.ErrNoRows", err)
+	}
+
+	if err := db.PurgeTodoByIDForUser(ctx, kept.TodoId, u.UserId); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("PurgeTodoByIDForUser of a todo not in the trash = %v, want sql.ErrNoRows", err)
+	}
+	if err := db.PurgeTodoByIDForUser(ctx, second.TodoId, u.UserId); err != nil {
+		t.Errorf("PurgeTodoByIDForUser: %v", err)
+	}
+	if _, err := db.RestoreTodoByIDForUser(ctx, second.TodoId, u.UserId); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RestoreTodoByIDForUser of a purged todo = %v, want sql.ErrNoRows", err)
+	}
+
+	for _, td := range []*todo.Todo{first, kept} {
+		if err := db.DeleteTodoByIDForUser(ctx, td.TodoId, u.UserId, 0); err != nil {
+			t.Fatalf("DeleteTodoByIDForUser: %v", err)
+		}
+	}
+	n, err := db.PurgeTrashForUser(ctx, u.UserId)
+	if err != nil {
+		t.Fatalf("PurgeTrashForUser: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("PurgeTrashForUser purged %d todos, want 2", n)
+	}
+	trash, err = db.GetTrashedTodosForUser(ctx, u.UserId)
+	if err != nil {
+		t.Fatalf("GetTrashedTodosForUser: %v", err)
+	}
+	if len(trash) != 0 {
+		t.Errorf("the trash still holds %v", todoIDs(trash))
+	}
+}
+
+func testTrashRetention(t *testing.T, db Service) {
+	ctx := context.Background()
+	u := newUser(t, db)
+	td := newTodo(t, db, u, "Old trashed todo", "")
+	if err := db.DeleteTodoByIDForUser(ctx, td.TodoId, u.UserId, 0); err != nil {
+		t.Fatalf("DeleteTodoByIDForUser: %v", err)
+	}
+
+	if _, err := db.PurgeTrashedTodosOlderThan(ctx, time.Hour); err != nil {
+		t.Fatalf("PurgeTrashedTodosOlderThan: %v", err)
+	}
+	if trash, _ := db.GetTrashedTodosForUser(ctx, u.UserId); len(trash) != 1 {
+		t.Errorf("a todo trashed just now was purged")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	n, err := db.PurgeTrashedTodosOlderThan(ctx, time.Millisecond)
+	if err != nil {
+		t.Fatalf("PurgeTrashedTodosOlderThan: %v", err)
+	}
+	if n < 1 {
+		t.Errorf("PurgeTrashedTodosOlderThan purged %d todos, want at least 1", n)
+	}
+	if trash, _ := db.GetTrashedTodosForUser(ctx, u.UserId); len(trash) != 0 {
+		t.Errorf("the todo past the retention was not purged")
+	}
+}
+
+func testChanges(t *testing.T, db Service) {
+	ctx := context.Background()
+	u := newUser(t, db)
+
+	cs, err := db.GetTodoChangesForUser(ctx, u.UserId, 0)
+	if err != nil {
+		t.Fatalf("GetTodoChangesForUser: %v", err)
+	}
+	if len(cs.Todos) != 0 || len(cs.Deleted) != 0 {
+		t.Errorf("changes of a new user = %+v, want none", cs)
+	}
+
+	updated := newTodo(t, db, u, "Updated todo", "")
+	trashed := newTodo(t, db, u, "Trashed todo", "")
+	purged := newTodo(t, db, u, "Purged todo", "")
+	cs, err = db.GetTodoChangesForUser(ctx, u.UserId, 0)
+	if err != nil {
+		t.Fatalf("GetTodoChangesForUser: %v", err)
+	}
+	if ids, want := todoIDs(cs.Todos), []int64{updated.TodoId, trashed.TodoId, purged.TodoId}; !slices.Equal(ids, want) {
+		t.Errorf("changed todos = %v, want %v", ids, want)
+	}
+	token := cs.Token
+	if token == 0 {
+		t.Fatalf("the changes have no token")
+	}
+
+	cs, err = db.GetTodoChangesForUser(ctx, u.UserId, token)
+	if err != nil {
+		t.Fatalf("GetTodoChangesForUser: %v", err)
+	}
+	// tokens are opaque, postgres moves them along with other transactions
+	if len(cs.Todos) != 0 || len(cs.Deleted) != 0 || cs.Token < token {
+		t.Errorf("changes since the last token = %+v, want none", cs)
+	}
+
+	updated.Title = "Updated title"
+	if err := db.UpdateTodoByIdForUser(ctx, updated); err != nil {
+		t.Fatalf("UpdateTodoByIdForUser: %v", err)
+	}
+	for _, td := range []*todo.Todo{trashed, purged} {
+		if err := db.DeleteTodoByIDForUser(ctx, td.TodoId, u.UserId, 0); err != nil {
+			t.Fatalf("DeleteTodoByIDForUser: %v", err)
+		}
+	}
+	if err := db.PurgeTodoByIDForUser(ctx, purged.TodoId, u.UserId); err != nil {
+		t.Fatalf("PurgeTodoByIDForUser: %v", err)
+	}
+
+	cs, err = db.GetTodoChangesForUser(ctx, u.UserId, token)
+	if err != nil {
+		t.Fatalf("GetTodoChangesForUser: %v", err)
+	}
+	if len(cs.Todos) != 1 || cs.Todos[0].Title != "Updated title" {
+		t.Errorf("changed todos = %+v, want the updated one", cs.Todos)
+	}
+	if want := []int64{trashed.TodoId, purged.TodoId}; !slices.Equal(cs.Deleted, want) {
+		t.Errorf("deleted todos = %v, want %v", cs.Deleted, want)
+	}
+	if cs.Token <= token {
+		t.Errorf("the token did not move past %d: %d", token, cs.Token)
+	}
+}
+
+func testSearch(t *testing.T, db Service) {
+	ctx := context.Background()
+	u, other := newUser(t, db), newUser(t, db)
+	milk := newTodo(t, db, u, "Buy milk", "from the corner shop")
+	bread := newTodo(t, db, u, "Bake bread", "buy flour first")
+	newTodo(t, db, other, "Buy milk too", "")
+	done := newTodo(t, db, u, "Buy stamps", "")
+	done.Status = todo.StatusCompleted
+	if err := db.UpdateTodoByIdForUser(ctx, done); err != nil {
+		t.Fatalf("UpdateTodoByIdForUser: %v", err)
+	}
+
+	search := func(query string, modify func(*todo.SearchQuery)) []*todo.SearchResult {
+		t.Helper()
+		q := &todo.SearchQuery{SearchReq: todo.SearchReq{Query: query}, OwnerID: u.UserId}
+		if modify != nil {
+			modify(q)
+		}
+		results, err := db.SearchTodos(ctx, q)
+		if err != nil {
+			t.Fatalf("SearchTodos(%q): %v", query, err)
+		}
+		return results
+	}
+	ids := func(results []*todo.SearchResult) []int64 {
+		ids := make([]int64, len(results))
+		for i, r := range results {
+			ids[i] = r.TodoId
+		}
+		return ids
+	}
+
+	results := search("bu", nil)
+	if got, want := ids(results), []int64{milk.TodoId, done.TodoId, bread.TodoId}; !slices.Equal(got, want) {
+		t.Errorf("prefix search = %v, want title matches ranked first %v", got, want)
+	}
+	if r := results[0]; !strings.Contains(r.TitleHighlight, "<mark>Buy</mark>") || r.Username != u.Username || r.Rank <= 0 {
+		t.Errorf("the first result is not ranked and highlighted: %+v", r)
+	}
+	if got, want := ids(search(`"buy milk"`, nil)), []int64{milk.TodoId}; !slices.Equal(got, want) {
+		t.Errorf("phrase search = %v, want %v", got, want)
+	}
+	if got, want := ids(search("buy -milk", nil)), []int64{done.TodoId, bread.TodoId}; !slices.Equal(got, want) {
+		t.Errorf("negated search = %v, want %v", got, want)
+	}
+	completed := todo.StatusCompleted
+	if got, want := ids(search("buy", func(q *todo.SearchQuery) { q.Status = &completed })), []int64{done.TodoId}; !slices.Equal(got, want) {
+		t.Errorf("search by status = %v, want %v", got, want)
+	}
+	if got := search("buy", func(q *todo.SearchQuery) { q.Limit, q.Offset = 1, 1 }); len(got) != 1 {
+		t.Errorf("a page of one returned %d results", len(got))
+	}
+	if got := search("!&|", nil); len(got) != 0 {
+		t.Errorf("a search without terms returned %v", ids(got))
+	}
+
+	// the texts are the users', only the tags of the matches are html
+	u = newUser(t, db)
+	newTodo(t, db, u, "Fix <b>bold</b> text", "")
+	typed := newTodo(t, db, u, "Typed <mark>tags</mark> stay text", "")
+	plain := newTodo(t, db, u, "Typed words", "")
+	if results := search("bold", nil); len(results) != 1 || results[0].TitleHighlight != "Fix &lt;b&gt;<mark>bold</mark>&lt;/b&gt; text" {
+		t.Errorf("the highlight of a text with html = %+v", results)
+	}
+	results = search("typed", nil)
+	if got, want := ids(results), []int64{typed.TodoId, plain.TodoId}; !slices.Equal(got, want) {
+		t.Fatalf("search of typed tags = %v, want %v", got, want)
+	}
+	if r := results[0]; !strings.Contains(r.TitleHighlight, "&lt;mark&gt;tags&lt;/mark&gt;") || r.Rank != results[1].Rank {
+		t.Errorf("typed tags were taken for matches: %+v", r)
+	}
+}
+
+func testImports(t *testing.T, db Service) {
+	ctx := context.Background()
+	u, other := newUser(t, db), newUser(t, db)
+	created := time.Now().Add(-72 * time.Hour).UTC().Truncate(time.Second)
+	updated, deleted := created.Add(time.Hour), created.Add(2*time.Hour)
+	kept := &todo.Todo{Title: "Imported todo", DueDate: created.Add(96 * time.Hour), CreatedAt: created, UpdatedAt: updated}
+	trashed := &todo.Todo{Title: "Imported to the trash", DueDate: created.Add(96 * time.Hour), CreatedAt: created, UpdatedAt: deleted, DeletedAt: &deleted}
+
+	if err := db.ImportTodos(ctx, u.UserId, "source", []todo.TodoImport{{SourceID: 7, Todo: kept}, {SourceID: 8, Todo: trashed}}); err != nil {
+		t.Fatalf("ImportTodos: %v", err)
+	}
+	if kept.TodoId == 0 || trashed.TodoId == 0 || kept.TodoId == trashed.TodoId || kept.Version != 1 {
+		t.Fatalf("ImportTodos gave the ids %d and %d, version %d", kept.TodoId, trashed.TodoId, kept.Version)
+	}
+	// the todos keep the times they carry
+	got, err := db.GetTodoByIDForUser(ctx, kept.TodoId, u.UserId)
+	if err != nil {
+		t.Fatalf("GetTodoByIDForUser of an imported todo: %v", err)
+	}
+	if got.Title != kept.Title || !got.CreatedAt.Equal(created) || !got.UpdatedAt.Equal(updated) || got.DeletedAt != nil {
+		t.Errorf("imported %+v, want it created at %v and updated at %v", got, created, updated)
+	}
+	trash, err := db.GetTrashedTodosForUser(ctx, u.UserId)
+	if err != nil {
+		t.Fatalf("GetTrashedTodosForUser: %v", err)
+	}
+	if len(trash) != 1 || trash[0].TodoId != trashed.TodoId || trash[0].DeletedAt == nil || !trash[0].DeletedAt.Equal(deleted) {
+		t.Errorf("the trash holds %+v, want the imported todo deleted at %v", trash, deleted)
+	}
+
+	// a second record of the same todo keeps the first
+	again := &todo.Todo{Title: "Imported again", DueDate: created.Add(96 * time.Hour), CreatedAt: created, UpdatedAt: created}
+	if err := db.ImportTodos(ctx, u.UserId, "source", []todo.TodoImport{{SourceID: 7, Todo: again}}); err != nil {
+		t.Fatalf("ImportTodos of an imported todo: %v", err)
+	}
+	ids, err := db.GetTodoImports(ctx, u.UserId, "source")
+	if err != nil {
+		t.Fatalf("GetTodoImports: %v", err)
+	}
+	if len(ids) != 2 || ids[7] != kept.TodoId || ids[8] != trashed.TodoId {
+		t.Errorf("GetTodoImports = %v, want 7 imported as %d and 8 as %d", ids, kept.TodoId, trashed.TodoId)
+	}
+	for _, q := range []struct {
+		uid    int64
+		source string
+	}{{u.UserId, "other source"}, {other.UserId, "source"}} {
+		if ids, err := db.GetTodoImports(ctx, q.uid, q.source); err != nil || len(ids) != 0 {
+			t.Errorf("GetTodoImports(%d, %q) = %v, %v, want nothing", q.uid, q.source, ids, err)
+		}
+	}
+	if err := db.ImportTodos(ctx, u.UserId, "source", nil); err != nil {
+		t.Errorf("ImportTodos of nothing: %v", err)
+	}
+}
+
+func testClientIDs(t *testing.T, db Service) {
+	ctx := context.Background()
+	u, other := newUser(t, db), newUser(t, db)
+	td := newTodo(t, db, u, "Created offline", "")
+
+	if _, err := db.GetClientTodoID(ctx, u.UserId, "client-1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetClientTodoID of an unknown client id = %v, want sql.ErrNoRows", err)
+	}
+	if err := db.InsertClientTodoID(ctx, u.UserId, "client-1", td.TodoId); err != nil {
+		t.Fatalf("InsertClientTodoID: %v", err)
+	}
+	// a second record of the same client id keeps the first
+	if err := db.InsertClientTodoID(ctx, u.UserId, "client-1", td.TodoId+1); err != nil {
+		t.Fatalf("InsertClientTodoID of a recorded client id: %v", err)
+	}
+	if tid, err := db.GetClientTodoID(ctx, u.UserId, "client-1"); err != nil || tid != td.TodoId {
+		t.Errorf("GetClientTodoID = %d, %v, want %d", tid, err, td.TodoId)
+	}
+	if _, err := db.GetClientTodoID(ctx, other.UserId, "client-1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetClientTodoID of another user = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func testIdempotencyKeys(t *testing.T, db Service) {
+	ctx := context.Background()
+	key := fmt.Sprintf("key%d", rand.N(1_000_000_000))
+
+	if rec, err := db.ReserveIdempotencyKey(ctx, key, "first", time.Hour); err != nil || rec != nil {
+		t.Fatalf("ReserveIdempotencyKey of a new key = %+v, %v, want it reserved", rec, err)
+	}
+	rec, err := db.ReserveIdempotencyKey(ctx, key, "second", time.Hour)
+	if err != nil || rec == nil || rec.Fingerprint != "first" || rec.Response != nil {
+		t.Fatalf("ReserveIdempotencyKey of a running key = %+v, %v, want the first request running", rec, err)
+	}
+	if err := db.CompleteIdempotencyKey(ctx, key, []byte("response"), time.Hour); err != nil {
+		t.Fatalf("CompleteIdempotencyKey: %v", err)
+	}
+	rec, err = db.ReserveIdempotencyKey(ctx, key, "second", time.Hour)
+	if err != nil || rec == nil || string(rec.Response) != "response" {
+		t.Fatalf("ReserveIdempotencyKey of a completed key = %+v, %v, want its response", rec, err)
+	}
+	// the response outlives the lease of the request
+	if rec, err := db.ReserveIdempotencyKey(ctx, key+"-leased", "first", -time.Second); err != nil || rec != nil {
+		t.Fatalf("ReserveIdempotencyKey of a new key = %+v, %v, want it reserved", rec, err)
+	}
+	if err := db.CompleteIdempotencyKey(ctx, key+"-leased", []byte("response"), time.Hour); err != nil {
+		t.Fatalf("CompleteIdempotencyKey after the lease: %v", err)
+	}
+	rec, err = db.ReserveIdempotencyKey(ctx, key+"-leased", "first", time.Hour)
+	if err != nil || rec == nil || string(rec.Response) != "response" {
+		t.Fatalf("ReserveIdempotencyKey of a key completed after its lease = %+v, %v, want its response", rec, err)
+	}
+
+	if err := db.ReleaseIdempotencyKey(ctx, key); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey: %v", err)
+	}
+	// a key reserved with a lease in the past has expired already, like the
+	// key of a request that never completed
+	if rec, err := db.ReserveIdempotencyKey(ctx, key, "third", -time.Second); err != nil || rec != nil {
+		t.Fatalf("ReserveIdempotencyKey of a released key = %+v, %v, want it reserved", rec, err)
+	}
+	if rec, err := db.ReserveIdempotencyKey(ctx, key, "fourth", -time.Second); err != nil || rec != nil {
+		t.Fatalf("ReserveIdempotencyKey of an expired key = %+v, %v, want it reserved", rec, err)
+	}
+	if purged, err := db.PurgeExpiredIdempotencyKeys(ctx); err != nil || purged < 1 {
+		t.Errorf("PurgeExpiredIdempotencyKeys = %d, %v, want the expired key purged", purged, err)
+	}
+}
+
+func testTx(t *testing.T, db Service) {
+	ctx := context.Background()
+	u := newUser(t, db)
+
+	var inTx *todo.Todo
+	err := db.WithTx(ctx, func(tx Store) error {
+		inTx = newTodo(t, tx, u, "Written in a transaction", "")
+		if _, err := tx.GetTodoByIDForUser(ctx, inTx.TodoId, u.UserId); err != nil {
+			return fmt.Errorf("the transaction does not see its own write: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+	if _, err := db.GetTodoByIDForUser(ctx, inTx.TodoId, u.UserId); err != nil {
+		t.Errorf("the committed todo is missing: %v", err)
+	}
+
+	errRollback := errors.New("roll back")
+	var rolledBack *todo.Todo
+	err = db.WithTx(ctx, func(tx Store) error {
+		rolledBack = newTodo(t, tx, u, "Rolled back todo", "")
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("WithTx = %v, want the error of fn", err)
+	}
+	if _, err := db.GetTodoByIDForUser(ctx, rolledBack.TodoId, u.UserId); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("the rolled back todo was stored: %v", err)
+	}
+}
+
+func testNotify(t *testing.T, db Service) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	channel := fmt.Sprintf("conformance_%d", rand.N(1_000_000))
+
+	received := make(chan string, 1)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- db.Listen(ctx, channel, func(payload string) {
+			select {
+			case received <- payload:
+			default:
+			}
+		})
+	}()
+
+	// the listener may not be subscribed yet, notify until it hears it
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case payload := <-received:
+			if payload != "hello" {
+				t.Errorf("received %q, want %q", payload, "hello")
+			}
+			done = true
+		case <-tick.C:
+			if err := db.Notify(ctx, channel, "hello"); err != nil {
+				t.Fatalf("Notify: %v", err)
+			}
+		case <-timeout:
+			t.Fatal("the notification never arrived")
+		}
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("Listen did not return once ctx was done")
+	}
+}
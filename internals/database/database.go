@@ -2,82 +2,200 @@ package database
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/exaring/otelpgx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/xenitane/todo-app-be-oe/internals/config"
 	"github.com/xenitane/todo-app-be-oe/internals/todo"
 	"github.com/xenitane/todo-app-be-oe/internals/user"
 )
 
+// UserStore reads and writes the users.
+type UserStore interface {
+	InsertUser(context.Context, *user.User) error
+	GetUserByUserName(context.Context, string) (*user.User, error)
+	GetAllUsers(context.Context) ([]*user.User, error)
+	UpadteUser(context.Context, *user.User) error
+	GetUsersByIDs(context.Context, []int64) ([]*user.User, error)
+}
+
+// TodoStore reads and writes the todos, their trash and their changes.
+type TodoStore interface {
+	GetAllTodosForUser(context.Context, int64) ([]*todo.Todo, error)
+	InsertTodo(context.Context, *todo.Todo) error
+	GetTodoByIDForUser(context.Context, int64, int64) (*todo.Todo, error)
+	DeleteTodoByIDForUser(context.Context, int64, int64, int64) error
+	UpdateTodoByIdForUser(context.Context, *todo.Todo) error
+	GetTodoChangesForUser(context.Context, int64, int64) (*todo.ChangeSet, error)
+	GetTodosForUsers(context.Context, []int64) ([]*todo.Todo, error)
+	CountTodosForUsers(context.Context, []int64) ([]*todo.TodoCount, error)
+
+	SearchTodos(context.Context, *todo.SearchQuery) ([]*todo.SearchResult, error)
+
+	// trash related queries
+	GetTrashedTodosForUser(context.Context, int64) ([]*todo.Todo, error)
+	RestoreTodoByIDForUser(context.Context, int64, int64) (*todo.Todo, error)
+	PurgeTodoByIDForUser(context.Context, int64, int64) error
+	PurgeTrashForUser(context.Context, int64) (int64, error)
+	PurgeTrashedTodosOlderThan(context.Context, time.Duration) (int64, error)
+
+	// import related queries
+	GetTodoImports(context.Context, int64, string) (map[int64]int64, error)
+	ImportTodos(context.Context, int64, string, []todo.TodoImport) error
+
+	// sync related queries
+	GetClientTodoID(context.Context, int64, string) (int64, error)
+	InsertClientTodoID(context.Context, int64, string, int64) error
+}
+
+// Store is every query, run on the pool or in the transaction of WithTx.
+type Store interface {
+	UserStore
+	TodoStore
+}
+
+// IdempotencyKeyStore keeps the responses to requests sent with an
+// idempotency key, for every replica to replay.
+type IdempotencyKeyStore interface {
+	ReserveIdempotencyKey(ctx context.Context, key, fingerprint string, lease time.Duration) (*IdempotencyKey, error)
+	CompleteIdempotencyKey(ctx context.Context, key string, response []byte, ttl time.Duration) error
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+	PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+}
+
 type Service interface {
-	Health() map[string]string
-	Close() error
+	Store
+	IdempotencyKeyStore
+
+	// WithTx runs fn in a serializable transaction, committed when fn
+	// returns nil and rolled back otherwise. When postgres aborts it to keep
+	// concurrent transactions serializable, it is run again, so fn must do
+	// nothing it cannot repeat besides its queries on tx.
+	WithTx(ctx context.Context, fn func(tx Store) error) error
 
-	// user related queries
-	InsertUser(*user.User) error
-	GetUserByUserName(string) (*user.User, error)
-	GetAllUsers() ([]*user.User, error)
-	UpadteUser(*user.User) error
+	Ping(context.Context) error
+	// Migrated reports whether the schema is up to date.
+	Migrated(context.Context) error
+	// System names the database the way traces do, e.g. postgresql.
+	System() string
+	// Stats describes the connection pool, PoolStats counts its connections.
+	Stats() map[string]string
+	PoolStats() PoolStats
+	Close() error
 
-	// to-do related queries
-	GetAllTodosForUser(int64) ([]*todo.Todo, error)
-	InsertTodo(*todo.Todo) error
-	GetTodoByIDForUser(int64, int64) (*todo.Todo, error)
-	DeleteTodoByIDForUser(int64, int64) error
-	UpdateTodoByIdForUser(*todo.Todo) error
+	// pub/sub over postgres LISTEN/NOTIFY
+	Notify(context.Context, string, string) error
+	Listen(context.Context, string, func(string)) error
 }
 
 type service struct {
-	db *sql.DB
+	*store
+	pool *pgxpool.Pool
+	name string
 }
 
-var (
-	database = os.Getenv("DB_DATABASE")
-	password = os.Getenv("DB_PASSWORD")
-	username = os.Getenv("DB_USERNAME")
-	port     = os.Getenv("DB_PORT")
-	host     = os.Getenv("DB_HOST")
-	schema   = os.Getenv("DB_SCHEMA")
-
-	dbInstance *service = nil
-)
+var dbInstance Service = nil
 
-func New() Service {
+// New opens the database cfg.Driver names, once; later calls return the
+// same Service. The process exits when it cannot be opened.
+func New(cfg config.DB) Service {
 	if dbInstance != nil {
 		return dbInstance
 	}
 
-	fmt.Println("connecting to database")
+	if cfg.Driver == config.DriverSQLite {
+		slog.Info("opening database", slog.String("path", cfg.Path))
+		db, err := OpenSQLite(cfg, nil)
+		if err != nil {
+			slog.Error("failed to open the database", slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+		dbInstance = db
+		return dbInstance
+	}
+
+	slog.Info("connecting to database", slog.String("host", cfg.Host), slog.String("database", cfg.Database))
 
-	connStr := fmt.Sprintf(
-		"user=%s password=%s host=%s port=%s dbname=%s sslmode=disable search_path=%s",
-		username,
-		password,
-		host,
-		port,
-		database,
-		schema,
-	)
-	db, err := sql.Open("pgx", connStr)
+	pc, err := poolConfig(cfg)
+	if err != nil {
+		slog.Error("invalid database config", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), pc)
 	if err != nil {
-		log.Fatalf("%v", err)
+		slog.Error("failed to open the database", slog.String("err", err.Error()))
+		os.Exit(1)
 	}
-	dbInstance = &service{
-		db: db,
+	s := &service{
+		store: &store{db: queryer{pool}, begin: pool.BeginTx},
+		pool:  pool,
+		name:  cfg.Database,
 	}
 
-	if err := dbInstance.initDb(); err != nil {
-		log.Fatalf("error while initializing database: %v", err)
+	if err := s.initDb(); err != nil {
+		slog.Error("failed to initialize the database", slog.String("err", err.Error()))
+		os.Exit(1)
 	}
 
+	dbInstance = s
 	return dbInstance
 }
 
+// poolConfig configures the pool and its connections. Statements are
+// prepared once per connection and cached, unless the cache is disabled, and
+// every one of them is traced as a child of the span of the service call
+// running it.
+func poolConfig(cfg config.DB) (*pgxpool.Config, error) {
+	params := [][2]string{
+		{"host", cfg.Host},
+		{"port", strconv.Itoa(cfg.Port)},
+		{"dbname", cfg.Database},
+		{"user", cfg.Username},
+		{"password", cfg.Password},
+		{"sslmode", cfg.SSLMode},
+		{"search_path", cfg.Schema},
+	}
+	if cfg.SSLRootCert != "" {
+		params = append(params, [2]string{"sslrootcert", cfg.SSLRootCert})
+	}
+	pairs := make([]string, len(params))
+	for i, p := range params {
+		pairs[i] = p[0] + "=" + quoteConnParam(p[1])
+	}
+
+	pc, err := pgxpool.ParseConfig(strings.Join(pairs, " "))
+	if err != nil {
+		return nil, err
+	}
+	pc.MinConns = int32(cfg.MinConns)
+	pc.MaxConns = int32(cfg.MaxConns)
+	pc.MaxConnLifetime = cfg.MaxConnLifetime
+	pc.MaxConnIdleTime = cfg.MaxConnIdleTime
+	pc.HealthCheckPeriod = cfg.HealthCheckPeriod
+
+	if cfg.StatementCacheSize > 0 {
+		pc.ConnConfig.StatementCacheCapacity = cfg.StatementCacheSize
+	} else {
+		pc.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeExec
+	}
+	pc.ConnConfig.Tracer = otelpgx.NewTracer(otelpgx.WithTrimSQLInSpanName())
+	return pc, nil
+}
+
+// quoteConnParam quotes a value of a keyword/value connection string.
+func quoteConnParam(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
 func (s *service) initDb() error {
 	query := `create table if not exists users(
 			id serial primary key,
@@ -89,7 +207,7 @@ func (s *service) initDb() error {
 			created_at timestamp default now()
 		);`
 
-	if _, err := s.db.Exec(query); err != nil {
+	if _, err := s.db.Exec(context.Background(), query); err != nil {
 		return err
 	}
 
@@ -103,53 +221,209 @@ func (s *service) initDb() error {
 		created_at timestamp default now(),
 		constraint fk_owner foreign key(owner_id) references users(id) on delete cascade on update cascade
 	);`
-	if _, err := s.db.Exec(query); err != nil {
+	if _, err := s.db.Exec(context.Background(), query); err != nil {
+		return err
+	}
+
+	query = `alter table users add column if not exists version bigint not null default 1;`
+	if _, err := s.db.Exec(context.Background(), query); err != nil {
+		return err
+	}
+
+	// every write to a todo takes a number from todo_change_seq, syncing
+	// clients use the highest number they have seen as their change token
+	query = `create sequence if not exists todo_change_seq;
+		alter table todos add column if not exists version bigint not null default 1;
+		alter table todos add column if not exists updated_at timestamp not null default now();
+		alter table todos add column if not exists change_seq bigint not null default nextval('todo_change_seq');
+		create index if not exists todos_owner_change_seq on todos(owner_id, change_seq);`
+	if _, err := s.db.Exec(context.Background(), query); err != nil {
+		return err
+	}
+
+	query = `alter table todos add column if not exists deleted_at timestamp;
+		create index if not exists todos_deleted_at on todos(deleted_at) where deleted_at is not null;`
+	if _, err := s.db.Exec(context.Background(), query); err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf(`alter table todos add column if not exists search tsvector generated always as (
+			setweight(to_tsvector('%[1]s', coalesce(title, '')), 'A') ||
+			setweight(to_tsvector('%[1]s', coalesce(description, '')), 'B')
+		) stored;
+		create index if not exists todos_search on todos using gin(search);`, searchConfig)
+	if _, err := s.db.Exec(context.Background(), query); err != nil {
+		return err
+	}
+
+	query = `create table if not exists todo_tombstones(
+		todo_id int primary key,
+		owner_id int not null,
+		change_seq bigint not null default nextval('todo_change_seq'),
+		deleted_at timestamp not null default now(),
+		constraint fk_owner foreign key(owner_id) references users(id) on delete cascade on update cascade
+	);
+	create index if not exists todo_tombstones_owner_change_seq on todo_tombstones(owner_id, change_seq);`
+	if _, err := s.db.Exec(context.Background(), query); err != nil {
+		return err
+	}
+
+	query = `alter table users add column if not exists disabled boolean not null default false;
+		alter table users add column if not exists token_version bigint not null default 0;`
+	if _, err := s.db.Exec(context.Background(), query); err != nil {
+		return err
+	}
+
+	// the ids imported todos got, by their id in the account they were
+	// exported from, so importing an archive again skips them
+	query = `create table if not exists todo_imports(
+		owner_id int not null,
+		source varchar(200) not null,
+		source_id bigint not null,
+		todo_id bigint not null,
+		primary key(owner_id, source, source_id),
+		constraint fk_owner foreign key(owner_id) references users(id) on delete cascade on update cascade
+	);`
+	if _, err := s.db.Exec(context.Background(), query); err != nil {
+		return err
+	}
+
+	// the ids the todos created by syncing clients got, by the id the client
+	// chose, so a create sent again returns the todo it created
+	query = `create table if not exists todo_client_ids(
+		owner_id int not null,
+		client_id varchar(100) not null,
+		todo_id bigint not null,
+		primary key(owner_id, client_id),
+		constraint fk_owner foreign key(owner_id) references users(id) on delete cascade on update cascade
+	);`
+	if _, err := s.db.Exec(context.Background(), query); err != nil {
+		return err
+	}
+
+	// the responses to requests sent with an idempotency key, by a hash of
+	// the key, the route and the user
+	query = `create table if not exists idempotency_keys(
+		key varchar(64) primary key,
+		fingerprint varchar(64) not null,
+		response bytea,
+		expires_at timestamp not null
+	);
+	create index if not exists idempotency_keys_expires_at on idempotency_keys(expires_at);`
+	if _, err := s.db.Exec(context.Background(), query); err != nil {
+		return err
+	}
+
+	// the transaction that last wrote a todo or its tombstone, change
+	// tokens are snapshots of the transactions that have committed
+	query = `alter table todos add column if not exists change_xid xid8 not null default pg_current_xact_id();
+		alter table todo_tombstones add column if not exists change_xid xid8 not null default pg_current_xact_id();
+		create index if not exists todos_owner_change_xid on todos(owner_id, change_xid);
+		create index if not exists todo_tombstones_owner_change_xid on todo_tombstones(owner_id, change_xid);
+		create or replace function todos_set_change_xid() returns trigger as $$
+		begin
+			new.change_xid := pg_current_xact_id();
+			return new;
+		end
+		$$ language plpgsql;
+		drop trigger if exists todos_change_xid on todos;
+		create trigger todos_change_xid before update on todos for each row execute function todos_set_change_xid();`
+	if _, err := s.db.Exec(context.Background(), query); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (s *service) Health() map[string]string {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+func (s *service) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
 
-	stats := make(map[string]string)
+// Migrated selects nothing from the tables and columns the last migrations
+// of initDb add, which fails when they are missing.
+func (s *service) Migrated(ctx context.Context) error {
+	query := `select id, version, change_seq, change_xid, deleted_at, search from todos limit 0;
+		select todo_id, change_xid from todo_tombstones limit 0;
+		select disabled, token_version from users limit 0;
+		select todo_id from todo_imports limit 0;
+		select todo_id from todo_client_ids limit 0;
+		select response from idempotency_keys limit 0;`
+	_, err := s.db.Exec(ctx, query)
+	return err
+}
 
-	err := s.db.PingContext(ctx)
-	if err != nil {
-		stats["status"] = "down"
-		stats["error"] = fmt.Sprintf("db down: %v", err)
-		log.Fatalf("db down: %v", err)
-		return stats
+// PoolStats counts the connections of the pool and the waits for them.
+type PoolStats struct {
+	MaxConns      int
+	TotalConns    int
+	AcquiredConns int
+	IdleConns     int
+
+	// AcquireCount counts the connections handed out, EmptyAcquireCount
+	// those that had to be waited for and AcquireDuration the time taken
+	AcquireCount         int64
+	EmptyAcquireCount    int64
+	CanceledAcquireCount int64
+	AcquireDuration      time.Duration
+
+	NewConnsCount     int64
+	MaxLifetimeClosed int64
+	MaxIdleClosed     int64
+}
+
+func (s *service) PoolStats() PoolStats {
+	st := s.pool.Stat()
+	return PoolStats{
+		MaxConns:             int(st.MaxConns()),
+		TotalConns:           int(st.TotalConns()),
+		AcquiredConns:        int(st.AcquiredConns()),
+		IdleConns:            int(st.IdleConns()),
+		AcquireCount:         st.AcquireCount(),
+		EmptyAcquireCount:    st.EmptyAcquireCount(),
+		CanceledAcquireCount: st.CanceledAcquireCount(),
+		AcquireDuration:      st.AcquireDuration(),
+		NewConnsCount:        st.NewConnsCount(),
+		MaxLifetimeClosed:    st.MaxLifetimeDestroyCount(),
+		MaxIdleClosed:        st.MaxIdleDestroyCount(),
 	}
+}
 
-	stats["status"] = "up"
-	stats["message"] = "It's Healthy"
+func (s *service) System() string {
+	return "postgresql"
+}
 
-	dbStats := s.db.Stats()
-	stats["open_connections"] = strconv.Itoa(dbStats.OpenConnections)
+func (s *service) Stats() map[string]string {
+	return poolStats(s.PoolStats())
+}
 
-	stats["in_use"] = strconv.Itoa(dbStats.InUse)
-	stats["idle"] = strconv.Itoa(dbStats.Idle)
-	stats["wait_count"] = strconv.FormatInt(dbStats.WaitCount, 10)
-	stats["wait_duration"] = dbStats.WaitDuration.String()
-	stats["max_idle_closed"] = strconv.FormatInt(dbStats.MaxIdleClosed, 10)
-	stats["max_lifetime_closed"] = strconv.FormatInt(dbStats.MaxLifetimeClosed, 10)
+// poolStats describes the connections of a pool and warns about its
+// bottlenecks in the message.
+func poolStats(ps PoolStats) map[string]string {
+	stats := make(map[string]string)
+	stats["message"] = "It's Healthy"
 
-	if dbStats.OpenConnections > 40 {
-		stats["message"] = "The database is experiencing heavy load."
+	stats["max_connections"] = strconv.Itoa(ps.MaxConns)
+	stats["open_connections"] = strconv.Itoa(ps.TotalConns)
+	stats["in_use"] = strconv.Itoa(ps.AcquiredConns)
+	stats["idle"] = strconv.Itoa(ps.IdleConns)
+	stats["wait_count"] = strconv.FormatInt(ps.EmptyAcquireCount, 10)
+	stats["acquire_duration"] = ps.AcquireDuration.String()
+	stats["max_idle_closed"] = strconv.FormatInt(ps.MaxIdleClosed, 10)
+	stats["max_lifetime_closed"] = strconv.FormatInt(ps.MaxLifetimeClosed, 10)
+
+	if ps.AcquiredConns == ps.MaxConns {
+		stats["message"] = "Every connection is in use, consider raising DB_MAX_CONNS."
 	}
 
-	if dbStats.WaitCount > 1000 {
+	if ps.EmptyAcquireCount > 1000 {
 		stats["message"] = "The database has a high number of wait events, indicating potential bottlenecks."
 	}
 
-	if dbStats.MaxIdleClosed > int64(dbStats.OpenConnections)/2 {
+	if ps.MaxIdleClosed > int64(ps.TotalConns)/2 {
 		stats["message"] = "Many idle connections are being closed, consider revising the connection pool settings."
 	}
 
-	if dbStats.MaxLifetimeClosed > int64(dbStats.OpenConnections)/2 {
+	if ps.MaxLifetimeClosed > int64(ps.TotalConns)/2 {
 		stats["message"] = "Many connections are being closed due to max lifetime, consider increasing max lifetime or revising the connection usage pattern."
 	}
 
@@ -157,6 +431,7 @@ func (s *service) Health() map[string]string {
 }
 
 func (s *service) Close() error {
-	log.Printf("Disconnecting from database: %s", database)
-	return s.db.Close()
+	slog.Info("disconnecting from database", slog.String("database", s.name))
+	s.pool.Close()
+	return nil
 }
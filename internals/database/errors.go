@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrUsernameTaken is returned by InsertUser when another user has the
+// username.
+var ErrUsernameTaken = errors.New("username taken")
+
+const (
+	uniqueViolation = "23505"
+
+	usersUsernameKey = "users_username_key"
+)
+
+// pgxQueryer is satisfied by both *pgxpool.Pool and pgx.Tx.
+type pgxQueryer interface {
+	Exec(context.Context, string, ...any) (pgconn.CommandTag, error)
+	Query(context.Context, string, ...any) (pgx.Rows, error)
+	QueryRow(context.Context, string, ...any) pgx.Row
+}
+
+// queryer runs the statements of the service on the pool or in a
+// transaction and turns the errors of pgx into those the Service returns.
+type queryer struct {
+	q pgxQueryer
+}
+
+func (q queryer) Exec(ctx context.Context, query string, args ...any) (pgconn.CommandTag, error) {
+	tag, err := q.q.Exec(ctx, query, args...)
+	return tag, mapErr(err)
+}
+
+func (q queryer) Query(ctx context.Context, query string, args ...any) (pgx.Rows, error) {
+	rows, err := q.q.Query(ctx, query, args...)
+	return rows, mapErr(err)
+}
+
+func (q queryer) QueryRow(ctx context.Context, query string, args ...any) pgx.Row {
+	return row{q.q.QueryRow(ctx, query, args...)}
+}
+
+type row struct {
+	pgx.Row
+}
+
+func (r row) Scan(dest ...any) error {
+	return mapErr(r.Row.Scan(dest...))
+}
+
+// mapErr reports missing rows as sql.ErrNoRows, the way database/sql does,
+// and violations of known constraints as their typed errors.
+func mapErr(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return sql.ErrNoRows
+	}
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	if pgErr.Code == uniqueViolation && pgErr.ConstraintName == usersUsernameKey {
+		return fmt.Errorf("%w: %w", ErrUsernameTaken, err)
+	}
+	return err
+}
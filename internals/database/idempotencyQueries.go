@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// IdempotencyKey is what is kept of a request sent with an idempotency key.
+// Response is nil until the request completes.
+type IdempotencyKey struct {
+	Fingerprint string
+	Response    []byte
+}
+
+// ReserveIdempotencyKey records key as running a request with the given
+// fingerprint for lease and returns nil, or the record of key when it is
+// known and has not expired. A request that neither completes nor releases
+// its key within the lease, such as one of a crashed replica, loses it.
+func (s *store) ReserveIdempotencyKey(ctx context.Context, key, fingerprint string, lease time.Duration) (*IdempotencyKey, error) {
+	reserveQry := `insert into idempotency_keys (key, fingerprint, expires_at) values ($1, $2, now() + make_interval(secs => $3))
+		on conflict (key) do update set fingerprint = excluded.fingerprint, response = null, expires_at = excluded.expires_at
+			where idempotency_keys.expires_at <= now()
+		returning key`
+	for {
+		err := s.db.QueryRow(ctx, reserveQry, key, fingerprint, lease.Seconds()).Scan(new(string))
+		if err == nil {
+			return nil, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		rec := new(IdempotencyKey)
+		err = s.db.QueryRow(ctx, `select fingerprint, response from idempotency_keys where key = $1`, key).Scan(&rec.Fingerprint, &rec.Response)
+		// released in the meantime, reserve it again
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return rec, nil
+	}
+}
+
+// CompleteIdempotencyKey stores the response of the request running under
+// key, to be replayed for ttl.
+func (s *store) CompleteIdempotencyKey(ctx context.Context, key string, response []byte, ttl time.Duration) error {
+	completeQry := `update idempotency_keys set response = $2, expires_at = now() + make_interval(secs => $3) where key = $1`
+	_, err := s.db.Exec(ctx, completeQry, key, response, ttl.Seconds())
+	return err
+}
+
+// ReleaseIdempotencyKey forgets key, so its request can be retried.
+func (s *store) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	_, err := s.db.Exec(ctx, `delete from idempotency_keys where key = $1`, key)
+	return err
+}
+
+// PurgeExpiredIdempotencyKeys deletes the keys that expired.
+func (s *store) PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	res, err := s.db.Exec(ctx, `delete from idempotency_keys where expires_at <= now()`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
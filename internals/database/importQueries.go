@@ -0,0 +1,86 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+// GetTodoImports returns the ids the todos the user imported from source
+// got, by their id in source.
+func (s *store) GetTodoImports(ctx context.Context, uid int64, source string) (map[int64]int64, error) {
+	rows, err := s.db.Query(ctx, `select source_id, todo_id from todo_imports where owner_id = $1 and source = $2`, uid, source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := map[int64]int64{}
+	for rows.Next() {
+		var sourceID, tid int64
+		if err := rows.Scan(&sourceID, &tid); err != nil {
+			return nil, err
+		}
+		ids[sourceID] = tid
+	}
+	return ids, rows.Err()
+}
+
+// ImportTodos stores the imported todos of the user with the times they
+// carry, trashed ones into the trash, and sets their ids and versions. It
+// records the id each one got by its id in source, keeping the records of
+// todos imported before. The todos are stored by a single statement.
+func (s *store) ImportTodos(ctx context.Context, uid int64, source string, imports []todo.TodoImport) error {
+	if len(imports) == 0 {
+		return nil
+	}
+	var (
+		sourceIDs    = make([]int64, len(imports))
+		titles       = make([]string, len(imports))
+		descriptions = make([]string, len(imports))
+		statuses     = make([]int16, len(imports))
+		dueDates     = make([]time.Time, len(imports))
+		createdAts   = make([]time.Time, len(imports))
+		updatedAts   = make([]time.Time, len(imports))
+		deletedAts   = make([]*time.Time, len(imports))
+	)
+	for i, imp := range imports {
+		t := imp.Todo
+		sourceIDs[i] = imp.SourceID
+		titles[i], descriptions[i], statuses[i] = t.Title, t.Description, t.Status
+		dueDates[i], createdAts[i], updatedAts[i] = t.DueDate.UTC(), t.CreatedAt.UTC(), t.UpdatedAt.UTC()
+		if t.DeletedAt != nil {
+			deletedAt := t.DeletedAt.UTC()
+			deletedAts[i] = &deletedAt
+		}
+	}
+	// the ids are drawn before inserting, so they map back to the source ids
+	importQry := `with rows as (
+			select nextval(pg_get_serial_sequence('todos', 'id')) as id, r.*
+			from unnest($3::bigint[], $4::text[], $5::text[], $6::smallint[], $7::timestamp[], $8::timestamp[], $9::timestamp[], $10::timestamp[])
+				with ordinality as r(source_id, title, description, status, due_date, created_at, updated_at, deleted_at, n)
+		), inserted as (
+			insert into todos (id, owner_id, title, description, status, due_date, created_at, updated_at, deleted_at)
+			select id, $1, title, description, status, due_date, created_at, updated_at, deleted_at from rows
+		), recorded as (
+			insert into todo_imports (owner_id, source, source_id, todo_id)
+			select $1, $2, source_id, id from rows
+			on conflict do nothing
+		)
+		select id from rows order by n`
+	rows, err := s.db.Query(ctx, importQry, uid, source, sourceIDs, titles, descriptions, statuses, dueDates, createdAts, updatedAts, deletedAts)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	i := 0
+	for rows.Next() {
+		t := imports[i].Todo
+		if err := rows.Scan(&t.TodoId); err != nil {
+			return err
+		}
+		t.OwnerId, t.Version = uid, 1
+		i++
+	}
+	return rows.Err()
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// listenerBuffer is how many notifications a local listener holds before
+// Notify waits for it
+const listenerBuffer = 64
+
+var errDatabaseClosed = errors.New("the database is closed")
+
+// localNotify is the pub/sub of the services living in the process, the
+// memory and sqlite ones, which only reaches the listeners of the process.
+type localNotify struct {
+	listenMu  sync.Mutex
+	listeners map[*localListener]struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type localListener struct {
+	channel string
+	ch      chan string
+	done    chan struct{}
+}
+
+func newLocalNotify() *localNotify {
+	return &localNotify{
+		listeners: map[*localListener]struct{}{},
+		closed:    make(chan struct{}),
+	}
+}
+
+// open fails once the service is closed.
+func (n *localNotify) open() error {
+	select {
+	case <-n.closed:
+		return errDatabaseClosed
+	default:
+		return nil
+	}
+}
+
+// close stops every listener.
+func (n *localNotify) close() {
+	n.closeOnce.Do(func() { close(n.closed) })
+}
+
+// Notify hands the payload to every listener of the channel, waiting for
+// those that are too far behind.
+func (n *localNotify) Notify(ctx context.Context, channel, payload string) error {
+	if err := n.open(); err != nil {
+		return err
+	}
+	n.listenMu.Lock()
+	var listeners []*localListener
+	for l := range n.listeners {
+		if l.channel == channel {
+			listeners = append(listeners, l)
+		}
+	}
+	n.listenMu.Unlock()
+
+	for _, l := range listeners {
+		select {
+		case l.ch <- payload:
+		case <-l.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Listen calls handler for every notification on the channel until ctx is
+// done or the service is closed.
+func (n *localNotify) Listen(ctx context.Context, channel string, handler func(payload string)) error {
+	if err := n.open(); err != nil {
+		return err
+	}
+	l := &localListener{
+		channel: channel,
+		ch:      make(chan string, listenerBuffer),
+		done:    make(chan struct{}),
+	}
+	n.listenMu.Lock()
+	n.listeners[l] = struct{}{}
+	n.listenMu.Unlock()
+	defer func() {
+		close(l.done)
+		n.listenMu.Lock()
+		delete(n.listeners, l)
+		n.listenMu.Unlock()
+	}()
+
+	for {
+		select {
+		case payload := <-l.ch:
+			handler(payload)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.closed:
+			return errDatabaseClosed
+		}
+	}
+}
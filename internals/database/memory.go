@@ -0,0 +1,720 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+// errMemorySerialization is what WithTx of the memory service fails with
+// once every attempt collided with another write
+var errMemorySerialization = errors.New("could not serialize access due to concurrent update")
+
+// memData holds the tables of the memory service and the counters of their
+// serial columns.
+type memData struct {
+	users      map[int64]*user.User
+	todos      map[int64]*memTodo
+	tombstones []memTombstone
+	imports    map[memImport]int64
+	clientIDs  map[memClientID]int64
+	idemKeys   map[string]memIdempotencyKey
+
+	userSeq   int64
+	todoSeq   int64
+	changeSeq int64
+}
+
+type memTodo struct {
+	todo.Todo
+	changeSeq int64
+}
+
+// memImport is the todo sourceID of source imported by the owner.
+type memImport struct {
+	ownerID  int64
+	source   string
+	sourceID int64
+}
+
+// memClientID is the id the owner's syncing client chose for a todo.
+type memClientID struct {
+	ownerID  int64
+	clientID string
+}
+
+type memIdempotencyKey struct {
+	IdempotencyKey
+	expiresAt time.Time
+}
+
+type memTombstone struct {
+	todoID    int64
+	ownerID   int64
+	changeSeq int64
+	deletedAt time.Time
+}
+
+func (d *memData) clone() *memData {
+	c := &memData{
+		users:      make(map[int64]*user.User, len(d.users)),
+		todos:      make(map[int64]*memTodo, len(d.todos)),
+		tombstones: slices.Clone(d.tombstones),
+		imports:    maps.Clone(d.imports),
+		clientIDs:  maps.Clone(d.clientIDs),
+		idemKeys:   maps.Clone(d.idemKeys),
+		userSeq:    d.userSeq,
+		todoSeq:    d.todoSeq,
+		changeSeq:  d.changeSeq,
+	}
+	for id, u := range d.users {
+		uc := *u
+		c.users[id] = &uc
+	}
+	for id, t := range d.todos {
+		tc := *t
+		c.todos[id] = &tc
+	}
+	return c
+}
+
+func (d *memData) nextChange() int64 {
+	d.changeSeq++
+	return d.changeSeq
+}
+
+func (d *memData) userByName(username string) *user.User {
+	for _, u := range d.users {
+		if u.Username == username {
+			return u
+		}
+	}
+	return nil
+}
+
+// todo returns the todo of the user, trashed or not, nil when there is none.
+func (d *memData) todo(tid, uid int64, trashed bool) *memTodo {
+	t, ok := d.todos[tid]
+	if !ok || t.OwnerId != uid || (t.DeletedAt != nil) != trashed {
+		return nil
+	}
+	return t
+}
+
+// sortedTodos returns the todos keep selects, ordered by id.
+func (d *memData) sortedTodos(keep func(*memTodo) bool) []*memTodo {
+	todos := []*memTodo{}
+	for _, t := range d.todos {
+		if keep(t) {
+			todos = append(todos, t)
+		}
+	}
+	slices.SortFunc(todos, func(a, b *memTodo) int {
+		return cmpInt64(a.TodoId, b.TodoId)
+	})
+	return todos
+}
+
+func (d *memData) purge(t *memTodo, now time.Time) {
+	delete(d.todos, t.TodoId)
+	d.tombstones = append(d.tombstones, memTombstone{
+		todoID:    t.TodoId,
+		ownerID:   t.OwnerId,
+		changeSeq: d.nextChange(),
+		deletedAt: now,
+	})
+}
+
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func copyUser(u *user.User) *user.User {
+	c := *u
+	return &c
+}
+
+func copyTodo(t *memTodo) *todo.Todo {
+	c := t.Todo
+	if t.DeletedAt != nil {
+		deletedAt := *t.DeletedAt
+		c.DeletedAt = &deletedAt
+	}
+	return &c
+}
+
+// memStore runs the queries of the Store on the tables of the memory
+// service or on the copy of them a transaction works on.
+type memStore struct {
+	mu sync.RWMutex
+	d  *memData
+	// gen counts the writes, a transaction commits only when there was
+	// none since it copied the tables
+	gen uint64
+	now func() time.Time
+}
+
+func (s *memStore) read(fn func(d *memData)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fn(s.d)
+}
+
+// write runs fn on the tables, which it must leave untouched when it fails.
+func (s *memStore) write(fn func(d *memData) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := fn(s.d); err != nil {
+		return err
+	}
+	s.gen++
+	return nil
+}
+
+// timestamp is the time the way postgres stores it in a timestamp column.
+func (s *memStore) timestamp() time.Time {
+	return s.now().UTC().Truncate(time.Microsecond)
+}
+
+func (s *memStore) InsertUser(_ context.Context, u *user.User) error {
+	return s.write(func(d *memData) error {
+		if d.userByName(u.Username) != nil {
+			return ErrUsernameTaken
+		}
+		d.userSeq++
+		u.UserId = d.userSeq
+		u.CreatedAt = s.timestamp()
+		u.Version = 1
+		d.users[u.UserId] = copyUser(u)
+		return nil
+	})
+}
+
+func (s *memStore) GetUserByUserName(_ context.Context, username string) (u *user.User, err error) {
+	s.read(func(d *memData) {
+		if found := d.userByName(username); found != nil {
+			u = copyUser(found)
+			return
+		}
+		err = sql.ErrNoRows
+	})
+	return u, err
+}
+
+func (s *memStore) GetAllUsers(context.Context) ([]*user.User, error) {
+	return s.usersWhere(func(*user.User) bool { return true }), nil
+}
+
+func (s *memStore) UpadteUser(_ context.Context, u *user.User) error {
+	return s.write(func(d *memData) error {
+		stored := d.userByName(u.Username)
+		if stored == nil {
+			return sql.ErrNoRows
+		}
+		if stored.Version != u.Version {
+			return ErrVersionConflict
+		}
+		stored.FirstName = u.FirstName
+		stored.LastName = u.LastName
+		stored.Password = u.Password
+		stored.IsAdmin = u.IsAdmin
+		stored.Disabled = u.Disabled
+		stored.TokenVersion = u.TokenVersion
+		stored.Version++
+		u.Version = stored.Version
+		return nil
+	})
+}
+
+func (s *memStore) GetUsersByIDs(_ context.Context, ids []int64) ([]*user.User, error) {
+	return s.usersWhere(func(u *user.User) bool { return slices.Contains(ids, u.UserId) }), nil
+}
+
+func (s *memStore) usersWhere(keep func(*user.User) bool) []*user.User {
+	users := []*user.User{}
+	s.read(func(d *memData) {
+		for _, u := range d.users {
+			if keep(u) {
+				users = append(users, copyUser(u))
+			}
+		}
+	})
+	slices.SortFunc(users, func(a, b *user.User) int {
+		return cmpInt64(a.UserId, b.UserId)
+	})
+	return users
+}
+
+func (s *memStore) GetAllTodosForUser(_ context.Context, uid int64) ([]*todo.Todo, error) {
+	return s.todosWhere(func(t *memTodo) bool {
+		return t.OwnerId == uid && t.DeletedAt == nil
+	}), nil
+}
+
+// GetTodosForUsers returns the todos of every given user, ordered by owner.
+func (s *memStore) GetTodosForUsers(_ context.Context, uids []int64) ([]*todo.Todo, error) {
+	todos := s.todosWhere(func(t *memTodo) bool {
+		return slices.Contains(uids, t.OwnerId) && t.DeletedAt == nil
+	})
+	slices.SortStableFunc(todos, func(a, b *todo.Todo) int {
+		return cmpInt64(a.OwnerId, b.OwnerId)
+	})
+	return todos, nil
+}
+
+func (s *memStore) todosWhere(keep func(*memTodo) bool) []*todo.Todo {
+	todos := []*todo.Todo{}
+	s.read(func(d *memData) {
+		for _, t := range d.sortedTodos(keep) {
+			todos = append(todos, copyTodo(t))
+		}
+	})
+	return todos
+}
+
+func (s *memStore) CountTodosForUsers(_ context.Context, uids []int64) ([]*todo.TodoCount, error) {
+	counts := []*todo.TodoCount{}
+	byOwner := map[int64]*todo.TodoCount{}
+	s.read(func(d *memData) {
+		for _, t := range d.sortedTodos(func(t *memTodo) bool {
+			return slices.Contains(uids, t.OwnerId) && t.DeletedAt == nil
+		}) {
+			c, ok := byOwner[t.OwnerId]
+			if !ok {
+				c = &todo.TodoCount{OwnerId: t.OwnerId}
+				byOwner[t.OwnerId] = c
+				counts = append(counts, c)
+			}
+			c.Total++
+			switch t.Status {
+			case 0:
+				c.Pending++
+			case 1:
+				c.InProgress++
+			case todo.StatusCompleted:
+				c.Completed++
+			}
+		}
+	})
+	return counts, nil
+}
+
+func (s *memStore) InsertTodo(_ context.Context, t *todo.Todo) error {
+	return s.write(func(d *memData) error {
+		if _, ok := d.users[t.OwnerId]; !ok {
+			return errors.New("the owner of the todo does not exist")
+		}
+		now := s.timestamp()
+		d.todoSeq++
+		t.TodoId = d.todoSeq
+		t.CreatedAt = now
+		t.UpdatedAt = now
+		t.Version = 1
+		t.DeletedAt = nil
+		d.todos[t.TodoId] = &memTodo{Todo: *t, changeSeq: d.nextChange()}
+		return nil
+	})
+}
+
+func (s *memStore) GetTodoByIDForUser(_ context.Context, tid, uid int64) (t *todo.Todo, err error) {
+	s.read(func(d *memData) {
+		if found := d.todo(tid, uid, false); found != nil {
+			t = copyTodo(found)
+			return
+		}
+		err = sql.ErrNoRows
+	})
+	return t, err
+}
+
+// DeleteTodoByIDForUser moves the todo to the trash. A non zero version
+// makes the delete conditional on the todo still being at that version.
+func (s *memStore) DeleteTodoByIDForUser(_ context.Context, tid, uid, version int64) error {
+	return s.write(func(d *memData) error {
+		t := d.todo(tid, uid, false)
+		if t == nil {
+			return sql.ErrNoRows
+		}
+		if version != 0 && t.Version != version {
+			return ErrVersionConflict
+		}
+		now := s.timestamp()
+		t.DeletedAt = &now
+		t.UpdatedAt = now
+		t.Version++
+		t.changeSeq = d.nextChange()
+		return nil
+	})
+}
+
+// UpdateTodoByIdForUser stores t if it is still at t.Version and bumps the
+// version.
+func (s *memStore) UpdateTodoByIdForUser(_ context.Context, t *todo.Todo) error {
+	return s.write(func(d *memData) error {
+		stored := d.todo(t.TodoId, t.OwnerId, false)
+		if stored == nil {
+			return sql.ErrNoRows
+		}
+		if stored.Version != t.Version {
+			return ErrVersionConflict
+		}
+		stored.Title = t.Title
+		stored.Description = t.Description
+		stored.Status = t.Status
+		stored.DueDate = t.DueDate
+		stored.Version++
+		stored.UpdatedAt = s.timestamp()
+		stored.changeSeq = d.nextChange()
+		t.Version, t.UpdatedAt = stored.Version, stored.UpdatedAt
+		return nil
+	})
+}
+
+// GetTodoChangesForUser returns every todo of the user written after the
+// change token since, the ids of those deleted or trashed after it and the
+// token to resume from.
+func (s *memStore) GetTodoChangesForUser(_ context.Context, uid, since int64) (*todo.ChangeSet, error) {
+	cs := &todo.ChangeSet{
+		Token:   since,
+		Todos:   []*todo.Todo{},
+		Deleted: []int64{},
+	}
+	s.read(func(d *memData) {
+		var changed []*memTodo
+		latest := int64(-1)
+		for _, t := range d.todos {
+			if t.OwnerId != uid {
+				continue
+			}
+			latest = max(latest, t.changeSeq)
+			if t.changeSeq > since {
+				changed = append(changed, t)
+			}
+		}
+		slices.SortFunc(changed, func(a, b *memTodo) int {
+			return cmpInt64(a.changeSeq, b.changeSeq)
+		})
+		for _, t := range changed {
+			if t.DeletedAt != nil {
+				cs.Deleted = append(cs.Deleted, t.TodoId)
+				continue
+			}
+			cs.Todos = append(cs.Todos, copyTodo(t))
+		}
+		// tombstones are appended in change order
+		for _, ts := range d.tombstones {
+			if ts.ownerID != uid {
+				continue
+			}
+			latest = max(latest, ts.changeSeq)
+			if ts.changeSeq > since {
+				cs.Deleted = append(cs.Deleted, ts.todoID)
+			}
+		}
+		if latest >= 0 {
+			cs.Token = latest
+		}
+	})
+	return cs, nil
+}
+
+func (s *memStore) GetTrashedTodosForUser(_ context.Context, uid int64) ([]*todo.Todo, error) {
+	todos := s.todosWhere(func(t *memTodo) bool {
+		return t.OwnerId == uid && t.DeletedAt != nil
+	})
+	slices.SortStableFunc(todos, func(a, b *todo.Todo) int {
+		return b.DeletedAt.Compare(*a.DeletedAt)
+	})
+	return todos, nil
+}
+
+// RestoreTodoByIDForUser takes a todo out of the trash and returns it.
+func (s *memStore) RestoreTodoByIDForUser(_ context.Context, tid, uid int64) (restored *todo.Todo, err error) {
+	err = s.write(func(d *memData) error {
+		t := d.todo(tid, uid, true)
+		if t == nil {
+			return sql.ErrNoRows
+		}
+		t.DeletedAt = nil
+		t.UpdatedAt = s.timestamp()
+		t.Version++
+		t.changeSeq = d.nextChange()
+		restored = copyTodo(t)
+		return nil
+	})
+	return restored, err
+}
+
+// PurgeTodoByIDForUser permanently deletes a trashed todo, leaving a
+// tombstone behind for syncing clients.
+func (s *memStore) PurgeTodoByIDForUser(_ context.Context, tid, uid int64) error {
+	return s.write(func(d *memData) error {
+		t := d.todo(tid, uid, true)
+		if t == nil {
+			return sql.ErrNoRows
+		}
+		d.purge(t, s.timestamp())
+		return nil
+	})
+}
+
+// PurgeTrashForUser empties the trash of a user and returns how many todos
+// were in it.
+func (s *memStore) PurgeTrashForUser(_ context.Context, uid int64) (int64, error) {
+	return s.purgeWhere(func(t *memTodo, _ time.Time) bool {
+		return t.OwnerId == uid
+	})
+}
+
+// PurgeTrashedTodosOlderThan permanently deletes every todo that has been in
+// the trash for longer than retention, across all users.
+func (s *memStore) PurgeTrashedTodosOlderThan(_ context.Context, retention time.Duration) (int64, error) {
+	return s.purgeWhere(func(t *memTodo, now time.Time) bool {
+		return t.DeletedAt.Before(now.Add(-retention))
+	})
+}
+
+// purgeWhere purges the trashed todos keep selects.
+func (s *memStore) purgeWhere(keep func(t *memTodo, now time.Time) bool) (int64, error) {
+	var purged int64
+	err := s.write(func(d *memData) error {
+		now := s.timestamp()
+		for _, t := range d.sortedTodos(func(t *memTodo) bool {
+			return t.DeletedAt != nil && keep(t, now)
+		}) {
+			d.purge(t, now)
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// GetTodoImports returns the ids the todos the user imported from source
+// got, by their id in source.
+func (s *memStore) GetTodoImports(_ context.Context, uid int64, source string) (ids map[int64]int64, _ error) {
+	ids = map[int64]int64{}
+	s.read(func(d *memData) {
+		for imp, tid := range d.imports {
+			if imp.ownerID == uid && imp.source == source {
+				ids[imp.sourceID] = tid
+			}
+		}
+	})
+	return ids, nil
+}
+
+// ImportTodos stores the imported todos of the user with the times they
+// carry, trashed ones into the trash, and sets their ids and versions. It
+// records the id each one got by its id in source, keeping the records of
+// todos imported before.
+func (s *memStore) ImportTodos(_ context.Context, uid int64, source string, imports []todo.TodoImport) error {
+	return s.write(func(d *memData) error {
+		if _, ok := d.users[uid]; !ok {
+			return errors.New("the owner of the todos does not exist")
+		}
+		for _, imp := range imports {
+			t := imp.Todo
+			d.todoSeq++
+			t.TodoId = d.todoSeq
+			t.OwnerId = uid
+			t.Version = 1
+			stored := &memTodo{Todo: *t, changeSeq: d.nextChange()}
+			if t.DeletedAt != nil {
+				deletedAt := *t.DeletedAt
+				stored.DeletedAt = &deletedAt
+			}
+			d.todos[t.TodoId] = stored
+			rec := memImport{ownerID: uid, source: source, sourceID: imp.SourceID}
+			if _, ok := d.imports[rec]; !ok {
+				d.imports[rec] = t.TodoId
+			}
+		}
+		return nil
+	})
+}
+
+// GetClientTodoID returns the id of the todo the user created offline under
+// clientID, sql.ErrNoRows when there is none.
+func (s *memStore) GetClientTodoID(_ context.Context, uid int64, clientID string) (tid int64, err error) {
+	s.read(func(d *memData) {
+		var ok bool
+		if tid, ok = d.clientIDs[memClientID{ownerID: uid, clientID: clientID}]; !ok {
+			err = sql.ErrNoRows
+		}
+	})
+	return tid, err
+}
+
+// InsertClientTodoID records that the todo the user created offline under
+// clientID got tid, unless it was recorded before.
+func (s *memStore) InsertClientTodoID(_ context.Context, uid int64, clientID string, tid int64) error {
+	return s.write(func(d *memData) error {
+		id := memClientID{ownerID: uid, clientID: clientID}
+		if _, ok := d.clientIDs[id]; !ok {
+			d.clientIDs[id] = tid
+		}
+		return nil
+	})
+}
+
+// ReserveIdempotencyKey records key as running a request with the given
+// fingerprint for lease and returns nil, or the record of key when it is
+// known and has not expired. A request that neither completes nor releases
+// its key within the lease, such as one of a crashed replica, loses it.
+func (s *memStore) ReserveIdempotencyKey(_ context.Context, key, fingerprint string, lease time.Duration) (rec *IdempotencyKey, _ error) {
+	err := s.write(func(d *memData) error {
+		now := s.now()
+		if k, ok := d.idemKeys[key]; ok && now.Before(k.expiresAt) {
+			rec = &IdempotencyKey{Fingerprint: k.Fingerprint, Response: slices.Clone(k.Response)}
+			return nil
+		}
+		d.idemKeys[key] = memIdempotencyKey{
+			IdempotencyKey: IdempotencyKey{Fingerprint: fingerprint},
+			expiresAt:      now.Add(lease),
+		}
+		return nil
+	})
+	return rec, err
+}
+
+// CompleteIdempotencyKey stores the response of the request running under
+// key, to be replayed for ttl.
+func (s *memStore) CompleteIdempotencyKey(_ context.Context, key string, response []byte, ttl time.Duration) error {
+	return s.write(func(d *memData) error {
+		if k, ok := d.idemKeys[key]; ok {
+			k.Response = slices.Clone(response)
+			k.expiresAt = s.now().Add(ttl)
+			d.idemKeys[key] = k
+		}
+		return nil
+	})
+}
+
+// ReleaseIdempotencyKey forgets key, so its request can be retried.
+func (s *memStore) ReleaseIdempotencyKey(_ context.Context, key string) error {
+	return s.write(func(d *memData) error {
+		delete(d.idemKeys, key)
+		return nil
+	})
+}
+
+// PurgeExpiredIdempotencyKeys deletes the keys that expired.
+func (s *memStore) PurgeExpiredIdempotencyKeys(context.Context) (purged int64, _ error) {
+	err := s.write(func(d *memData) error {
+		now := s.now()
+		for key, k := range d.idemKeys {
+			if !now.Before(k.expiresAt) {
+				delete(d.idemKeys, key)
+				purged++
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// memory is a Service keeping everything in memory, for tests and trying
+// the api out. It has the semantics of the postgres one, except that
+// searches match words without stemming them.
+type memory struct {
+	*memStore
+	*localNotify
+}
+
+// NewMemory returns an empty Service that keeps everything in memory. now
+// tells the time of its timestamps, time.Now when nil.
+func NewMemory(now func() time.Time) Service {
+	if now == nil {
+		now = time.Now
+	}
+	return &memory{
+		memStore: &memStore{
+			d: &memData{
+				users:     map[int64]*user.User{},
+				todos:     map[int64]*memTodo{},
+				imports:   map[memImport]int64{},
+				clientIDs: map[memClientID]int64{},
+				idemKeys:  map[string]memIdempotencyKey{},
+			},
+			now: now,
+		},
+		localNotify: newLocalNotify(),
+	}
+}
+
+// WithTx runs fn on a copy of the tables and stores the copy when fn
+// succeeds and nothing was written in the meantime. Otherwise fn is run
+// again on a fresh copy, like postgres retries serialization failures.
+func (m *memory) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	for attempt := 1; ; attempt++ {
+		m.mu.RLock()
+		tx := &memStore{d: m.d.clone(), now: m.now}
+		gen := m.gen
+		m.mu.RUnlock()
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		committed := m.gen == gen
+		if committed {
+			m.d = tx.d
+			m.gen++
+		}
+		m.mu.Unlock()
+
+		if committed {
+			return nil
+		}
+		if attempt == maxTxAttempts {
+			return errMemorySerialization
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(txRetryBackoff(attempt)):
+		}
+	}
+}
+
+func (m *memory) Ping(context.Context) error {
+	return m.open()
+}
+
+// Migrated always succeeds, the tables of the memory service need no
+// migrations.
+func (m *memory) Migrated(ctx context.Context) error {
+	return m.Ping(ctx)
+}
+
+func (m *memory) System() string {
+	return "memory"
+}
+
+func (m *memory) Stats() map[string]string {
+	return map[string]string{"message": "It's Healthy"}
+}
+
+func (m *memory) PoolStats() PoolStats {
+	return PoolStats{}
+}
+
+func (m *memory) Close() error {
+	m.close()
+	return nil
+}
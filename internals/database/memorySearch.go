@@ -0,0 +1,194 @@
+package database
+
+import (
+	"context"
+	"html"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+// the weights postgres gives the title and description lexemes by default
+const (
+	memTitleWeight       = 1.0
+	memDescriptionWeight = 0.4
+)
+
+// memSearchTerm is a term of a search of the memory service, as
+// buildTSQuery builds them: a phrase of exact words or prefixes that must all
+// match, possibly negated.
+type memSearchTerm struct {
+	words  []string
+	phrase bool
+	negate bool
+}
+
+func parseMemSearch(input string) []memSearchTerm {
+	var terms []memSearchTerm
+	for i, chunk := range strings.Split(input, `"`) {
+		if i%2 == 1 {
+			// inside quotes
+			if words := memWords(chunk); len(words) > 0 {
+				terms = append(terms, memSearchTerm{words: words, phrase: true})
+			}
+			continue
+		}
+		for _, field := range strings.Fields(chunk) {
+			if words := memWords(field); len(words) > 0 {
+				terms = append(terms, memSearchTerm{words: words, negate: strings.HasPrefix(field, "-")})
+			}
+		}
+	}
+	return terms
+}
+
+func memWords(s string) []string {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range words {
+		words[i] = strings.ToLower(w)
+	}
+	return words
+}
+
+func (t memSearchTerm) matchesWord(want, word string) bool {
+	if t.phrase {
+		return word == want
+	}
+	return strings.HasPrefix(word, want)
+}
+
+// matches reports whether the words of a document satisfy the term.
+func (t memSearchTerm) matches(doc []string) bool {
+	found := false
+	if t.phrase {
+		for i := 0; i+len(t.words) <= len(doc) && !found; i++ {
+			found = true
+			for j, w := range t.words {
+				if doc[i+j] != w {
+					found = false
+					break
+				}
+			}
+		}
+	} else {
+		found = true
+		for _, w := range t.words {
+			if !slices.ContainsFunc(doc, func(word string) bool { return t.matchesWord(w, word) }) {
+				found = false
+				break
+			}
+		}
+	}
+	return found != t.negate
+}
+
+// memHits counts the words of doc the terms that are not negated match.
+func memHits(terms []memSearchTerm, doc []string) int {
+	n := 0
+	for _, word := range doc {
+		if memHighlighted(terms, word) {
+			n++
+		}
+	}
+	return n
+}
+
+// memRank weighs the matching words of the title and description, without
+// normalizing by the length of the document, like ts_rank does by default.
+func memRank(terms []memSearchTerm, title, description []string) float32 {
+	return float32(memTitleWeight*float64(memHits(terms, title)) + memDescriptionWeight*float64(memHits(terms, description)))
+}
+
+func memHighlighted(terms []memSearchTerm, word string) bool {
+	for _, t := range terms {
+		if t.negate {
+			continue
+		}
+		for _, w := range t.words {
+			if t.matchesWord(w, word) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// memHighlight escapes the html of text and wraps the words the terms match
+// in <mark> tags.
+func memHighlight(terms []memSearchTerm, text string) string {
+	var b, word strings.Builder
+	flush := func() {
+		if word.Len() == 0 {
+			return
+		}
+		if memHighlighted(terms, strings.ToLower(word.String())) {
+			b.WriteString("<mark>" + word.String() + "</mark>")
+		} else {
+			b.WriteString(word.String())
+		}
+		word.Reset()
+	}
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word.WriteRune(r)
+			continue
+		}
+		flush()
+		b.WriteString(html.EscapeString(string(r)))
+	}
+	flush()
+	return b.String()
+}
+
+// SearchTodos ranks todos by how many words of their title and description
+// match the query and highlights the matches with <mark> tags.
+func (s *memStore) SearchTodos(_ context.Context, q *todo.SearchQuery) ([]*todo.SearchResult, error) {
+	results := []*todo.SearchResult{}
+	terms := parseMemSearch(q.Query)
+	if len(terms) == 0 {
+		return results, nil
+	}
+
+	s.read(func(d *memData) {
+		for _, t := range d.sortedTodos(func(t *memTodo) bool {
+			return t.DeletedAt == nil &&
+				(q.OwnerID == 0 || t.OwnerId == q.OwnerID) &&
+				(q.Status == nil || t.Status == *q.Status) &&
+				(q.DueBefore == nil || t.DueDate.Before(*q.DueBefore)) &&
+				(q.DueAfter == nil || !t.DueDate.Before(*q.DueAfter))
+		}) {
+			title, description := memWords(t.Title), memWords(t.Description)
+			doc := append(slices.Clone(title), description...)
+			if !slices.ContainsFunc(terms, func(term memSearchTerm) bool { return !term.matches(doc) }) {
+				results = append(results, &todo.SearchResult{
+					Todo:                 copyTodo(t),
+					Username:             d.users[t.OwnerId].Username,
+					Rank:                 memRank(terms, title, description),
+					TitleHighlight:       memHighlight(terms, t.Title),
+					DescriptionHighlight: memHighlight(terms, t.Description),
+				})
+			}
+		}
+	})
+	slices.SortStableFunc(results, func(a, b *todo.SearchResult) int {
+		switch {
+		case a.Rank > b.Rank:
+			return -1
+		case a.Rank < b.Rank:
+			return 1
+		}
+		return 0
+	})
+
+	limit := q.Limit
+	if limit == 0 {
+		limit = defaultSearchLimit
+	}
+	start := min(q.Offset, len(results))
+	end := min(start+limit, len(results))
+	return results[start:end], nil
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	testConformance(t, NewMemory(nil))
+}
+
+func TestMemoryClock(t *testing.T) {
+	now := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	db := NewMemory(func() time.Time { return now })
+	u := newUser(t, db)
+	td := newTodo(t, db, u, "Clocked todo", "")
+	if !u.CreatedAt.Equal(now) || !td.CreatedAt.Equal(now) || !td.UpdatedAt.Equal(now) {
+		t.Errorf("timestamps do not come from the clock: %v, %v, %v", u.CreatedAt, td.CreatedAt, td.UpdatedAt)
+	}
+
+	ctx := context.Background()
+	if err := db.DeleteTodoByIDForUser(ctx, td.TodoId, u.UserId, 0); err != nil {
+		t.Fatalf("DeleteTodoByIDForUser: %v", err)
+	}
+	now = now.Add(2 * time.Hour)
+	if n, _ := db.PurgeTrashedTodosOlderThan(ctx, 3*time.Hour); n != 0 {
+		t.Errorf("purged %d todos before the retention passed", n)
+	}
+	if n, _ := db.PurgeTrashedTodosOlderThan(ctx, time.Hour); n != 1 {
+		t.Errorf("purged %d todos after the retention passed, want 1", n)
+	}
+}
+
+func TestMemoryTxRetries(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemory(nil)
+	u := newUser(t, db)
+
+	attempts := 0
+	err := db.WithTx(ctx, func(tx Store) error {
+		attempts++
+		if attempts == 1 {
+			// a concurrent write, the transaction no longer serializes
+			newTodo(t, db, u, "Concurrent todo", "")
+		}
+		newTodo(t, tx, u, "Transaction todo", "")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("fn ran %d times, want 2", attempts)
+	}
+	if todos, _ := db.GetAllTodosForUser(ctx, u.UserId); len(todos) != 2 {
+		t.Errorf("stored %d todos, want 2", len(todos))
+	}
+
+	err = db.WithTx(ctx, func(tx Store) error {
+		newTodo(t, db, u, "Concurrent todo", "")
+		return nil
+	})
+	if !errors.Is(err, errMemorySerialization) {
+		t.Errorf("WithTx colliding on every attempt = %v, want errMemorySerialization", err)
+	}
+}
+
+func TestMemoryConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemory(nil)
+	u := newUser(t, db)
+	td := newTodo(t, db, u, "Contended todo", "")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	applied, conflicts := 0, 0
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			update := *td
+			update.Status = 1
+			err := db.UpdateTodoByIdForUser(ctx, &update)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				applied++
+			case errors.Is(err, ErrVersionConflict):
+				conflicts++
+			default:
+				t.Errorf("UpdateTodoByIdForUser: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if applied != 1 || conflicts != 19 {
+		t.Errorf("%d updates of the same version applied and %d conflicted, want 1 and 19", applied, conflicts)
+	}
+
+	got, err := db.GetTodoByIDForUser(ctx, td.TodoId, u.UserId)
+	if err != nil {
+		t.Fatalf("GetTodoByIDForUser: %v", err)
+	}
+	if got.Version != 2 || got.Status != 1 {
+		t.Errorf("stored %+v, want status 1 at version 2", got)
+	}
+	got.Status = todo.StatusCompleted
+	if again, _ := db.GetTodoByIDForUser(ctx, td.TodoId, u.UserId); again.Status != 1 {
+		t.Error("changing a todo read from the store changed the stored one")
+	}
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func (s *service) Notify(ctx context.Context, channel, payload string) error {
+	_, err := s.db.Exec(ctx, `select pg_notify($1, $2)`, channel, payload)
+	return err
+}
+
+// Listen holds a dedicated connection from the pool, subscribes it to the
+// channel and calls handler for every notification until ctx is done or the
+// connection fails. The connection is taken out of the pool for good because
+// it is still listening.
+func (s *service) Listen(ctx context.Context, channel string, handler func(payload string)) error {
+	pooled, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "listen "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return err
+	}
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		handler(n.Payload)
+	}
+}
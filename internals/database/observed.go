@@ -0,0 +1,275 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+// Observer is told when a Service method, named by method, is called. The
+// call runs with the context it returns, and done is called with the error
+// the call returned.
+type Observer func(ctx context.Context, method string) (_ context.Context, done func(err error))
+
+type observedStore struct {
+	Store
+	observers []Observer
+}
+
+type observed struct {
+	*observedStore
+	svc Service
+}
+
+// Observe reports every query of s to the observers, the first one
+// observing the outermost. Queries in the transactions of WithTx are
+// reported too, within the transaction. System, Stats, PoolStats, Close and
+// Listen, which only returns once it stops listening, are not reported.
+func Observe(s Service, observers ...Observer) Service {
+	return &observed{
+		observedStore: &observedStore{Store: s, observers: observers},
+		svc:           s,
+	}
+}
+
+// Timeout is an Observer giving every call at most d, and WithTx, whose
+// queries are calls of their own, at most txd for the transaction and its
+// retries. The deadline of the caller's context still applies when sooner.
+// A zero limit sets none.
+func Timeout(d, txd time.Duration) Observer {
+	return func(ctx context.Context, method string) (context.Context, func(error)) {
+		limit := d
+		if method == "WithTx" {
+			limit = txd
+		}
+		if limit <= 0 {
+			return ctx, func(error) {}
+		}
+		ctx, cancel := context.WithTimeout(ctx, limit)
+		return ctx, func(error) { cancel() }
+	}
+}
+
+// start tells the observers about a call and returns its context and the
+// function to report how it ended with.
+func (o *observedStore) start(ctx context.Context, method string) (context.Context, func(*error)) {
+	dones := make([]func(error), len(o.observers))
+	for i, observe := range o.observers {
+		ctx, dones[i] = observe(ctx, method)
+	}
+	return ctx, func(err *error) {
+		for i := len(dones) - 1; i >= 0; i-- {
+			dones[i](*err)
+		}
+	}
+}
+
+func (o *observed) Ping(ctx context.Context) (err error) {
+	ctx, done := o.start(ctx, "Ping")
+	defer done(&err)
+	return o.svc.Ping(ctx)
+}
+
+func (o *observed) Migrated(ctx context.Context) (err error) {
+	ctx, done := o.start(ctx, "Migrated")
+	defer done(&err)
+	return o.svc.Migrated(ctx)
+}
+
+func (o *observedStore) InsertUser(ctx context.Context, u *user.User) (err error) {
+	ctx, done := o.start(ctx, "InsertUser")
+	defer done(&err)
+	return o.Store.InsertUser(ctx, u)
+}
+
+func (o *observedStore) GetUserByUserName(ctx context.Context, username string) (v *user.User, err error) {
+	ctx, done := o.start(ctx, "GetUserByUserName")
+	defer done(&err)
+	return o.Store.GetUserByUserName(ctx, username)
+}
+
+func (o *observedStore) GetAllUsers(ctx context.Context) (v []*user.User, err error) {
+	ctx, done := o.start(ctx, "GetAllUsers")
+	defer done(&err)
+	return o.Store.GetAllUsers(ctx)
+}
+
+func (o *observedStore) UpadteUser(ctx context.Context, u *user.User) (err error) {
+	ctx, done := o.start(ctx, "UpadteUser")
+	defer done(&err)
+	return o.Store.UpadteUser(ctx, u)
+}
+
+func (o *observedStore) GetUsersByIDs(ctx context.Context, ids []int64) (v []*user.User, err error) {
+	ctx, done := o.start(ctx, "GetUsersByIDs")
+	defer done(&err)
+	return o.Store.GetUsersByIDs(ctx, ids)
+}
+
+func (o *observedStore) GetAllTodosForUser(ctx context.Context, uid int64) (v []*todo.Todo, err error) {
+	ctx, done := o.start(ctx, "GetAllTodosForUser")
+	defer done(&err)
+	return o.Store.GetAllTodosForUser(ctx, uid)
+}
+
+func (o *observedStore) InsertTodo(ctx context.Context, t *todo.Todo) (err error) {
+	ctx, done := o.start(ctx, "InsertTodo")
+	defer done(&err)
+	return o.Store.InsertTodo(ctx, t)
+}
+
+func (o *observedStore) GetTodoByIDForUser(ctx context.Context, tid, uid int64) (v *todo.Todo, err error) {
+	ctx, done := o.start(ctx, "GetTodoByIDForUser")
+	defer done(&err)
+	return o.Store.GetTodoByIDForUser(ctx, tid, uid)
+}
+
+func (o *observedStore) DeleteTodoByIDForUser(ctx context.Context, tid, uid, version int64) (err error) {
+	ctx, done := o.start(ctx, "DeleteTodoByIDForUser")
+	defer done(&err)
+	return o.Store.DeleteTodoByIDForUser(ctx, tid, uid, version)
+}
+
+func (o *observedStore) UpdateTodoByIdForUser(ctx context.Context, t *todo.Todo) (err error) {
+	ctx, done := o.start(ctx, "UpdateTodoByIdForUser")
+	defer done(&err)
+	return o.Store.UpdateTodoByIdForUser(ctx, t)
+}
+
+func (o *observedStore) GetTodoChangesForUser(ctx context.Context, uid, since int64) (v *todo.ChangeSet, err error) {
+	ctx, done := o.start(ctx, "GetTodoChangesForUser")
+	defer done(&err)
+	return o.Store.GetTodoChangesForUser(ctx, uid, since)
+}
+
+func (o *observedStore) GetTodosForUsers(ctx context.Context, uids []int64) (v []*todo.Todo, err error) {
+	ctx, done := o.start(ctx, "GetTodosForUsers")
+	defer done(&err)
+	return o.Store.GetTodosForUsers(ctx, uids)
+}
+
+func (o *observedStore) CountTodosForUsers(ctx context.Context, uids []int64) (v []*todo.TodoCount, err error) {
+	ctx, done := o.start(ctx, "CountTodosForUsers")
+	defer done(&err)
+	return o.Store.CountTodosForUsers(ctx, uids)
+}
+
+func (o *observedStore) SearchTodos(ctx context.Context, q *todo.SearchQuery) (v []*todo.SearchResult, err error) {
+	ctx, done := o.start(ctx, "SearchTodos")
+	defer done(&err)
+	return o.Store.SearchTodos(ctx, q)
+}
+
+func (o *observedStore) GetTrashedTodosForUser(ctx context.Context, uid int64) (v []*todo.Todo, err error) {
+	ctx, done := o.start(ctx, "GetTrashedTodosForUser")
+	defer done(&err)
+	return o.Store.GetTrashedTodosForUser(ctx, uid)
+}
+
+func (o *observedStore) RestoreTodoByIDForUser(ctx context.Context, tid, uid int64) (v *todo.Todo, err error) {
+	ctx, done := o.start(ctx, "RestoreTodoByIDForUser")
+	defer done(&err)
+	return o.Store.RestoreTodoByIDForUser(ctx, tid, uid)
+}
+
+func (o *observedStore) PurgeTodoByIDForUser(ctx context.Context, tid, uid int64) (err error) {
+	ctx, done := o.start(ctx, "PurgeTodoByIDForUser")
+	defer done(&err)
+	return o.Store.PurgeTodoByIDForUser(ctx, tid, uid)
+}
+
+func (o *observedStore) PurgeTrashForUser(ctx context.Context, uid int64) (v int64, err error) {
+	ctx, done := o.start(ctx, "PurgeTrashForUser")
+	defer done(&err)
+	return o.Store.PurgeTrashForUser(ctx, uid)
+}
+
+func (o *observedStore) PurgeTrashedTodosOlderThan(ctx context.Context, retention time.Duration) (v int64, err error) {
+	ctx, done := o.start(ctx, "PurgeTrashedTodosOlderThan")
+	defer done(&err)
+	return o.Store.PurgeTrashedTodosOlderThan(ctx, retention)
+}
+
+func (o *observedStore) GetTodoImports(ctx context.Context, uid int64, source string) (v map[int64]int64, err error) {
+	ctx, done := o.start(ctx, "GetTodoImports")
+	defer done(&err)
+	return o.Store.GetTodoImports(ctx, uid, source)
+}
+
+func (o *observedStore) ImportTodos(ctx context.Context, uid int64, source string, imports []todo.TodoImport) (err error) {
+	ctx, done := o.start(ctx, "ImportTodos")
+	defer done(&err)
+	return o.Store.ImportTodos(ctx, uid, source, imports)
+}
+
+func (o *observedStore) GetClientTodoID(ctx context.Context, uid int64, clientID string) (v int64, err error) {
+	ctx, done := o.start(ctx, "GetClientTodoID")
+	defer done(&err)
+	return o.Store.GetClientTodoID(ctx, uid, clientID)
+}
+
+func (o *observedStore) InsertClientTodoID(ctx context.Context, uid int64, clientID string, tid int64) (err error) {
+	ctx, done := o.start(ctx, "InsertClientTodoID")
+	defer done(&err)
+	return o.Store.InsertClientTodoID(ctx, uid, clientID, tid)
+}
+
+func (o *observed) ReserveIdempotencyKey(ctx context.Context, key, fingerprint string, lease time.Duration) (v *IdempotencyKey, err error) {
+	ctx, done := o.start(ctx, "ReserveIdempotencyKey")
+	defer done(&err)
+	return o.svc.ReserveIdempotencyKey(ctx, key, fingerprint, lease)
+}
+
+func (o *observed) CompleteIdempotencyKey(ctx context.Context, key string, response []byte, ttl time.Duration) (err error) {
+	ctx, done := o.start(ctx, "CompleteIdempotencyKey")
+	defer done(&err)
+	return o.svc.CompleteIdempotencyKey(ctx, key, response, ttl)
+}
+
+func (o *observed) ReleaseIdempotencyKey(ctx context.Context, key string) (err error) {
+	ctx, done := o.start(ctx, "ReleaseIdempotencyKey")
+	defer done(&err)
+	return o.svc.ReleaseIdempotencyKey(ctx, key)
+}
+
+func (o *observed) PurgeExpiredIdempotencyKeys(ctx context.Context) (v int64, err error) {
+	ctx, done := o.start(ctx, "PurgeExpiredIdempotencyKeys")
+	defer done(&err)
+	return o.svc.PurgeExpiredIdempotencyKeys(ctx)
+}
+
+func (o *observed) Notify(ctx context.Context, channel, payload string) (err error) {
+	ctx, done := o.start(ctx, "Notify")
+	defer done(&err)
+	return o.svc.Notify(ctx, channel, payload)
+}
+
+func (o *observed) WithTx(ctx context.Context, fn func(tx Store) error) (err error) {
+	ctx, done := o.start(ctx, "WithTx")
+	defer done(&err)
+	return o.svc.WithTx(ctx, func(tx Store) error {
+		return fn(&observedStore{Store: tx, observers: o.observers})
+	})
+}
+
+func (o *observed) System() string {
+	return o.svc.System()
+}
+
+func (o *observed) Stats() map[string]string {
+	return o.svc.Stats()
+}
+
+func (o *observed) PoolStats() PoolStats {
+	return o.svc.PoolStats()
+}
+
+func (o *observed) Close() error {
+	return o.svc.Close()
+}
+
+func (o *observed) Listen(ctx context.Context, channel string, handler func(string)) error {
+	return o.svc.Listen(ctx, channel, handler)
+}
@@ -0,0 +1,28 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	observe := Timeout(time.Second, time.Minute)
+	for _, tt := range []struct {
+		method string
+		limit  time.Duration
+	}{{"InsertTodo", time.Second}, {"WithTx", time.Minute}} {
+		ctx, done := observe(context.Background(), tt.method)
+		deadline, ok := ctx.Deadline()
+		if left := time.Until(deadline); !ok || left > tt.limit || left < tt.limit-time.Second/2 {
+			t.Errorf("%s runs with %v left, want %v", tt.method, left, tt.limit)
+		}
+		done(nil)
+	}
+
+	ctx, done := Timeout(time.Second, 0)(context.Background(), "WithTx")
+	defer done(nil)
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("WithTx has a deadline with no transaction limit")
+	}
+}
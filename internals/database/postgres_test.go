@@ -0,0 +1,23 @@
+package database
+
+import (
+	"os"
+	"testing"
+
+	"github.com/xenitane/todo-app-be-oe/internals/config"
+)
+
+// TestPostgresConformance runs against the database of the DB_* variables,
+// `make itest` with the database of docker-compose.yml up.
+func TestPostgresConformance(t *testing.T) {
+	if _, ok := os.LookupEnv("DB_HOST"); !ok {
+		t.Skip("DB_HOST is not set")
+	}
+	cfg, err := config.Read(nil, os.LookupEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := New(cfg.DB)
+	defer db.Close()
+	testConformance(t, db)
+}
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+const (
+	searchConfig       = "english"
+	defaultSearchLimit = 20
+)
+
+// SearchTodos ranks todos by how well their title and description match the
+// query and highlights the matches with <mark> tags.
+func (s *store) SearchTodos(ctx context.Context, q *todo.SearchQuery) ([]*todo.SearchResult, error) {
+	tsQuery := buildTSQuery(q.Query)
+	results := []*todo.SearchResult{}
+	if tsQuery == "" {
+		return results, nil
+	}
+
+	args := []any{tsQuery}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	where := []string{"t.deleted_at is null", "t.search @@ q.query"}
+	if q.OwnerID != 0 {
+		where = append(where, "t.owner_id = "+arg(q.OwnerID))
+	}
+	if q.Status != nil {
+		where = append(where, "t.status = "+arg(*q.Status))
+	}
+	if q.DueBefore != nil {
+		where = append(where, "t.due_date < "+arg(*q.DueBefore))
+	}
+	if q.DueAfter != nil {
+		where = append(where, "t.due_date >= "+arg(*q.DueAfter))
+	}
+	limit := q.Limit
+	if limit == 0 {
+		limit = defaultSearchLimit
+	}
+
+	query := `select t.id, t.owner_id, t.title, t.description, t.status, t.due_date, t.created_at, t.version, t.updated_at, t.deleted_at,
+			u.username,
+			ts_rank(t.search, q.query) as rank,
+			ts_headline('` + searchConfig + `', t.title, q.query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true'),
+			ts_headline('` + searchConfig + `', coalesce(t.description, ''), q.query, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2')
+		from todos t
+		join users u on u.id = t.owner_id,
+		to_tsquery('` + searchConfig + `', $1) q(query)
+		where ` + strings.Join(where, " and ") + `
+		order by rank desc, t.id
+		limit ` + arg(limit) + ` offset ` + arg(q.Offset)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := &todo.SearchResult{Todo: new(todo.Todo)}
+		err := rows.Scan(
+			&r.TodoId,
+			&r.OwnerId,
+			&r.Title,
+			&r.Description,
+			&r.Status,
+			&r.DueDate,
+			&r.CreatedAt,
+			&r.Version,
+			&r.UpdatedAt,
+			&r.DeletedAt,
+			&r.Username,
+			&r.Rank,
+			&r.TitleHighlight,
+			&r.DescriptionHighlight,
+		)
+		if err != nil {
+			return nil, err
+		}
+		r.TitleHighlight = escapeHighlight(r.Title, r.TitleHighlight)
+		r.DescriptionHighlight = escapeHighlight(r.Description, r.DescriptionHighlight)
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// escapeHighlight escapes the html of a text the database highlighted with
+// <mark> tags, keeping the tags. Tags typed into the text itself cannot be
+// told apart from those of the database, such texts are escaped whole,
+// without highlights.
+func escapeHighlight(text, highlighted string) string {
+	if strings.Contains(text, "<mark>") || strings.Contains(text, "</mark>") {
+		return html.EscapeString(text)
+	}
+	highlighted = html.EscapeString(highlighted)
+	return strings.NewReplacer("&lt;mark&gt;", "<mark>", "&lt;/mark&gt;", "</mark>").Replace(highlighted)
+}
+
+// buildTSQuery turns user input into to_tsquery syntax. Bare terms become
+// prefix matches, "quoted phrases" phrase matches and -terms negations, all
+// of them and-ed together. Anything that is not a letter or digit separates
+// terms, so the result never contains tsquery operators from the input.
+func buildTSQuery(input string) string {
+	var parts []string
+	for i, chunk := range strings.Split(input, `"`) {
+		if i%2 == 1 {
+			// inside quotes
+			if words := lexemes(chunk); len(words) > 0 {
+				parts = append(parts, "("+strings.Join(words, " <-> ")+")")
+			}
+			continue
+		}
+		for _, field := range strings.Fields(chunk) {
+			negate := strings.HasPrefix(field, "-")
+			words := lexemes(field)
+			if len(words) == 0 {
+				continue
+			}
+			for j := range words {
+				words[j] += ":*"
+			}
+			term := strings.Join(words, " & ")
+			if negate {
+				term = "!(" + term + ")"
+			}
+			parts = append(parts, term)
+		}
+	}
+	return strings.Join(parts, " & ")
+}
+
+func lexemes(s string) []string {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range words {
+		words[i] = "'" + strings.ToLower(w) + "'"
+	}
+	return words
+}
@@ -0,0 +1,324 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/config"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const (
+	// sqliteBusyTimeout is how long a write waits for the one holding the
+	// database before it fails
+	sqliteBusyTimeout = 5 * time.Second
+
+	// timestamps are stored in utc with a fixed number of digits, so that
+	// comparing them as text compares the times
+	sqliteTimeFormat = "2006-01-02 15:04:05.000000"
+)
+
+// sqliteMigrations build the schema, the user_version of the database counts
+// those that ran. Change the schema by appending to them, never by editing
+// one that has been released.
+var sqliteMigrations = []string{
+	`create table users(
+		id integer primary key autoincrement,
+		username text not null unique check(length(username) <= 20),
+		first_name text not null check(length(first_name) <= 50),
+		last_name text not null check(length(last_name) <= 50),
+		password text not null,
+		is_admin boolean not null default false,
+		created_at timestamp not null,
+		version integer not null default 1
+	);
+
+	create table todos(
+		id integer primary key autoincrement,
+		owner_id integer not null references users(id) on delete cascade on update cascade,
+		title text not null check(length(title) <= 50),
+		description text check(length(description) <= 320),
+		status integer not null default 0,
+		due_date timestamp not null,
+		created_at timestamp not null,
+		version integer not null default 1,
+		updated_at timestamp not null,
+		deleted_at timestamp,
+		change_seq integer not null
+	);
+	create index todos_owner_change_seq on todos(owner_id, change_seq);
+	create index todos_deleted_at on todos(deleted_at) where deleted_at is not null;
+
+	create table todo_tombstones(
+		todo_id integer primary key,
+		owner_id integer not null references users(id) on delete cascade on update cascade,
+		change_seq integer not null,
+		deleted_at timestamp not null
+	);
+	create index todo_tombstones_owner_change_seq on todo_tombstones(owner_id, change_seq);
+
+	-- every write to a todo takes a number from it, syncing clients use the
+	-- highest number they have seen as their change token
+	create table todo_change_seq(value integer not null);
+	insert into todo_change_seq values (0);`,
+
+	// the search index reads the todos, the triggers keep it in step
+	`create virtual table todos_search using fts5(
+		title, description,
+		content = 'todos', content_rowid = 'id',
+		tokenize = 'porter unicode61'
+	);
+	create trigger todos_search_insert after insert on todos begin
+		insert into todos_search(rowid, title, description) values (new.id, new.title, new.description);
+	end;
+	create trigger todos_search_delete after delete on todos begin
+		insert into todos_search(todos_search, rowid, title, description) values ('delete', old.id, old.title, old.description);
+	end;
+	create trigger todos_search_update after update of title, description on todos begin
+		insert into todos_search(todos_search, rowid, title, description) values ('delete', old.id, old.title, old.description);
+		insert into todos_search(rowid, title, description) values (new.id, new.title, new.description);
+	end;`,
+
+	// disabled users cannot sign in, bumping token_version revokes the
+	// tokens issued before
+	`alter table users add column disabled boolean not null default false;
+	alter table users add column token_version integer not null default 0;`,
+
+	// the ids imported todos got, by their id in the account they were
+	// exported from
+	`create table todo_imports(
+		owner_id integer not null references users(id) on delete cascade on update cascade,
+		source text not null check(length(source) <= 200),
+		source_id integer not null,
+		todo_id integer not null,
+		primary key(owner_id, source, source_id)
+	);`,
+
+	// the ids the todos created by syncing clients got, by the id the client
+	// chose
+	`create table todo_client_ids(
+		owner_id integer not null references users(id) on delete cascade on update cascade,
+		client_id text not null check(length(client_id) <= 100),
+		todo_id integer not null,
+		primary key(owner_id, client_id)
+	);`,
+
+	// the responses to requests sent with an idempotency key, by a hash of
+	// the key, the route and the user
+	`create table idempotency_keys(
+		key text primary key,
+		fingerprint text not null,
+		response blob,
+		expires_at timestamp not null
+	);
+	create index idempotency_keys_expires_at on idempotency_keys(expires_at);`,
+}
+
+// sqliteService is a Service keeping everything in a sqlite file, for
+// running the app without a database server. Notifications only reach the
+// listeners of the process, so it serves a single replica.
+type sqliteService struct {
+	*sqliteStore
+	*localNotify
+	db   *sql.DB
+	path string
+}
+
+// OpenSQLite opens the sqlite database at cfg.Path, creating it when it is
+// missing, and migrates it. now tells the time of its timestamps, time.Now
+// when nil.
+func OpenSQLite(cfg config.DB, now func() time.Time) (Service, error) {
+	if now == nil {
+		now = time.Now
+	}
+	params := url.Values{
+		"_pragma": {
+			fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout.Milliseconds()),
+			"journal_mode(wal)",
+			"synchronous(normal)",
+			"foreign_keys(on)",
+		},
+		// transactions take the write lock as they begin, instead of
+		// failing when they first write while another one holds it
+		"_txlock": {"immediate"},
+	}
+	dsn := (&url.URL{Scheme: "file", Path: cfg.Path, RawQuery: params.Encode()}).String()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxConns)
+	db.SetMaxIdleConns(cfg.MaxConns)
+	db.SetConnMaxLifetime(cfg.MaxConnLifetime)
+	db.SetConnMaxIdleTime(cfg.MaxConnIdleTime)
+
+	s := &sqliteService{
+		sqliteStore: &sqliteStore{
+			db: db,
+			atomic: func(ctx context.Context, fn func(q sqlQueryer) error) error {
+				return inSQLiteTx(ctx, db, func(tx *sql.Tx) error { return fn(tx) })
+			},
+			now: now,
+		},
+		localNotify: newLocalNotify(),
+		db:          db,
+		path:        cfg.Path,
+	}
+	if err := s.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating %s: %w", cfg.Path, err)
+	}
+	return s, nil
+}
+
+// migrate runs the migrations the database has not run yet, all in one
+// transaction.
+func (s *sqliteService) migrate(ctx context.Context) error {
+	return inSQLiteTx(ctx, s.db, func(tx *sql.Tx) error {
+		var version int
+		if err := tx.QueryRowContext(ctx, `pragma user_version`).Scan(&version); err != nil {
+			return err
+		}
+		if version > len(sqliteMigrations) {
+			return fmt.Errorf("the database is at migration %d, newer than this server's %d", version, len(sqliteMigrations))
+		}
+		for i, m := range sqliteMigrations[version:] {
+			if _, err := tx.ExecContext(ctx, m); err != nil {
+				return fmt.Errorf("migration %d: %w", version+i+1, err)
+			}
+		}
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(`pragma user_version = %d`, len(sqliteMigrations)))
+		return err
+	})
+}
+
+// inSQLiteTx runs fn in a transaction, committed when fn returns nil and
+// rolled back otherwise.
+func inSQLiteTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// a no-op once committed
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteTxStore runs the queries in tx, the writes made of many statements
+// in a savepoint of it.
+func sqliteTxStore(tx *sql.Tx, now func() time.Time) *sqliteStore {
+	return &sqliteStore{
+		db: tx,
+		atomic: func(ctx context.Context, fn func(q sqlQueryer) error) error {
+			if _, err := tx.ExecContext(ctx, `savepoint atomic`); err != nil {
+				return err
+			}
+			if err := fn(tx); err != nil {
+				tx.ExecContext(context.WithoutCancel(ctx), `rollback to atomic; release atomic`)
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `release atomic`)
+			return err
+		},
+		now: now,
+	}
+}
+
+// WithTx runs fn in a transaction. sqlite has one writer at a time, so
+// transactions are serializable; one that could not get the database before
+// the busy timeout is run again.
+func (s *sqliteService) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	for attempt := 1; ; attempt++ {
+		err := inSQLiteTx(ctx, s.db, func(tx *sql.Tx) error {
+			return fn(sqliteTxStore(tx, s.now))
+		})
+		if attempt == maxTxAttempts || !sqliteRetryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(txRetryBackoff(attempt)):
+		}
+	}
+}
+
+// sqliteRetryable reports whether err is sqlite failing to lock the
+// database.
+func sqliteRetryable(err error) bool {
+	var liteErr *sqlite.Error
+	if !errors.As(err, &liteErr) {
+		return false
+	}
+	// the extended codes keep the primary one in their low byte
+	code := liteErr.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// mapSQLiteErr reports violations of known constraints as their typed
+// errors.
+func mapSQLiteErr(err error) error {
+	var liteErr *sqlite.Error
+	if !errors.As(err, &liteErr) {
+		return err
+	}
+	if liteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE && strings.Contains(liteErr.Error(), "users.username") {
+		return fmt.Errorf("%w: %w", ErrUsernameTaken, err)
+	}
+	return err
+}
+
+func (s *sqliteService) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Migrated reports whether every migration has run.
+func (s *sqliteService) Migrated(ctx context.Context) error {
+	var version int
+	if err := s.db.QueryRowContext(ctx, `pragma user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version != len(sqliteMigrations) {
+		return fmt.Errorf("the database is at migration %d of %d", version, len(sqliteMigrations))
+	}
+	return nil
+}
+
+func (s *sqliteService) PoolStats() PoolStats {
+	st := s.db.Stats()
+	return PoolStats{
+		MaxConns:          st.MaxOpenConnections,
+		TotalConns:        st.OpenConnections,
+		AcquiredConns:     st.InUse,
+		IdleConns:         st.Idle,
+		EmptyAcquireCount: st.WaitCount,
+		AcquireDuration:   st.WaitDuration,
+		MaxLifetimeClosed: st.MaxLifetimeClosed,
+		MaxIdleClosed:     st.MaxIdleClosed + st.MaxIdleTimeClosed,
+	}
+}
+
+func (s *sqliteService) System() string {
+	return "sqlite"
+}
+
+func (s *sqliteService) Stats() map[string]string {
+	return poolStats(s.PoolStats())
+}
+
+func (s *sqliteService) Close() error {
+	slog.Info("closing database", slog.String("path", s.path))
+	s.close()
+	return s.db.Close()
+}
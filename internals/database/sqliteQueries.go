@@ -0,0 +1,513 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+// sqliteNextChange is the number the next write to a todo takes, the write
+// then moves the sequence past it with bumpChangeSeq
+const sqliteNextChange = `(select value + 1 from todo_change_seq)`
+
+// sqlQueryer is satisfied by both *sql.DB and *sql.Tx.
+type sqlQueryer interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+	QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}
+
+// sqliteStore runs the queries of the Store on the sqlite database or in a
+// transaction.
+type sqliteStore struct {
+	db sqlQueryer
+	// atomic runs the writes of many statements in fn all or not at all
+	atomic func(ctx context.Context, fn func(q sqlQueryer) error) error
+	now    func() time.Time
+}
+
+// timestamp is the time the way it is stored.
+func (s *sqliteStore) timestamp() time.Time {
+	return s.now().UTC().Truncate(time.Microsecond)
+}
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+// sqliteIDs passes ids as one argument, read back with json_each.
+func sqliteIDs(ids []int64) string {
+	b, _ := json.Marshal(ids)
+	return string(b)
+}
+
+func bumpChangeSeq(ctx context.Context, q sqlQueryer, n int64) error {
+	_, err := q.ExecContext(ctx, `update todo_change_seq set value = value + $1`, n)
+	return err
+}
+
+// InsertUser stores u and sets its id, creation time and version. It fails
+// with ErrUsernameTaken when the username is in use.
+func (s *sqliteStore) InsertUser(ctx context.Context, u *user.User) error {
+	insertQry := `insert into users (username, first_name, last_name, password, is_admin, created_at, disabled, token_version) values ($1, $2, $3, $4, $5, $6, $7, $8)
+		returning id, version`
+	now := s.timestamp()
+	err := s.db.QueryRowContext(ctx, insertQry, u.Username, u.FirstName, u.LastName, u.Password, u.IsAdmin, sqliteTime(now), u.Disabled, u.TokenVersion).Scan(&u.UserId, &u.Version)
+	if err != nil {
+		return mapSQLiteErr(err)
+	}
+	u.CreatedAt = now
+	return nil
+}
+
+func (s *sqliteStore) GetUserByUserName(ctx context.Context, username string) (*user.User, error) {
+	query := `select ` + userColumns + ` from users where username = $1`
+	return scanUserRow(s.db.QueryRowContext(ctx, query, username))
+}
+
+func (s *sqliteStore) GetAllUsers(ctx context.Context) ([]*user.User, error) {
+	return s.queryUsers(ctx, `select `+userColumns+` from users order by id`)
+}
+
+// GetUsersByIDs returns the users with the given ids, in no particular order.
+func (s *sqliteStore) GetUsersByIDs(ctx context.Context, ids []int64) ([]*user.User, error) {
+	return s.queryUsers(ctx, `select `+userColumns+` from users where id in (select value from json_each($1))`, sqliteIDs(ids))
+}
+
+func (s *sqliteStore) queryUsers(ctx context.Context, query string, args ...any) ([]*user.User, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []*user.User{}
+	for rows.Next() {
+		user, err := scanUserRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// UpadteUser stores u if it is still at u.Version and bumps the version.
+func (s *sqliteStore) UpadteUser(ctx context.Context, u *user.User) error {
+	updateQry := `update users set
+			first_name = $2, last_name = $3, password = $4, is_admin = $5,
+			disabled = $7, token_version = $8,
+			version = version + 1
+		where username = $1 and version = $6
+		returning version`
+	err := s.db.QueryRowContext(ctx, updateQry, u.Username, u.FirstName, u.LastName, u.Password, u.IsAdmin, u.Version, u.Disabled, u.TokenVersion).Scan(&u.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		var exists bool
+		if err := s.db.QueryRowContext(ctx, `select exists(select 1 from users where username = $1)`, u.Username).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return ErrVersionConflict
+		}
+	}
+	return err
+}
+
+func (s *sqliteStore) GetAllTodosForUser(ctx context.Context, uid int64) ([]*todo.Todo, error) {
+	return s.queryTodos(ctx, s.db, `select `+todoColumns+` from todos where owner_id = $1 and deleted_at is null order by id`, uid)
+}
+
+// GetTodosForUsers returns the todos of every given user, ordered by owner.
+func (s *sqliteStore) GetTodosForUsers(ctx context.Context, uids []int64) ([]*todo.Todo, error) {
+	query := `select ` + todoColumns + ` from todos
+		where owner_id in (select value from json_each($1)) and deleted_at is null
+		order by owner_id, id`
+	return s.queryTodos(ctx, s.db, query, sqliteIDs(uids))
+}
+
+func (s *sqliteStore) queryTodos(ctx context.Context, q sqlQueryer, query string, args ...any) ([]*todo.Todo, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	todos := []*todo.Todo{}
+	for rows.Next() {
+		todo, err := scanTodoRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, todo)
+	}
+	return todos, rows.Err()
+}
+
+// CountTodosForUsers counts the todos of every given user by status. Users
+// without todos are left out.
+func (s *sqliteStore) CountTodosForUsers(ctx context.Context, uids []int64) ([]*todo.TodoCount, error) {
+	query := `select owner_id,
+			count(*),
+			count(*) filter (where status = 0),
+			count(*) filter (where status = 1),
+			count(*) filter (where status = 2)
+		from todos where owner_id in (select value from json_each($1)) and deleted_at is null
+		group by owner_id`
+	rows, err := s.db.QueryContext(ctx, query, sqliteIDs(uids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []*todo.TodoCount{}
+	for rows.Next() {
+		c := new(todo.TodoCount)
+		if err := rows.Scan(&c.OwnerId, &c.Total, &c.Pending, &c.InProgress, &c.Completed); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+func (s *sqliteStore) GetTodoByIDForUser(ctx context.Context, tid, uid int64) (*todo.Todo, error) {
+	query := `select ` + todoColumns + ` from todos where id = $1 and owner_id = $2 and deleted_at is null`
+	return scanTodoRow(s.db.QueryRowContext(ctx, query, tid, uid))
+}
+
+func (s *sqliteStore) InsertTodo(ctx context.Context, t *todo.Todo) error {
+	return s.atomic(ctx, func(q sqlQueryer) error {
+		now := s.timestamp()
+		insertQry := `insert into todos (owner_id, title, description, status, due_date, created_at, updated_at, change_seq)
+			values ($1, $2, $3, $4, $5, $6, $6, ` + sqliteNextChange + `)
+			returning id, version`
+		err := q.QueryRowContext(ctx, insertQry, t.OwnerId, t.Title, t.Description, t.Status, sqliteTime(t.DueDate), sqliteTime(now)).Scan(&t.TodoId, &t.Version)
+		if err != nil {
+			return err
+		}
+		t.CreatedAt, t.UpdatedAt = now, now
+		return bumpChangeSeq(ctx, q, 1)
+	})
+}
+
+// DeleteTodoByIDForUser moves the todo to the trash. A non zero version
+// makes the delete conditional on the todo still being at that version.
+func (s *sqliteStore) DeleteTodoByIDForUser(ctx context.Context, tid, uid, version int64) error {
+	return s.atomic(ctx, func(q sqlQueryer) error {
+		now := s.timestamp()
+		deleteQry := `update todos set
+				deleted_at = $4,
+				version = version + 1,
+				updated_at = $4,
+				change_seq = ` + sqliteNextChange + `
+			where id = $1 and owner_id = $2 and deleted_at is null and ($3 = 0 or version = $3)`
+		res, err := q.ExecContext(ctx, deleteQry, tid, uid, version, sqliteTime(now))
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return sqliteMissingOrConflict(ctx, q, tid, uid)
+		}
+		return bumpChangeSeq(ctx, q, 1)
+	})
+}
+
+// UpdateTodoByIdForUser stores t if it is still at t.Version and bumps the
+// version.
+func (s *sqliteStore) UpdateTodoByIdForUser(ctx context.Context, t *todo.Todo) error {
+	return s.atomic(ctx, func(q sqlQueryer) error {
+		now := s.timestamp()
+		updateQry := `update todos set
+				title = $3, description = $4, status = $5, due_date = $6,
+				version = version + 1,
+				updated_at = $8,
+				change_seq = ` + sqliteNextChange + `
+			where id = $1 and owner_id = $2 and version = $7 and deleted_at is null
+			returning version`
+		err := q.QueryRowContext(ctx, updateQry, t.TodoId, t.OwnerId, t.Title, t.Description, t.Status, sqliteTime(t.DueDate), t.Version, sqliteTime(now)).Scan(&t.Version)
+		if errors.Is(err, sql.ErrNoRows) {
+			return sqliteMissingOrConflict(ctx, q, t.TodoId, t.OwnerId)
+		}
+		if err != nil {
+			return err
+		}
+		t.UpdatedAt = now
+		return bumpChangeSeq(ctx, q, 1)
+	})
+}
+
+func sqliteMissingOrConflict(ctx context.Context, q sqlQueryer, tid, uid int64) error {
+	var exists bool
+	err := q.QueryRowContext(ctx, `select exists(select 1 from todos where id = $1 and owner_id = $2 and deleted_at is null)`, tid, uid).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrVersionConflict
+	}
+	return sql.ErrNoRows
+}
+
+// GetTodoChangesForUser returns every todo of the user written after the
+// change token since, the ids of those deleted or trashed after it and the
+// token to resume from. It reads in a transaction, which holds off the
+// writes, so no change is ever skipped.
+func (s *sqliteStore) GetTodoChangesForUser(ctx context.Context, uid, since int64) (*todo.ChangeSet, error) {
+	cs := &todo.ChangeSet{
+		Token:   since,
+		Todos:   []*todo.Todo{},
+		Deleted: []int64{},
+	}
+	err := s.atomic(ctx, func(q sqlQueryer) error {
+		changed, err := s.queryTodos(ctx, q, `select `+todoColumns+` from todos where owner_id = $1 and change_seq > $2 order by change_seq`, uid, since)
+		if err != nil {
+			return err
+		}
+		for _, t := range changed {
+			if t.DeletedAt != nil {
+				cs.Deleted = append(cs.Deleted, t.TodoId)
+				continue
+			}
+			cs.Todos = append(cs.Todos, t)
+		}
+
+		rows, err := q.QueryContext(ctx, `select todo_id from todo_tombstones where owner_id = $1 and change_seq > $2 order by change_seq`, uid, since)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			cs.Deleted = append(cs.Deleted, id)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		return q.QueryRowContext(ctx, `select coalesce(max(change_seq), $2) from (
+				select change_seq from todos where owner_id = $1
+				union all
+				select change_seq from todo_tombstones where owner_id = $1
+			)`, uid, since).Scan(&cs.Token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (s *sqliteStore) GetTrashedTodosForUser(ctx context.Context, uid int64) ([]*todo.Todo, error) {
+	query := `select ` + todoColumns + ` from todos where owner_id = $1 and deleted_at is not null order by deleted_at desc`
+	return s.queryTodos(ctx, s.db, query, uid)
+}
+
+// RestoreTodoByIDForUser takes a todo out of the trash and returns it.
+func (s *sqliteStore) RestoreTodoByIDForUser(ctx context.Context, tid, uid int64) (restored *todo.Todo, err error) {
+	err = s.atomic(ctx, func(q sqlQueryer) error {
+		now := s.timestamp()
+		restoreQry := `update todos set
+				deleted_at = null,
+				version = version + 1,
+				updated_at = $3,
+				change_seq = ` + sqliteNextChange + `
+			where id = $1 and owner_id = $2 and deleted_at is not null`
+		res, err := q.ExecContext(ctx, restoreQry, tid, uid, sqliteTime(now))
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return sql.ErrNoRows
+		}
+		if err := bumpChangeSeq(ctx, q, 1); err != nil {
+			return err
+		}
+		restored, err = scanTodoRow(q.QueryRowContext(ctx, `select `+todoColumns+` from todos where id = $1`, tid))
+		return err
+	})
+	return restored, err
+}
+
+// PurgeTodoByIDForUser permanently deletes a trashed todo, leaving a
+// tombstone behind for syncing clients.
+func (s *sqliteStore) PurgeTodoByIDForUser(ctx context.Context, tid, uid int64) error {
+	n, err := s.purgeWhere(ctx, `id = $1 and owner_id = $2`, tid, uid)
+	if err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// PurgeTrashForUser empties the trash of a user and returns how many todos
+// were in it.
+func (s *sqliteStore) PurgeTrashForUser(ctx context.Context, uid int64) (int64, error) {
+	return s.purgeWhere(ctx, `owner_id = $1`, uid)
+}
+
+// PurgeTrashedTodosOlderThan permanently deletes every todo that has been in
+// the trash for longer than retention, across all users.
+func (s *sqliteStore) PurgeTrashedTodosOlderThan(ctx context.Context, retention time.Duration) (int64, error) {
+	return s.purgeWhere(ctx, `deleted_at < $1`, sqliteTime(s.timestamp().Add(-retention)))
+}
+
+// purgeWhere purges the trashed todos cond, numbering its arguments from
+// $1, selects. Every purged todo leaves a tombstone with a change number of
+// its own.
+func (s *sqliteStore) purgeWhere(ctx context.Context, cond string, args ...any) (int64, error) {
+	where := `deleted_at is not null and ` + cond
+	var purged int64
+	err := s.atomic(ctx, func(q sqlQueryer) error {
+		now := s.timestamp()
+		tombstoneQry := fmt.Sprintf(`insert into todo_tombstones (todo_id, owner_id, change_seq, deleted_at)
+			select id, owner_id, (select value from todo_change_seq) + row_number() over (order by id), $%d
+			from todos where %s`, len(args)+1, where)
+		res, err := q.ExecContext(ctx, tombstoneQry, append(args[:len(args):len(args)], sqliteTime(now))...)
+		if err != nil {
+			return err
+		}
+		if purged, err = res.RowsAffected(); err != nil || purged == 0 {
+			return err
+		}
+		if _, err := q.ExecContext(ctx, `delete from todos where `+where, args...); err != nil {
+			return err
+		}
+		return bumpChangeSeq(ctx, q, purged)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// GetTodoImports returns the ids the todos the user imported from source
+// got, by their id in source.
+func (s *sqliteStore) GetTodoImports(ctx context.Context, uid int64, source string) (map[int64]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `select source_id, todo_id from todo_imports where owner_id = $1 and source = $2`, uid, source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := map[int64]int64{}
+	for rows.Next() {
+		var sourceID, tid int64
+		if err := rows.Scan(&sourceID, &tid); err != nil {
+			return nil, err
+		}
+		ids[sourceID] = tid
+	}
+	return ids, rows.Err()
+}
+
+// ImportTodos stores the imported todos of the user with the times they
+// carry, trashed ones into the trash, and sets their ids and versions. It
+// records the id each one got by its id in source, keeping the records of
+// todos imported before.
+func (s *sqliteStore) ImportTodos(ctx context.Context, uid int64, source string, imports []todo.TodoImport) error {
+	return s.atomic(ctx, func(q sqlQueryer) error {
+		insertQry := `insert into todos (owner_id, title, description, status, due_date, created_at, updated_at, deleted_at, change_seq)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, (select value from todo_change_seq) + $9)
+			returning id, version`
+		recordQry := `insert into todo_imports (owner_id, source, source_id, todo_id) values ($1, $2, $3, $4)
+			on conflict do nothing`
+		for i, imp := range imports {
+			t := imp.Todo
+			var deletedAt any
+			if t.DeletedAt != nil {
+				deletedAt = sqliteTime(*t.DeletedAt)
+			}
+			err := q.QueryRowContext(ctx, insertQry, uid, t.Title, t.Description, t.Status, sqliteTime(t.DueDate),
+				sqliteTime(t.CreatedAt), sqliteTime(t.UpdatedAt), deletedAt, i+1).Scan(&t.TodoId, &t.Version)
+			if err != nil {
+				return err
+			}
+			t.OwnerId = uid
+			if _, err := q.ExecContext(ctx, recordQry, uid, source, imp.SourceID, t.TodoId); err != nil {
+				return err
+			}
+		}
+		return bumpChangeSeq(ctx, q, int64(len(imports)))
+	})
+}
+
+// GetClientTodoID returns the id of the todo the user created offline under
+// clientID, sql.ErrNoRows when there is none.
+func (s *sqliteStore) GetClientTodoID(ctx context.Context, uid int64, clientID string) (int64, error) {
+	var tid int64
+	err := s.db.QueryRowContext(ctx, `select todo_id from todo_client_ids where owner_id = $1 and client_id = $2`, uid, clientID).Scan(&tid)
+	return tid, err
+}
+
+// InsertClientTodoID records that the todo the user created offline under
+// clientID got tid, unless it was recorded before.
+func (s *sqliteStore) InsertClientTodoID(ctx context.Context, uid int64, clientID string, tid int64) error {
+	_, err := s.db.ExecContext(ctx, `insert into todo_client_ids (owner_id, client_id, todo_id) values ($1, $2, $3)
+		on conflict do nothing`, uid, clientID, tid)
+	return err
+}
+
+// ReserveIdempotencyKey records key as running a request with the given
+// fingerprint for lease and returns nil, or the record of key when it is
+// known and has not expired. A request that neither completes nor releases
+// its key within the lease, such as one of a crashed replica, loses it.
+func (s *sqliteStore) ReserveIdempotencyKey(ctx context.Context, key, fingerprint string, lease time.Duration) (*IdempotencyKey, error) {
+	reserveQry := `insert into idempotency_keys (key, fingerprint, expires_at) values ($1, $2, $3)
+		on conflict (key) do update set fingerprint = excluded.fingerprint, response = null, expires_at = excluded.expires_at
+			where idempotency_keys.expires_at <= $4
+		returning key`
+	for {
+		now := s.timestamp()
+		err := s.db.QueryRowContext(ctx, reserveQry, key, fingerprint, sqliteTime(now.Add(lease)), sqliteTime(now)).Scan(new(string))
+		if err == nil {
+			return nil, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		rec := new(IdempotencyKey)
+		err = s.db.QueryRowContext(ctx, `select fingerprint, response from idempotency_keys where key = $1`, key).Scan(&rec.Fingerprint, &rec.Response)
+		// released in the meantime, reserve it again
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return rec, nil
+	}
+}
+
+// CompleteIdempotencyKey stores the response of the request running under
+// key, to be replayed for ttl.
+func (s *sqliteStore) CompleteIdempotencyKey(ctx context.Context, key string, response []byte, ttl time.Duration) error {
+	completeQry := `update idempotency_keys set response = $2, expires_at = $3 where key = $1`
+	_, err := s.db.ExecContext(ctx, completeQry, key, response, sqliteTime(s.timestamp().Add(ttl)))
+	return err
+}
+
+// ReleaseIdempotencyKey forgets key, so its request can be retried.
+func (s *sqliteStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `delete from idempotency_keys where key = $1`, key)
+	return err
+}
+
+// PurgeExpiredIdempotencyKeys deletes the keys that expired.
+func (s *sqliteStore) PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `delete from idempotency_keys where expires_at <= $1`, sqliteTime(s.timestamp()))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+// ftsQuery turns the terms of a search, parsed the way buildTSQuery reads
+// them, into an fts5 query: the terms and-ed together less the negated ones.
+// fts5 cannot match on negated terms alone, their query is returned with
+// negatedOnly set so the caller excludes its matches instead.
+func ftsQuery(terms []memSearchTerm) (query string, negatedOnly bool) {
+	var positive, negated []string
+	for _, t := range terms {
+		words := make([]string, len(t.words))
+		for i, w := range t.words {
+			// words are letters and digits, quoting makes them literal
+			words[i] = `"` + w + `"*`
+		}
+		expr := "(" + strings.Join(words, " AND ") + ")"
+		if t.phrase {
+			expr = `"` + strings.Join(t.words, " ") + `"`
+		}
+		if t.negate {
+			negated = append(negated, expr)
+		} else {
+			positive = append(positive, expr)
+		}
+	}
+	switch {
+	case len(positive) == 0:
+		return strings.Join(negated, " OR "), true
+	case len(negated) == 0:
+		return strings.Join(positive, " AND "), false
+	}
+	return "(" + strings.Join(positive, " AND ") + ") NOT (" + strings.Join(negated, " OR ") + ")", false
+}
+
+// sqliteMarks counts the <mark> tags highlight added to the text of a
+// column, less those typed into the text.
+func sqliteMarks(highlighted, text string) string {
+	return fmt.Sprintf(`((length(%[1]s) - length(replace(%[1]s, '<mark>', '')) - length(%[2]s) + length(replace(%[2]s, '<mark>', ''))) / 6)`, highlighted, text)
+}
+
+// SearchTodos ranks todos by how many words of their title and description
+// match the query, like postgres ranks them, and highlights the matches with
+// <mark> tags. Words are stemmed by the porter tokenizer of the search index.
+func (s *sqliteStore) SearchTodos(ctx context.Context, q *todo.SearchQuery) ([]*todo.SearchResult, error) {
+	results := []*todo.SearchResult{}
+	terms := parseMemSearch(q.Query)
+	if len(terms) == 0 {
+		return results, nil
+	}
+	match, negatedOnly := ftsQuery(terms)
+
+	args := []any{match}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	from := `todos_search join todos t on t.id = todos_search.rowid`
+	highlights := `highlight(todos_search, 0, '<mark>', '</mark>') as title_highlight,
+			snippet(todos_search, 1, '<mark>', '</mark>', ' ... ', 35) as description_highlight,
+			highlight(todos_search, 1, '<mark>', '</mark>') as description_marked`
+	where := []string{"t.deleted_at is null", "todos_search match $1"}
+	if negatedOnly {
+		from = `todos t`
+		highlights = `t.title as title_highlight,
+			coalesce(t.description, '') as description_highlight,
+			coalesce(t.description, '') as description_marked`
+		where[1] = "t.id not in (select rowid from todos_search where todos_search match $1)"
+	}
+	if q.OwnerID != 0 {
+		where = append(where, "t.owner_id = "+arg(q.OwnerID))
+	}
+	if q.Status != nil {
+		where = append(where, "t.status = "+arg(*q.Status))
+	}
+	if q.DueBefore != nil {
+		where = append(where, "t.due_date < "+arg(sqliteTime(*q.DueBefore)))
+	}
+	if q.DueAfter != nil {
+		where = append(where, "t.due_date >= "+arg(sqliteTime(*q.DueAfter)))
+	}
+	limit := q.Limit
+	if limit == 0 {
+		limit = defaultSearchLimit
+	}
+
+	query := fmt.Sprintf(`select id, owner_id, title, description, status, due_date, created_at, version, updated_at, deleted_at,
+			username,
+			%g * %s + %g * %s as score,
+			title_highlight, description_highlight
+		from (
+			select t.id, t.owner_id, t.title, t.description, t.status, t.due_date, t.created_at, t.version, t.updated_at, t.deleted_at,
+				u.username,
+				%s
+			from %s
+			join users u on u.id = t.owner_id
+			where %s
+		)
+		order by score desc, id
+		limit %s offset %s`,
+		memTitleWeight, sqliteMarks("title_highlight", "title"), memDescriptionWeight, sqliteMarks("description_marked", "coalesce(description, '')"),
+		highlights, from, strings.Join(where, " and "), arg(limit), arg(q.Offset))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := &todo.SearchResult{Todo: new(todo.Todo)}
+		err := rows.Scan(
+			&r.TodoId,
+			&r.OwnerId,
+			&r.Title,
+			&r.Description,
+			&r.Status,
+			&r.DueDate,
+			&r.CreatedAt,
+			&r.Version,
+			&r.UpdatedAt,
+			&r.DeletedAt,
+			&r.Username,
+			&r.Rank,
+			&r.TitleHighlight,
+			&r.DescriptionHighlight,
+		)
+		if err != nil {
+			return nil, err
+		}
+		r.TitleHighlight = escapeHighlight(r.Title, r.TitleHighlight)
+		r.DescriptionHighlight = escapeHighlight(r.Description, r.DescriptionHighlight)
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
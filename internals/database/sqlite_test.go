@@ -0,0 +1,128 @@
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/config"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+func openTestSQLite(t *testing.T, now func() time.Time) Service {
+	t.Helper()
+	cfg := config.Default().DB
+	cfg.Driver = config.DriverSQLite
+	cfg.Path = filepath.Join(t.TempDir(), "todo.db")
+	db, err := OpenSQLite(cfg, now)
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	testConformance(t, openTestSQLite(t, nil))
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	cfg := config.Default().DB
+	cfg.Path = filepath.Join(t.TempDir(), "todo.db")
+	db, err := OpenSQLite(cfg, nil)
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	u := newUser(t, db)
+	newTodo(t, db, u, "Kept across restarts", "")
+	db.Close()
+
+	// opening it again runs no migration twice and keeps the rows
+	db, err = OpenSQLite(cfg, nil)
+	if err != nil {
+		t.Fatalf("OpenSQLite of a migrated database: %v", err)
+	}
+	defer db.Close()
+	if err := db.Migrated(context.Background()); err != nil {
+		t.Errorf("Migrated: %v", err)
+	}
+	if todos, _ := db.GetAllTodosForUser(context.Background(), u.UserId); len(todos) != 1 {
+		t.Errorf("the reopened database has %d todos, want 1", len(todos))
+	}
+}
+
+func TestSQLiteClock(t *testing.T) {
+	now := time.Date(2030, 1, 2, 3, 4, 5, 678900000, time.UTC)
+	db := openTestSQLite(t, func() time.Time { return now })
+	ctx := context.Background()
+	u := newUser(t, db)
+	td := newTodo(t, db, u, "Clocked todo", "")
+
+	stored, err := db.GetTodoByIDForUser(ctx, td.TodoId, u.UserId)
+	if err != nil {
+		t.Fatalf("GetTodoByIDForUser: %v", err)
+	}
+	if !stored.CreatedAt.Equal(now) || !stored.UpdatedAt.Equal(now) || !stored.DueDate.Equal(td.DueDate) {
+		t.Errorf("stored times %v, %v and %v, want %v and the due date %v", stored.CreatedAt, stored.UpdatedAt, stored.DueDate, now, td.DueDate)
+	}
+
+	if err := db.DeleteTodoByIDForUser(ctx, td.TodoId, u.UserId, 0); err != nil {
+		t.Fatalf("DeleteTodoByIDForUser: %v", err)
+	}
+	now = now.Add(2 * time.Hour)
+	if n, _ := db.PurgeTrashedTodosOlderThan(ctx, 3*time.Hour); n != 0 {
+		t.Errorf("purged %d todos before the retention passed", n)
+	}
+	if n, _ := db.PurgeTrashedTodosOlderThan(ctx, time.Hour); n != 1 {
+		t.Errorf("purged %d todos after the retention passed, want 1", n)
+	}
+}
+
+func TestSQLiteConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t, nil)
+	u := newUser(t, db)
+
+	// sqlite has one writer at a time, the others wait for it
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			insert := func(st Store) *todo.Todo {
+				td := &todo.Todo{OwnerId: u.UserId, Title: "Concurrent todo", DueDate: time.Now()}
+				if err := st.InsertTodo(ctx, td); err != nil {
+					t.Errorf("InsertTodo: %v", err)
+				}
+				return td
+			}
+			err := db.WithTx(ctx, func(tx Store) error {
+				td := insert(tx)
+				td.Status = 1
+				return tx.UpdateTodoByIdForUser(ctx, td)
+			})
+			if err != nil {
+				t.Errorf("WithTx: %v", err)
+			}
+			insert(db)
+		}()
+	}
+	wg.Wait()
+
+	todos, err := db.GetAllTodosForUser(ctx, u.UserId)
+	if err != nil {
+		t.Fatalf("GetAllTodosForUser: %v", err)
+	}
+	if len(todos) != 40 {
+		t.Errorf("stored %d todos, want 40", len(todos))
+	}
+	cs, err := db.GetTodoChangesForUser(ctx, u.UserId, 0)
+	if err != nil {
+		t.Fatalf("GetTodoChangesForUser: %v", err)
+	}
+	if cs.Token != 60 {
+		t.Errorf("60 writes moved the change token to %d", cs.Token)
+	}
+}
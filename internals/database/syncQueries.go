@@ -0,0 +1,22 @@
+package database
+
+import (
+	"context"
+)
+
+// GetClientTodoID returns the id of the todo the user created offline under
+// clientID, sql.ErrNoRows when there is none.
+func (s *store) GetClientTodoID(ctx context.Context, uid int64, clientID string) (int64, error) {
+	var tid int64
+	err := s.db.QueryRow(ctx, `select todo_id from todo_client_ids where owner_id = $1 and client_id = $2`, uid, clientID).Scan(&tid)
+	return tid, err
+}
+
+// InsertClientTodoID records that the todo the user created offline under
+// clientID got tid, unless it was recorded before.
+func (s *store) InsertClientTodoID(ctx context.Context, uid int64, clientID string, tid int64) error {
+	insertQry := `insert into todo_client_ids (owner_id, client_id, todo_id) values ($1, $2, $3)
+		on conflict do nothing`
+	_, err := s.db.Exec(ctx, insertQry, uid, clientID, tid)
+	return err
+}
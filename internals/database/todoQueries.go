@@ -1,18 +1,47 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"strconv"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/xenitane/todo-app-be-oe/internals/todo"
 )
 
-func (s *service) GetAllTodosForUser(userID int64) ([]*todo.Todo, error) {
-	query := `select * from todos where owner_id = $1`
-	rows, err := s.db.Query(query, userID)
+// ErrVersionConflict is returned by writes guarded by a version when the row
+// has been changed since that version was read.
+var ErrVersionConflict = errors.New("version conflict")
+
+const todoColumns = `id, owner_id, title, description, status, due_date, created_at, version, updated_at, deleted_at`
+
+func (s *store) GetAllTodosForUser(ctx context.Context, userID int64) ([]*todo.Todo, error) {
+	query := `select ` + todoColumns + ` from todos where owner_id = $1 and deleted_at is null`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	todos := []*todo.Todo{}
+	for rows.Next() {
+		todo, err := scanTodoRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, todo)
+	}
+	return todos, rows.Err()
+}
+
+// GetTodosForUsers returns the todos of every given user, ordered by owner.
+func (s *store) GetTodosForUsers(ctx context.Context, userIDs []int64) ([]*todo.Todo, error) {
+	query := `select ` + todoColumns + ` from todos where owner_id = any($1) and deleted_at is null order by owner_id, id`
+	rows, err := s.db.Query(ctx, query, userIDs)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	todos := []*todo.Todo{}
 	for rows.Next() {
 		todo, err := scanTodoRow(rows)
@@ -21,22 +50,46 @@ func (s *service) GetAllTodosForUser(userID int64) ([]*todo.Todo, error) {
 		}
 		todos = append(todos, todo)
 	}
-	return todos, nil
+	return todos, rows.Err()
 }
 
-func (s *service) GetTodoByIDForUser(tid, uid int64) (*todo.Todo, error) {
-	query := `select * from todos where id = $1 and owner_id = $2;`
-	rows, err := s.db.Query(query, tid, uid)
+// CountTodosForUsers counts the todos of every given user by status. Users
+// without todos are left out.
+func (s *store) CountTodosForUsers(ctx context.Context, userIDs []int64) ([]*todo.TodoCount, error) {
+	query := `select owner_id,
+			count(*),
+			count(*) filter (where status = 0),
+			count(*) filter (where status = 1),
+			count(*) filter (where status = 2)
+		from todos where owner_id = any($1) and deleted_at is null
+		group by owner_id`
+	rows, err := s.db.Query(ctx, query, userIDs)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+	counts := []*todo.TodoCount{}
 	for rows.Next() {
-		return scanTodoRow(rows)
+		c := new(todo.TodoCount)
+		if err := rows.Scan(&c.OwnerId, &c.Total, &c.Pending, &c.InProgress, &c.Completed); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
 	}
-	return nil, sql.ErrNoRows
+	return counts, rows.Err()
 }
 
-func scanTodoRow(rows *sql.Rows) (*todo.Todo, error) {
+func (s *store) GetTodoByIDForUser(ctx context.Context, tid, uid int64) (*todo.Todo, error) {
+	query := `select ` + todoColumns + ` from todos where id = $1 and owner_id = $2 and deleted_at is null;`
+	return scanTodoRow(s.db.QueryRow(ctx, query, tid, uid))
+}
+
+// rowScanner is satisfied by both *sql.Rows and *sql.Row.
+type rowScanner interface {
+	Scan(...any) error
+}
+
+func scanTodoRow(rows rowScanner) (*todo.Todo, error) {
 	todo := new(todo.Todo)
 	err := rows.Scan(
 		&todo.TodoId,
@@ -46,6 +99,9 @@ func scanTodoRow(rows *sql.Rows) (*todo.Todo, error) {
 		&todo.Status,
 		&todo.DueDate,
 		&todo.CreatedAt,
+		&todo.Version,
+		&todo.UpdatedAt,
+		&todo.DeletedAt,
 	)
 	if err != nil {
 		return nil, err
@@ -53,40 +109,154 @@ func scanTodoRow(rows *sql.Rows) (*todo.Todo, error) {
 	return todo, nil
 }
 
-func (s *service) InsertTodo(t *todo.Todo) error {
-	insertQuery := `insert into todos (owner_id, title, description, status, due_date) values ($1, $2, $3, $4, $5) returning id;`
-	rows, err := s.db.Query(
+func (s *store) InsertTodo(ctx context.Context, t *todo.Todo) error {
+	return insertTodo(ctx, s.db, t)
+}
+
+func insertTodo(ctx context.Context, q queryer, t *todo.Todo) error {
+	insertQuery := `insert into todos (owner_id, title, description, status, due_date) values ($1, $2, $3, $4, $5) returning id, created_at, version, updated_at;`
+	return q.QueryRow(
+		ctx,
 		insertQuery,
 		t.OwnerId,
 		t.Title,
 		t.Description,
 		t.Status,
 		t.DueDate,
-	)
+	).Scan(&t.TodoId, &t.CreatedAt, &t.Version, &t.UpdatedAt)
+}
+
+// DeleteTodoByIDForUser moves the todo to the trash. A non zero version
+// makes the delete conditional on the todo still being at that version.
+func (s *store) DeleteTodoByIDForUser(ctx context.Context, tid, uid, version int64) error {
+	return deleteTodo(ctx, s.db, tid, uid, version)
+}
+
+func deleteTodo(ctx context.Context, q queryer, tid, uid, version int64) error {
+	deleteQuery := `update todos set
+			deleted_at = now(),
+			version = version + 1,
+			updated_at = now(),
+			change_seq = nextval('todo_change_seq')
+		where id = $1 and owner_id = $2 and deleted_at is null and ($3 = 0 or version = $3)`
+	res, err := q.Exec(ctx, deleteQuery, tid, uid, version)
 	if err != nil {
 		return err
 	}
-	for rows.Next() {
-		return rows.Scan(&t.TodoId)
+	if res.RowsAffected() == 0 {
+		return missingOrConflict(ctx, q, tid, uid)
+	}
+	return nil
+}
+
+// UpdateTodoByIdForUser stores t if it is still at t.Version and bumps the
+// version.
+func (s *store) UpdateTodoByIdForUser(ctx context.Context, t *todo.Todo) error {
+	return updateTodo(ctx, s.db, t)
+}
+
+func updateTodo(ctx context.Context, q queryer, t *todo.Todo) error {
+	updateQry := `update todos set
+			(title, description, status, due_date) = ($3, $4, $5, $6),
+			version = version + 1,
+			updated_at = now(),
+			change_seq = nextval('todo_change_seq')
+		where id = $1 and owner_id = $2 and version = $7 and deleted_at is null
+		returning version, updated_at`
+	err := q.QueryRow(ctx, updateQry, t.TodoId, t.OwnerId, t.Title, t.Description, t.Status, t.DueDate, t.Version).Scan(&t.Version, &t.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return missingOrConflict(ctx, q, t.TodoId, t.OwnerId)
 	}
-	return errors.New("could not insert")
+	return err
 }
 
-func (s *service) DeleteTodoByIDForUser(tid, uid int64) error {
-	deleteQuery := `delete from todos wherer id = $1 and owner_id = $2`
-	res, err := s.db.Exec(deleteQuery, tid, uid)
+func missingOrConflict(ctx context.Context, q queryer, tid, uid int64) error {
+	var exists bool
+	err := q.QueryRow(ctx, `select exists(select 1 from todos where id = $1 and owner_id = $2 and deleted_at is null)`, tid, uid).Scan(&exists)
 	if err != nil {
 		return err
 	}
-	ra, err := res.RowsAffected()
-	if err != nil || ra == 0 {
-		return err
+	if exists {
+		return ErrVersionConflict
 	}
-	return nil
+	return sql.ErrNoRows
 }
 
-func (s *service) UpdateTodoByIdForUser(t *todo.Todo) error {
-	updateQry := `update todos set (title, description, status, due_date) = ($3, $4, $5, $6) where id = $1 and owner_id = $2`
-	_, err := s.db.Exec(updateQry, t.TodoId, t.OwnerId, t.Title, t.Description, t.Status, t.DueDate)
-	return err
+// xidTokenBase offsets the change tokens, which are transaction ids, above
+// the change_seq numbers given as tokens before them, so that those resync
+// everything.
+const xidTokenBase = 1 << 62
+
+// GetTodoChangesForUser returns every todo of the user written after the
+// change token since, the ids of those deleted or trashed after it and the
+// token to resume from.
+//
+// The token is the oldest transaction still running when the changes are
+// read, every transaction before it has committed or rolled back. Changes of
+// the later ones that have committed are returned again with the next token,
+// those still running are returned once they commit, whatever the order of
+// their change_seq numbers.
+func (s *store) GetTodoChangesForUser(ctx context.Context, uid, since int64) (*todo.ChangeSet, error) {
+	pgTx, err := s.begin(ctx, pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	defer pgTx.Rollback(ctx)
+	tx := queryer{pgTx}
+
+	cs := &todo.ChangeSet{
+		Todos:   []*todo.Todo{},
+		Deleted: []int64{},
+	}
+	sinceXid := "0"
+	if since >= xidTokenBase {
+		sinceXid = strconv.FormatInt(since-xidTokenBase, 10)
+	}
+
+	// the first statement takes the snapshot every other one reads
+	var xmin int64
+	if err := tx.QueryRow(ctx, `select pg_snapshot_xmin(pg_current_snapshot())::text::bigint`).Scan(&xmin); err != nil {
+		return nil, err
+	}
+	cs.Token = xidTokenBase + xmin
+
+	rows, err := tx.Query(ctx, `select `+todoColumns+` from todos where owner_id = $1 and change_xid >= $2::xid8 order by change_seq`, uid, sinceXid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := scanTodoRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		if t.DeletedAt != nil {
+			cs.Deleted = append(cs.Deleted, t.TodoId)
+			continue
+		}
+		cs.Todos = append(cs.Todos, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(ctx, `select todo_id from todo_tombstones where owner_id = $1 and change_xid >= $2::xid8 order by change_seq`, uid, sinceXid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		cs.Deleted = append(cs.Deleted, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return cs, nil
 }
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+func (s *store) GetTrashedTodosForUser(ctx context.Context, uid int64) ([]*todo.Todo, error) {
+	query := `select ` + todoColumns + ` from todos where owner_id = $1 and deleted_at is not null order by deleted_at desc`
+	rows, err := s.db.Query(ctx, query, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	todos := []*todo.Todo{}
+	for rows.Next() {
+		todo, err := scanTodoRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, todo)
+	}
+	return todos, rows.Err()
+}
+
+// RestoreTodoByIDForUser takes a todo out of the trash and returns it.
+func (s *store) RestoreTodoByIDForUser(ctx context.Context, tid, uid int64) (*todo.Todo, error) {
+	restoreQry := `update todos set
+			deleted_at = null,
+			version = version + 1,
+			updated_at = now(),
+			change_seq = nextval('todo_change_seq')
+		where id = $1 and owner_id = $2 and deleted_at is not null
+		returning ` + todoColumns
+	return scanTodoRow(s.db.QueryRow(ctx, restoreQry, tid, uid))
+}
+
+// PurgeTodoByIDForUser permanently deletes a trashed todo, leaving a
+// tombstone behind for syncing clients.
+func (s *store) PurgeTodoByIDForUser(ctx context.Context, tid, uid int64) error {
+	purgeQry := `with purged as (
+			delete from todos where id = $1 and owner_id = $2 and deleted_at is not null returning id, owner_id
+		)
+		insert into todo_tombstones (todo_id, owner_id) select id, owner_id from purged`
+	res, err := s.db.Exec(ctx, purgeQry, tid, uid)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PurgeTrashForUser empties the trash of a user and returns how many todos
+// were in it.
+func (s *store) PurgeTrashForUser(ctx context.Context, uid int64) (int64, error) {
+	purgeQry := `with purged as (
+			delete from todos where owner_id = $1 and deleted_at is not null returning id, owner_id
+		)
+		insert into todo_tombstones (todo_id, owner_id) select id, owner_id from purged`
+	res, err := s.db.Exec(ctx, purgeQry, uid)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
+
+// PurgeTrashedTodosOlderThan permanently deletes every todo that has been in
+// the trash for longer than retention, across all users. The cutoff is
+// computed by the database so it agrees with the clock that set deleted_at.
+func (s *store) PurgeTrashedTodosOlderThan(ctx context.Context, retention time.Duration) (int64, error) {
+	purgeQry := `with purged as (
+			delete from todos where deleted_at < now() - make_interval(secs => $1) returning id, owner_id
+		)
+		insert into todo_tombstones (todo_id, owner_id) select id, owner_id from purged`
+	res, err := s.db.Exec(ctx, purgeQry, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
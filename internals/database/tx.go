@@ -0,0 +1,83 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	// maxTxAttempts is how often WithTx runs a transaction postgres keeps
+	// aborting before giving up
+	maxTxAttempts = 5
+	txRetryDelay  = 10 * time.Millisecond
+
+	serializationFailure = "40001"
+	deadlockDetected     = "40P01"
+)
+
+// store runs the queries of the Store on the pool or in a transaction.
+type store struct {
+	db queryer
+	// begin starts a transaction on the pool or, in a transaction, a
+	// savepoint, which ignores the options
+	begin func(context.Context, pgx.TxOptions) (pgx.Tx, error)
+}
+
+func txStore(tx pgx.Tx) *store {
+	return &store{
+		db: queryer{tx},
+		begin: func(ctx context.Context, _ pgx.TxOptions) (pgx.Tx, error) {
+			return tx.Begin(ctx)
+		},
+	}
+}
+
+func (s *service) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	for attempt := 1; ; attempt++ {
+		err := s.runTx(ctx, fn)
+		if attempt == maxTxAttempts || !retryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(txRetryBackoff(attempt)):
+		}
+	}
+}
+
+func (s *service) runTx(ctx context.Context, fn func(tx Store) error) error {
+	tx, err := s.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	if err != nil {
+		return mapErr(err)
+	}
+	// a no-op once committed
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	if err := fn(txStore(tx)); err != nil {
+		return err
+	}
+	return mapErr(tx.Commit(ctx))
+}
+
+// retryable reports whether err aborted a transaction that may succeed when
+// run again, which includes the errors the queries of fn returned.
+func retryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == serializationFailure || pgErr.Code == deadlockDetected
+}
+
+// txRetryBackoff doubles the delay with every attempt, jittered so the
+// transactions that collided do not collide again.
+func txRetryBackoff(attempt int) time.Duration {
+	d := txRetryDelay << (attempt - 1)
+	return d/2 + rand.N(d/2)
+}
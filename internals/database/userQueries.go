@@ -1,23 +1,42 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 
 	"github.com/xenitane/todo-app-be-oe/internals/user"
 )
 
-func (s *service) UpadteUser(u *user.User) error {
-	updateQry := `update users set (first_name, last_name, password, is_admin)=($2, $3, $4, $5) where username = $1`
-	_, err := s.db.Exec(updateQry, u.Username, u.FirstName, u.LastName, u.Password, u.IsAdmin)
+const userColumns = `id, username, first_name, last_name, password, is_admin, created_at, version, disabled, token_version`
+
+// UpadteUser stores u if it is still at u.Version and bumps the version.
+func (s *store) UpadteUser(ctx context.Context, u *user.User) error {
+	updateQry := `update users set
+			(first_name, last_name, password, is_admin, disabled, token_version) = ($2, $3, $4, $5, $7, $8),
+			version = version + 1
+		where username = $1 and version = $6
+		returning version`
+	err := s.db.QueryRow(ctx, updateQry, u.Username, u.FirstName, u.LastName, u.Password, u.IsAdmin, u.Version, u.Disabled, u.TokenVersion).Scan(&u.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		var exists bool
+		if err := s.db.QueryRow(ctx, `select exists(select 1 from users where username = $1)`, u.Username).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return ErrVersionConflict
+		}
+	}
 	return err
 }
 
-func (s *service) GetAllUsers() ([]*user.User, error) {
-	query := `select * from users`
-	rows, err := s.db.Query(query)
+func (s *store) GetAllUsers(ctx context.Context) ([]*user.User, error) {
+	query := `select ` + userColumns + ` from users`
+	rows, err := s.db.Query(ctx, query)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	users := []*user.User{}
 	for rows.Next() {
 		user, err := scanUserRow(rows)
@@ -26,35 +45,33 @@ func (s *service) GetAllUsers() ([]*user.User, error) {
 		}
 		users = append(users, user)
 	}
-	return users, nil
+	return users, rows.Err()
 }
 
-func (s *service) InsertUser(u *user.User) error {
-	insertQry := `insert into users (username,first_name,last_name,password,is_admin)	values ($1, $2, $3, $4, $5);`
-	_, err := s.db.Query(
+// InsertUser stores u and sets its id, creation time and version. It fails
+// with ErrUsernameTaken when the username is in use.
+func (s *store) InsertUser(ctx context.Context, u *user.User) error {
+	insertQry := `insert into users (username,first_name,last_name,password,is_admin,disabled,token_version)	values ($1, $2, $3, $4, $5, $6, $7)
+		returning id, created_at, version`
+	return s.db.QueryRow(
+		ctx,
 		insertQry,
 		u.Username,
 		u.FirstName,
 		u.LastName,
 		u.Password,
 		u.IsAdmin,
-	)
-	return err
+		u.Disabled,
+		u.TokenVersion,
+	).Scan(&u.UserId, &u.CreatedAt, &u.Version)
 }
 
-func (s *service) GetUserByUserName(username string) (*user.User, error) {
-	query := `select * from users where username = $1`
-	rows, err := s.db.Query(query, username)
-	if err != nil {
-		return nil, err
-	}
-	for rows.Next() {
-		return scanUserRow(rows)
-	}
-	return nil, sql.ErrNoRows
+func (s *store) GetUserByUserName(ctx context.Context, username string) (*user.User, error) {
+	query := `select ` + userColumns + ` from users where username = $1`
+	return scanUserRow(s.db.QueryRow(ctx, query, username))
 }
 
-func scanUserRow(rows *sql.Rows) (*user.User, error) {
+func scanUserRow(rows rowScanner) (*user.User, error) {
 	user := new(user.User)
 	err := rows.Scan(
 		&user.UserId,
@@ -64,6 +81,31 @@ func scanUserRow(rows *sql.Rows) (*user.User, error) {
 		&user.Password,
 		&user.IsAdmin,
 		&user.CreatedAt,
+		&user.Version,
+		&user.Disabled,
+		&user.TokenVersion,
 	)
-	return user, err
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetUsersByIDs returns the users with the given ids, in no particular order.
+func (s *store) GetUsersByIDs(ctx context.Context, ids []int64) ([]*user.User, error) {
+	query := `select ` + userColumns + ` from users where id = any($1)`
+	rows, err := s.db.Query(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []*user.User{}
+	for rows.Next() {
+		user, err := scanUserRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
 }
@@ -0,0 +1,171 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+const (
+	TodoCreated  = "todo.created"
+	TodoUpdated  = "todo.updated"
+	TodoDeleted  = "todo.deleted"
+	TodoRestored = "todo.restored"
+
+	// channel is the postgres NOTIFY channel shared by every replica.
+	channel = "todo_events"
+
+	subscriberBuffer = 16
+)
+
+type Event struct {
+	Type     string     `json:"type"`
+	Username string     `json:"username"`
+	Todo     *todo.Todo `json:"todo"`
+}
+
+// Transport carries events between server replicas. database.Service
+// implements it with LISTEN/NOTIFY.
+type Transport interface {
+	Notify(context.Context, string, string) error
+	Listen(context.Context, string, func(string)) error
+}
+
+type subscriber struct {
+	ch chan Event
+}
+
+// Broker fans todo events out to every open stream of the users allowed to
+// see them. Events are always published through the transport and delivered
+// locally only when they come back from it, so a replica treats its own
+// events exactly like those of its peers.
+type Broker struct {
+	transport Transport
+
+	mu   sync.RWMutex
+	subs map[string]map[*subscriber]struct{}
+
+	// listenErr is why the broker is not listening, nil while it is
+	listenMu  sync.Mutex
+	listenErr error
+}
+
+var errNotListening = errors.New("the event listener is not running")
+
+func NewBroker(t Transport) *Broker {
+	return &Broker{
+		transport: t,
+		subs:      make(map[string]map[*subscriber]struct{}),
+		listenErr: errNotListening,
+	}
+}
+
+// Run listens on the transport until ctx is done, reconnecting with a
+// backoff whenever the listening connection drops.
+func (b *Broker) Run(ctx context.Context) {
+	defer b.setListenErr(errNotListening)
+	backoff := time.Second
+	for {
+		b.setListenErr(nil)
+		err := b.transport.Listen(ctx, channel, b.dispatch)
+		if ctx.Err() != nil {
+			return
+		}
+		b.setListenErr(fmt.Errorf("the event listener stopped: %w", err))
+		slog.WarnContext(ctx, "event listener stopped", slog.String("err", err.Error()), slog.Duration("retry_in", backoff))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// Listening reports why events from other replicas are not being received,
+// nil when they are.
+func (b *Broker) Listening(context.Context) error {
+	b.listenMu.Lock()
+	defer b.listenMu.Unlock()
+	return b.listenErr
+}
+
+func (b *Broker) setListenErr(err error) {
+	b.listenMu.Lock()
+	defer b.listenMu.Unlock()
+	b.listenErr = err
+}
+
+func (b *Broker) Publish(ctx context.Context, e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return b.transport.Notify(ctx, channel, string(payload))
+}
+
+// Subscribe registers a stream for the given user. The returned channel is
+// closed when cancel is called or when the subscriber falls too far behind.
+func (b *Broker) Subscribe(username string) (<-chan Event, func()) {
+	sub := &subscriber{ch: make(chan Event, subscriberBuffer)}
+
+	b.mu.Lock()
+	if b.subs[username] == nil {
+		b.subs[username] = make(map[*subscriber]struct{})
+	}
+	b.subs[username][sub] = struct{}{}
+	b.mu.Unlock()
+
+	return sub.ch, func() { b.remove(username, sub) }
+}
+
+func (b *Broker) remove(username string, sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[username][sub]; !ok {
+		return
+	}
+	delete(b.subs[username], sub)
+	if len(b.subs[username]) == 0 {
+		delete(b.subs, username)
+	}
+	close(sub.ch)
+}
+
+func (b *Broker) dispatch(payload string) {
+	var e Event
+	if err := json.Unmarshal([]byte(payload), &e); err != nil {
+		slog.Warn("dropping malformed event", slog.String("err", err.Error()))
+		return
+	}
+
+	var slow []func()
+	b.mu.RLock()
+	for _, username := range recipients(e) {
+		for sub := range b.subs[username] {
+			select {
+			case sub.ch <- e:
+			default:
+				slow = append(slow, func() { b.remove(username, sub) })
+			}
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, drop := range slow {
+		drop()
+	}
+}
+
+// recipients lists the users that should receive the event. Todos are only
+// visible to their owner for now; once todos can be shared, the users they
+// are shared with belong here too.
+func recipients(e Event) []string {
+	return []string{e.Username}
+}
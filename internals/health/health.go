@@ -0,0 +1,134 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	StatusUp       = "up"
+	StatusDown     = "down"
+	StatusDraining = "draining"
+)
+
+// Check reports whether something the server depends on works, a nil error
+// means it does. It should give up once ctx is done.
+type Check func(ctx context.Context) error
+
+type Result struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type Report struct {
+	Status    string            `json:"status"`
+	Checks    map[string]Result `json:"checks"`
+	CheckedAt time.Time         `json:"checkedAt"`
+}
+
+func (r *Report) Up() bool {
+	return r.Status == StatusUp
+}
+
+// Public leaves out the errors of the checks, which may name hosts or
+// other internals.
+func (r *Report) Public() *Report {
+	public := &Report{Status: r.Status, Checks: make(map[string]Result, len(r.Checks)), CheckedAt: r.CheckedAt}
+	for name, res := range r.Checks {
+		res.Error = ""
+		public.Checks[name] = res
+	}
+	return public
+}
+
+type check struct {
+	name    string
+	timeout time.Duration
+	run     Check
+}
+
+// Checker runs a set of checks and caches their report, so probes hitting
+// the server often do not each reach the database.
+type Checker struct {
+	ttl    time.Duration
+	checks []check
+
+	mu     sync.Mutex
+	report *Report
+}
+
+func NewChecker(ttl time.Duration) *Checker {
+	return &Checker{ttl: ttl}
+}
+
+// Add registers a check that fails when it takes longer than timeout.
+func (c *Checker) Add(name string, timeout time.Duration, run Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check{name: name, timeout: timeout, run: run})
+	c.report = nil
+}
+
+// Run returns the cached report, running the checks again once it is older
+// than the ttl. Concurrent callers wait for the same run.
+func (c *Checker) Run(ctx context.Context) *Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.report != nil && time.Since(c.report.CheckedAt) < c.ttl {
+		return c.report
+	}
+
+	// the report is shared, a caller going away must not fail it
+	ctx = context.WithoutCancel(ctx)
+	report := &Report{Status: StatusUp, Checks: make(map[string]Result, len(c.checks))}
+	results := make([]Result, len(c.checks))
+	var wg sync.WaitGroup
+	for i, ch := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = ch.do(ctx)
+		}()
+	}
+	wg.Wait()
+	report.CheckedAt = time.Now()
+	for i, ch := range c.checks {
+		report.Checks[ch.name] = results[i]
+		if results[i].Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	c.report = report
+	return report
+}
+
+// do runs the check, giving up on it at the timeout even when it ignores
+// its context.
+func (ch check) do(ctx context.Context) Result {
+	ctx, cancel := context.WithTimeout(ctx, ch.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- ch.run(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	res := Result{Status: StatusUp, Duration: time.Since(start).Round(time.Microsecond).String()}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = errors.New("timed out after " + ch.timeout.String())
+	}
+	if err != nil {
+		res.Status = StatusDown
+		res.Error = err.Error()
+	}
+	return res
+}
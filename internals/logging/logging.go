@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/xenitane/todo-app-be-oe/internals/config"
+)
+
+type loggerKey struct{}
+
+// New returns the logger of the app writing to w in the format and from the
+// level the config names. Records logged with a context of a traced span
+// carry its trace and span ids.
+func New(cfg config.Log, w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level(cfg.Level)}
+	var h slog.Handler
+	if cfg.Format == config.LogText {
+		h = slog.NewTextHandler(w, opts)
+	} else {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(traceHandler{h})
+}
+
+func level(name string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+// WithContext returns a copy of ctx carrying l, the logger of everything
+// done on behalf of the request ctx belongs to.
+func WithContext(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger stored in ctx, the default one outside of
+// requests.
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// ObserveQuery is a database.Observer logging every call of the service at
+// debug level with the logger of the request making it.
+func ObserveQuery(ctx context.Context, method string) (context.Context, func(error)) {
+	start := time.Now()
+	return ctx, func(err error) {
+		attrs := []slog.Attr{
+			slog.String("method", method),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			attrs = append(attrs, slog.String("err", err.Error()))
+		}
+		FromContext(ctx).LogAttrs(ctx, slog.LevelDebug, "QUERY", attrs...)
+	}
+}
+
+// traceHandler adds the ids of the span in the context of a record.
+type traceHandler struct {
+	slog.Handler
+}
+
+func (h traceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,187 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/xenitane/todo-app-be-oe/internals/database"
+)
+
+const namespace = "todoapp"
+
+// Metrics holds the collectors of the server in a registry of their own.
+type Metrics struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	queryDuration   *prometheus.HistogramVec
+
+	Signups        prometheus.Counter
+	Signins        prometheus.Counter
+	FailedSignins  prometheus.Counter
+	TodosCreated   prometheus.Counter
+	TodosCompleted prometheus.Counter
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Http requests by method, route and status.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to answer http requests, by method and route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "db",
+			Name:      "query_duration_seconds",
+			Help:      "Time taken by the database queries, by service method and outcome.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"method", "outcome"}),
+
+		Signups:        counter("signups_total", "Accounts created."),
+		Signins:        counter("signins_total", "Successful signins."),
+		FailedSignins:  counter("failed_signins_total", "Signins rejected for a wrong username or password."),
+		TodosCreated:   counter("todos_created_total", "Todos created."),
+		TodosCompleted: counter("todos_completed_total", "Todos whose status was set to completed."),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.queryDuration,
+		m.Signups,
+		m.Signins,
+		m.FailedSignins,
+		m.TodosCreated,
+		m.TodosCompleted,
+	)
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+	return m
+}
+
+func counter(name, help string) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{Namespace: namespace, Name: name, Help: help})
+}
+
+// Handler serves the metrics in the prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return m.handler
+}
+
+// Middleware counts and times the requests by the route they matched, so
+// paths with ids in them share a series.
+func (m *Metrics) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			route := c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+			method := c.Request().Method
+			m.requests.WithLabelValues(method, route, strconv.Itoa(c.Response().Status)).Inc()
+			m.requestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
+
+// ObserveQuery is a database.Observer timing the queries.
+func (m *Metrics) ObserveQuery(ctx context.Context, method string) (context.Context, func(error)) {
+	start := time.Now()
+	return ctx, func(err error) {
+		outcome := "ok"
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			outcome = "not_found"
+		case errors.Is(err, context.DeadlineExceeded):
+			outcome = "timeout"
+		case errors.Is(err, database.ErrVersionConflict):
+			outcome = "conflict"
+		case err != nil:
+			outcome = "error"
+		}
+		m.queryDuration.WithLabelValues(method, outcome).Observe(time.Since(start).Seconds())
+	}
+}
+
+// RegisterDBStats exports the connection pool stats of the database.
+func (m *Metrics) RegisterDBStats(db database.Service) {
+	m.registry.MustRegister(&dbStatsCollector{db: db})
+}
+
+var (
+	dbMaxConns          = dbDesc("max_connections", "Maximum number of connections to the database.")
+	dbOpen              = dbDesc("open_connections", "Established connections, in use or idle.")
+	dbInUse             = dbDesc("in_use_connections", "Connections currently in use.")
+	dbIdle              = dbDesc("idle_connections", "Idle connections.")
+	dbAcquireCount      = dbDesc("acquire_count_total", "Connections taken from the pool.")
+	dbWaitCount         = dbDesc("wait_count_total", "Connections waited for.")
+	dbCanceledAcquires  = dbDesc("canceled_acquire_count_total", "Waits for a connection given up on.")
+	dbAcquireDuration   = dbDesc("acquire_duration_seconds_total", "Time taken to get connections from the pool.")
+	dbNewConns          = dbDesc("new_connections_total", "Connections opened.")
+	dbMaxIdleClosed     = dbDesc("max_idle_closed_total", "Connections closed because of the idle time limit.")
+	dbMaxLifetimeClosed = dbDesc("max_lifetime_closed_total", "Connections closed because of their maximum lifetime.")
+)
+
+func dbDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db", name), help, nil, nil)
+}
+
+// dbStatsCollector reads the pool stats on every scrape.
+type dbStatsCollector struct {
+	db database.Service
+}
+
+func (dc *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dbMaxConns
+	ch <- dbOpen
+	ch <- dbInUse
+	ch <- dbIdle
+	ch <- dbAcquireCount
+	ch <- dbWaitCount
+	ch <- dbCanceledAcquires
+	ch <- dbAcquireDuration
+	ch <- dbNewConns
+	ch <- dbMaxIdleClosed
+	ch <- dbMaxLifetimeClosed
+}
+
+func (dc *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	s := dc.db.PoolStats()
+	ch <- prometheus.MustNewConstMetric(dbMaxConns, prometheus.GaugeValue, float64(s.MaxConns))
+	ch <- prometheus.MustNewConstMetric(dbOpen, prometheus.GaugeValue, float64(s.TotalConns))
+	ch <- prometheus.MustNewConstMetric(dbInUse, prometheus.GaugeValue, float64(s.AcquiredConns))
+	ch <- prometheus.MustNewConstMetric(dbIdle, prometheus.GaugeValue, float64(s.IdleConns))
+	ch <- prometheus.MustNewConstMetric(dbAcquireCount, prometheus.CounterValue, float64(s.AcquireCount))
+	ch <- prometheus.MustNewConstMetric(dbWaitCount, prometheus.CounterValue, float64(s.EmptyAcquireCount))
+	ch <- prometheus.MustNewConstMetric(dbCanceledAcquires, prometheus.CounterValue, float64(s.CanceledAcquireCount))
+	ch <- prometheus.MustNewConstMetric(dbAcquireDuration, prometheus.CounterValue, s.AcquireDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(dbNewConns, prometheus.CounterValue, float64(s.NewConnsCount))
+	ch <- prometheus.MustNewConstMetric(dbMaxIdleClosed, prometheus.CounterValue, float64(s.MaxIdleClosed))
+	ch <- prometheus.MustNewConstMetric(dbMaxLifetimeClosed, prometheus.CounterValue, float64(s.MaxLifetimeClosed))
+}
@@ -15,6 +15,13 @@ func CORS() echo.MiddlewareFunc {
 			echo.HeaderAllow,
 			echo.HeaderContentType,
 			echo.HeaderAuthorization,
+			"If-Match",
+			"If-None-Match",
+			HeaderIdempotencyKey,
+		},
+		ExposeHeaders: []string{
+			"ETag",
+			HeaderIdempotentReplayed,
 		},
 		AllowMethods: []string{
 			http.MethodGet,
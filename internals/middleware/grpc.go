@@ -0,0 +1,246 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+
+	"github.com/xenitane/todo-app-be-oe/internals/logging"
+)
+
+// The interceptors of the grpc api, the counterparts of the echo middlewares.
+
+const problemDomain = "todo-app"
+
+// grpcCodes are the status codes of the http statuses handlers fail with
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusMethodNotAllowed:      codes.Unimplemented,
+	http.StatusConflict:              codes.Aborted,
+	http.StatusPreconditionFailed:    codes.FailedPrecondition,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	http.StatusTeapot:                codes.PermissionDenied,
+	http.StatusUnprocessableEntity:   codes.InvalidArgument,
+	http.StatusTooManyRequests:       codes.ResourceExhausted,
+	http.StatusInternalServerError:   codes.Internal,
+	http.StatusServiceUnavailable:    codes.Unavailable,
+}
+
+type claimsKey struct{}
+
+// ClaimsFromContext returns the claims GRPCAuth verified for the call.
+func ClaimsFromContext(ctx context.Context) (*JWTCustomClaims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*JWTCustomClaims)
+	return claims, ok
+}
+
+// GRPCAuth verifies the jwt sent as "authorization: Bearer <jwt>" metadata,
+// except for the methods public reports true for, and runs check on its
+// claims.
+func GRPCAuth(signingKey []byte, check TokenCheck, public func(fullMethod string) bool) (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	authorize := func(ctx context.Context, fullMethod string) (context.Context, error) {
+		if public(fullMethod) {
+			return ctx, nil
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, auth := range md.Get("authorization") {
+			token, ok := strings.CutPrefix(auth, "Bearer ")
+			if !ok {
+				continue
+			}
+			claims, err := ParseToken(token, signingKey)
+			if err != nil {
+				return nil, status.Error(codes.Unauthenticated, "invalid or expired jwt")
+			}
+			if check != nil {
+				if err := check(ctx, claims); err != nil {
+					return nil, checkStatus(err)
+				}
+			}
+			if call, ok := ctx.Value(grpcCallKey{}).(*grpcCall); ok {
+				call.username = claims.Username
+			}
+			l := logging.FromContext(ctx).With(slog.String("username", claims.Username))
+			return logging.WithContext(context.WithValue(ctx, claimsKey{}, claims), l), nil
+		}
+		return nil, status.Error(codes.Unauthenticated, "missing or malformed jwt")
+	}
+
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authorize(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authorize(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	}
+	return unary, stream
+}
+
+// checkStatus is the status of an error of a TokenCheck.
+func checkStatus(err error) error {
+	var he *echo.HTTPError
+	if !errors.As(err, &he) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	code, ok := grpcCodes[he.Code]
+	if !ok {
+		code = codes.Unknown
+	}
+	return status.Error(code, fmt.Sprint(he.Message))
+}
+
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// GRPCErrors turns handler errors into statuses carrying what their problem
+// details would: the problem code as the reason of an ErrorInfo, violations
+// as a BadRequest and, in debug mode, the internal error as DebugInfo.
+// Errors that already are statuses pass unchanged.
+func GRPCErrors(ps *Problems) (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		return resp, ps.grpcStatus(ctx, err)
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return ps.grpcStatus(ss.Context(), handler(srv, ss))
+	}
+	return unary, stream
+}
+
+func (ps *Problems) grpcStatus(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	p := ps.Describe(err, strings.Join(md.Get("accept-language"), ","))
+
+	code, ok := grpcCodes[p.Status]
+	if !ok {
+		code = codes.Unknown
+	}
+	// the rest routes answer 401 to callers lacking permissions too
+	if _, authenticated := ClaimsFromContext(ctx); authenticated && code == codes.Unauthenticated {
+		code = codes.PermissionDenied
+	}
+	msg := p.Detail
+	if msg == "" {
+		msg = p.Title
+	}
+
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{Reason: p.Code, Domain: problemDomain}}
+	if len(p.Violations) > 0 {
+		br := new(errdetails.BadRequest)
+		for _, v := range p.Violations {
+			br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{
+				Field:       v.Field,
+				Description: v.Message,
+			})
+		}
+		details = append(details, br)
+	}
+	if p.Internal != "" {
+		details = append(details, &errdetails.DebugInfo{Detail: p.Internal})
+	}
+	st, err := status.New(code, msg).WithDetails(details...)
+	if err != nil {
+		return status.Error(code, msg)
+	}
+	return st.Err()
+}
+
+// GRPCLogger logs every call the way Logger logs http requests. Calls get
+// their id from the x-request-id metadata, or a new one, and a logger
+// carrying it in their context.
+func GRPCLogger(base *slog.Logger) (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	begin := func(ctx context.Context, setHeader func(metadata.MD) error) (context.Context, *grpcCall) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		id := ""
+		if ids := md.Get("x-request-id"); len(ids) > 0 {
+			id = ids[0]
+		}
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		_ = setHeader(metadata.Pairs("x-request-id", id))
+		call := &grpcCall{start: time.Now()}
+		ctx = context.WithValue(ctx, grpcCallKey{}, call)
+		return logging.WithContext(ctx, base.With(slog.String("request_id", id))), call
+	}
+	log := func(ctx context.Context, call *grpcCall, fullMethod string, err error) {
+		attrs := []slog.Attr{
+			slog.String("method", fullMethod),
+			slog.String("code", status.Code(err).String()),
+			slog.Duration("latency", time.Since(call.start)),
+		}
+		if call.username != "" {
+			attrs = append(attrs, slog.String("username", call.username))
+		}
+		if err == nil {
+			logging.FromContext(ctx).LogAttrs(ctx, slog.LevelInfo, "RPC", attrs...)
+			return
+		}
+		level := slog.LevelWarn
+		switch status.Code(err) {
+		case codes.Internal, codes.Unknown, codes.Unavailable, codes.DataLoss:
+			level = slog.LevelError
+		}
+		attrs = append(attrs, slog.String("err", err.Error()))
+		logging.FromContext(ctx).LogAttrs(ctx, level, "RPC_ERROR", attrs...)
+	}
+
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, call := begin(ctx, func(md metadata.MD) error { return grpc.SetHeader(ctx, md) })
+		resp, err := handler(ctx, req)
+		log(ctx, call, info.FullMethod, err)
+		return resp, err
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, call := begin(ss.Context(), ss.SetHeader)
+		err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+		log(ctx, call, info.FullMethod, err)
+		return err
+	}
+	return unary, stream
+}
+
+type grpcCallKey struct{}
+
+// grpcCall is what GRPCLogger learns about a call from the interceptors
+// after it.
+type grpcCall struct {
+	start    time.Time
+	username string
+}
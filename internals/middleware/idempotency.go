@@ -0,0 +1,287 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	HeaderIdempotencyKey     = "Idempotency-Key"
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+// IdempotencyRecord is what is kept of a request sent with an idempotency
+// key. Until the request completes only its fingerprint is known.
+type IdempotencyRecord struct {
+	Fingerprint string
+	Done        bool
+	Status      int
+	Header      http.Header
+	Body        []byte
+}
+
+// IdempotencyStore keeps the records of idempotency keys until they expire.
+type IdempotencyStore interface {
+	// Reserve records key as running a request with the given fingerprint
+	// for lease and returns nil, or the record of key when it is known.
+	Reserve(ctx context.Context, key, fingerprint string, lease time.Duration) (*IdempotencyRecord, error)
+	// Complete stores the response of the request running under key, to
+	// be replayed for ttl.
+	Complete(ctx context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) error
+	// Release forgets key, so its request can be retried.
+	Release(ctx context.Context, key string) error
+}
+
+// Idempotency makes retries of a request sent with an Idempotency-Key header
+// safe: the first response is stored for ttl and replayed to later requests
+// with the same key. Keys are scoped to the route, the path and the user of
+// the jwt, so the middleware has to run after the jwt one.
+//
+// A key reused with a different body gets 422 and one whose request still
+// runs gets 409. A running request holds its key for lease at most, so the
+// key of one that never finished, on a replica that crashed, is freed well
+// before ttl. Failed requests are not stored, they can be retried.
+func Idempotency(store IdempotencyStore, ttl, lease time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(HeaderIdempotencyKey)
+			if key == "" {
+				return next(c)
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				return &echo.HTTPError{
+					Code:    http.StatusBadRequest,
+					Message: "the idempotency key is longer than 255 characters",
+				}
+			}
+
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return &echo.HTTPError{
+					Code:     http.StatusBadRequest,
+					Message:  "error reading request body",
+					Internal: err,
+				}
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+			sum := sha256.Sum256(body)
+			fingerprint := hex.EncodeToString(sum[:])
+
+			scope := []string{c.Request().Method, c.Request().URL.Path, key}
+			if token, ok := c.Get("user").(*jwt.Token); ok {
+				if claims, ok := token.Claims.(*JWTCustomClaims); ok {
+					scope = append(scope, claims.Username)
+				}
+			}
+			storeKey := strings.Join(scope, "\x00")
+
+			ctx := c.Request().Context()
+			rec, err := store.Reserve(ctx, storeKey, fingerprint, lease)
+			if err != nil {
+				return &echo.HTTPError{
+					Code:     http.StatusInternalServerError,
+					Message:  "internal server error",
+					Internal: err,
+				}
+			}
+			if rec != nil {
+				return replay(c, rec, fingerprint)
+			}
+
+			// the record is kept even when the client is gone, its retry
+			// is what replays it
+			ctx = context.WithoutCancel(ctx)
+			rw := &recordingWriter{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = rw
+			err = next(c)
+			c.Response().Writer = rw.ResponseWriter
+			if err != nil || c.Response().Status >= http.StatusInternalServerError {
+				if rerr := store.Release(ctx, storeKey); rerr != nil {
+					c.Logger().Error(rerr)
+				}
+				return err
+			}
+
+			header := c.Response().Header().Clone()
+			header.Del(echo.HeaderXRequestID)
+			err = store.Complete(ctx, storeKey, &IdempotencyRecord{
+				Fingerprint: fingerprint,
+				Done:        true,
+				Status:      c.Response().Status,
+				Header:      header,
+				Body:        rw.body.Bytes(),
+			}, ttl)
+			if err != nil {
+				c.Logger().Error(err)
+			}
+			return nil
+		}
+	}
+}
+
+func replay(c echo.Context, rec *IdempotencyRecord, fingerprint string) error {
+	if rec.Fingerprint != fingerprint {
+		return &echo.HTTPError{
+			Code:    http.StatusUnprocessableEntity,
+			Message: "the idempotency key was used with a different request",
+		}
+	}
+	if !rec.Done {
+		return &echo.HTTPError{
+			Code:    http.StatusConflict,
+			Message: "a request with this idempotency key is still running",
+		}
+	}
+	for name, values := range rec.Header {
+		c.Response().Header()[name] = values
+	}
+	c.Response().Header().Set(HeaderIdempotentReplayed, "true")
+	c.Response().WriteHeader(rec.Status)
+	_, err := c.Response().Write(rec.Body)
+	return err
+}
+
+// recordingWriter keeps a copy of the body written through it.
+type recordingWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type memoryIdempotencyEntry struct {
+	key     string
+	rec     *IdempotencyRecord
+	size    int
+	expires time.Time
+}
+
+// memoryIdempotencyStore keeps the records in memory, which suits a single
+// instance. The responses it keeps take at most maxBytes, the oldest are
+// dropped first to make room. Expired records are swept at most once a
+// minute.
+type memoryIdempotencyStore struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	maxBytes int
+	bytes    int
+	// order holds the entries from the oldest, running requests by when
+	// they started and responses by when they completed
+	order     *list.List
+	lastSweep time.Time
+}
+
+func NewMemoryIdempotencyStore(maxBytes int) IdempotencyStore {
+	return &memoryIdempotencyStore{
+		entries:  make(map[string]*list.Element),
+		maxBytes: maxBytes,
+		order:    list.New(),
+	}
+}
+
+func (ms *memoryIdempotencyStore) Reserve(_ context.Context, key, fingerprint string, lease time.Duration) (*IdempotencyRecord, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(ms.lastSweep) > time.Minute {
+		for el := ms.order.Front(); el != nil; {
+			next := el.Next()
+			if now.After(el.Value.(*memoryIdempotencyEntry).expires) {
+				ms.remove(el)
+			}
+			el = next
+		}
+		ms.lastSweep = now
+	}
+	if el, ok := ms.entries[key]; ok {
+		e := el.Value.(*memoryIdempotencyEntry)
+		if now.Before(e.expires) {
+			rec := *e.rec
+			return &rec, nil
+		}
+		ms.remove(el)
+	}
+	ms.add(&memoryIdempotencyEntry{
+		key:     key,
+		rec:     &IdempotencyRecord{Fingerprint: fingerprint},
+		size:    len(key) + len(fingerprint),
+		expires: now.Add(lease),
+	})
+	return nil, nil
+}
+
+// Complete stores the response, unless it alone takes more than maxBytes:
+// its key is then forgotten, like a failed request.
+func (ms *memoryIdempotencyStore) Complete(_ context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	el, ok := ms.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*memoryIdempotencyEntry)
+	size := len(key) + len(rec.Fingerprint) + len(rec.Body)
+	for name, values := range rec.Header {
+		size += len(name)
+		for _, v := range values {
+			size += len(v)
+		}
+	}
+	ms.bytes += size - e.size
+	e.rec, e.size, e.expires = rec, size, time.Now().Add(ttl)
+	ms.order.MoveToBack(el)
+	if size > ms.maxBytes {
+		ms.remove(el)
+		return nil
+	}
+	// the running requests are not dropped, their keys would be reused
+	for el := ms.order.Front(); el != nil && ms.bytes > ms.maxBytes; {
+		next := el.Next()
+		if el.Value.(*memoryIdempotencyEntry).rec.Done {
+			ms.remove(el)
+		}
+		el = next
+	}
+	return nil
+}
+
+func (ms *memoryIdempotencyStore) Release(_ context.Context, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if el, ok := ms.entries[key]; ok {
+		ms.remove(el)
+	}
+	return nil
+}
+
+func (ms *memoryIdempotencyStore) add(e *memoryIdempotencyEntry) {
+	ms.entries[e.key] = ms.order.PushBack(e)
+	ms.bytes += e.size
+}
+
+func (ms *memoryIdempotencyStore) remove(el *list.Element) {
+	e := ms.order.Remove(el).(*memoryIdempotencyEntry)
+	delete(ms.entries, e.key)
+	ms.bytes -= e.size
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// cancelStore fails like the database store once the context it is given is
+// done.
+type cancelStore struct {
+	IdempotencyStore
+}
+
+func (st cancelStore) Complete(ctx context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return st.IdempotencyStore.Complete(ctx, key, rec, ttl)
+}
+
+func (st cancelStore) Release(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return st.IdempotencyStore.Release(ctx, key)
+}
+
+func TestIdempotencyClientGone(t *testing.T) {
+	e := echo.New()
+	calls := 0
+	e.POST("/", func(c echo.Context) error {
+		calls++
+		return c.String(http.StatusCreated, "created")
+	}, func(next echo.HandlerFunc) echo.HandlerFunc {
+		// the client disconnects while the request runs
+		return func(c echo.Context) error {
+			ctx, cancel := context.WithCancel(c.Request().Context())
+			c.SetRequest(c.Request().WithContext(ctx))
+			err := next(c)
+			cancel()
+			return err
+		}
+	}, Idempotency(cancelStore{NewMemoryIdempotencyStore(1 << 20)}, time.Hour, time.Minute))
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+		req.Header.Set(HeaderIdempotencyKey, "gone-1")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	send()
+	rec := send()
+	if rec.Code != http.StatusCreated || rec.Header().Get(HeaderIdempotentReplayed) != "true" || calls != 1 {
+		t.Errorf("the retry answered %d after %d calls, want the response replayed", rec.Code, calls)
+	}
+}
+
+func TestIdempotencyLease(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryIdempotencyStore(1 << 20)
+	if rec, err := store.Reserve(ctx, "key", "first", -time.Second); err != nil || rec != nil {
+		t.Fatalf("Reserve of a new key = %+v, %v, want it reserved", rec, err)
+	}
+	// the request holding the key never finished
+	if rec, err := store.Reserve(ctx, "key", "second", time.Minute); err != nil || rec != nil {
+		t.Fatalf("Reserve after the lease = %+v, %v, want it reserved again", rec, err)
+	}
+	if err := store.Complete(ctx, "key", &IdempotencyRecord{Fingerprint: "second", Done: true, Status: http.StatusCreated}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := store.Reserve(ctx, "key", "second", time.Minute); err != nil || rec == nil || !rec.Done {
+		t.Errorf("Reserve of a completed key = %+v, %v, want its response", rec, err)
+	}
+}
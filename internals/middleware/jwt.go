@@ -1,7 +1,9 @@
 package middleware
 
 import (
-	"os"
+	"context"
+	"errors"
+	"net/http"
 
 	"github.com/golang-jwt/jwt/v5"
 	echojwt "github.com/labstack/echo-jwt/v4"
@@ -11,14 +13,103 @@ import (
 type JWTCustomClaims struct {
 	Username string `json:"username"`
 	IsAdmin  bool   `json:"isAdmin"`
+	// TokenVersion is the token version of the user when the token was
+	// issued, bumping it revokes the token
+	TokenVersion int64 `json:"tokenVersion,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func JWT() echo.MiddlewareFunc {
-	return echojwt.WithConfig(echojwt.Config{
+// TokenCheck runs on the claims of every token that verifies, the token is
+// refused when it fails. It may update the claims the handlers see. Its
+// error is returned as is, it should be an *echo.HTTPError.
+type TokenCheck func(ctx context.Context, claims *JWTCustomClaims) error
+
+func JWT(signingKey []byte, check TokenCheck) echo.MiddlewareFunc {
+	return withCheck(check, echojwt.WithConfig(echojwt.Config{
+		NewClaimsFunc: func(c echo.Context) jwt.Claims {
+			return new(JWTCustomClaims)
+		},
+		SigningKey:     signingKey,
+		SuccessHandler: logUsername,
+	}))
+}
+
+// StreamJWT is JWT for long lived streams. Browsers cannot set headers on
+// EventSource and WebSocket requests, so the token may also be passed as the
+// access_token query parameter, which Logger redacts.
+func StreamJWT(signingKey []byte, check TokenCheck) echo.MiddlewareFunc {
+	return withCheck(check, echojwt.WithConfig(echojwt.Config{
+		NewClaimsFunc: func(c echo.Context) jwt.Claims {
+			return new(JWTCustomClaims)
+		},
+		SigningKey:     signingKey,
+		TokenLookup:    "header:Authorization:Bearer ,query:access_token",
+		SuccessHandler: logUsername,
+	}))
+}
+
+// OptionalJWT is JWT for endpoints that also serve anonymous requests.
+// Requests without a token pass through with no claims set, those with an
+// invalid one are still rejected.
+func OptionalJWT(signingKey []byte, check TokenCheck) echo.MiddlewareFunc {
+	return withCheck(check, echojwt.WithConfig(echojwt.Config{
 		NewClaimsFunc: func(c echo.Context) jwt.Claims {
 			return new(JWTCustomClaims)
 		},
-		SigningKey: []byte(os.Getenv("JWT_SIGNING_KEY")),
-	})
+		SigningKey:     signingKey,
+		SuccessHandler: logUsername,
+		ErrorHandler: func(c echo.Context, err error) error {
+			var missing *echojwt.TokenExtractionError
+			if errors.As(err, &missing) {
+				return nil
+			}
+			return &echo.HTTPError{
+				Code:     http.StatusUnauthorized,
+				Message:  "invalid or expired jwt",
+				Internal: err,
+			}
+		},
+		ContinueOnIgnoredError: true,
+	}))
+}
+
+// withCheck runs check after verify, on the requests verify found a token
+// on.
+func withCheck(check TokenCheck, verify echo.MiddlewareFunc) echo.MiddlewareFunc {
+	if check == nil {
+		return verify
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return verify(func(c echo.Context) error {
+			if token, ok := c.Get("user").(*jwt.Token); ok {
+				if claims, ok := token.Claims.(*JWTCustomClaims); ok {
+					if err := check(c.Request().Context(), claims); err != nil {
+						return err
+					}
+				}
+			}
+			return next(c)
+		})
+	}
+}
+
+func logUsername(c echo.Context) {
+	if token, ok := c.Get("user").(*jwt.Token); ok {
+		if claims, ok := token.Claims.(*JWTCustomClaims); ok {
+			withUsername(c, claims)
+		}
+	}
+}
+
+// ParseToken verifies a signed token the way the JWT middlewares do and
+// returns its claims.
+func ParseToken(signed string, signingKey []byte) (*JWTCustomClaims, error) {
+	claims := new(JWTCustomClaims)
+	_, err := jwt.ParseWithClaims(signed, claims, func(t *jwt.Token) (interface{}, error) {
+		return signingKey, nil
+	}, jwt.WithValidMethods([]string{echojwt.AlgorithmHS256}))
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
 }
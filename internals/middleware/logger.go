@@ -1,43 +1,72 @@
 package middleware
 
 import (
-	"context"
 	"log/slog"
-	"os"
+	"net/http"
+	"net/url"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+
+	"github.com/xenitane/todo-app-be-oe/internals/logging"
 )
 
+// Logger logs every request with the logger RequestID put in its context,
+// so the lines carry the request id and, once authenticated, the username.
+// Server errors are logged as errors, client errors as warnings.
 func Logger() echo.MiddlewareFunc {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
-		LogStatus:   true,
-		LogURI:      true,
-		LogError:    true,
-		HandleError: true,
+		LogStatus:        true,
+		LogRoutePath:     true,
+		LogLatency:       true,
+		LogContentLength: true,
+		LogResponseSize:  true,
+		LogError:         true,
+		HandleError:      true,
 		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			ctx := c.Request().Context()
+			attrs := []slog.Attr{
+				slog.String("method", c.Request().Method),
+				slog.String("uri", loggedURI(c.Request().URL)),
+				slog.String("route", v.RoutePath),
+				slog.Int("status", v.Status),
+				slog.Duration("latency", v.Latency),
+				slog.String("bytes_in", v.ContentLength),
+				slog.Int64("bytes_out", v.ResponseSize),
+			}
 			if v.Error == nil {
-				logger.LogAttrs(
-					context.Background(),
-					slog.LevelInfo,
-					"REQUEST",
-					slog.String("method", c.Request().Method),
-					slog.String("uri", v.URI),
-					slog.Int("status", v.Status),
-				)
-			} else {
-				logger.LogAttrs(
-					context.Background(),
-					slog.LevelError,
-					"REQUEST_ERROR",
-					slog.String("method", c.Request().Method),
-					slog.String("uri", v.URI),
-					slog.Int("status", v.Status),
-					slog.String("err", v.Error.Error()),
-				)
+				logging.FromContext(ctx).LogAttrs(ctx, slog.LevelInfo, "REQUEST", attrs...)
+				return nil
+			}
+			level := slog.LevelWarn
+			if v.Status >= http.StatusInternalServerError {
+				level = slog.LevelError
 			}
+			attrs = append(attrs, slog.String("err", v.Error.Error()))
+			logging.FromContext(ctx).LogAttrs(ctx, level, "REQUEST_ERROR", attrs...)
 			return nil
 		},
 	})
 }
+
+// secretParams are the query parameters carrying secrets, the jwt of the
+// streams, whose values are never logged
+var secretParams = []string{"access_token"}
+
+// loggedURI is the path and query of u with the values of secretParams
+// redacted.
+func loggedURI(u *url.URL) string {
+	logged := *u
+	q := logged.Query()
+	redacted := false
+	for _, p := range secretParams {
+		if q.Has(p) {
+			q.Set(p, "REDACTED")
+			redacted = true
+		}
+	}
+	if redacted {
+		logged.RawQuery = q.Encode()
+	}
+	return logged.RequestURI()
+}
@@ -0,0 +1,279 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/es"
+	"github.com/go-playground/locales/fr"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	es_translations "github.com/go-playground/validator/v10/translations/es"
+	fr_translations "github.com/go-playground/validator/v10/translations/fr"
+	"github.com/labstack/echo/v4"
+)
+
+const MIMEApplicationProblemJSON = "application/problem+json"
+
+// Problem is an RFC 7807 problem detail. Code is stable across releases and
+// is what clients should switch on; Title and Detail are for humans.
+type Problem struct {
+	Type       string      `json:"type"`
+	Title      string      `json:"title"`
+	Status     int         `json:"status"`
+	Detail     string      `json:"detail,omitempty"`
+	Instance   string      `json:"instance,omitempty"`
+	Code       string      `json:"code"`
+	RequestID  string      `json:"requestId,omitempty"`
+	Violations []Violation `json:"violations,omitempty"`
+	Internal   string      `json:"internal,omitempty"`
+}
+
+// Violation is a failed validation rule of a single request field.
+type Violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// Violations can be set as the Internal error of an echo.HTTPError to report
+// them the way validation errors are.
+type Violations []Violation
+
+func (vs Violations) Error() string {
+	msgs := make([]string, len(vs))
+	for i, v := range vs {
+		msgs[i] = strings.TrimPrefix(v.Field+": "+v.Message, ": ")
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// problem codes by status, a handler error is mapped to the code of its
+// status unless it is a validation failure
+var problemCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusPreconditionFailed:    "precondition_failed",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusTeapot:                "forbidden_operation",
+	http.StatusUnprocessableEntity:   "unprocessable_entity",
+	http.StatusTooManyRequests:       "too_many_requests",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+const codeValidationFailed = "validation_failed"
+
+// problem titles by code, english falls back to the status text
+var problemTitles = map[string]map[string]string{
+	"en": {
+		codeValidationFailed: "Validation failed",
+	},
+	"es": {
+		"bad_request":            "Solicitud incorrecta",
+		"unauthorized":           "No autorizado",
+		"forbidden":              "Prohibido",
+		"not_found":              "No encontrado",
+		"method_not_allowed":     "Método no permitido",
+		"conflict":               "Conflicto",
+		"precondition_failed":    "Precondición fallida",
+		"payload_too_large":      "Contenido demasiado grande",
+		"unsupported_media_type": "Tipo de contenido no soportado",
+		"forbidden_operation":    "Operación no permitida",
+		"unprocessable_entity":   "Entidad no procesable",
+		"too_many_requests":      "Demasiadas solicitudes",
+		"internal_error":         "Error interno del servidor",
+		"unavailable":            "Servicio no disponible",
+		codeValidationFailed:     "La validación ha fallado",
+	},
+	"fr": {
+		"bad_request":            "Requête incorrecte",
+		"unauthorized":           "Non autorisé",
+		"forbidden":              "Interdit",
+		"not_found":              "Introuvable",
+		"method_not_allowed":     "Méthode non autorisée",
+		"conflict":               "Conflit",
+		"precondition_failed":    "Échec de la précondition",
+		"payload_too_large":      "Contenu trop volumineux",
+		"unsupported_media_type": "Type de contenu non pris en charge",
+		"forbidden_operation":    "Opération interdite",
+		"unprocessable_entity":   "Entité non traitable",
+		"too_many_requests":      "Trop de requêtes",
+		"internal_error":         "Erreur interne du serveur",
+		"unavailable":            "Service indisponible",
+		codeValidationFailed:     "La validation a échoué",
+	},
+}
+
+// notStaleTranslations are the messages of the custom not-stale rule
+var notStaleTranslations = map[string]string{
+	"en": "{0} must not be in the past",
+	"es": "{0} no debe estar en el pasado",
+	"fr": "{0} ne doit pas être dans le passé",
+}
+
+// Problems turns handler errors into problem details. Validation errors list
+// their violations translated to the language asked for in Accept-Language.
+// Internal error details are only included when debug is set, the request
+// id always is.
+type Problems struct {
+	uni   *ut.UniversalTranslator
+	debug bool
+}
+
+// NewProblems registers the translations of the validation messages with v.
+func NewProblems(v *validator.Validate, debug bool) *Problems {
+	english := en.New()
+	uni := ut.New(english, english, es.New(), fr.New())
+	for locale, register := range map[string]func(*validator.Validate, ut.Translator) error{
+		"en": en_translations.RegisterDefaultTranslations,
+		"es": es_translations.RegisterDefaultTranslations,
+		"fr": fr_translations.RegisterDefaultTranslations,
+	} {
+		trans, _ := uni.GetTranslator(locale)
+		if err := register(v, trans); err != nil {
+			panic(err)
+		}
+		if err := v.RegisterTranslation("not-stale", trans, func(trans ut.Translator) error {
+			return trans.Add("not-stale", notStaleTranslations[locale], true)
+		}, func(trans ut.Translator, fe validator.FieldError) string {
+			msg, _ := trans.T("not-stale", fe.Field())
+			return msg
+		}); err != nil {
+			panic(err)
+		}
+		for code, title := range problemTitles[locale] {
+			if err := trans.Add(code, title, true); err != nil {
+				panic(err)
+			}
+		}
+	}
+	return &Problems{uni: uni, debug: debug}
+}
+
+// New describes err, as returned by a handler serving c.
+func (ps *Problems) New(err error, c echo.Context) *Problem {
+	p := ps.Describe(err, c.Request().Header.Get("Accept-Language"))
+	p.Instance = c.Request().URL.Path
+	p.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+	return p
+}
+
+// Describe describes err for a client accepting the languages of the
+// Accept-Language style acceptLanguage, without the request details.
+func (ps *Problems) Describe(err error, acceptLanguage string) *Problem {
+	he := new(echo.HTTPError)
+	if !errors.As(err, &he) {
+		he = &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  http.StatusText(http.StatusInternalServerError),
+			Internal: err,
+		}
+	}
+
+	// running out of time is no bug, the client may retry
+	if he.Code == http.StatusInternalServerError && errors.Is(he.Internal, context.DeadlineExceeded) {
+		he = &echo.HTTPError{
+			Code:     http.StatusServiceUnavailable,
+			Message:  "the request timed out",
+			Internal: he.Internal,
+		}
+	}
+
+	trans, _ := ps.uni.FindTranslator(acceptedLocales(acceptLanguage)...)
+
+	p := &Problem{
+		Status: he.Code,
+		Code:   problemCodes[he.Code],
+	}
+	if p.Code == "" {
+		p.Code = strings.ToLower(strings.ReplaceAll(http.StatusText(he.Code), " ", "_"))
+	}
+
+	var verrs validator.ValidationErrors
+	var violations Violations
+	if errors.As(he.Internal, &violations) {
+		p.Code = codeValidationFailed
+		p.Violations = violations
+	} else if errors.As(he.Internal, &verrs) {
+		p.Code = codeValidationFailed
+		for _, fe := range verrs {
+			p.Violations = append(p.Violations, Violation{
+				Field:   fieldPath(fe),
+				Rule:    fe.Tag(),
+				Param:   fe.Param(),
+				Message: fe.Translate(trans),
+			})
+		}
+	}
+
+	p.Type = "urn:todo-app:problem:" + p.Code
+	p.Title = http.StatusText(he.Code)
+	if title, err := trans.T(p.Code); err == nil {
+		p.Title = title
+	}
+	if msg, ok := he.Message.(string); ok && (he.Code < 500 || ps.debug) {
+		p.Detail = msg
+	}
+	if ps.debug && he.Internal != nil {
+		p.Internal = he.Internal.Error()
+	}
+	return p
+}
+
+// HandleError is an echo.HTTPErrorHandler rendering every error as
+// application/problem+json.
+func (ps *Problems) HandleError(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	p := ps.New(err, c)
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(p.Status)
+	} else {
+		c.Response().Header().Set(echo.HeaderContentType, MIMEApplicationProblemJSON)
+		err = c.JSON(p.Status, p)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
+
+// fieldPath is the namespace of the failing field without the name of the
+// top level struct, i.e. the path of the field in the request body.
+func fieldPath(fe validator.FieldError) string {
+	ns := fe.Namespace()
+	if i := strings.IndexByte(ns, '.'); i >= 0 {
+		return ns[i+1:]
+	}
+	return ns
+}
+
+// acceptedLocales lists the locales of an Accept-Language header in order
+// of preference, each followed by its base language.
+func acceptedLocales(header string) []string {
+	var locales []string
+	for _, part := range strings.Split(header, ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+		tag = strings.ReplaceAll(tag, "-", "_")
+		locales = append(locales, tag)
+		if base, _, ok := strings.Cut(tag, "_"); ok {
+			locales = append(locales, base)
+		}
+	}
+	return locales
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"log/slog"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+
+	"github.com/xenitane/todo-app-be-oe/internals/logging"
+)
+
+// maxRequestIDLen bounds the ids accepted from clients
+const maxRequestIDLen = 128
+
+// RequestID gives every request an id, the X-Request-ID it came with when
+// that is a sane one, and echoes it back. The request's context gets a
+// logger derived from base that carries the id.
+func RequestID(base *slog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id := c.Request().Header.Get(echo.HeaderXRequestID)
+			if !validRequestID(id) {
+				id = uuid.NewString()
+			}
+			c.Response().Header().Set(echo.HeaderXRequestID, id)
+			withLogger(c, base.With(slog.String("request_id", id)))
+			return next(c)
+		}
+	}
+}
+
+// validRequestID accepts printable ascii without spaces, which keeps what
+// clients send from breaking log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func withLogger(c echo.Context, l *slog.Logger) {
+	req := c.Request()
+	c.SetRequest(req.WithContext(logging.WithContext(req.Context(), l)))
+}
+
+// withUsername adds the user of verified claims to the request's logger.
+func withUsername(c echo.Context, claims *JWTCustomClaims) {
+	l := logging.FromContext(c.Request().Context())
+	withLogger(c, l.With(slog.String("username", claims.Username)))
+}
@@ -0,0 +1,160 @@
+package openapi
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+)
+
+const bearerAuth = "bearerAuth"
+
+// Doc describes what the route table cannot tell about a handler.
+type Doc struct {
+	Summary string
+	Tags    []string
+	// Auth marks routes behind the jwt middleware.
+	Auth bool
+	// Params is a struct whose param, query and header tags name the parameters,
+	// path parameters without one are documented as strings.
+	Params any
+	// Body is the json request body.
+	Body any
+	// Responses maps the success statuses to their json body, nil for none.
+	Responses map[int]any
+	// ContentType of the success responses, json unless set.
+	ContentType string
+}
+
+var pathParam = regexp.MustCompile(`:([^/]+)`)
+
+// Path converts an echo route path to an OpenAPI path template.
+func Path(echoPath string) string {
+	return pathParam.ReplaceAllString(echoPath, "{$1}")
+}
+
+// Build derives the document from the routes registered on e. Routes are
+// matched to their Doc by handler name, which is what echo names routes by,
+// so every registered route is listed even when it is not documented yet.
+func Build(info Info, routes []*echo.Route, docs map[string]Doc) *Document {
+	r := newReflector()
+	problem := &MediaType{Schema: r.schemaOf(reflect.TypeOf(xenmw.Problem{}))}
+
+	doc := &Document{
+		OpenAPI: Version,
+		Info:    info,
+		Paths:   make(map[string]*PathItem),
+		Components: Components{
+			SecuritySchemes: map[string]*SecurityScheme{
+				bearerAuth: {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+			},
+		},
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+
+	for _, route := range routes {
+		if !isHTTPMethod(route.Method) || strings.Contains(route.Path, "*") {
+			// echo registers internal not found routes for groups, and
+			// wildcard routes serve files rather than api operations
+			continue
+		}
+		d := docs[route.Name]
+		op := &Operation{
+			OperationID: operationID(route.Name),
+			Summary:     d.Summary,
+			Tags:        d.Tags,
+			Responses:   make(map[string]*Response),
+		}
+
+		documented := make(map[string]bool)
+		if d.Params != nil {
+			for _, p := range r.parameters(reflect.TypeOf(d.Params)) {
+				op.Parameters = append(op.Parameters, p)
+				documented[p.In+":"+p.Name] = true
+			}
+		}
+		for _, m := range pathParam.FindAllStringSubmatch(route.Path, -1) {
+			if !documented["path:"+m[1]] {
+				op.Parameters = append(op.Parameters, &Parameter{
+					Name:     m[1],
+					In:       "path",
+					Required: true,
+					Schema:   &Schema{Type: Types{"string"}},
+				})
+			}
+		}
+
+		if d.Body != nil {
+			op.RequestBody = &RequestBody{
+				Required: true,
+				Content: map[string]*MediaType{
+					echo.MIMEApplicationJSON: {Schema: r.schemaOf(reflect.TypeOf(d.Body))},
+				},
+			}
+		}
+
+		contentType := d.ContentType
+		if contentType == "" {
+			contentType = echo.MIMEApplicationJSON
+		}
+		for status, body := range d.Responses {
+			res := &Response{Description: http.StatusText(status)}
+			if body != nil {
+				res.Content = map[string]*MediaType{
+					contentType: {Schema: r.schemaOf(reflect.TypeOf(body))},
+				}
+			}
+			op.Responses[strconv.Itoa(status)] = res
+		}
+		if len(d.Responses) == 0 {
+			op.Responses["200"] = &Response{Description: http.StatusText(http.StatusOK)}
+		}
+		op.Responses["default"] = &Response{
+			Description: "Problem",
+			Content:     map[string]*MediaType{xenmw.MIMEApplicationProblemJSON: problem},
+		}
+
+		if d.Auth {
+			op.Security = []SecurityRequirement{{bearerAuth: {}}}
+		}
+
+		path := Path(route.Path)
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = &PathItem{}
+		}
+		(*doc.Paths[path])[strings.ToLower(route.Method)] = op
+	}
+
+	doc.Components.Schemas = r.schemas
+	return doc
+}
+
+func isHTTPMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// operationID turns a handler name like pkg.(*Server).HandleSignup-fm into
+// HandleSignup.
+func operationID(handlerName string) string {
+	name := strings.TrimSuffix(handlerName, "-fm")
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
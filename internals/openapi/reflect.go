@@ -0,0 +1,225 @@
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// reflector derives schemas from go types. Named structs become components
+// referenced by name, everything else is inlined.
+type reflector struct {
+	schemas map[string]*Schema
+}
+
+func newReflector() *reflector {
+	return &reflector{schemas: make(map[string]*Schema)}
+}
+
+func (r *reflector) schemaOf(t reflect.Type) *Schema {
+	if t.Kind() == reflect.Pointer {
+		// nil pointers marshal to null
+		s := r.schemaOf(t.Elem())
+		if s.Ref == "" && len(s.Type) > 0 && !s.Type.Has("null") {
+			s.Type = append(s.Type, "null")
+		}
+		return s
+	}
+	switch t {
+	case timeType:
+		return &Schema{Type: Types{"string"}, Format: "date-time"}
+	case rawMessageType:
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: Types{"boolean"}}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &Schema{Type: Types{"integer"}, Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: Types{"integer"}, Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: Types{"number"}, Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: Types{"number"}, Format: "double"}
+	case reflect.String:
+		return &Schema{Type: Types{"string"}}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: Types{"string"}, Format: "byte"}
+		}
+		return &Schema{Type: Types{"array"}, Items: r.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: Types{"object"}, AdditionalProperties: r.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return r.structSchema(t)
+		}
+		name := t.Name()
+		if _, ok := r.schemas[name]; !ok {
+			// reserve the name first so recursive types terminate
+			r.schemas[name] = &Schema{}
+			*r.schemas[name] = *r.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+	return &Schema{}
+}
+
+func (r *reflector) structSchema(t reflect.Type) *Schema {
+	s := &Schema{Type: Types{"object"}, Properties: make(map[string]*Schema)}
+	for _, f := range jsonFields(t) {
+		fs := r.schemaOf(f.Type)
+		if applyValidateTag(fs, f.Tag.Get("validate")) {
+			s.Required = append(s.Required, f.name)
+		}
+		s.Properties[f.name] = fs
+	}
+	return s
+}
+
+type field struct {
+	reflect.StructField
+	name string
+}
+
+// jsonFields lists the fields encoding/json would marshal, with the fields of
+// embedded structs promoted.
+func jsonFields(t reflect.Type) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, jsonFields(ft)...)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, field{StructField: f, name: name})
+	}
+	return fields
+}
+
+// applyValidateTag narrows the schema with the rules of a go-playground
+// validate tag and reports whether the field is required. Rules that have
+// no json schema counterpart are left to the handlers.
+func applyValidateTag(s *Schema, tag string) bool {
+	required := false
+	for _, rule := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(rule, "=")
+		if s.Ref != "" && name != "required" {
+			// constraints belong to the referenced component
+			continue
+		}
+		switch name {
+		case "dive":
+			// rules after dive apply to the elements
+			return required
+		case "required":
+			required = true
+		case "min", "max", "len":
+			n, err := strconv.Atoi(param)
+			if err != nil {
+				continue
+			}
+			switch s.Type[0] {
+			case "string":
+				if name != "max" {
+					s.MinLength = &n
+				}
+				if name != "min" {
+					s.MaxLength = &n
+				}
+			case "array":
+				if name != "max" {
+					s.MinItems = &n
+				}
+				if name != "min" {
+					s.MaxItems = &n
+				}
+			case "integer", "number":
+				f := float64(n)
+				if name != "max" {
+					s.Minimum = &f
+				}
+				if name != "min" {
+					s.Maximum = &f
+				}
+			}
+		case "oneof":
+			for _, v := range strings.Fields(param) {
+				if s.Type.Has("integer") {
+					if n, err := strconv.Atoi(v); err == nil {
+						s.Enum = append(s.Enum, n)
+					}
+					continue
+				}
+				s.Enum = append(s.Enum, v)
+			}
+		case "alpha":
+			s.Pattern = "^[a-zA-Z]+$"
+		case "alphanum":
+			s.Pattern = "^[a-zA-Z0-9]+$"
+		case "not-stale":
+			s.Description = "must not be in the past"
+		}
+	}
+	return required
+}
+
+// parameters describes the path, query and header parameters of a struct
+// the way echo binds them, from its param, query and header tags.
+func (r *reflector) parameters(t reflect.Type) []*Parameter {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var params []*Parameter
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			params = append(params, r.parameters(f.Type)...)
+			continue
+		}
+		for _, in := range []string{"path", "query", "header"} {
+			key := in
+			if in == "path" {
+				key = "param"
+			}
+			name := f.Tag.Get(key)
+			if name == "" {
+				continue
+			}
+			s := r.schemaOf(f.Type)
+			required := applyValidateTag(s, f.Tag.Get("validate"))
+			params = append(params, &Parameter{
+				Name:     name,
+				In:       in,
+				Required: required || in == "path",
+				Schema:   s,
+			})
+		}
+	}
+	return params
+}
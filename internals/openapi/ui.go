@@ -0,0 +1,35 @@
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	swaggerFiles "github.com/swaggo/files/v2"
+)
+
+// UIHandler serves the bundled Swagger UI pointed at the document at
+// specURL. Mount it with the mount path stripped from the request path.
+func UIHandler(specURL string) http.Handler {
+	files := http.FileServer(http.FS(swaggerFiles.FS))
+	initializer := fmt.Sprintf(`window.onload = function() {
+  window.ui = SwaggerUIBundle({
+    url: %q,
+    dom_id: "#swagger-ui",
+    deepLinking: true,
+    presets: [SwaggerUIBundle.presets.apis, SwaggerUIStandalonePreset],
+    plugins: [SwaggerUIBundle.plugins.DownloadUrl],
+    layout: "StandaloneLayout"
+  });
+};
+`, specURL)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Base(r.URL.Path) == "swagger-initializer.js" {
+			w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+			fmt.Fprint(w, initializer)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
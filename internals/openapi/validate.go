@@ -0,0 +1,327 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/logging"
+	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+)
+
+// Validator checks requests against the document and rejects those that do
+// not match it with a 400. Responses are checked too, mismatches are logged
+// as they point at a bug in the server or in the document. It is meant for
+// development, every request pays for a json round trip of its bodies.
+func Validator(doc *Document) echo.MiddlewareFunc {
+	v := &validator{doc: doc, patterns: make(map[string]*regexp.Regexp)}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			item := doc.Paths[Path(c.Path())]
+			if item == nil {
+				return next(c)
+			}
+			op := (*item)[strings.ToLower(c.Request().Method)]
+			if op == nil {
+				return next(c)
+			}
+
+			if violations := v.request(c, op); len(violations) > 0 {
+				return &echo.HTTPError{
+					Code:     http.StatusBadRequest,
+					Message:  "the request does not match the api specification",
+					Internal: violations,
+				}
+			}
+
+			rec := &recorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = rec
+			err := next(c)
+			if err != nil {
+				// render the error now so its status and problem are checked,
+				// the error handler leaves committed responses alone
+				c.Error(err)
+			}
+			if violations := v.response(op, c.Response().Status, c.Response().Header().Get(echo.HeaderContentType), rec.body.Bytes()); len(violations) > 0 {
+				ctx := c.Request().Context()
+				logging.FromContext(ctx).WarnContext(ctx, "the response does not match the api specification",
+					slog.String("method", c.Request().Method),
+					slog.String("route", c.Path()),
+					slog.Any("violations", violations),
+				)
+			}
+			return err
+		}
+	}
+}
+
+// recorder keeps a copy of the response body.
+type recorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	// streams are neither json nor finite
+	if strings.Contains(r.Header().Get(echo.HeaderContentType), "json") {
+		r.body.Write(b)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+type validator struct {
+	doc *Document
+
+	mu       sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+func (v *validator) request(c echo.Context, op *Operation) xenmw.Violations {
+	var violations xenmw.Violations
+	for _, p := range op.Parameters {
+		var raw string
+		var present bool
+		switch p.In {
+		case "path":
+			raw, present = c.Param(p.Name), true
+		case "query":
+			raw, present = c.QueryParam(p.Name), c.QueryParams().Has(p.Name)
+		case "header":
+			raw = c.Request().Header.Get(p.Name)
+			present = raw != ""
+		}
+		if !present {
+			if p.Required {
+				violations = append(violations, xenmw.Violation{Field: p.Name, Rule: "required", Message: p.Name + " is required"})
+			}
+			continue
+		}
+		violations = append(violations, v.value(p.Name, v.coerce(raw, p.Schema), p.Schema)...)
+	}
+
+	if op.RequestBody == nil {
+		return violations
+	}
+	media := op.RequestBody.Content[echo.MIMEApplicationJSON]
+	ct, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if media == nil || ct != echo.MIMEApplicationJSON {
+		return violations
+	}
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return append(violations, xenmw.Violation{Rule: "body", Message: err.Error()})
+	}
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+	val, err := decode(body)
+	if err != nil {
+		return append(violations, xenmw.Violation{Rule: "json", Message: err.Error()})
+	}
+	return append(violations, v.value("", val, media.Schema)...)
+}
+
+func (v *validator) response(op *Operation, status int, contentType string, body []byte) xenmw.Violations {
+	res := op.Responses[strconv.Itoa(status)]
+	if res == nil {
+		res = op.Responses["default"]
+		if status < 400 {
+			return xenmw.Violations{{Rule: "status", Param: strconv.Itoa(status), Message: "undocumented status"}}
+		}
+	}
+	ct, _, _ := mime.ParseMediaType(contentType)
+	media := res.Content[ct]
+	if media == nil || media.Schema == nil || !strings.HasSuffix(ct, "json") {
+		return nil
+	}
+	val, err := decode(body)
+	if err != nil {
+		return xenmw.Violations{{Rule: "json", Message: err.Error()}}
+	}
+	return v.value("", val, media.Schema)
+}
+
+func decode(body []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var val any
+	err := dec.Decode(&val)
+	return val, err
+}
+
+// coerce converts a path or query parameter to the type of its schema so it
+// can be validated like a json value. Values that do not convert are kept
+// as strings and fail the type check.
+func (v *validator) coerce(raw string, s *Schema) any {
+	switch v.resolve(s).Type.primary() {
+	case "integer", "number":
+		return json.Number(raw)
+	case "boolean":
+		if b, err := strconv.ParseBool(raw); err == nil {
+			return b
+		}
+	}
+	return raw
+}
+
+func (v *validator) resolve(s *Schema) *Schema {
+	for s.Ref != "" {
+		s = v.doc.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+func (v *validator) value(path string, val any, s *Schema) xenmw.Violations {
+	s = v.resolve(s)
+	fail := func(rule, param, format string, args ...any) xenmw.Violations {
+		return xenmw.Violations{{Field: path, Rule: rule, Param: param, Message: fmt.Sprintf(format, args...)}}
+	}
+
+	typ := s.Type.primary()
+	if val == nil {
+		if typ == "" || s.Type.Has("null") {
+			return nil
+		}
+		return fail("type", typ, "must be of type %s, not null", typ)
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(val) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("enum", fmt.Sprint(s.Enum), "must be one of %v", s.Enum)
+		}
+	}
+
+	switch typ {
+	case "object":
+		obj, ok := val.(map[string]any)
+		if !ok {
+			return fail("type", typ, "must be an object")
+		}
+		var violations xenmw.Violations
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				violations = append(violations, xenmw.Violation{Field: join(path, name), Rule: "required", Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fv := obj[name]
+			if ps, ok := s.Properties[name]; ok {
+				violations = append(violations, v.value(join(path, name), fv, ps)...)
+			} else if s.AdditionalProperties != nil {
+				violations = append(violations, v.value(join(path, name), fv, s.AdditionalProperties)...)
+			}
+		}
+		return violations
+
+	case "array":
+		arr, ok := val.([]any)
+		if !ok {
+			return fail("type", typ, "must be an array")
+		}
+		if s.MinItems != nil && len(arr) < *s.MinItems {
+			return fail("minItems", strconv.Itoa(*s.MinItems), "must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(arr) > *s.MaxItems {
+			return fail("maxItems", strconv.Itoa(*s.MaxItems), "must have at most %d items", *s.MaxItems)
+		}
+		var violations xenmw.Violations
+		if s.Items != nil {
+			for i, item := range arr {
+				violations = append(violations, v.value(fmt.Sprintf("%s[%d]", path, i), item, s.Items)...)
+			}
+		}
+		return violations
+
+	case "string":
+		str, ok := val.(string)
+		if !ok {
+			return fail("type", typ, "must be a string")
+		}
+		n := utf8.RuneCountInString(str)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fail("minLength", strconv.Itoa(*s.MinLength), "must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fail("maxLength", strconv.Itoa(*s.MaxLength), "must be at most %d characters long", *s.MaxLength)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fail("format", s.Format, "must be an RFC 3339 date-time")
+			}
+		}
+		if s.Pattern != "" && !v.pattern(s.Pattern).MatchString(str) {
+			return fail("pattern", s.Pattern, "must match %s", s.Pattern)
+		}
+
+	case "integer", "number":
+		num, ok := val.(json.Number)
+		if !ok {
+			return fail("type", typ, "must be a %s", typ)
+		}
+		f, err := num.Float64()
+		if err != nil {
+			return fail("type", typ, "must be a %s", typ)
+		}
+		if typ == "integer" {
+			if _, err := num.Int64(); err != nil {
+				return fail("type", typ, "must be an integer")
+			}
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return fail("minimum", fmt.Sprint(*s.Minimum), "must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fail("maximum", fmt.Sprint(*s.Maximum), "must be at most %v", *s.Maximum)
+		}
+
+	case "boolean":
+		if _, ok := val.(bool); !ok {
+			return fail("type", typ, "must be a boolean")
+		}
+	}
+	return nil
+}
+
+func (v *validator) pattern(p string) *regexp.Regexp {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	re, ok := v.patterns[p]
+	if !ok {
+		re = regexp.MustCompile(p)
+		v.patterns[p] = re
+	}
+	return re
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,57 @@
+package openapi
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/logging"
+)
+
+func TestValidatorChecksErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		required string
+		reported bool
+	}{
+		{"matching problem", "message", false},
+		{"mismatching problem", "code", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := &Document{Paths: map[string]*PathItem{
+				"/todo": {"get": {Responses: map[string]*Response{
+					"200": {Description: "OK"},
+					"404": {Description: "Not Found", Content: map[string]*MediaType{
+						echo.MIMEApplicationJSON: {Schema: &Schema{Type: Types{"object"}, Required: []string{tt.required}}},
+					}},
+				}}},
+			}}
+
+			var logs bytes.Buffer
+			e := echo.New()
+			e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+				return func(c echo.Context) error {
+					ctx := logging.WithContext(c.Request().Context(), slog.New(slog.NewTextHandler(&logs, nil)))
+					c.SetRequest(c.Request().WithContext(ctx))
+					return next(c)
+				}
+			}, Validator(doc))
+			e.GET("/todo", func(c echo.Context) error {
+				return echo.ErrNotFound
+			})
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/todo", nil))
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotFound)
+			}
+			if reported := strings.Contains(logs.String(), "does not match"); reported != tt.reported {
+				t.Errorf("mismatch reported = %v, want %v: %s", reported, tt.reported, logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902) over json documents.
+
+const (
+	MIMEMergePatch = "application/merge-patch+json"
+	MIMEJSONPatch  = "application/json-patch+json"
+)
+
+// ErrTestFailed is wrapped by the error of a json patch whose test
+// operation did not match.
+var ErrTestFailed = errors.New("test failed")
+
+// Error is an operation of a json patch that cannot be applied, Op is its
+// index in the patch.
+type Error struct {
+	Op   int
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("operation %d at %q: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Merge applies the merge patch to doc.
+func Merge(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decode(patch)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(merge(target, p))
+}
+
+func merge(target, patch any) any {
+	pm, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	tm, ok := target.(map[string]any)
+	if !ok {
+		tm = make(map[string]any)
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(tm, k)
+			continue
+		}
+		tm[k] = merge(tm[k], v)
+	}
+	return tm
+}
+
+type operation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Apply applies the json patch to doc. The operations run in order and the
+// patch fails as a whole at the first one that cannot be applied.
+func Apply(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	var ops []operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("a json patch must be an array of operations: %w", err)
+	}
+	for i, op := range ops {
+		if op.Path == nil {
+			return nil, &Error{Op: i, Err: errors.New("path is missing")}
+		}
+		target, err = apply(target, &op)
+		if err != nil {
+			return nil, &Error{Op: i, Path: *op.Path, Err: err}
+		}
+	}
+	return json.Marshal(target)
+}
+
+func apply(doc any, op *operation) (any, error) {
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value, from any
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, errors.New("value is missing")
+		}
+		if value, err = decode(op.Value); err != nil {
+			return nil, err
+		}
+	case "move", "copy":
+		if op.From == nil {
+			return nil, errors.New("from is missing")
+		}
+		fromPath, err := parsePointer(*op.From)
+		if err != nil {
+			return nil, err
+		}
+		if from, err = get(doc, fromPath); err != nil {
+			return nil, fmt.Errorf("from: %w", err)
+		}
+		if op.Op == "copy" {
+			return add(doc, path, clone(from))
+		}
+		if isPrefix(fromPath, path) {
+			if len(fromPath) == len(path) {
+				return doc, nil
+			}
+			return nil, errors.New("a value cannot be moved into itself")
+		}
+		if doc, err = remove(doc, fromPath); err != nil {
+			return nil, err
+		}
+		return add(doc, path, from)
+	case "remove":
+	default:
+		return nil, fmt.Errorf("unknown operation %q", op.Op)
+	}
+
+	switch op.Op {
+	case "add":
+		return add(doc, path, value)
+	case "replace":
+		if _, err := get(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		return update(doc, path, func(parent any, key string) (any, error) {
+			switch p := parent.(type) {
+			case map[string]any:
+				p[key] = value
+			case []any:
+				i, _ := index(key, len(p))
+				p[i] = value
+			}
+			return parent, nil
+		})
+	case "test":
+		current, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(current, value) {
+			return nil, ErrTestFailed
+		}
+		return doc, nil
+	default:
+		return remove(doc, path)
+	}
+}
+
+func add(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(doc, path, func(parent any, key string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			p[key] = value
+			return p, nil
+		case []any:
+			i := len(p)
+			if key != "-" {
+				var err error
+				if i, err = index(key, len(p)+1); err != nil {
+					return nil, err
+				}
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = value
+			return p, nil
+		}
+		return nil, errors.New("the parent is not an object or an array")
+	})
+}
+
+func remove(doc any, path []string) (any, error) {
+	if len(path) == 0 {
+		return nil, errors.New("the whole document cannot be removed")
+	}
+	return update(doc, path, func(parent any, key string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			if _, ok := p[key]; !ok {
+				return nil, errors.New("the path does not exist")
+			}
+			delete(p, key)
+			return p, nil
+		case []any:
+			i, err := index(key, len(p))
+			if err != nil {
+				return nil, err
+			}
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return nil, errors.New("the parent is not an object or an array")
+	})
+}
+
+// update replaces the parent of the last token of path with what f makes of
+// it and returns the updated document. Arrays are values, so the parents are
+// stored back on the way up.
+func update(doc any, path []string, f func(parent any, key string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return f(doc, path[0])
+	}
+	child, err := get(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = update(child, path[1:], f)
+	if err != nil {
+		return nil, err
+	}
+	switch d := doc.(type) {
+	case map[string]any:
+		d[path[0]] = child
+	case []any:
+		i, _ := index(path[0], len(d))
+		d[i] = child
+	}
+	return doc, nil
+}
+
+func get(doc any, path []string) (any, error) {
+	for _, key := range path {
+		switch d := doc.(type) {
+		case map[string]any:
+			v, ok := d[key]
+			if !ok {
+				return nil, errors.New("the path does not exist")
+			}
+			doc = v
+		case []any:
+			i, err := index(key, len(d))
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, errors.New("the path does not exist")
+		}
+	}
+	return doc, nil
+}
+
+// index parses an array index below n.
+func index(key string, n int) (int, error) {
+	i, err := strconv.Atoi(key)
+	if err != nil || i < 0 || (len(key) > 1 && key[0] == '0') || key[0] == '+' {
+		return 0, fmt.Errorf("%q is not an array index", key)
+	}
+	if i >= n {
+		return 0, fmt.Errorf("index %d is out of bounds", i)
+	}
+	return i, nil
+}
+
+// parsePointer splits an RFC 6901 json pointer into its unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("%q is not a json pointer", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func decode(b []byte) (any, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("invalid character after top-level value")
+	}
+	return v, nil
+}
+
+func clone(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = clone(e)
+		}
+		return m
+	case []any:
+		s := make([]any, len(v))
+		for i, e := range v {
+			s[i] = clone(e)
+		}
+		return s
+	}
+	return v
+}
+
+// equal compares json values, numbers by value.
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			w, ok := b[k]
+			if !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		return errA == nil && errB == nil && x == y
+	}
+	return a == b
+}
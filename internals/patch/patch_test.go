@@ -0,0 +1,107 @@
+package patch
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		{"add a member", `{"a":1}`, `[{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`},
+		{"add replaces a member", `{"a":1}`, `[{"op":"add","path":"/a","value":[1]}]`, `{"a":[1]}`},
+		{"add into an array", `{"a":[1,3]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2,3]}`},
+		{"add to the end of an array", `{"a":[1]}`, `[{"op":"add","path":"/a/-","value":2}]`, `{"a":[1,2]}`},
+		{"add the whole document", `{"a":1}`, `[{"op":"add","path":"","value":[]}]`, `[]`},
+		{"remove a member", `{"a":1,"b":2}`, `[{"op":"remove","path":"/a"}]`, `{"b":2}`},
+		{"remove an array item", `{"a":[1,2,3]}`, `[{"op":"remove","path":"/a/1"}]`, `{"a":[1,3]}`},
+		{"replace a member", `{"a":1}`, `[{"op":"replace","path":"/a","value":"x"}]`, `{"a":"x"}`},
+		{"replace an array item", `[1,2]`, `[{"op":"replace","path":"/0","value":null}]`, `[null,2]`},
+		{"move a member", `{"a":{"b":1},"c":{}}`, `[{"op":"move","from":"/a/b","path":"/c/d"}]`, `{"a":{},"c":{"d":1}}`},
+		{"move within an array", `[1,2,3]`, `[{"op":"move","from":"/0","path":"/-"}]`, `[2,3,1]`},
+		{"move to itself", `{"a":1}`, `[{"op":"move","from":"/a","path":"/a"}]`, `{"a":1}`},
+		{"copy a member", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`},
+		{"test then replace", `{"a":[1,{"b":2.0}]}`, `[{"op":"test","path":"/a","value":[1,{"b":2}]},{"op":"replace","path":"/a","value":0}]`, `{"a":0}`},
+		{"escaped slash", `{"a/b":1}`, `[{"op":"replace","path":"/a~1b","value":2}]`, `{"a/b":2}`},
+		{"escaped tilde", `{"a~b":1}`, `[{"op":"remove","path":"/a~0b"}]`, `{}`},
+		{"escapes in order", `{"~1":1}`, `[{"op":"test","path":"/~01","value":1}]`, `{"~1":1}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Apply([]byte(tt.doc), []byte(tt.patch))
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Apply = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		patch  string
+		op     int
+		failed bool
+	}{
+		{"failing test aborts the patch", `[{"op":"add","path":"/b","value":2},{"op":"test","path":"/a","value":2},{"op":"remove","path":"/a"}]`, 1, true},
+		{"test of a missing member", `[{"op":"test","path":"/b","value":null}]`, 0, false},
+		{"remove of a missing member", `[{"op":"remove","path":"/b"}]`, 0, false},
+		{"replace of a missing member", `[{"op":"replace","path":"/b","value":1}]`, 0, false},
+		{"array index out of bounds", `[{"op":"add","path":"/c/3","value":1}]`, 0, false},
+		{"array index with a leading zero", `[{"op":"replace","path":"/c/01","value":1}]`, 0, false},
+		{"end of an array outside add", `[{"op":"remove","path":"/c/-"}]`, 0, false},
+		{"move into a child of itself", `[{"op":"move","from":"/c","path":"/c/0"}]`, 0, false},
+		{"missing path", `[{"op":"add","value":1}]`, 0, false},
+		{"missing value", `[{"op":"add","path":"/b"}]`, 0, false},
+		{"unknown op", `[{"op":"append","path":"/b","value":1}]`, 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Apply([]byte(`{"a":1,"c":[1,2]}`), []byte(tt.patch))
+			var pe *Error
+			if !errors.As(err, &pe) {
+				t.Fatalf("Apply = %s, %v, want an operation error", got, err)
+			}
+			if pe.Op != tt.op || errors.Is(err, ErrTestFailed) != tt.failed {
+				t.Errorf("Apply failed with %v, want operation %d to fail (test failed %v)", err, tt.op, tt.failed)
+			}
+			if got != nil {
+				t.Errorf("Apply returned %s along with its error", got)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		{"replace a member", `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{"add a member", `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{"null deletes a member", `{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{"null of a missing member", `{"a":"b"}`, `{"c":null}`, `{"a":"b"}`},
+		{"null deletes a nested member", `{"a":{"b":1,"c":2}}`, `{"a":{"b":null}}`, `{"a":{"c":2}}`},
+		{"arrays are replaced", `{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{"nulls in new objects are dropped", `{}`, `{"a":{"b":null,"c":1}}`, `{"a":{"c":1}}`},
+		{"a non object patch replaces the document", `{"a":1}`, `["x"]`, `["x"]`},
+		{"an object patch replaces a non object", `[1]`, `{"a":1}`, `{"a":1}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Merge([]byte(tt.doc), []byte(tt.patch))
+			if err != nil {
+				t.Fatalf("Merge: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Merge = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
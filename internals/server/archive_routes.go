@@ -0,0 +1,217 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/xenitane/todo-app-be-oe/internals/archive"
+	"github.com/xenitane/todo-app-be-oe/internals/database"
+	"github.com/xenitane/todo-app-be-oe/internals/events"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+// importBodyLimit bounds the archives imported, it fits the 10000 todos an
+// archive may hold.
+const importBodyLimit = "16M"
+
+func (s *Server) RegisterArchiveRoutes(g *echo.Group) {
+	g.GET("/export/", s.HandleExport)
+	g.GET("/export/todos.csv", s.HandleExportCSV)
+	g.POST("/import/", s.HandleImport, middleware.BodyLimit(importBodyLimit))
+}
+
+// HandleExport downloads everything the user owns as an archive, which
+// HandleImport reads back.
+func (s *Server) HandleExport(c echo.Context) error {
+	u, err := s.pathOwner(c, false)
+	if err != nil {
+		return err
+	}
+	todos, err := s.exportTodos(c.Request().Context(), u)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.json"`, u.Username))
+	return c.JSON(http.StatusOK, archive.New(u, todos, s.now()))
+}
+
+// HandleExportCSV downloads the todos of the user as csv, for spreadsheets.
+func (s *Server) HandleExportCSV(c echo.Context) error {
+	u, err := s.pathOwner(c, false)
+	if err != nil {
+		return err
+	}
+	todos, err := s.exportTodos(c.Request().Context(), u)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s-todos.csv"`, u.Username))
+	c.Response().WriteHeader(http.StatusOK)
+	return archive.WriteCSV(c.Response(), todos)
+}
+
+// exportTodos returns every todo of the user, trashed ones included, ordered
+// by id. Both are read in one transaction, so a todo moving to the trash
+// meanwhile is exported once.
+func (s *Server) exportTodos(ctx context.Context, u *user.User) ([]*todo.Todo, error) {
+	var todos []*todo.Todo
+	err := s.db.WithTx(ctx, func(tx database.Store) error {
+		var err error
+		todos, err = userTodos(ctx, tx, u.UserId)
+		return err
+	})
+	if err != nil {
+		return nil, &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "internal server error",
+			Internal: err,
+		}
+	}
+	return todos, nil
+}
+
+// userTodos returns the todos and the trashed todos of the user, ordered by
+// id.
+func userTodos(ctx context.Context, st database.Store, uid int64) ([]*todo.Todo, error) {
+	todos, err := st.GetAllTodosForUser(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	trashed, err := st.GetTrashedTodosForUser(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	todos = append(todos, trashed...)
+	slices.SortFunc(todos, func(a, b *todo.Todo) int {
+		return cmp.Compare(a.TodoId, b.TodoId)
+	})
+	return todos, nil
+}
+
+// HandleImport adds the todos of an archive to those of the user, with new
+// ids. Todos imported before from the same source are skipped, so importing
+// an archive twice adds its todos once. A dry run checks the archive and
+// tells what importing it would do, without storing anything.
+func (s *Server) HandleImport(c echo.Context) error {
+	u, err := s.pathOwner(c, true)
+	if err != nil {
+		return err
+	}
+	params := new(importParams)
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, params); err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Message:  "invalid import parameters",
+			Internal: err,
+		}
+	}
+	a := new(archive.Archive)
+	if err := c.Bind(a); err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusUnprocessableEntity,
+			Message:  "error binding request body",
+			Internal: err,
+		}
+	}
+	if a.Version != archive.Version {
+		return &echo.HTTPError{
+			Code:    http.StatusUnprocessableEntity,
+			Message: fmt.Sprintf("archives of version %d cannot be imported, only those of version %d", a.Version, archive.Version),
+		}
+	}
+	for i := range a.Todos {
+		a.Todos[i].Title = strings.TrimSpace(a.Todos[i].Title)
+		a.Todos[i].Description = strings.TrimSpace(a.Todos[i].Description)
+	}
+	if err := s.v.Struct(a); err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusUnprocessableEntity,
+			Message:  "invalid request body",
+			Internal: err,
+		}
+	}
+
+	ctx := c.Request().Context()
+	res, created, err := s.importArchive(ctx, u, a, params.DryRun)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "internal server error",
+			Internal: err,
+		}
+	}
+	for _, t := range created {
+		s.metrics.TodosCreated.Inc()
+		s.publishTodoEvent(ctx, events.TodoCreated, u.Username, t)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// importArchive stores the todos of the archive the user has not imported
+// yet, in one transaction, and returns the todos it created out of the
+// trash. The todos keep the times they were archived with. Archives exported
+// from the account itself skip the todos it still has.
+func (s *Server) importArchive(ctx context.Context, u *user.User, a *archive.Archive, dryRun bool) (*archive.ImportResult, []*todo.Todo, error) {
+	var res *archive.ImportResult
+	var created []*todo.Todo
+	err := s.db.WithTx(ctx, func(tx database.Store) error {
+		res = &archive.ImportResult{DryRun: dryRun, Todos: make([]archive.ImportedTodo, len(a.Todos))}
+		created = nil
+
+		imported, err := tx.GetTodoImports(ctx, u.UserId, a.Source)
+		if err != nil {
+			return err
+		}
+		if a.Source == archive.Source(u) {
+			own, err := userTodos(ctx, tx, u.UserId)
+			if err != nil {
+				return err
+			}
+			for _, t := range own {
+				imported[t.TodoId] = t.TodoId
+			}
+		}
+
+		var imports []todo.TodoImport
+		now := s.now()
+		for i := range a.Todos {
+			at := &a.Todos[i]
+			if tid, ok := imported[at.ID]; ok {
+				res.Skipped++
+				res.Todos[i] = archive.ImportedTodo{ID: at.ID, TodoID: tid, Skipped: true}
+				continue
+			}
+			res.Imported++
+			res.Todos[i] = archive.ImportedTodo{ID: at.ID}
+			if !dryRun {
+				imports = append(imports, todo.TodoImport{SourceID: at.ID, Todo: at.Todo(u.UserId, now)})
+			}
+		}
+		if err := tx.ImportTodos(ctx, u.UserId, a.Source, imports); err != nil {
+			return err
+		}
+
+		byID := make(map[int64]int64, len(imports))
+		for _, imp := range imports {
+			byID[imp.SourceID] = imp.Todo.TodoId
+			if imp.Todo.DeletedAt == nil {
+				created = append(created, imp.Todo)
+			}
+		}
+		for i := range res.Todos {
+			if !res.Todos[i].Skipped {
+				res.Todos[i].TodoID = byID[res.Todos[i].ID]
+			}
+		}
+		return nil
+	})
+	return res, created, err
+}
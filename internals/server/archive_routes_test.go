@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/archive"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+func exportURL(username string) string {
+	return "/api/user/" + username + "/export/"
+}
+
+func importURL(username string) string {
+	return "/api/user/" + username + "/import/"
+}
+
+func TestExport(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("exporter")
+	other := ts.signup("exportsnoop")
+	admin := ts.admin("theadmin")
+	kept := ts.addTodo(token, "exporter", "Kept todo")
+	trashed := ts.addTodo(token, "exporter", "Trashed todo")
+	ts.expect(http.StatusOK, request{method: http.MethodDelete, path: todoURL("exporter", trashed), token: token})
+
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: exportURL("exporter"), token: token})
+	a := decode[archive.Archive](t, rec)
+	if a.Version != archive.Version || a.Source == "" || a.Profile.Username != "exporter" {
+		t.Errorf("exported %+v", a)
+	}
+	if len(a.Todos) != 2 || a.Todos[0].ID != kept || a.Todos[0].DeletedAt != nil || a.Todos[1].ID != trashed || a.Todos[1].DeletedAt == nil {
+		t.Errorf("exported the todos %+v, want the kept one then the trashed one", a.Todos)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); !strings.Contains(cd, "attachment") {
+		t.Errorf("Content-Disposition = %q, want an attachment", cd)
+	}
+
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: exportURL("exporter") + "todos.csv", token: token})
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("Content-Type = %q, want csv", ct)
+	}
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("reading the csv: %v", err)
+	}
+	if len(rows) != 3 || rows[0][0] != "id" || rows[1][1] != "Kept todo" || rows[1][7] != "" || rows[2][7] == "" {
+		t.Errorf("exported the csv %q", rows)
+	}
+
+	// texts starting like formulas are not run by spreadsheets
+	ts.addTodo(token, "exporter", "=HYPERLINK(1)")
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: exportURL("exporter") + "todos.csv", token: token})
+	rows, err = csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("reading the csv: %v", err)
+	}
+	if got := rows[len(rows)-1][1]; got != "'=HYPERLINK(1)" {
+		t.Errorf("exported the title %q, want it quoted", got)
+	}
+
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: exportURL("exporter"), token: other})
+	ts.expect(http.StatusOK, request{method: http.MethodGet, path: exportURL("exporter"), token: admin})
+}
+
+func TestImport(t *testing.T) {
+	ts := newTestServer(t)
+	from := ts.signup("importfrom")
+	into := ts.signup("importinto")
+	ts.addTodo(from, "importfrom", "Moved todo")
+	trashed := ts.addTodo(from, "importfrom", "Moved to the trash")
+	ts.expect(http.StatusOK, request{method: http.MethodDelete, path: todoURL("importfrom", trashed), token: from})
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: exportURL("importfrom"), token: from})
+	a := decode[archive.Archive](t, rec)
+
+	rec = ts.expect(http.StatusOK, request{method: http.MethodPost, path: importURL("importinto") + "?dryRun=true", token: into, body: a})
+	if res := decode[archive.ImportResult](t, rec); !res.DryRun || res.Imported != 2 || res.Skipped != 0 || res.Todos[0].TodoID != 0 {
+		t.Errorf("the dry run answered %+v", res)
+	}
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: todosURL("importinto"), token: into})
+	if todos := decode[[]todo.Todo](t, rec); len(todos) != 0 {
+		t.Fatalf("the dry run stored %+v", todos)
+	}
+
+	// the imported todos keep their times, not those of the import
+	ts.clock.Set(ts.clock.Now().Add(time.Hour))
+	rec = ts.expect(http.StatusOK, request{method: http.MethodPost, path: importURL("importinto"), token: into, body: a})
+	res := decode[archive.ImportResult](t, rec)
+	if res.DryRun || res.Imported != 2 || res.Skipped != 0 {
+		t.Errorf("the import answered %+v", res)
+	}
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: todosURL("importinto"), token: into})
+	todos := decode[[]todo.Todo](t, rec)
+	if len(todos) != 1 || todos[0].Title != "Moved todo" || todos[0].TodoId != res.Todos[0].TodoID ||
+		!todos[0].CreatedAt.Equal(a.Todos[0].CreatedAt) || !todos[0].UpdatedAt.Equal(a.Todos[0].UpdatedAt) {
+		t.Errorf("imported the todos %+v, mapped as %+v", todos, res.Todos)
+	}
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: trashURL("importinto"), token: into})
+	if trash := decode[[]todo.Todo](t, rec); len(trash) != 1 || trash[0].TodoId != res.Todos[1].TodoID ||
+		trash[0].DeletedAt == nil || !trash[0].DeletedAt.Equal(*a.Todos[1].DeletedAt) {
+		t.Errorf("imported the trash %+v, mapped as %+v", trash, res.Todos)
+	}
+
+	// importing again maps the todos to those imported before
+	rec = ts.expect(http.StatusOK, request{method: http.MethodPost, path: importURL("importinto"), token: into, body: a})
+	again := decode[archive.ImportResult](t, rec)
+	if again.Imported != 0 || again.Skipped != 2 || again.Todos[0].TodoID != res.Todos[0].TodoID || !again.Todos[0].Skipped {
+		t.Errorf("importing again answered %+v", again)
+	}
+
+	// the account the archive comes from has its todos already
+	rec = ts.expect(http.StatusOK, request{method: http.MethodPost, path: importURL("importfrom"), token: from, body: a})
+	if own := decode[archive.ImportResult](t, rec); own.Imported != 0 || own.Skipped != 2 {
+		t.Errorf("importing into the exported account answered %+v", own)
+	}
+
+	// only the owner may import
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodPost, path: importURL("importinto"), token: from, body: a})
+}
+
+func TestImportTooLarge(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("bigimport")
+	body := `{"version": 1, "source": "big", "todos": [` + strings.Repeat(" ", 16<<20) + `]}`
+	rec := ts.expect(http.StatusRequestEntityTooLarge, request{method: http.MethodPost, path: importURL("bigimport"), token: token, body: body})
+	if code := problemCode(t, rec); code != "payload_too_large" {
+		t.Errorf("problem code = %q, want payload_too_large", code)
+	}
+}
+
+func TestImportInvalidArchive(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("badimport")
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: exportURL("badimport"), token: token})
+	a := decode[archive.Archive](t, rec)
+
+	a.Version = archive.Version + 1
+	ts.expect(http.StatusUnprocessableEntity, request{method: http.MethodPost, path: importURL("badimport"), token: token, body: a})
+
+	a.Version = archive.Version
+	a.Todos = []archive.Todo{{ID: 1, Title: "Same id", DueDate: ts.clock.Now()}, {ID: 1, Title: "Same id", DueDate: ts.clock.Now()}}
+	rec = ts.expect(http.StatusUnprocessableEntity, request{method: http.MethodPost, path: importURL("badimport"), token: token, body: a})
+	if code := problemCode(t, rec); code != "validation_failed" {
+		t.Errorf("problem code = %q, want validation_failed", code)
+	}
+}
@@ -1,19 +1,22 @@
 package server
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/database"
 	"github.com/xenitane/todo-app-be-oe/internals/middleware"
 	"github.com/xenitane/todo-app-be-oe/internals/user"
 )
 
 func (s *Server) RegisterAuthRoutes(g *echo.Group) {
-	g.POST("/signup/", s.HandleSignup)
+	g.POST("/signup/", s.HandleSignup, s.idempotent)
 	g.POST("/signin/", s.handleSignin)
 }
 
@@ -27,35 +30,48 @@ func (s *Server) HandleSignup(c echo.Context) error {
 		}
 	}
 
-	userReq.FirstName = strings.TrimSpace(userReq.FirstName)
-	userReq.LastName = strings.TrimSpace(userReq.LastName)
-	userReq.Username = strings.TrimSpace(userReq.Username)
+	u, err := s.signup(c.Request().Context(), userReq)
+	if err != nil {
+		return err
+	}
+	c.JSON(http.StatusCreated, u)
+	return nil
+}
 
+// signup validates the request and creates the account it describes.
+func (s *Server) signup(ctx context.Context, userReq *user.UserSignUpReq) (*user.User, error) {
+	userReq.Trim()
 	if err := s.v.Struct(userReq); err != nil {
-		return &echo.HTTPError{
+		return nil, &echo.HTTPError{
 			Code:     http.StatusUnprocessableEntity,
 			Message:  "invalid request body",
 			Internal: err,
 		}
 	}
-	u, err := user.NewFromReg(userReq)
+	u, err := user.NewFromReg(ctx, userReq)
 	if err != nil {
-		return &echo.HTTPError{
+		return nil, &echo.HTTPError{
 			Code:     http.StatusUnprocessableEntity,
 			Message:  "there is an issue with your password",
 			Internal: err,
 		}
 	}
-	if err := s.db.InsertUser(u); err != nil {
-		return &echo.HTTPError{
+	if err := s.db.InsertUser(ctx, u); err != nil {
+		if errors.Is(err, database.ErrUsernameTaken) {
+			return nil, &echo.HTTPError{
+				Code:     http.StatusConflict,
+				Message:  "this username is already taken",
+				Internal: err,
+			}
+		}
+		return nil, &echo.HTTPError{
 			Code:     http.StatusInternalServerError,
-			Message:  "this username is already taken",
+			Message:  "error creating the user",
 			Internal: err,
 		}
 	}
-	u.CreatedAt = time.Now()
-	c.JSON(http.StatusCreated, u)
-	return nil
+	s.metrics.Signups.Inc()
+	return u, nil
 }
 
 func (s *Server) handleSignin(c echo.Context) error {
@@ -67,46 +83,93 @@ func (s *Server) handleSignin(c echo.Context) error {
 			Internal: err,
 		}
 	}
+	resp, err := s.signin(c.Request().Context(), userReq)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Add("x-token-auth", resp.Token)
+	c.JSON(http.StatusCreated, resp)
+	return nil
+}
+
+// signin checks the credentials and issues a jwt for them.
+func (s *Server) signin(ctx context.Context, userReq *user.UserSignInReq) (*user.UserSignInResp, error) {
 	userReq.Username = strings.TrimSpace(userReq.Username)
 	if err := s.v.Struct(userReq); nil != err {
-		return &echo.HTTPError{
+		return nil, &echo.HTTPError{
 			Code:     http.StatusUnprocessableEntity,
 			Message:  "invalid request body",
 			Internal: err,
 		}
 	}
-	user, err := s.db.GetUserByUserName(userReq.Username)
-	if err != nil {
-		return err
+	u, err := s.db.GetUserByUserName(ctx, userReq.Username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "internal server error",
+			Internal: err,
+		}
 	}
-	if !user.MatchPassword(userReq.Password) {
-		return &echo.HTTPError{
+	if err != nil || !u.MatchPassword(ctx, userReq.Password) {
+		s.metrics.FailedSignins.Inc()
+		return nil, &echo.HTTPError{
 			Code:    http.StatusUnauthorized,
 			Message: "incorrect credentials",
 		}
 	}
+	if u.Disabled {
+		s.metrics.FailedSignins.Inc()
+		return nil, &echo.HTTPError{
+			Code:    http.StatusForbidden,
+			Message: "this account is disabled",
+		}
+	}
 
 	claims := &middleware.JWTCustomClaims{
-		Username: user.Username,
-		IsAdmin:  user.IsAdmin,
+		Username:     u.Username,
+		IsAdmin:      u.IsAdmin,
+		TokenVersion: u.TokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 720)),
+			ExpiresAt: jwt.NewNumericDate(s.now().Add(time.Hour * 720)),
 		},
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	t, err := token.SignedString([]byte(os.Getenv("JWT_SIGNING_KEY")))
+	t, err := token.SignedString(s.signingKey)
 	if err != nil {
-		return &echo.HTTPError{
+		return nil, &echo.HTTPError{
 			Internal: err,
 			Code:     http.StatusInternalServerError,
 			Message:  "An error occoured",
 		}
 	}
 
-	c.Response().Header().Add("x-token-auth", t)
-	c.JSON(http.StatusCreated, map[string]any{
-		"user":  user,
-		"token": t,
-	})
+	s.metrics.Signins.Inc()
+	return &user.UserSignInResp{
+		User:  u,
+		Token: t,
+	}, nil
+}
+
+// checkToken refuses the tokens of users that are gone or disabled and those
+// issued before the tokens of their user were revoked. The admin rights of
+// the claims are those the user has now, not those it had when the token
+// was issued.
+func (s *Server) checkToken(ctx context.Context, claims *middleware.JWTCustomClaims) error {
+	u, err := s.db.GetUserByUserName(ctx, claims.Username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "internal server error",
+			Internal: err,
+		}
+	}
+	if err != nil || u.Disabled || u.TokenVersion != claims.TokenVersion {
+		return &echo.HTTPError{
+			Code:     http.StatusUnauthorized,
+			Message:  "the jwt has been revoked",
+			Internal: err,
+		}
+	}
+	claims.IsAdmin = u.IsAdmin
 	return nil
 }
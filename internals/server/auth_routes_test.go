@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+func TestSignup(t *testing.T) {
+	ts := newTestServer(t)
+	body := map[string]string{
+		"username":  "newuser",
+		"password":  testPassword,
+		"firstName": "Jhon",
+		"lastName":  "Meyr",
+	}
+	rec := ts.expect(http.StatusCreated, request{method: http.MethodPost, path: "/api/auth/signup/", body: body})
+	u := decode[user.User](t, rec)
+	if u.Username != "newuser" || u.FirstName != "Jhon" || u.IsAdmin || u.Version != 1 {
+		t.Errorf("signed up %+v", u)
+	}
+	if !u.CreatedAt.Equal(ts.clock.Now().UTC().Truncate(time.Microsecond)) {
+		t.Errorf("created at %v, want the time of the clock %v", u.CreatedAt, ts.clock.Now())
+	}
+
+	rec = ts.expect(http.StatusConflict, request{method: http.MethodPost, path: "/api/auth/signup/", body: body})
+	if code := problemCode(t, rec); code != "conflict" {
+		t.Errorf("problem code = %q, want conflict", code)
+	}
+
+	// rejected by the api specification before the handler runs
+	body["username"] = "bad"
+	rec = ts.expect(http.StatusBadRequest, request{method: http.MethodPost, path: "/api/auth/signup/", body: body})
+	if code := problemCode(t, rec); code != "validation_failed" {
+		t.Errorf("problem code = %q, want validation_failed", code)
+	}
+}
+
+func TestSignupIsIdempotent(t *testing.T) {
+	ts := newTestServer(t)
+	r := request{
+		method:  http.MethodPost,
+		path:    "/api/auth/signup/",
+		headers: map[string]string{"Idempotency-Key": "signup-1"},
+		body: map[string]string{
+			"username":  "retried",
+			"password":  testPassword,
+			"firstName": "Test",
+			"lastName":  "User",
+		},
+	}
+	first := ts.expect(http.StatusCreated, r)
+	replay := ts.expect(http.StatusCreated, r)
+	if replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("the retry was not replayed")
+	}
+	if replay.Body.String() != first.Body.String() {
+		t.Errorf("replayed %s, want %s", replay.Body, first.Body)
+	}
+
+	r.body = map[string]string{
+		"username":  "different",
+		"password":  testPassword,
+		"firstName": "Test",
+		"lastName":  "User",
+	}
+	ts.expect(http.StatusUnprocessableEntity, r)
+}
+
+func TestSignin(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("signedin")
+
+	claims, err := xenmw.ParseToken(token, ts.signingKey)
+	if err != nil {
+		t.Fatalf("the token does not verify: %v", err)
+	}
+	if claims.Username != "signedin" || claims.IsAdmin {
+		t.Errorf("claims = %+v", claims)
+	}
+	if want := ts.clock.Now().Add(720 * time.Hour); !claims.ExpiresAt.Time.Equal(want.Truncate(time.Second)) {
+		t.Errorf("the token expires at %v, want %v", claims.ExpiresAt.Time, want)
+	}
+
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodPost, path: "/api/auth/signin/", body: map[string]string{
+		"username": "signedin",
+		"password": "wrong password",
+	}})
+	// unknown users look like a wrong password
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodPost, path: "/api/auth/signin/", body: map[string]string{
+		"username": "nobody",
+		"password": testPassword,
+	}})
+}
+
+func TestExpiredToken(t *testing.T) {
+	ts := newTestServer(t)
+	ts.clock.Set(time.Now().Add(-721 * time.Hour))
+	token := ts.signup("expired")
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/api/user/expired/", token: token})
+}
+
+func TestRevokedToken(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("revoked")
+	ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/api/user/revoked/", token: token})
+
+	u, err := ts.db.GetUserByUserName(context.Background(), "revoked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.TokenVersion++
+	if err := ts.db.UpadteUser(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	rec := ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/api/user/revoked/", token: token})
+	if code := problemCode(t, rec); code != "unauthorized" {
+		t.Errorf("problem code = %q, want unauthorized", code)
+	}
+
+	// signing in again issues a token of the new version
+	token = ts.signin("revoked")
+	ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/api/user/revoked/", token: token})
+}
+
+func TestDemotedAdmin(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("theadmin")
+	demoted := ts.admin("demoted")
+	ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/api/user/", token: demoted})
+
+	// the admin rights are those of the database, whatever the token says
+	u, err := ts.db.GetUserByUserName(context.Background(), "demoted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.IsAdmin = false
+	if err := ts.db.UpadteUser(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/api/user/", token: demoted})
+
+	// demoting through the api revokes the tokens
+	promoted := ts.signup("promoted")
+	ts.expect(http.StatusOK, request{method: http.MethodPatch, path: "/api/user/promoted/", token: admin, body: map[string]any{
+		"isAdmin": true,
+	}})
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/api/user/promoted/", token: promoted})
+	ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/api/user/", token: ts.signin("promoted")})
+}
+
+func TestDisabledUser(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("disabled")
+
+	u, err := ts.db.GetUserByUserName(context.Background(), "disabled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Disabled = true
+	if err := ts.db.UpadteUser(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/api/user/disabled/", token: token})
+	rec := ts.expect(http.StatusForbidden, request{method: http.MethodPost, path: "/api/auth/signin/", body: map[string]string{
+		"username": "disabled",
+		"password": testPassword,
+	}})
+	if code := problemCode(t, rec); code != "forbidden" {
+		t.Errorf("problem code = %q, want forbidden", code)
+	}
+}
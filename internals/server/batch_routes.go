@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/database"
+	"github.com/xenitane/todo-app-be-oe/internals/events"
+	"github.com/xenitane/todo-app-be-oe/internals/logging"
+	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+// batchResult reports what happened to one operation of a batch. Status is
+// the status the matching single todo route would have answered with, and
+// Error its problem details. Operations of an atomic batch that was rolled
+// back because of another one get 424.
+type batchResult struct {
+	Op     string         `json:"op"`
+	TodoID int64          `json:"todoId,omitempty"`
+	Status int            `json:"status"`
+	Todo   *todo.Todo     `json:"todo,omitempty"`
+	Error  *xenmw.Problem `json:"error,omitempty"`
+}
+
+type batchResp struct {
+	Applied bool          `json:"applied"`
+	Results []batchResult `json:"results"`
+}
+
+// HandleTodoBatch runs many creates, updates and deletes in one request, in
+// order. Without atomic every operation that succeeds is kept and the batch
+// answers 200. An atomic batch runs in one transaction, the first operation
+// that fails rolls it back and its status is the one of the batch.
+func (s *Server) HandleTodoBatch(c echo.Context) error {
+	claims, err := getClaims(c)
+	if err != nil {
+		return err
+	}
+	if claims.Username != c.Param("username") {
+		return &echo.HTTPError{
+			Code:    http.StatusUnauthorized,
+			Message: "You don't have permissions for this method",
+		}
+	}
+	u, err := s.db.GetUserByUserName(c.Request().Context(), c.Param("username"))
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusNotFound,
+			Message:  "this user does not exist",
+			Internal: err,
+		}
+	}
+	batchReq := new(todo.BatchReq)
+	if err := c.Bind(batchReq); err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusUnprocessableEntity,
+			Message:  "error binding request body",
+			Internal: err,
+		}
+	}
+	if err := s.v.Struct(batchReq); err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusUnprocessableEntity,
+			Message:  "invalid request body",
+			Internal: err,
+		}
+	}
+
+	if batchReq.Atomic {
+		return s.runAtomicBatch(c, u, batchReq.Ops)
+	}
+	ctx := c.Request().Context()
+	results := make([]batchResult, len(batchReq.Ops))
+	for i := range batchReq.Ops {
+		op := &batchReq.Ops[i]
+		w, err := s.prepareBatchOp(ctx, s.db, u, op)
+		if err == nil {
+			err = s.storeBatchWrite(ctx, s.db, u, w)
+		}
+		if err != nil {
+			results[i] = s.failedBatchResult(c, i, op, batchWriteError(op, err))
+			continue
+		}
+		s.publishBatchWrite(ctx, u, w)
+		results[i] = appliedBatchResult(op, w)
+	}
+	return c.JSON(http.StatusOK, &batchResp{Applied: true, Results: results})
+}
+
+func (s *Server) runAtomicBatch(c echo.Context, u *user.User, ops []todo.BatchOp) error {
+	ctx := c.Request().Context()
+	var writes []*todo.BatchWrite
+	failed := -1
+	// updates read their todos in the transaction too, so no other write
+	// can come between the read and the write
+	err := s.db.WithTx(ctx, func(tx database.Store) error {
+		writes, failed = make([]*todo.BatchWrite, len(ops)), -1
+		for i := range ops {
+			w, err := s.prepareBatchOp(ctx, tx, u, &ops[i])
+			if err == nil {
+				err = s.storeBatchWrite(ctx, tx, u, w)
+			}
+			if err != nil {
+				failed = i
+				return err
+			}
+			writes[i] = w
+		}
+		return nil
+	})
+	if err != nil && failed < 0 {
+		return &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "internal server error",
+			Internal: err,
+		}
+	}
+
+	results := make([]batchResult, len(ops))
+	if err != nil {
+		for i := range ops {
+			results[i] = batchResult{Op: ops[i].Op, TodoID: ops[i].TodoID, Status: http.StatusFailedDependency}
+		}
+		results[failed] = s.failedBatchResult(c, failed, &ops[failed], batchWriteError(&ops[failed], err))
+		return c.JSON(results[failed].Status, &batchResp{Results: results})
+	}
+	for i, w := range writes {
+		s.publishBatchWrite(ctx, u, w)
+		results[i] = appliedBatchResult(&ops[i], w)
+	}
+	return c.JSON(http.StatusOK, &batchResp{Applied: true, Results: results})
+}
+
+// prepareBatchOp checks op the way its single todo route would and turns it
+// into the write it stands for. Updates read the todo to apply the changes
+// to it.
+func (s *Server) prepareBatchOp(ctx context.Context, st database.Store, u *user.User, op *todo.BatchOp) (*todo.BatchWrite, error) {
+	if op.Todo != nil {
+		op.Todo.Title = strings.TrimSpace(op.Todo.Title)
+		op.Todo.Description = strings.TrimSpace(op.Todo.Description)
+	}
+	if op.Changes != nil {
+		op.Changes.Trim()
+	}
+	if err := s.v.Struct(op); err != nil {
+		return nil, &echo.HTTPError{
+			Code:     http.StatusUnprocessableEntity,
+			Message:  "invalid request body",
+			Internal: err,
+		}
+	}
+
+	w := &todo.BatchWrite{Op: op.Op, TodoID: op.TodoID}
+	switch op.Op {
+	case todo.BatchOpCreate:
+		w.Todo = todo.NewFromAdd(op.Todo, u.UserId)
+
+	case todo.BatchOpUpdate:
+		t, err := st.GetTodoByIDForUser(ctx, op.TodoID, u.UserId)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkVersion(op.Version, t.Version); err != nil {
+			return nil, err
+		}
+		wasCompleted := t.Status == todo.StatusCompleted
+		w.Unchanged = !t.Apply(op.Changes)
+		w.Todo = t
+		w.Completes = !wasCompleted && t.Status == todo.StatusCompleted
+
+	case todo.BatchOpDelete:
+		if op.Version != nil {
+			w.Version = *op.Version
+		}
+	}
+	return w, nil
+}
+
+func (s *Server) storeBatchWrite(ctx context.Context, st database.Store, u *user.User, w *todo.BatchWrite) error {
+	switch w.Op {
+	case todo.BatchOpCreate:
+		return st.InsertTodo(ctx, w.Todo)
+	case todo.BatchOpUpdate:
+		if w.Unchanged {
+			return nil
+		}
+		return st.UpdateTodoByIdForUser(ctx, w.Todo)
+	default:
+		return st.DeleteTodoByIDForUser(ctx, w.TodoID, u.UserId, w.Version)
+	}
+}
+
+func (s *Server) publishBatchWrite(ctx context.Context, u *user.User, w *todo.BatchWrite) {
+	switch w.Op {
+	case todo.BatchOpCreate:
+		s.metrics.TodosCreated.Inc()
+		s.publishTodoEvent(ctx, events.TodoCreated, u.Username, w.Todo)
+	case todo.BatchOpUpdate:
+		if w.Unchanged {
+			return
+		}
+		if w.Completes {
+			s.metrics.TodosCompleted.Inc()
+		}
+		s.publishTodoEvent(ctx, events.TodoUpdated, u.Username, w.Todo)
+	default:
+		s.publishTodoEvent(ctx, events.TodoDeleted, u.Username, &todo.Todo{TodoId: w.TodoID})
+	}
+}
+
+// batchWriteError gives the errors of the database the status the single
+// todo routes answer them with.
+func batchWriteError(op *todo.BatchOp, err error) error {
+	if errors.Is(err, database.ErrVersionConflict) {
+		return versionedWriteError(op.Version, err)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return &echo.HTTPError{
+			Code:     http.StatusNotFound,
+			Message:  "this user has no todo with this the given id",
+			Internal: err,
+		}
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he
+	}
+	return &echo.HTTPError{
+		Code:     http.StatusInternalServerError,
+		Message:  "internal server error",
+		Internal: err,
+	}
+}
+
+// failedBatchResult reports the error of the i-th operation, its violations
+// name their field within the batch.
+func (s *Server) failedBatchResult(c echo.Context, i int, op *todo.BatchOp, err error) batchResult {
+	p := s.problems.New(err, c)
+	for j := range p.Violations {
+		p.Violations[j].Field = fmt.Sprintf("ops[%d].%s", i, p.Violations[j].Field)
+	}
+	if p.Status >= http.StatusInternalServerError {
+		ctx := c.Request().Context()
+		logging.FromContext(ctx).ErrorContext(ctx, "batch operation failed", slog.String("err", err.Error()))
+	}
+	return batchResult{Op: op.Op, TodoID: op.TodoID, Status: p.Status, Error: p}
+}
+
+func appliedBatchResult(op *todo.BatchOp, w *todo.BatchWrite) batchResult {
+	res := batchResult{Op: op.Op, TodoID: op.TodoID, Todo: w.Todo}
+	switch op.Op {
+	case todo.BatchOpCreate:
+		res.TodoID = w.Todo.TodoId
+		res.Status = http.StatusCreated
+	case todo.BatchOpUpdate:
+		res.Status = http.StatusOK
+	default:
+		res.Status = http.StatusNoContent
+	}
+	return res
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/database"
+)
+
+const (
+	headerETag        = "ETag"
+	headerIfMatch     = "If-Match"
+	headerIfNoneMatch = "If-None-Match"
+)
+
+// Versioned resources use their version column as a strong entity tag.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// etagListMatches reports whether the If-Match or If-None-Match style header
+// value lists the tag of version. Weak tags only match when weak is set.
+func etagListMatches(header string, version int64, weak bool) bool {
+	want := etag(version)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == want {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch fails with 412 when the request carries an If-Match header
+// that does not match the current version of the resource.
+func checkIfMatch(c echo.Context, version int64) error {
+	header := c.Request().Header.Get(headerIfMatch)
+	if header == "" || etagListMatches(header, version, false) {
+		return nil
+	}
+	return &echo.HTTPError{
+		Code:    http.StatusPreconditionFailed,
+		Message: "the resource has been modified",
+	}
+}
+
+// conflictError is returned when a write lost the race against another one
+// that happened after the resource was read. Clients that asked for a
+// precondition get 412, the rest 409.
+func conflictError(c echo.Context, err error) error {
+	code := http.StatusConflict
+	if c.Request().Header.Get(headerIfMatch) != "" {
+		code = http.StatusPreconditionFailed
+	}
+	return &echo.HTTPError{
+		Code:     code,
+		Message:  "the resource has been modified",
+		Internal: err,
+	}
+}
+
+// checkVersion is checkIfMatch for the optional version of a request.
+func checkVersion(want *int64, version int64) error {
+	if want != nil && *want != version {
+		return &echo.HTTPError{
+			Code:    http.StatusPreconditionFailed,
+			Message: "the resource has been modified",
+		}
+	}
+	return nil
+}
+
+// versionedWriteError maps a write that lost a race the way conflictError
+// does, requests given a version fail their precondition.
+func versionedWriteError(version *int64, err error) error {
+	if errors.Is(err, database.ErrVersionConflict) {
+		code := http.StatusConflict
+		if version != nil {
+			code = http.StatusPreconditionFailed
+		}
+		return &echo.HTTPError{
+			Code:     code,
+			Message:  "the resource has been modified",
+			Internal: err,
+		}
+	}
+	return err
+}
+
+// respondVersioned writes v as json with the entity tag of version, or a bare
+// 304 when the client already holds that version.
+func respondVersioned(c echo.Context, code int, version int64, v any) error {
+	c.Response().Header().Set(headerETag, etag(version))
+	if c.Request().Method == http.MethodGet {
+		if header := c.Request().Header.Get(headerIfNoneMatch); header != "" && etagListMatches(header, version, true) {
+			return c.NoContent(http.StatusNotModified)
+		}
+	}
+	return c.JSON(code, v)
+}
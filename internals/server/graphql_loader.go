@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+// loader batches the lookups of a graphql request by key. The executor
+// resolves a query level by level and only then calls the thunks returned
+// by load, so every key asked for on one level is fetched by a single query
+// the first time one of them is needed.
+type loader[K comparable, V any] struct {
+	fetch func([]K) (map[K]V, error)
+
+	mu      sync.Mutex
+	pending []K
+	values  map[K]V
+	errs    map[K]error
+}
+
+func newLoader[K comparable, V any](fetch func([]K) (map[K]V, error)) *loader[K, V] {
+	return &loader[K, V]{
+		fetch:  fetch,
+		values: make(map[K]V),
+		errs:   make(map[K]error),
+	}
+}
+
+// load queues key for the next batch and returns a thunk that yields its
+// value. Keys the batch does not return yield the zero value.
+func (l *loader[K, V]) load(key K) func() (interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.values[key]; !ok {
+		l.pending = append(l.pending, key)
+	}
+	return func() (interface{}, error) {
+		return l.get(key)
+	}
+}
+
+func (l *loader[K, V]) get(key K) (V, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pending) > 0 {
+		keys := l.pending
+		l.pending = nil
+		values, err := l.fetch(keys)
+		for _, k := range keys {
+			if err != nil {
+				l.errs[k] = err
+				continue
+			}
+			l.values[k] = values[k]
+		}
+	}
+	return l.values[key], l.errs[key]
+}
+
+// prime stores a value fetched some other way so it is not fetched again.
+func (l *loader[K, V]) prime(key K, value V) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.values[key] = value
+}
+
+// loaders are the loaders of a single graphql request. They are never
+// shared between requests, so their values are only as stale as the request.
+type loaders struct {
+	users  *loader[int64, *user.User]
+	todos  *loader[int64, []*todo.Todo]
+	counts *loader[int64, *todo.TodoCount]
+}
+
+// newLoaders makes the loaders of a request, which query with its context.
+func (s *Server) newLoaders(ctx context.Context) *loaders {
+	return &loaders{
+		users: newLoader(func(ids []int64) (map[int64]*user.User, error) {
+			users, err := s.db.GetUsersByIDs(ctx, ids)
+			if err != nil {
+				return nil, loadError(err)
+			}
+			byID := make(map[int64]*user.User, len(users))
+			for _, u := range users {
+				byID[u.UserId] = u
+			}
+			return byID, nil
+		}),
+		todos: newLoader(func(ownerIDs []int64) (map[int64][]*todo.Todo, error) {
+			todos, err := s.db.GetTodosForUsers(ctx, ownerIDs)
+			if err != nil {
+				return nil, loadError(err)
+			}
+			byOwner := make(map[int64][]*todo.Todo, len(ownerIDs))
+			for _, id := range ownerIDs {
+				byOwner[id] = []*todo.Todo{}
+			}
+			for _, t := range todos {
+				byOwner[t.OwnerId] = append(byOwner[t.OwnerId], t)
+			}
+			return byOwner, nil
+		}),
+		counts: newLoader(func(ownerIDs []int64) (map[int64]*todo.TodoCount, error) {
+			counts, err := s.db.CountTodosForUsers(ctx, ownerIDs)
+			if err != nil {
+				return nil, loadError(err)
+			}
+			byOwner := make(map[int64]*todo.TodoCount, len(ownerIDs))
+			for _, id := range ownerIDs {
+				byOwner[id] = &todo.TodoCount{OwnerId: id}
+			}
+			for _, c := range counts {
+				byOwner[c.OwnerId] = c
+			}
+			return byOwner, nil
+		}),
+	}
+}
+
+func loadError(err error) error {
+	return &echo.HTTPError{
+		Code:     http.StatusInternalServerError,
+		Message:  "internal server error",
+		Internal: err,
+	}
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"github.com/labstack/echo/v4"
+	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+)
+
+const (
+	// maxQueryDepth is how deeply selections may nest, user { todos { owner } }
+	// is three levels deep
+	maxQueryDepth = 6
+	// maxQueryComplexity caps the fields a query may select, counting those
+	// under a list once per expected item
+	maxQueryComplexity = 2000
+	listComplexity     = 10
+)
+
+type graphqlReq struct {
+	Query         string                 `json:"query" validate:"required"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphqlParams is a graphql request in the query string, with the
+// variables as a json object.
+type graphqlParams struct {
+	Query         string `query:"query" validate:"required"`
+	OperationName string `query:"operationName"`
+	Variables     string `query:"variables"`
+}
+
+type graphqlResp struct {
+	Data   any                        `json:"data,omitempty"`
+	Errors []gqlerrors.FormattedError `json:"errors,omitempty"`
+}
+
+func (s *Server) RegisterGraphQLRoutes(g *echo.Group) {
+	g.GET("/", s.HandleGraphQLQuery)
+	g.POST("/", s.HandleGraphQL)
+}
+
+func (s *Server) HandleGraphQL(c echo.Context) error {
+	req := new(graphqlReq)
+	if err := c.Bind(req); err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusUnprocessableEntity,
+			Message:  "error binding request body",
+			Internal: err,
+		}
+	}
+	return s.serveGraphQL(c, req)
+}
+
+// HandleGraphQLQuery serves queries sent with GET, which lets them be
+// cached. Mutations are refused.
+func (s *Server) HandleGraphQLQuery(c echo.Context) error {
+	params := new(graphqlParams)
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, params); err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Message:  "invalid query parameters",
+			Internal: err,
+		}
+	}
+	req := &graphqlReq{
+		Query:         params.Query,
+		OperationName: params.OperationName,
+	}
+	if params.Variables != "" {
+		if err := json.Unmarshal([]byte(params.Variables), &req.Variables); err != nil {
+			return &echo.HTTPError{
+				Code:     http.StatusBadRequest,
+				Message:  "variables must be a json object",
+				Internal: err,
+			}
+		}
+	}
+	return s.serveGraphQL(c, req)
+}
+
+// serveGraphQL runs a graphql request. Requests that cannot be executed at
+// all get a 400, errors of single fields are reported next to the data.
+func (s *Server) serveGraphQL(c echo.Context, req *graphqlReq) error {
+	if strings.TrimSpace(req.Query) == "" {
+		return &echo.HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: "the query is missing",
+		}
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(req.Query), Name: "GraphQL request"}),
+	})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, &graphqlResp{Errors: gqlerrors.FormatErrors(err)})
+	}
+	if res := graphql.ValidateDocument(&s.graphql, doc, nil); !res.IsValid {
+		return c.JSON(http.StatusBadRequest, &graphqlResp{Errors: res.Errors})
+	}
+
+	for _, op := range operations(doc, req.OperationName) {
+		if op.Operation == ast.OperationTypeMutation && c.Request().Method != http.MethodPost {
+			return &echo.HTTPError{
+				Code:    http.StatusMethodNotAllowed,
+				Message: "mutations must be sent with POST",
+			}
+		}
+		if err := checkQueryLimits(&s.graphql, doc, op); err != nil {
+			return c.JSON(http.StatusBadRequest, &graphqlResp{Errors: gqlerrors.FormatErrors(err)})
+		}
+	}
+
+	var claims *xenmw.JWTCustomClaims
+	if c.Get("user") != nil {
+		if claims, err = getClaims(c); err != nil {
+			return err
+		}
+	}
+	ctx := context.WithValue(c.Request().Context(), graphqlRequestKey{}, &graphqlRequest{
+		claims:  claims,
+		loaders: s.newLoaders(c.Request().Context()),
+	})
+
+	res := graphql.Execute(graphql.ExecuteParams{
+		Schema:        s.graphql,
+		AST:           doc,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       ctx,
+	})
+	for i := range res.Errors {
+		s.describeGraphQLError(c, &res.Errors[i])
+	}
+	return c.JSON(http.StatusOK, &graphqlResp{Data: res.Data, Errors: res.Errors})
+}
+
+// describeGraphQLError gives the errors the resolvers return the message and
+// code their problem details would have on the rest routes, which keeps
+// internal errors as private as there.
+func (s *Server) describeGraphQLError(c echo.Context, fe *gqlerrors.FormattedError) {
+	var he *echo.HTTPError
+	for err := fe.OriginalError(); err != nil && he == nil; {
+		switch e := err.(type) {
+		case *echo.HTTPError:
+			he = e
+		case gqlerrors.FormattedError:
+			err = e.OriginalError()
+		case *gqlerrors.Error:
+			err = e.OriginalError
+		default:
+			err = nil
+		}
+	}
+	if he == nil {
+		return
+	}
+	p := s.problems.New(he, c)
+	fe.Message = p.Detail
+	if fe.Message == "" {
+		fe.Message = p.Title
+	}
+	fe.Extensions = map[string]interface{}{
+		"code":   p.Code,
+		"status": p.Status,
+	}
+	if len(p.Violations) > 0 {
+		fe.Extensions["violations"] = p.Violations
+	}
+	if p.Internal != "" {
+		fe.Extensions["internal"] = p.Internal
+	}
+}
+
+// operations lists the operations of doc that run for operationName.
+func operations(doc *ast.Document, operationName string) []*ast.OperationDefinition {
+	var ops []*ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if operationName == "" || (op.Name != nil && op.Name.Value == operationName) {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+var errQueryTooComplex = errors.New("the query is too complex")
+
+// checkQueryLimits rejects operations nested deeper than maxQueryDepth or
+// costing more than maxQueryComplexity. It runs on validated documents, so
+// fragments are known and acyclic. Introspection is bounded by the schema
+// and not counted.
+func checkQueryLimits(schema *graphql.Schema, doc *ast.Document, op *ast.OperationDefinition) error {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, def := range doc.Definitions {
+		if frag, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[frag.Name.Value] = frag
+		}
+	}
+	root := schema.QueryType()
+	if op.Operation == ast.OperationTypeMutation {
+		root = schema.MutationType()
+	}
+
+	var walk func(set *ast.SelectionSet, parent *graphql.Object, depth int) (int, error)
+	walk = func(set *ast.SelectionSet, parent *graphql.Object, depth int) (int, error) {
+		if set == nil || parent == nil {
+			return 0, nil
+		}
+		if depth > maxQueryDepth {
+			return 0, fmt.Errorf("the query is nested deeper than %d levels", maxQueryDepth)
+		}
+		cost := 0
+		for _, sel := range set.Selections {
+			var c int
+			var err error
+			switch sel := sel.(type) {
+			case *ast.Field:
+				if strings.HasPrefix(sel.Name.Value, "__") {
+					continue
+				}
+				def := parent.Fields()[sel.Name.Value]
+				if def == nil {
+					continue
+				}
+				typ, list := unwrapType(def.Type)
+				obj, _ := typ.(*graphql.Object)
+				c, err = walk(sel.SelectionSet, obj, depth+1)
+				if list {
+					c *= listComplexity
+				}
+				c++
+			case *ast.InlineFragment:
+				c, err = walk(sel.SelectionSet, parent, depth)
+			case *ast.FragmentSpread:
+				if frag := fragments[sel.Name.Value]; frag != nil {
+					c, err = walk(frag.SelectionSet, parent, depth)
+				}
+			}
+			if err != nil {
+				return 0, err
+			}
+			cost += c
+			if cost > maxQueryComplexity {
+				return 0, errQueryTooComplex
+			}
+		}
+		return cost, nil
+	}
+	_, err := walk(op.SelectionSet, root, 1)
+	return err
+}
+
+// unwrapType strips the non null and list wrappers off t and reports whether
+// there was a list among them.
+func unwrapType(t graphql.Type) (graphql.Type, bool) {
+	list := false
+	for {
+		switch w := t.(type) {
+		case *graphql.NonNull:
+			t = w.OfType
+		case *graphql.List:
+			t, list = w.OfType, true
+		default:
+			return t, list
+		}
+	}
+}
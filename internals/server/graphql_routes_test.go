@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+type testGraphQLResp struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string         `json:"message"`
+		Extensions map[string]any `json:"extensions"`
+	} `json:"errors"`
+}
+
+func TestGraphQLQuery(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("graphuser")
+	ts.addTodo(token, "graphuser", "Graph todo")
+
+	query := `query ($name: String!) { user(username: $name) { username todoCount { total } todos { title } } }`
+	rec := ts.expect(http.StatusOK, request{method: http.MethodPost, path: "/api/graphql/", token: token, body: map[string]any{
+		"query":     query,
+		"variables": map[string]string{"name": "graphuser"},
+	}})
+	resp := decode[testGraphQLResp](t, rec)
+	if len(resp.Errors) != 0 {
+		t.Fatalf("errors = %+v", resp.Errors)
+	}
+	var data struct {
+		User struct {
+			Username  string `json:"username"`
+			TodoCount struct {
+				Total int `json:"total"`
+			} `json:"todoCount"`
+			Todos []struct {
+				Title string `json:"title"`
+			} `json:"todos"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.User.Username != "graphuser" || data.User.TodoCount.Total != 1 || len(data.User.Todos) != 1 || data.User.Todos[0].Title != "Graph todo" {
+		t.Errorf("data = %s", resp.Data)
+	}
+
+	params := url.Values{"query": {`{ me { username } }`}}
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/api/graphql/?" + params.Encode(), token: token})
+	if resp := decode[testGraphQLResp](t, rec); string(resp.Data) != `{"me":{"username":"graphuser"}}` {
+		t.Errorf("me = %s", resp.Data)
+	}
+}
+
+func TestGraphQLMutation(t *testing.T) {
+	ts := newTestServer(t)
+
+	// anonymous callers may only sign up
+	rec := ts.expect(http.StatusOK, request{method: http.MethodPost, path: "/api/graphql/", body: map[string]any{
+		"query": `mutation { signup(input: {username: "graphsigned", password: "a long password", firstName: "Graph", lastName: "Signed"}) { username version } }`,
+	}})
+	if resp := decode[testGraphQLResp](t, rec); len(resp.Errors) != 0 || string(resp.Data) != `{"signup":{"username":"graphsigned","version":1}}` {
+		t.Errorf("signup = %s %+v", resp.Data, resp.Errors)
+	}
+
+	rec = ts.expect(http.StatusOK, request{method: http.MethodPost, path: "/api/graphql/", body: map[string]any{
+		"query": `mutation { addTodo(username: "graphsigned", input: {title: "Anonymous", description: "Some details", dueDate: "` + ts.dueDate() + `"}) { id } }`,
+	}})
+	resp := decode[testGraphQLResp](t, rec)
+	if len(resp.Errors) != 1 || resp.Errors[0].Extensions["status"] != float64(http.StatusUnauthorized) {
+		t.Errorf("anonymous addTodo answered %s %+v", resp.Data, resp.Errors)
+	}
+
+	// mutations cannot be sent with GET
+	params := url.Values{"query": {`mutation { signup(input: {username: "getsigned", password: "a long password", firstName: "Graph", lastName: "Signed"}) { username } }`}}
+	ts.expect(http.StatusMethodNotAllowed, request{method: http.MethodGet, path: "/api/graphql/?" + params.Encode()})
+}
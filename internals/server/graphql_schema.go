@@ -0,0 +1,463 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/graphql-go/graphql"
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/database"
+	"github.com/xenitane/todo-app-be-oe/internals/events"
+	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+// graphqlRequest is what the resolvers of a request know about it.
+type graphqlRequest struct {
+	// claims of the caller, nil for anonymous requests
+	claims *xenmw.JWTCustomClaims
+	*loaders
+}
+
+type graphqlRequestKey struct{}
+
+func graphqlRequestFrom(ctx context.Context) *graphqlRequest {
+	return ctx.Value(graphqlRequestKey{}).(*graphqlRequest)
+}
+
+func (r *graphqlRequest) authorize(username string, adminAllowed bool) error {
+	return authorize(r.claims, username, adminAllowed)
+}
+
+var todoStatusEnum = graphql.NewEnum(graphql.EnumConfig{
+	Name: "TodoStatus",
+	Values: graphql.EnumValueConfigMap{
+		"PENDING":     {Value: int16(0)},
+		"IN_PROGRESS": {Value: int16(1)},
+		"COMPLETED":   {Value: int16(2)},
+	},
+})
+
+// graphqlSchema builds the schema served at /api/graphql. Fields resolve to
+// the same types the rest routes return, fields not resolved here are read
+// from their json tag.
+func (s *Server) graphqlSchema() (graphql.Schema, error) {
+	todoCountType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "TodoCount",
+		Fields: graphql.Fields{
+			"total":      {Type: graphql.NewNonNull(graphql.Int)},
+			"pending":    {Type: graphql.NewNonNull(graphql.Int)},
+			"inProgress": {Type: graphql.NewNonNull(graphql.Int)},
+			"completed":  {Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	todoType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Todo",
+		Fields: graphql.Fields{
+			"id": {
+				Type: graphql.NewNonNull(graphql.ID),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return strconv.FormatInt(p.Source.(*todo.Todo).TodoId, 10), nil
+				},
+			},
+			"title":       {Type: graphql.NewNonNull(graphql.String)},
+			"description": {Type: graphql.NewNonNull(graphql.String)},
+			"status":      {Type: graphql.NewNonNull(todoStatusEnum)},
+			"dueDate":     {Type: graphql.NewNonNull(graphql.DateTime)},
+			"createdAt":   {Type: graphql.NewNonNull(graphql.DateTime)},
+			"updatedAt":   {Type: graphql.NewNonNull(graphql.DateTime)},
+			"version":     {Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"username":  {Type: graphql.NewNonNull(graphql.String)},
+			"firstName": {Type: graphql.NewNonNull(graphql.String)},
+			"lastName":  {Type: graphql.NewNonNull(graphql.String)},
+			"isAdmin":   {Type: graphql.NewNonNull(graphql.Boolean)},
+			"createdAt": {Type: graphql.NewNonNull(graphql.DateTime)},
+			"version":   {Type: graphql.NewNonNull(graphql.Int)},
+			"todos": {
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(todoType))),
+				Args: graphql.FieldConfigArgument{
+					"status": {Type: todoStatusEnum},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					req := graphqlRequestFrom(p.Context)
+					u := p.Source.(*user.User)
+					if err := req.authorize(u.Username, true); err != nil {
+						return nil, err
+					}
+					req.users.prime(u.UserId, u)
+					status, filter := p.Args["status"].(int16)
+					load := req.todos.load(u.UserId)
+					return func() (interface{}, error) {
+						todos, err := load()
+						if err != nil || !filter {
+							return todos, err
+						}
+						filtered := []*todo.Todo{}
+						for _, t := range todos.([]*todo.Todo) {
+							if t.Status == status {
+								filtered = append(filtered, t)
+							}
+						}
+						return filtered, nil
+					}, nil
+				},
+			},
+			"todoCount": {
+				Type: graphql.NewNonNull(todoCountType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					req := graphqlRequestFrom(p.Context)
+					u := p.Source.(*user.User)
+					if err := req.authorize(u.Username, true); err != nil {
+						return nil, err
+					}
+					return req.counts.load(u.UserId), nil
+				},
+			},
+		},
+	})
+
+	// a todo is only ever reached through its owner, so its owner is as
+	// visible as the todo itself
+	todoType.AddFieldConfig("owner", &graphql.Field{
+		Type: graphql.NewNonNull(userType),
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return graphqlRequestFrom(p.Context).users.load(p.Source.(*todo.Todo).OwnerId), nil
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"me": {
+				Type: userType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					req := graphqlRequestFrom(p.Context)
+					if req.claims == nil {
+						return nil, nil
+					}
+					return s.graphqlUser(p.Context, req.claims.Username, true)
+				},
+			},
+			"user": {
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"username": {Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return s.graphqlUser(p.Context, p.Args["username"].(string), true)
+				},
+			},
+			"users": {
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userType))),
+				Description: "Every user, admin only",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					req := graphqlRequestFrom(p.Context)
+					if req.claims == nil || !req.claims.IsAdmin {
+						return nil, &echo.HTTPError{
+							Code:    http.StatusUnauthorized,
+							Message: "you are not admin",
+						}
+					}
+					users, err := s.db.GetAllUsers(p.Context)
+					if err != nil {
+						return nil, loadError(err)
+					}
+					for _, u := range users {
+						req.users.prime(u.UserId, u)
+					}
+					return users, nil
+				},
+			},
+			"todo": {
+				Type: todoType,
+				Args: graphql.FieldConfigArgument{
+					"username": {Type: graphql.NewNonNull(graphql.String)},
+					"id":       {Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					u, err := s.graphqlUser(p.Context, p.Args["username"].(string), true)
+					if err != nil {
+						return nil, err
+					}
+					return s.graphqlTodo(p.Context, u, p.Args["id"])
+				},
+			},
+		},
+	})
+
+	signupInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "SignupInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"username":  {Type: graphql.NewNonNull(graphql.String)},
+			"password":  {Type: graphql.NewNonNull(graphql.String)},
+			"firstName": {Type: graphql.NewNonNull(graphql.String)},
+			"lastName":  {Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	userUpdateInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UserUpdateInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"firstName": {Type: graphql.String},
+			"lastName":  {Type: graphql.String},
+			"password":  {Type: graphql.String},
+			"isAdmin":   {Type: graphql.Boolean},
+		},
+	})
+	todoAddInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "TodoAddInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"title":       {Type: graphql.NewNonNull(graphql.String)},
+			"description": {Type: graphql.NewNonNull(graphql.String)},
+			"dueDate":     {Type: graphql.NewNonNull(graphql.DateTime)},
+		},
+	})
+	todoUpdateInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "TodoUpdateInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"title":       {Type: graphql.String},
+			"description": {Type: graphql.String},
+			"status":      {Type: todoStatusEnum},
+			"dueDate":     {Type: graphql.DateTime},
+		},
+	})
+
+	// version makes a write conditional, like If-Match does for the rest
+	// routes
+	versionArg := &graphql.ArgumentConfig{
+		Type:        graphql.Int,
+		Description: "Fail unless the resource is still at this version",
+	}
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"signup": {
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"input": {Type: graphql.NewNonNull(signupInput)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					userReq := new(user.UserSignUpReq)
+					if err := decodeInput(p.Args["input"], userReq); err != nil {
+						return nil, err
+					}
+					return s.signup(p.Context, userReq)
+				},
+			},
+			"updateUser": {
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"username": {Type: graphql.NewNonNull(graphql.String)},
+					"input":    {Type: graphql.NewNonNull(userUpdateInput)},
+					"version":  versionArg,
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					req := graphqlRequestFrom(p.Context)
+					u, err := s.graphqlUser(p.Context, p.Args["username"].(string), true)
+					if err != nil {
+						return nil, err
+					}
+					if err := checkVersionArg(p.Args, u.Version); err != nil {
+						return nil, err
+					}
+					userUpdateReq := new(user.UserUpdateReq)
+					if err := decodeInput(p.Args["input"], userUpdateReq); err != nil {
+						return nil, err
+					}
+					if err := s.updateUser(p.Context, req.claims, u, userUpdateReq); err != nil {
+						return nil, graphqlWriteError(p.Args, err)
+					}
+					return u, nil
+				},
+			},
+			"addTodo": {
+				Type: graphql.NewNonNull(todoType),
+				Args: graphql.FieldConfigArgument{
+					"username": {Type: graphql.NewNonNull(graphql.String)},
+					"input":    {Type: graphql.NewNonNull(todoAddInput)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					u, err := s.graphqlUser(p.Context, p.Args["username"].(string), false)
+					if err != nil {
+						return nil, err
+					}
+					todoAddReq := new(todo.TodoAddReq)
+					if err := decodeInput(p.Args["input"], todoAddReq); err != nil {
+						return nil, err
+					}
+					return s.addTodo(p.Context, u, todoAddReq)
+				},
+			},
+			"updateTodo": {
+				Type: graphql.NewNonNull(todoType),
+				Args: graphql.FieldConfigArgument{
+					"username": {Type: graphql.NewNonNull(graphql.String)},
+					"id":       {Type: graphql.NewNonNull(graphql.ID)},
+					"input":    {Type: graphql.NewNonNull(todoUpdateInput)},
+					"version":  versionArg,
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					u, err := s.graphqlUser(p.Context, p.Args["username"].(string), false)
+					if err != nil {
+						return nil, err
+					}
+					t, err := s.graphqlTodo(p.Context, u, p.Args["id"])
+					if err != nil {
+						return nil, err
+					}
+					if err := checkVersionArg(p.Args, t.Version); err != nil {
+						return nil, err
+					}
+					todoUpdateReq := new(todo.TodoUpdateReq)
+					if err := decodeInput(p.Args["input"], todoUpdateReq); err != nil {
+						return nil, err
+					}
+					if err := s.updateTodo(p.Context, u, t, todoUpdateReq); err != nil {
+						return nil, graphqlWriteError(p.Args, err)
+					}
+					return t, nil
+				},
+			},
+			"deleteTodo": {
+				Type:        graphql.NewNonNull(graphql.ID),
+				Description: "Move a todo to the trash, returns its id",
+				Args: graphql.FieldConfigArgument{
+					"username": {Type: graphql.NewNonNull(graphql.String)},
+					"id":       {Type: graphql.NewNonNull(graphql.ID)},
+					"version":  versionArg,
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					u, err := s.graphqlUser(p.Context, p.Args["username"].(string), true)
+					if err != nil {
+						return nil, err
+					}
+					todoID, err := parseTodoID(p.Args["id"])
+					if err != nil {
+						return nil, err
+					}
+					version, _ := p.Args["version"].(int)
+					err = s.db.DeleteTodoByIDForUser(p.Context, todoID, u.UserId, int64(version))
+					if errors.Is(err, database.ErrVersionConflict) {
+						return nil, graphqlWriteError(p.Args, err)
+					}
+					if err != nil {
+						return nil, &echo.HTTPError{
+							Code:     http.StatusNotFound,
+							Message:  "this user has no todo with this the given id",
+							Internal: err,
+						}
+					}
+					s.publishTodoEvent(p.Context, events.TodoDeleted, u.Username, &todo.Todo{TodoId: todoID})
+					return strconv.FormatInt(todoID, 10), nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    query,
+		Mutation: mutation,
+	})
+}
+
+// graphqlUser authorizes the caller for the user and looks it up.
+func (s *Server) graphqlUser(ctx context.Context, username string, adminAllowed bool) (*user.User, error) {
+	req := graphqlRequestFrom(ctx)
+	if err := req.authorize(username, adminAllowed); err != nil {
+		return nil, err
+	}
+	u, err := s.db.GetUserByUserName(ctx, username)
+	if err != nil {
+		return nil, &echo.HTTPError{
+			Code:     http.StatusNotFound,
+			Message:  "this user does not exist",
+			Internal: err,
+		}
+	}
+	req.users.prime(u.UserId, u)
+	return u, nil
+}
+
+func (s *Server) graphqlTodo(ctx context.Context, u *user.User, id any) (*todo.Todo, error) {
+	todoID, err := parseTodoID(id)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.db.GetTodoByIDForUser(ctx, todoID, u.UserId)
+	if err != nil {
+		return nil, &echo.HTTPError{
+			Code:     http.StatusNotFound,
+			Message:  "this user has not todo with this the given id",
+			Internal: err,
+		}
+	}
+	return t, nil
+}
+
+func parseTodoID(id any) (int64, error) {
+	todoID, err := strconv.ParseInt(id.(string), 10, 64)
+	if err != nil {
+		return 0, &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Internal: err,
+			Message:  "invalid todo id format",
+		}
+	}
+	return todoID, nil
+}
+
+// checkVersionArg is checkIfMatch for the version argument of mutations.
+func checkVersionArg(args map[string]interface{}, version int64) error {
+	if v, ok := args["version"].(int); ok && int64(v) != version {
+		return &echo.HTTPError{
+			Code:    http.StatusPreconditionFailed,
+			Message: "the resource has been modified",
+		}
+	}
+	return nil
+}
+
+// graphqlWriteError maps a write that lost a race the way conflictError
+// does, mutations given a version fail their precondition.
+func graphqlWriteError(args map[string]interface{}, err error) error {
+	if errors.Is(err, database.ErrVersionConflict) {
+		code := http.StatusConflict
+		if _, ok := args["version"].(int); ok {
+			code = http.StatusPreconditionFailed
+		}
+		return &echo.HTTPError{
+			Code:     code,
+			Message:  "the resource has been modified",
+			Internal: err,
+		}
+	}
+	return err
+}
+
+// decodeInput fills the request type of the matching rest route from an
+// input object, so both are bound by the same json names.
+func decodeInput(input any, dst any) error {
+	b, err := json.Marshal(input)
+	if err == nil {
+		err = json.Unmarshal(b, dst)
+	}
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusUnprocessableEntity,
+			Message:  "error binding request body",
+			Internal: err,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+	pb "github.com/xenitane/todo-app-be-oe/internals/pb/todoappv1"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// RegisterGRPCServices builds the grpc server of the api defined in
+// proto/todoapp/v1. Its services call the same helpers as the rest routes,
+// so both apply the same validation and authorization.
+func (s *Server) RegisterGRPCServices() *grpc.Server {
+	logUnary, logStream := xenmw.GRPCLogger(s.logger)
+	authUnary, authStream := xenmw.GRPCAuth(s.signingKey, s.checkToken, func(fullMethod string) bool {
+		return strings.HasPrefix(fullMethod, "/"+pb.AuthService_ServiceDesc.ServiceName+"/") ||
+			strings.HasPrefix(fullMethod, "/grpc.reflection.")
+	})
+	errUnary, errStream := xenmw.GRPCErrors(s.problems)
+
+	g := grpc.NewServer(
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(logUnary, authUnary, errUnary),
+		grpc.ChainStreamInterceptor(logStream, authStream, errStream),
+	)
+	pb.RegisterAuthServiceServer(g, &grpcAuthService{s: s})
+	pb.RegisterUserServiceServer(g, &grpcUserService{s: s})
+	pb.RegisterTodoServiceServer(g, &grpcTodoService{s: s})
+	reflection.Register(g)
+	return g
+}
+
+// withGRPC serves grpc calls with g and everything else with h. Calls are
+// told apart by their content type, and http/2 without tls is accepted so
+// both share one port. The http/2 connections are closed gracefully when
+// the http server shuts down.
+func (s *Server) withGRPC(g *grpc.Server, h http.Handler) http.Handler {
+	h2s := &http2.Server{}
+	if err := http2.ConfigureServer(s.http, h2s); err != nil {
+		panic(err)
+	}
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			s.grpcCalls.Add(1)
+			defer s.grpcCalls.Done()
+			g.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}), h2s)
+}
+
+func userToProto(u *user.User) *pb.User {
+	return &pb.User{
+		Username:  u.Username,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		IsAdmin:   u.IsAdmin,
+		CreatedAt: timestamppb.New(u.CreatedAt),
+		Version:   u.Version,
+	}
+}
+
+func todoToProto(t *todo.Todo) *pb.Todo {
+	return &pb.Todo{
+		Id:          t.TodoId,
+		Title:       t.Title,
+		Description: t.Description,
+		Status:      pb.TodoStatus(t.Status),
+		DueDate:     timestamppb.New(t.DueDate),
+		CreatedAt:   timestamppb.New(t.CreatedAt),
+		UpdatedAt:   timestamppb.New(t.UpdatedAt),
+		Version:     t.Version,
+	}
+}
+
+// timeFromProto is nil for unset timestamps.
+func timeFromProto(ts *timestamppb.Timestamp) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := ts.AsTime()
+	return &t
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/database"
+	"github.com/xenitane/todo-app-be-oe/internals/events"
+	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+	pb "github.com/xenitane/todo-app-be-oe/internals/pb/todoappv1"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+// The grpc services return the same errors as the rest handlers, the
+// GRPCErrors interceptor maps them to statuses.
+
+type grpcAuthService struct {
+	pb.UnimplementedAuthServiceServer
+	s *Server
+}
+
+func (a *grpcAuthService) Signup(ctx context.Context, req *pb.SignupRequest) (*pb.User, error) {
+	u, err := a.s.signup(ctx, &user.UserSignUpReq{
+		Username:  req.Username,
+		Password:  req.Password,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return userToProto(u), nil
+}
+
+func (a *grpcAuthService) Signin(ctx context.Context, req *pb.SigninRequest) (*pb.SigninResponse, error) {
+	resp, err := a.s.signin(ctx, &user.UserSignInReq{
+		Username: req.Username,
+		Password: req.Password,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SigninResponse{User: userToProto(resp.User), Token: resp.Token}, nil
+}
+
+type grpcUserService struct {
+	pb.UnimplementedUserServiceServer
+	s *Server
+}
+
+func (us *grpcUserService) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	claims, ok := xenmw.ClaimsFromContext(ctx)
+	if !ok || !claims.IsAdmin {
+		return nil, &echo.HTTPError{
+			Code:    http.StatusUnauthorized,
+			Message: "you are not admin",
+		}
+	}
+	users, err := us.s.db.GetAllUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.ListUsersResponse{Users: make([]*pb.User, len(users))}
+	for i, u := range users {
+		resp.Users[i] = userToProto(u)
+	}
+	return resp, nil
+}
+
+func (us *grpcUserService) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.User, error) {
+	u, err := us.s.grpcUser(ctx, req.Username, true)
+	if err != nil {
+		return nil, err
+	}
+	return userToProto(u), nil
+}
+
+func (us *grpcUserService) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.User, error) {
+	u, err := us.s.grpcUser(ctx, req.Username, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(req.Version, u.Version); err != nil {
+		return nil, err
+	}
+	claims, _ := xenmw.ClaimsFromContext(ctx)
+	err = us.s.updateUser(ctx, claims, u, &user.UserUpdateReq{
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Password:  req.Password,
+		IsAdmin:   req.IsAdmin,
+	})
+	if err != nil {
+		return nil, versionedWriteError(req.Version, err)
+	}
+	return userToProto(u), nil
+}
+
+type grpcTodoService struct {
+	pb.UnimplementedTodoServiceServer
+	s *Server
+}
+
+func (ts *grpcTodoService) ListTodos(ctx context.Context, req *pb.ListTodosRequest) (*pb.ListTodosResponse, error) {
+	u, err := ts.s.grpcUser(ctx, req.Username, true)
+	if err != nil {
+		return nil, err
+	}
+	todos, err := ts.s.db.GetAllTodosForUser(ctx, u.UserId)
+	if err != nil {
+		return nil, &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "internal server error",
+			Internal: err,
+		}
+	}
+	resp := &pb.ListTodosResponse{Todos: make([]*pb.Todo, len(todos))}
+	for i, t := range todos {
+		resp.Todos[i] = todoToProto(t)
+	}
+	return resp, nil
+}
+
+func (ts *grpcTodoService) AddTodo(ctx context.Context, req *pb.AddTodoRequest) (*pb.Todo, error) {
+	u, err := ts.s.grpcUser(ctx, req.Username, false)
+	if err != nil {
+		return nil, err
+	}
+	todoAddReq := &todo.TodoAddReq{
+		Title:       req.Title,
+		Description: req.Description,
+	}
+	if req.DueDate != nil {
+		todoAddReq.DueDate = req.DueDate.AsTime()
+	}
+	t, err := ts.s.addTodo(ctx, u, todoAddReq)
+	if err != nil {
+		return nil, err
+	}
+	return todoToProto(t), nil
+}
+
+func (ts *grpcTodoService) SearchTodos(ctx context.Context, req *pb.SearchTodosRequest) (*pb.SearchTodosResponse, error) {
+	u, err := ts.s.grpcUser(ctx, req.Username, true)
+	if err != nil {
+		return nil, err
+	}
+	searchReq := &todo.SearchReq{
+		Query:     req.Query,
+		DueBefore: timeFromProto(req.DueBefore),
+		DueAfter:  timeFromProto(req.DueAfter),
+		Limit:     int(req.Limit),
+		Offset:    int(req.Offset),
+	}
+	if req.Status != nil {
+		status := int16(*req.Status)
+		searchReq.Status = &status
+	}
+	results, err := ts.s.search(ctx, searchReq, u.UserId)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.SearchTodosResponse{Results: make([]*pb.SearchResult, len(results))}
+	for i, r := range results {
+		resp.Results[i] = &pb.SearchResult{
+			Todo:                 todoToProto(r.Todo),
+			Rank:                 r.Rank,
+			TitleHighlight:       r.TitleHighlight,
+			DescriptionHighlight: r.DescriptionHighlight,
+		}
+	}
+	return resp, nil
+}
+
+func (ts *grpcTodoService) GetTodo(ctx context.Context, req *pb.GetTodoRequest) (*pb.Todo, error) {
+	u, err := ts.s.grpcUser(ctx, req.Username, true)
+	if err != nil {
+		return nil, err
+	}
+	t, err := ts.s.grpcTodo(ctx, u, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	return todoToProto(t), nil
+}
+
+func (ts *grpcTodoService) UpdateTodo(ctx context.Context, req *pb.UpdateTodoRequest) (*pb.Todo, error) {
+	u, err := ts.s.grpcUser(ctx, req.Username, false)
+	if err != nil {
+		return nil, err
+	}
+	t, err := ts.s.grpcTodo(ctx, u, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(req.Version, t.Version); err != nil {
+		return nil, err
+	}
+	todoUpdateReq := &todo.TodoUpdateReq{
+		Title:       req.Title,
+		Description: req.Description,
+		DueDate:     timeFromProto(req.DueDate),
+	}
+	if req.Status != nil {
+		status := int16(*req.Status)
+		todoUpdateReq.Status = &status
+	}
+	if err := ts.s.updateTodo(ctx, u, t, todoUpdateReq); err != nil {
+		return nil, versionedWriteError(req.Version, err)
+	}
+	return todoToProto(t), nil
+}
+
+func (ts *grpcTodoService) DeleteTodo(ctx context.Context, req *pb.DeleteTodoRequest) (*pb.DeleteTodoResponse, error) {
+	u, err := ts.s.grpcUser(ctx, req.Username, true)
+	if err != nil {
+		return nil, err
+	}
+	err = ts.s.db.DeleteTodoByIDForUser(ctx, req.Id, u.UserId, req.GetVersion())
+	if errors.Is(err, database.ErrVersionConflict) {
+		return nil, versionedWriteError(req.Version, err)
+	}
+	if err != nil {
+		return nil, &echo.HTTPError{
+			Code:     http.StatusNotFound,
+			Message:  "this user has no todo with this the given id",
+			Internal: err,
+		}
+	}
+	ts.s.publishTodoEvent(ctx, events.TodoDeleted, u.Username, &todo.Todo{TodoId: req.Id})
+	return &pb.DeleteTodoResponse{}, nil
+}
+
+// grpcUser authorizes the caller for the user and looks it up.
+func (s *Server) grpcUser(ctx context.Context, username string, adminAllowed bool) (*user.User, error) {
+	claims, _ := xenmw.ClaimsFromContext(ctx)
+	if err := authorize(claims, username, adminAllowed); err != nil {
+		return nil, err
+	}
+	u, err := s.db.GetUserByUserName(ctx, username)
+	if err != nil {
+		return nil, &echo.HTTPError{
+			Code:     http.StatusNotFound,
+			Message:  "this user does not exist",
+			Internal: err,
+		}
+	}
+	return u, nil
+}
+
+func (s *Server) grpcTodo(ctx context.Context, u *user.User, id int64) (*todo.Todo, error) {
+	t, err := s.db.GetTodoByIDForUser(ctx, id, u.UserId)
+	if err != nil {
+		return nil, &echo.HTTPError{
+			Code:     http.StatusNotFound,
+			Message:  "this user has not todo with this the given id",
+			Internal: err,
+		}
+	}
+	return t, nil
+}
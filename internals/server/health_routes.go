@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/health"
+)
+
+const (
+	// healthCacheTTL is how long a probe result is reused
+	healthCacheTTL = 2 * time.Second
+
+	pingTimeout     = time.Second
+	migratedTimeout = 2 * time.Second
+	workersTimeout  = 100 * time.Millisecond
+)
+
+type healthResp struct {
+	*health.Report
+	Pool map[string]string `json:"pool"`
+}
+
+// registerHealthChecks sets up the probes. The process is live while its
+// background workers run, restarting it would not help with anything else.
+// It is ready when it can serve requests: the database answers and has the
+// current schema and events from other replicas come in.
+func (s *Server) registerHealthChecks() {
+	s.liveness = health.NewChecker(healthCacheTTL)
+	s.liveness.Add("workers", workersTimeout, s.workersAlive)
+
+	s.readiness = health.NewChecker(healthCacheTTL)
+	s.readiness.Add("database", pingTimeout, s.db.Ping)
+	s.readiness.Add("migrations", migratedTimeout, s.db.Migrated)
+	s.readiness.Add("events", workersTimeout, s.events.Listening)
+}
+
+// workersAlive fails when a background worker returned while the server is
+// still running.
+func (s *Server) workersAlive(context.Context) error {
+	if s.draining.Load() {
+		return nil
+	}
+	started, running := s.workersStarted.Load(), s.workersRunning.Load()
+	if running < started {
+		return fmt.Errorf("%d of %d background workers stopped", started-running, started)
+	}
+	return nil
+}
+
+func (s *Server) LivenessHandler(c echo.Context) error {
+	report := s.liveness.Run(c.Request().Context())
+	return c.JSON(healthStatus(report), report.Public())
+}
+
+func (s *Server) ReadinessHandler(c echo.Context) error {
+	if s.draining.Load() {
+		return c.JSON(http.StatusServiceUnavailable, &health.Report{
+			Status:    health.StatusDraining,
+			Checks:    map[string]health.Result{},
+			CheckedAt: s.now(),
+		})
+	}
+	report := s.readiness.Run(c.Request().Context())
+	return c.JSON(healthStatus(report), report.Public())
+}
+
+// HealthHandler shows admins the readiness checks with their errors and
+// the connection pool stats.
+func (s *Server) HealthHandler(c echo.Context) error {
+	claims, err := getClaims(c)
+	if err != nil {
+		return err
+	}
+	if !claims.IsAdmin {
+		return &echo.HTTPError{
+			Code:    http.StatusUnauthorized,
+			Message: "you are not admin",
+		}
+	}
+	report := s.readiness.Run(c.Request().Context())
+	if s.draining.Load() {
+		report = &health.Report{Status: health.StatusDraining, Checks: report.Checks, CheckedAt: report.CheckedAt}
+	}
+	return c.JSON(http.StatusOK, healthResp{Report: report, Pool: s.db.Stats()})
+}
+
+func healthStatus(r *health.Report) int {
+	if r.Up() {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/database"
+	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+)
+
+// idempotencyPurgeInterval is how often the expired idempotency keys are
+// deleted from the database
+const idempotencyPurgeInterval = time.Hour
+
+// dbIdempotencyStore keeps the records of idempotency keys in the database,
+// so a retry reaching another replica is replayed too.
+type dbIdempotencyStore struct {
+	db database.Service
+}
+
+// idempotentResponse is the response of a completed record, as stored.
+type idempotentResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// hashIdempotencyKey hashes the key of the middleware, which holds the route,
+// the path and the username besides the one of the client, to a fixed
+// length.
+func hashIdempotencyKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (st dbIdempotencyStore) Reserve(ctx context.Context, key, fingerprint string, lease time.Duration) (*xenmw.IdempotencyRecord, error) {
+	k, err := st.db.ReserveIdempotencyKey(ctx, hashIdempotencyKey(key), fingerprint, lease)
+	if err != nil || k == nil {
+		return nil, err
+	}
+	rec := &xenmw.IdempotencyRecord{Fingerprint: k.Fingerprint}
+	if k.Response == nil {
+		return rec, nil
+	}
+	var res idempotentResponse
+	if err := json.Unmarshal(k.Response, &res); err != nil {
+		return nil, err
+	}
+	rec.Done, rec.Status, rec.Header, rec.Body = true, res.Status, res.Header, res.Body
+	return rec, nil
+}
+
+func (st dbIdempotencyStore) Complete(ctx context.Context, key string, rec *xenmw.IdempotencyRecord, ttl time.Duration) error {
+	res, err := json.Marshal(idempotentResponse{Status: rec.Status, Header: rec.Header, Body: rec.Body})
+	if err != nil {
+		return err
+	}
+	return st.db.CompleteIdempotencyKey(ctx, hashIdempotencyKey(key), res, ttl)
+}
+
+func (st dbIdempotencyStore) Release(ctx context.Context, key string) error {
+	return st.db.ReleaseIdempotencyKey(ctx, hashIdempotencyKey(key))
+}
+
+// purgeIdempotencyKeys deletes the expired idempotency keys from the
+// database, once at start and then every idempotencyPurgeInterval until ctx
+// is done.
+func (s *Server) purgeIdempotencyKeys(ctx context.Context) {
+	ticker := time.NewTicker(idempotencyPurgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := s.db.PurgeExpiredIdempotencyKeys(ctx)
+		if err != nil {
+			s.logger.ErrorContext(ctx, "failed to purge idempotency keys", slog.String("err", err.Error()))
+		} else if purged > 0 {
+			s.logger.InfoContext(ctx, "purged idempotency keys", slog.Int64("keys", purged))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
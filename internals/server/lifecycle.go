@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Run starts the background workers and serves the api until ctx is done,
+// then shuts down: the server reports itself not ready, waits the shutdown
+// delay so load balancers stop sending traffic, stops accepting connections,
+// ends the open streams and waits up to the shutdown timeout for in-flight
+// requests. The workers are stopped and the database closed last. Run
+// returns nil when every request finished in time.
+func (s *Server) Run(ctx context.Context) error {
+	workers, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	s.startWorker(func() { s.events.Run(workers) })
+	s.startWorker(func() { s.purgeTrash(workers) })
+	if s.idempotencyInDB {
+		s.startWorker(func() { s.purgeIdempotencyKeys(workers) })
+	}
+
+	served := make(chan error, 2)
+	go func() {
+		served <- s.http.ListenAndServe()
+	}()
+	if s.metricsHTTP != nil {
+		go func() {
+			served <- s.metricsHTTP.ListenAndServe()
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-served:
+		err = fmt.Errorf("cannot start the server: %w", err)
+	case <-ctx.Done():
+		err = s.shutdown()
+	}
+
+	stopWorkers()
+	s.workers.Wait()
+	if cerr := s.db.Close(); cerr != nil {
+		err = errors.Join(err, fmt.Errorf("closing the database: %w", cerr))
+	}
+	return err
+}
+
+func (s *Server) startWorker(f func()) {
+	s.workers.Add(1)
+	s.workersStarted.Add(1)
+	s.workersRunning.Add(1)
+	go func() {
+		defer s.workers.Done()
+		defer s.workersRunning.Add(-1)
+		f()
+	}()
+}
+
+// shutdown drains the http server and the grpc calls it serves.
+func (s *Server) shutdown() error {
+	s.draining.Store(true)
+	if s.shutdownDelay > 0 {
+		s.logger.Info("shutting down", slog.Duration("delay", s.shutdownDelay))
+		time.Sleep(s.shutdownDelay)
+	}
+	s.logger.Info("waiting for in-flight requests", slog.Duration("timeout", s.shutdownTimeout))
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	if err := s.http.Shutdown(ctx); err != nil {
+		s.http.Close()
+		return fmt.Errorf("requests still in flight after %v: %w", s.shutdownTimeout, err)
+	}
+
+	// grpc calls run on hijacked http/2 connections, Shutdown only told
+	// their clients to go away
+	calls := make(chan struct{})
+	go func() {
+		s.grpcCalls.Wait()
+		close(calls)
+	}()
+	select {
+	case <-calls:
+	case <-ctx.Done():
+		s.http.Close()
+		return fmt.Errorf("grpc calls still in flight after %v: %w", s.shutdownTimeout, ctx.Err())
+	}
+
+	// the metrics are served until the end, to cover the shutdown
+	if s.metricsHTTP != nil {
+		if err := s.metricsHTTP.Shutdown(ctx); err != nil {
+			s.metricsHTTP.Close()
+		}
+	}
+	return nil
+}
+
+// stopStreams ends the event streams, which would otherwise stay open for
+// as long as their clients do.
+func (s *Server) stopStreams() {
+	s.stoppingOnce.Do(func() { close(s.stopping) })
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// metricsRoutes serves the metrics alone, for the metrics port.
+func (s *Server) metricsRoutes() http.Handler {
+	e := echo.New()
+	e.HTTPErrorHandler = s.problems.HandleError
+	e.Use(middleware.Recover())
+	if s.metricsToken != "" {
+		e.GET("/metrics", s.HandleMetrics, s.metricsAuth())
+	} else {
+		e.GET("/metrics", s.HandleMetrics)
+	}
+	return e
+}
+
+// metricsAuth lets through the requests bearing the metrics token.
+func (s *Server) metricsAuth() echo.MiddlewareFunc {
+	return middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		Validator: func(key string, c echo.Context) (bool, error) {
+			return subtle.ConstantTimeCompare([]byte(key), []byte(s.metricsToken)) == 1, nil
+		},
+		ErrorHandler: func(err error, c echo.Context) error {
+			return &echo.HTTPError{
+				Code:     http.StatusUnauthorized,
+				Message:  "missing or invalid metrics token",
+				Internal: err,
+			}
+		},
+	})
+}
+
+func (s *Server) HandleMetrics(c echo.Context) error {
+	s.metrics.Handler().ServeHTTP(c.Response(), c.Request())
+	return nil
+}
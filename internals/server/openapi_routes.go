@@ -0,0 +1,307 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"runtime"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/archive"
+	"github.com/xenitane/todo-app-be-oe/internals/events"
+	"github.com/xenitane/todo-app-be-oe/internals/health"
+	"github.com/xenitane/todo-app-be-oe/internals/openapi"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+const specPath = "/api/openapi.json"
+
+// path and query parameters of the documented routes, in the form echo binds
+// them
+type (
+	userPath struct {
+		Username string `param:"username"`
+	}
+	todoPath struct {
+		Username string `param:"username"`
+		Todo     int64  `param:"todo"`
+	}
+	searchParams struct {
+		Username string `param:"username"`
+		todo.SearchReq
+	}
+	idempotencyKey struct {
+		IdempotencyKey string `header:"Idempotency-Key" validate:"max=255"`
+	}
+	idempotentUserPath struct {
+		userPath
+		idempotencyKey
+	}
+	syncParams struct {
+		Username string `param:"username"`
+		Since    string `query:"since"`
+	}
+	importParams struct {
+		Username string `param:"username"`
+		DryRun   bool   `query:"dryRun"`
+	}
+	streamParams struct {
+		Username    string `param:"username"`
+		AccessToken string `query:"access_token"`
+	}
+)
+
+func (s *Server) RegisterDocsRoutes(g *echo.Group) {
+	g.GET("/openapi.json", s.HandleOpenAPISpec)
+	g.GET("/docs/*", echo.WrapHandler(http.StripPrefix("/api/docs/", openapi.UIHandler(specPath))))
+}
+
+func (s *Server) HandleOpenAPISpec(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.spec)
+}
+
+// handlerName is how echo names the route of a handler.
+func handlerName(h echo.HandlerFunc) string {
+	return runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+}
+
+// apiDocs documents the handlers. Paths and methods come from the route
+// table, so only what it cannot tell goes here.
+func (s *Server) apiDocs() map[string]openapi.Doc {
+	return map[string]openapi.Doc{
+		handlerName(s.HiHandler): {
+			Summary:   "Greeting",
+			Tags:      []string{"meta"},
+			Responses: map[int]any{http.StatusOK: map[string]string{}},
+		},
+		handlerName(s.LivenessHandler): {
+			Summary: "Liveness probe, fails when a background worker stopped",
+			Tags:    []string{"meta"},
+			Responses: map[int]any{
+				http.StatusOK:                 health.Report{},
+				http.StatusServiceUnavailable: health.Report{},
+			},
+		},
+		handlerName(s.ReadinessHandler): {
+			Summary: "Readiness probe, fails when the database or the event listener is down or the server is shutting down",
+			Tags:    []string{"meta"},
+			Responses: map[int]any{
+				http.StatusOK:                 health.Report{},
+				http.StatusServiceUnavailable: health.Report{},
+			},
+		},
+		handlerName(s.HandleMetrics): {
+			Summary:     "Prometheus metrics, requires the metrics token",
+			Tags:        []string{"meta"},
+			Auth:        true,
+			Responses:   map[int]any{http.StatusOK: ""},
+			ContentType: "text/plain",
+		},
+		handlerName(s.HealthHandler): {
+			Summary:   "Detailed health with the check errors and the connection pool stats, admin only",
+			Tags:      []string{"meta"},
+			Auth:      true,
+			Responses: map[int]any{http.StatusOK: healthResp{}},
+		},
+
+		handlerName(s.HandleSignup): {
+			Summary:   "Create an account",
+			Tags:      []string{"auth"},
+			Params:    idempotencyKey{},
+			Body:      user.UserSignUpReq{},
+			Responses: map[int]any{http.StatusCreated: user.User{}},
+		},
+		handlerName(s.handleSignin): {
+			Summary:   "Get a jwt",
+			Tags:      []string{"auth"},
+			Body:      user.UserSignInReq{},
+			Responses: map[int]any{http.StatusCreated: user.UserSignInResp{}},
+		},
+
+		handlerName(s.HandleAllUsers): {
+			Summary:   "List all users, admin only",
+			Tags:      []string{"users"},
+			Auth:      true,
+			Responses: map[int]any{http.StatusOK: []user.User{}},
+		},
+		handlerName(s.HandleUserByUserName): {
+			Summary:   "Get a user",
+			Tags:      []string{"users"},
+			Auth:      true,
+			Params:    userPath{},
+			Responses: map[int]any{http.StatusOK: user.User{}, http.StatusNotModified: nil},
+		},
+		handlerName(s.HandleUpdateUser): {
+			Summary:   "Patch a user with a merge or json patch, only admins may set isAdmin",
+			Tags:      []string{"users"},
+			Auth:      true,
+			Params:    userPath{},
+			Body:      user.UserUpdateReq{},
+			Responses: map[int]any{http.StatusOK: user.User{}},
+		},
+
+		handlerName(s.HandleGetAllTodosOfUser): {
+			Summary:   "List the todos of a user",
+			Tags:      []string{"todos"},
+			Auth:      true,
+			Params:    userPath{},
+			Responses: map[int]any{http.StatusOK: []todo.Todo{}},
+		},
+		handlerName(s.HandleAddTodoForUser): {
+			Summary:   "Add a todo",
+			Tags:      []string{"todos"},
+			Auth:      true,
+			Params:    idempotentUserPath{},
+			Body:      todo.TodoAddReq{},
+			Responses: map[int]any{http.StatusCreated: todo.Todo{}},
+		},
+		handlerName(s.HandleGetTodoByIDForUser): {
+			Summary:   "Get a todo",
+			Tags:      []string{"todos"},
+			Auth:      true,
+			Params:    todoPath{},
+			Responses: map[int]any{http.StatusOK: todo.Todo{}, http.StatusNotModified: nil},
+		},
+		handlerName(s.HandleUpdateTodoByIDForUser): {
+			Summary:   "Patch a todo with a merge or json patch",
+			Tags:      []string{"todos"},
+			Auth:      true,
+			Params:    todoPath{},
+			Body:      todo.TodoUpdateReq{},
+			Responses: map[int]any{http.StatusOK: todo.Todo{}},
+		},
+		handlerName(s.HandleDeleteTodoByIDForUser): {
+			Summary:   "Move a todo to the trash",
+			Tags:      []string{"todos"},
+			Auth:      true,
+			Params:    todoPath{},
+			Responses: map[int]any{http.StatusOK: nil},
+		},
+		handlerName(s.HandleTodoBatch): {
+			Summary:   "Create, update and delete many todos",
+			Tags:      []string{"todos"},
+			Auth:      true,
+			Params:    idempotentUserPath{},
+			Body:      todo.BatchReq{},
+			Responses: map[int]any{http.StatusOK: batchResp{}},
+		},
+		handlerName(s.HandleSearchTodosOfUser): {
+			Summary:   "Search the todos of a user",
+			Tags:      []string{"search"},
+			Auth:      true,
+			Params:    searchParams{},
+			Responses: map[int]any{http.StatusOK: []todo.SearchResult{}},
+		},
+		handlerName(s.HandleSearchAllTodos): {
+			Summary:   "Search the todos of every user, admin only",
+			Tags:      []string{"search"},
+			Auth:      true,
+			Params:    todo.SearchReq{},
+			Responses: map[int]any{http.StatusOK: []todo.SearchResult{}},
+		},
+
+		handlerName(s.HandleGetTodoChanges): {
+			Summary:   "Get the todo changes since a change token",
+			Tags:      []string{"sync"},
+			Auth:      true,
+			Params:    syncParams{},
+			Responses: map[int]any{http.StatusOK: todo.SyncResp{}},
+		},
+		handlerName(s.HandleSyncTodos): {
+			Summary:   "Apply offline changes and get the todo changes since a change token",
+			Tags:      []string{"sync"},
+			Auth:      true,
+			Params:    userPath{},
+			Body:      todo.SyncReq{},
+			Responses: map[int]any{http.StatusOK: todo.SyncResp{}},
+		},
+
+		handlerName(s.HandleGetTrash): {
+			Summary:   "List the trashed todos of a user",
+			Tags:      []string{"trash"},
+			Auth:      true,
+			Params:    userPath{},
+			Responses: map[int]any{http.StatusOK: []todo.Todo{}},
+		},
+		handlerName(s.HandleEmptyTrash): {
+			Summary:   "Purge every trashed todo",
+			Tags:      []string{"trash"},
+			Auth:      true,
+			Params:    userPath{},
+			Responses: map[int]any{http.StatusOK: map[string]int64{}},
+		},
+		handlerName(s.HandleRestoreTodo): {
+			Summary:   "Restore a todo from the trash",
+			Tags:      []string{"trash"},
+			Auth:      true,
+			Params:    todoPath{},
+			Responses: map[int]any{http.StatusOK: todo.Todo{}},
+		},
+		handlerName(s.HandlePurgeTodo): {
+			Summary:   "Purge a trashed todo",
+			Tags:      []string{"trash"},
+			Auth:      true,
+			Params:    todoPath{},
+			Responses: map[int]any{http.StatusNoContent: nil},
+		},
+
+		handlerName(s.HandleExport): {
+			Summary:   "Export the profile and todos of a user as an archive",
+			Tags:      []string{"archive"},
+			Auth:      true,
+			Params:    userPath{},
+			Responses: map[int]any{http.StatusOK: archive.Archive{}},
+		},
+		handlerName(s.HandleExportCSV): {
+			Summary:     "Export the todos of a user as csv",
+			Tags:        []string{"archive"},
+			Auth:        true,
+			Params:      userPath{},
+			Responses:   map[int]any{http.StatusOK: ""},
+			ContentType: "text/csv",
+		},
+		handlerName(s.HandleImport): {
+			Summary:   "Import the todos of an archive, skipping those imported before",
+			Tags:      []string{"archive"},
+			Auth:      true,
+			Params:    importParams{},
+			Body:      archive.Archive{},
+			Responses: map[int]any{http.StatusOK: archive.ImportResult{}},
+		},
+
+		handlerName(s.HandleTodoEventStream): {
+			Summary:     "Stream todo events as server-sent events",
+			Tags:        []string{"stream"},
+			Auth:        true,
+			Params:      streamParams{},
+			ContentType: "text/event-stream",
+			Responses:   map[int]any{http.StatusOK: events.Event{}},
+		},
+		handlerName(s.HandleTodoEventSocket): {
+			Summary:   "Stream todo events over a websocket",
+			Tags:      []string{"stream"},
+			Auth:      true,
+			Params:    streamParams{},
+			Responses: map[int]any{http.StatusSwitchingProtocols: nil},
+		},
+
+		handlerName(s.HandleGraphQL): {
+			Summary:   "Run a graphql query or mutation, the jwt is optional",
+			Tags:      []string{"graphql"},
+			Body:      graphqlReq{},
+			Responses: map[int]any{http.StatusOK: graphqlResp{}},
+		},
+		handlerName(s.HandleGraphQLQuery): {
+			Summary:   "Run a graphql query, the jwt is optional",
+			Tags:      []string{"graphql"},
+			Params:    graphqlParams{},
+			Responses: map[int]any{http.StatusOK: graphqlResp{}},
+		},
+
+		handlerName(s.HandleOpenAPISpec): {
+			Summary:   "This document",
+			Tags:      []string{"meta"},
+			Responses: map[int]any{http.StatusOK: nil},
+		},
+	}
+}
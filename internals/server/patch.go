@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+	"github.com/xenitane/todo-app-be-oe/internals/patch"
+)
+
+// patchDocument applies the patch in the request body to current, the
+// writable fields of a resource, and decodes the result into patched. The
+// content type picks the format: json patch, or merge patch, which plain
+// json is taken as.
+func patchDocument(c echo.Context, current, patched any) error {
+	ct, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	var apply func(doc, p []byte) ([]byte, error)
+	switch ct {
+	case echo.MIMEApplicationJSON, patch.MIMEMergePatch:
+		apply = patch.Merge
+	case patch.MIMEJSONPatch:
+		apply = patch.Apply
+	default:
+		return &echo.HTTPError{
+			Code:    http.StatusUnsupportedMediaType,
+			Message: "patches must be " + patch.MIMEMergePatch + " or " + patch.MIMEJSONPatch,
+		}
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Message:  "error reading request body",
+			Internal: err,
+		}
+	}
+	doc, err := json.Marshal(current)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "internal server error",
+			Internal: err,
+		}
+	}
+	doc, err = apply(doc, body)
+	if errors.Is(err, patch.ErrTestFailed) {
+		return &echo.HTTPError{
+			Code:     http.StatusConflict,
+			Message:  "a test operation of the patch failed",
+			Internal: err,
+		}
+	}
+	var pe *patch.Error
+	if errors.As(err, &pe) {
+		return &echo.HTTPError{
+			Code:    http.StatusUnprocessableEntity,
+			Message: "the patch cannot be applied",
+			Internal: xenmw.Violations{{
+				Field:   pe.Path,
+				Rule:    "patch",
+				Param:   strconv.Itoa(pe.Op),
+				Message: fmt.Sprintf("operation %d failed: %v", pe.Op, pe.Err),
+			}},
+		}
+	}
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Message:  "the patch is not valid",
+			Internal: err,
+		}
+	}
+
+	d := json.NewDecoder(bytes.NewReader(doc))
+	d.DisallowUnknownFields()
+	if err := d.Decode(patched); err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusUnprocessableEntity,
+			Message:  "invalid request body",
+			Internal: decodeViolations(err),
+		}
+	}
+	return nil
+}
+
+// decodeViolations describes why a patched document does not decode.
+func decodeViolations(err error) xenmw.Violations {
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		return xenmw.Violations{{
+			Field:   te.Field,
+			Rule:    "type",
+			Param:   te.Value,
+			Message: te.Field + " cannot be a " + te.Value,
+		}}
+	}
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field, _ = strconv.Unquote(field)
+		return xenmw.Violations{{
+			Field:   field,
+			Rule:    "unknown",
+			Message: field + " is not a field that can be patched",
+		}}
+	}
+	return xenmw.Violations{{Rule: "decode", Message: err.Error()}}
+}
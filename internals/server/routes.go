@@ -1,42 +1,119 @@
 package server
 
 import (
+	"log"
 	"net/http"
+	"path"
+	"strings"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
 
 	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+	"github.com/xenitane/todo-app-be-oe/internals/openapi"
+	"github.com/xenitane/todo-app-be-oe/internals/tracing"
 )
 
 func (s *Server) RegisterRoutes() http.Handler {
+	schema, err := s.graphqlSchema()
+	if err != nil {
+		log.Fatalf("invalid graphql schema: %v", err)
+	}
+	s.graphql = schema
+
 	e := echo.New()
+	e.HTTPErrorHandler = s.problems.HandleError
 	e.Use(middleware.Recover())
+	e.Use(otelecho.Middleware(tracing.ServiceName, otelecho.WithSkipper(func(c echo.Context) bool {
+		// the probes run every few seconds and would drown the traces
+		switch c.Path() {
+		case "/livez/", "/readyz/":
+			return true
+		}
+		return false
+	})))
+	e.Use(xenmw.RequestID(s.logger))
 	e.Use(xenmw.Logger())
+	e.Use(s.metrics.Middleware())
 	e.Use(xenmw.CORS())
 	e.Use(middleware.AddTrailingSlashWithConfig(middleware.TrailingSlashConfig{
-		Skipper:      middleware.DefaultSkipper,
+		// files such as openapi.json and the docs assets keep their path
+		Skipper: func(c echo.Context) bool {
+			return strings.Contains(path.Base(c.Request().URL.Path), ".")
+		},
 		RedirectCode: http.StatusFound,
 	}))
 
 	e.GET("/", s.HiHandler)
-	e.GET("/health/", s.HealthHandler)
+	e.GET("/livez/", s.LivenessHandler)
+	e.GET("/readyz/", s.ReadinessHandler)
+	e.GET("/health/", s.HealthHandler, xenmw.JWT(s.signingKey, s.checkToken))
+	if s.metricsHTTP == nil && s.metricsToken != "" {
+		e.GET("/metrics/", s.HandleMetrics, s.metricsAuth())
+	}
 
 	apiGrp := e.Group("/api")
 
+	s.RegisterDocsRoutes(apiGrp)
 	s.RegisterAuthRoutes(apiGrp.Group("/auth"))
-	s.RegisterUserRoutes(apiGrp.Group("/user", xenmw.JWT()))
+	s.RegisterUserRoutes(apiGrp.Group("/user", xenmw.JWT(s.signingKey, s.checkToken)))
+	s.RegisterSearchRoutes(apiGrp.Group("/search", xenmw.JWT(s.signingKey, s.checkToken)))
+	s.RegisterStreamRoutes(apiGrp.Group("/stream", xenmw.StreamJWT(s.signingKey, s.checkToken)))
+	s.RegisterGraphQLRoutes(apiGrp.Group("/graphql", xenmw.OptionalJWT(s.signingKey, s.checkToken)))
+
+	s.spec = openapi.Build(openapi.Info{
+		Title:   "Todo App",
+		Version: "1.0.0",
+	}, e.Routes(), s.apiDocs())
+	if s.debug {
+		e.Use(openapi.Validator(s.spec))
+	}
 
 	return e
 }
 
+func getClaims(c echo.Context) (*xenmw.JWTCustomClaims, error) {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return nil, &echo.HTTPError{
+			Code:    http.StatusInternalServerError,
+			Message: "jwt missing",
+		}
+	}
+	claims, ok := token.Claims.(*xenmw.JWTCustomClaims)
+	if !ok {
+		return nil, &echo.HTTPError{
+			Code:    http.StatusInternalServerError,
+			Message: "failed to cast claims",
+		}
+	}
+	return claims, nil
+}
+
+// authorize applies the rule the routes share: users may act on their own
+// account, admins on any when adminAllowed is set. claims is nil for
+// anonymous callers.
+func authorize(claims *xenmw.JWTCustomClaims, username string, adminAllowed bool) error {
+	if claims == nil {
+		return &echo.HTTPError{
+			Code:    http.StatusUnauthorized,
+			Message: "missing or malformed jwt",
+		}
+	}
+	if claims.Username != username && !(adminAllowed && claims.IsAdmin) {
+		return &echo.HTTPError{
+			Code:    http.StatusUnauthorized,
+			Message: "you dont have access",
+		}
+	}
+	return nil
+}
+
 func (s *Server) HiHandler(c echo.Context) error {
 	resp := map[string]string{
 		"message": "Hello there",
 	}
 	return c.JSON(http.StatusOK, resp)
 }
-
-func (s *Server) HealthHandler(c echo.Context) error {
-	return c.JSON(http.StatusOK, s.db.Health())
-}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/xenitane/todo-app-be-oe/internals/health"
+)
+
+func TestHi(t *testing.T) {
+	ts := newTestServer(t)
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/"})
+	if got := decode[map[string]string](t, rec)["message"]; got != "Hello there" {
+		t.Errorf("message = %q", got)
+	}
+	if rec.Header().Get("X-Request-Id") == "" {
+		t.Error("the response has no request id")
+	}
+}
+
+func TestTrailingSlashRedirect(t *testing.T) {
+	ts := newTestServer(t)
+	rec := ts.expect(http.StatusFound, request{method: http.MethodGet, path: "/livez"})
+	if got := rec.Header().Get("Location"); got != "/livez/" {
+		t.Errorf("redirected to %q, want /livez/", got)
+	}
+}
+
+func TestProbes(t *testing.T) {
+	ts := newTestServer(t)
+	for _, path := range []string{"/livez/", "/readyz/"} {
+		rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: path})
+		if got := decode[health.Report](t, rec).Status; got != health.StatusUp {
+			t.Errorf("%s status = %q, want %q", path, got, health.StatusUp)
+		}
+	}
+
+	ts.draining.Store(true)
+	rec := ts.expect(http.StatusServiceUnavailable, request{method: http.MethodGet, path: "/readyz/"})
+	if got := decode[health.Report](t, rec).Status; got != health.StatusDraining {
+		t.Errorf("status while draining = %q, want %q", got, health.StatusDraining)
+	}
+}
+
+func TestReadinessFollowsTheDatabase(t *testing.T) {
+	ts := newTestServer(t)
+	ts.db.Close()
+	ts.expect(http.StatusServiceUnavailable, request{method: http.MethodGet, path: "/readyz/"})
+}
+
+func TestHealth(t *testing.T) {
+	ts := newTestServer(t)
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/health/"})
+
+	token := ts.signup("regular")
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/health/", token: token})
+
+	admin := ts.admin("admin1")
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/health/", token: admin})
+	resp := decode[healthResp](t, rec)
+	for _, check := range []string{"database", "migrations", "events"} {
+		if res, ok := resp.Checks[check]; !ok || res.Status != health.StatusUp {
+			t.Errorf("check %s = %+v, want it up", check, res)
+		}
+	}
+	if resp.Pool["message"] == "" {
+		t.Errorf("the pool stats are missing: %v", resp.Pool)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t)
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/metrics/"})
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/metrics/", token: "wrong"})
+
+	ts.signup("counted")
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/metrics/", token: testMetricsToken})
+	for _, metric := range []string{"todoapp_signups_total 1", "todoapp_http_requests_total", "todoapp_db_query_duration_seconds"} {
+		if !strings.Contains(rec.Body.String(), metric) {
+			t.Errorf("the metrics lack %s", metric)
+		}
+	}
+}
+
+func TestDocs(t *testing.T) {
+	ts := newTestServer(t)
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/api/openapi.json"})
+	spec := decode[struct {
+		OpenAPI string         `json:"openapi"`
+		Paths   map[string]any `json:"paths"`
+	}](t, rec)
+	if spec.OpenAPI == "" || spec.Paths["/api/user/{username}/todo/"] == nil {
+		t.Errorf("the spec is incomplete: %s", rec.Body)
+	}
+
+	ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/api/docs/"})
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/api/docs/swagger-initializer.js"})
+	if !strings.Contains(rec.Body.String(), specPath) {
+		t.Error("the docs do not load the spec")
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	ts := newTestServer(t)
+	rec := ts.expect(http.StatusNotFound, request{method: http.MethodGet, path: "/nowhere/"})
+	if code := problemCode(t, rec); code != "not_found" {
+		t.Errorf("problem code = %q, want not_found", code)
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+func (s *Server) RegisterSearchRoutes(g *echo.Group) {
+	g.GET("/todo/", s.HandleSearchAllTodos)
+}
+
+// HandleSearchTodosOfUser searches the todos of the user in the path.
+func (s *Server) HandleSearchTodosOfUser(c echo.Context) error {
+	claims, err := getClaims(c)
+	if err != nil {
+		return err
+	}
+	if claims.Username != c.Param("username") && !claims.IsAdmin {
+		return &echo.HTTPError{
+			Code:    http.StatusUnauthorized,
+			Message: "you dont have access",
+		}
+	}
+	u, err := s.db.GetUserByUserName(c.Request().Context(), c.Param("username"))
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusNotFound,
+			Message:  "this user does not exist",
+			Internal: err,
+		}
+	}
+	return s.searchTodos(c, u.UserId)
+}
+
+// HandleSearchAllTodos lets admins search the todos of every user.
+func (s *Server) HandleSearchAllTodos(c echo.Context) error {
+	claims, err := getClaims(c)
+	if err != nil {
+		return err
+	}
+	if !claims.IsAdmin {
+		return &echo.HTTPError{
+			Code:    http.StatusUnauthorized,
+			Message: "you are not admin",
+		}
+	}
+	return s.searchTodos(c, 0)
+}
+
+func (s *Server) searchTodos(c echo.Context, ownerID int64) error {
+	searchReq := new(todo.SearchReq)
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, searchReq); err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Message:  "invalid search parameters",
+			Internal: err,
+		}
+	}
+	results, err := s.search(c.Request().Context(), searchReq, ownerID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, results)
+}
+
+// search validates the search and runs it over the todos of the owner, or
+// of every user for an ownerID of 0.
+func (s *Server) search(ctx context.Context, searchReq *todo.SearchReq, ownerID int64) ([]*todo.SearchResult, error) {
+	searchReq.Query = strings.TrimSpace(searchReq.Query)
+	if err := s.v.Struct(searchReq); err != nil {
+		return nil, &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Message:  "invalid search parameters",
+			Internal: err,
+		}
+	}
+	results, err := s.db.SearchTodos(ctx, &todo.SearchQuery{
+		SearchReq: *searchReq,
+		OwnerID:   ownerID,
+	})
+	if err != nil {
+		return nil, &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "internal server error",
+			Internal: err,
+		}
+	}
+	if ownerID != 0 {
+		for _, r := range results {
+			r.Username = ""
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+func TestSearchAllTodos(t *testing.T) {
+	ts := newTestServer(t)
+	first := ts.signup("firstuser")
+	second := ts.signup("seconduser")
+	admin := ts.admin("theadmin")
+	ts.addTodo(first, "firstuser", "Quarterly report")
+	ts.addTodo(second, "seconduser", "Report the bug")
+	ts.addTodo(second, "seconduser", "Unrelated todo")
+
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/api/search/todo/?q=report", token: first})
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/api/search/todo/?q=report", token: admin})
+	results := decode[[]todo.SearchResult](t, rec)
+	owners := map[string]bool{}
+	for _, r := range results {
+		owners[r.Username] = true
+	}
+	if len(results) != 2 || !owners["firstuser"] || !owners["seconduser"] {
+		t.Errorf("found %+v", results)
+	}
+
+	ts.expect(http.StatusBadRequest, request{method: http.MethodGet, path: "/api/search/todo/", token: admin})
+}
@@ -2,44 +2,182 @@ package server
 
 import (
 	"fmt"
+	"log/slog"
 	"net/http"
-	"os"
-	"strconv"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/graphql-go/graphql"
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/config"
 	"github.com/xenitane/todo-app-be-oe/internals/database"
+	"github.com/xenitane/todo-app-be-oe/internals/events"
+	"github.com/xenitane/todo-app-be-oe/internals/health"
+	"github.com/xenitane/todo-app-be-oe/internals/logging"
+	"github.com/xenitane/todo-app-be-oe/internals/metrics"
+	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+	"github.com/xenitane/todo-app-be-oe/internals/openapi"
+	"github.com/xenitane/todo-app-be-oe/internals/tracing"
 )
 
 type Server struct {
-	port int
-	v    *validator.Validate
-	db   database.Service
+	port   int
+	v      *validator.Validate
+	db     database.Service
+	logger *slog.Logger
+	now    func() time.Time
+
+	// signingKey signs and verifies the jwts
+	signingKey []byte
+
+	problems *xenmw.Problems
+
+	events *events.Broker
+
+	trashRetention time.Duration
+
+	// idempotent makes retried POSTs carrying an Idempotency-Key safe,
+	// idempotencyInDB is set when their responses are kept in the database
+	idempotent      echo.MiddlewareFunc
+	idempotencyInDB bool
+
+	// debug exposes internal error details to clients and validates
+	// requests and responses against the api specification
+	debug bool
+
+	spec    *openapi.Document
+	graphql graphql.Schema
+
+	metrics *metrics.Metrics
+	// metricsToken guards the metrics, metricsHTTP serves them on a port of
+	// their own when set
+	metricsToken string
+	metricsHTTP  *http.Server
+
+	http *http.Server
+	// grpcCalls counts the running grpc calls, which http.Server.Shutdown
+	// does not wait for
+	grpcCalls sync.WaitGroup
+	// workers counts the background goroutines Run starts, workersRunning
+	// those that have not returned yet
+	workers        sync.WaitGroup
+	workersStarted atomic.Int32
+	workersRunning atomic.Int32
+
+	liveness  *health.Checker
+	readiness *health.Checker
+
+	shutdownDelay   time.Duration
+	shutdownTimeout time.Duration
+	// draining is set once shutdown begins, the server reports itself not
+	// ready from then on
+	draining atomic.Bool
+	// stopping is closed when shutdown begins, to end the open streams
+	stopping     chan struct{}
+	stoppingOnce sync.Once
+}
+
+// Deps are what the server runs on besides its config.
+type Deps struct {
+	DB database.Service
+	// Clock tells the time, time.Now when nil
+	Clock func() time.Time
+}
+
+// New builds the server on the postgres database of the config, Run serves
+// it.
+func New(cfg *config.Config) *Server {
+	return NewWithDeps(cfg, Deps{DB: database.New(cfg.DB)})
 }
 
-func New() *http.Server {
-	port, _ := strconv.Atoi(os.Getenv("PORT"))
+// NewWithDeps builds the server on the given dependencies, tests use it to
+// run it on the memory database.
+func NewWithDeps(cfg *config.Config, deps Deps) *Server {
+	if deps.Clock == nil {
+		deps.Clock = time.Now
+	}
+	m := metrics.New()
+	db := deps.DB
+	m.RegisterDBStats(db)
+
 	NewServer := &Server{
-		port: port,
-		v:    validator.New(),
-		db:   database.New(),
+		port:       cfg.Port,
+		v:          validator.New(),
+		db:         database.Observe(db, tracing.ObserveQuery(db.System()), m.ObserveQuery, logging.ObserveQuery, database.Timeout(cfg.DB.QueryTimeout, cfg.DB.TxTimeout)),
+		logger:     slog.Default(),
+		now:        deps.Clock,
+		signingKey: []byte(cfg.JWT.SigningKey),
+
+		metrics:      m,
+		metricsToken: cfg.Metrics.Token,
+
+		trashRetention: cfg.TrashRetention,
+
+		debug: cfg.Development(),
+
+		shutdownDelay:   cfg.ShutdownDelay,
+		shutdownTimeout: cfg.ShutdownTimeout,
+		stopping:        make(chan struct{}),
+	}
+
+	if cfg.IdempotencyStore == config.IdempotencyMemory {
+		NewServer.idempotent = xenmw.Idempotency(xenmw.NewMemoryIdempotencyStore(cfg.IdempotencyMaxBytes), cfg.IdempotencyTTL, cfg.IdempotencyLease)
+	} else {
+		NewServer.idempotent = xenmw.Idempotency(dbIdempotencyStore{db: NewServer.db}, cfg.IdempotencyTTL, cfg.IdempotencyLease)
+		NewServer.idempotencyInDB = true
 	}
 
-	NewServer.v.RegisterValidation("not-stale", validateDateNotStale)
+	NewServer.v.RegisterValidation("not-stale", NewServer.validateDateNotStale)
+	NewServer.v.RegisterTagNameFunc(requestFieldName)
+	NewServer.problems = xenmw.NewProblems(NewServer.v, NewServer.debug)
 
-	return &http.Server{
+	NewServer.events = events.NewBroker(NewServer.db)
+	NewServer.registerHealthChecks()
+
+	if cfg.Metrics.Port != 0 {
+		NewServer.metricsHTTP = &http.Server{
+			Addr:         fmt.Sprintf(":%d", cfg.Metrics.Port),
+			Handler:      NewServer.metricsRoutes(),
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+	}
+
+	NewServer.http = &http.Server{
 		Addr:         fmt.Sprintf(":%d", NewServer.port),
-		Handler:      NewServer.RegisterRoutes(),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
+	NewServer.http.Handler = NewServer.withGRPC(NewServer.RegisterGRPCServices(), NewServer.RegisterRoutes())
+	NewServer.http.RegisterOnShutdown(NewServer.stopStreams)
+
+	return NewServer
 }
 
-func validateDateNotStale(fl validator.FieldLevel) bool {
+func (s *Server) validateDateNotStale(fl validator.FieldLevel) bool {
 	ts, ok := fl.Field().Interface().(time.Time)
 	if !ok {
 		return false
 	}
-	return !ts.Before(time.Now().Round(0))
+	return !ts.Before(s.now().Round(0))
+}
+
+// requestFieldName names struct fields in validation errors the way clients
+// see them, by their json or query parameter name.
+func requestFieldName(f reflect.StructField) string {
+	for _, key := range []string{"json", "query"} {
+		name, _, _ := strings.Cut(f.Tag.Get(key), ",")
+		if name == "-" {
+			return ""
+		}
+		if name != "" {
+			return name
+		}
+	}
+	return f.Name
 }
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/config"
+	"github.com/xenitane/todo-app-be-oe/internals/database"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+const (
+	testPassword     = "correct horse"
+	testMetricsToken = "metrics-token"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testClock is a clock the tests set, it starts at the current time.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// testServer is a server on the memory database, validating its traffic
+// against the api specification like in development.
+type testServer struct {
+	*Server
+	t     *testing.T
+	db    database.Service
+	clock *testClock
+}
+
+func testConfig() *config.Config {
+	cfg := config.Default()
+	cfg.Env = config.EnvDevelopment
+	cfg.JWT.SigningKey = "test-signing-key"
+	cfg.Metrics.Token = testMetricsToken
+	return cfg
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	return newTestServerWith(t, testConfig())
+}
+
+// newProductionTestServer is a test server configured like in production, it
+// does not check the traffic against the api specification, so the tests
+// reach the checks of the handlers.
+func newProductionTestServer(t *testing.T) *testServer {
+	t.Helper()
+	cfg := testConfig()
+	cfg.Env = config.EnvProduction
+	return newTestServerWith(t, cfg)
+}
+
+func newTestServerWith(t *testing.T, cfg *config.Config) *testServer {
+	t.Helper()
+	clock := &testClock{now: time.Now()}
+	db := database.NewMemory(clock.Now)
+	s := NewWithDeps(cfg, Deps{DB: db, Clock: clock.Now})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.startWorker(func() { s.events.Run(ctx) })
+	t.Cleanup(func() {
+		cancel()
+		s.workers.Wait()
+		db.Close()
+	})
+	// the event listener subscribes in the background
+	for s.events.Listening(ctx) != nil {
+		time.Sleep(time.Millisecond)
+	}
+	return &testServer{Server: s, t: t, db: db, clock: clock}
+}
+
+// replica is another server on the database of ts, the way another replica
+// of the api runs. Its workers are not started.
+func (ts *testServer) replica() *testServer {
+	return &testServer{
+		Server: NewWithDeps(testConfig(), Deps{DB: ts.db, Clock: ts.clock.Now}),
+		t:      ts.t,
+		db:     ts.db,
+		clock:  ts.clock,
+	}
+}
+
+// request describes a call to the api. A body that is not a string is sent
+// as json.
+type request struct {
+	method  string
+	path    string
+	token   string
+	body    any
+	headers map[string]string
+}
+
+func (ts *testServer) do(r request) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var body io.Reader
+	switch b := r.body.(type) {
+	case nil:
+	case string:
+		body = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(r.method, r.path, body)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	ts.http.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// expect does the request and fails the test unless it answers with code.
+func (ts *testServer) expect(code int, r request) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	rec := ts.do(r)
+	if rec.Code != code {
+		ts.t.Fatalf("%s %s answered %d, want %d: %s", r.method, r.path, rec.Code, code, rec.Body)
+	}
+	return rec
+}
+
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	return v
+}
+
+// problemCode is the code of the problem details the response carries.
+func problemCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/problem+json") {
+		t.Fatalf("the error is served as %q: %s", ct, rec.Body)
+	}
+	return decode[struct {
+		Code string `json:"code"`
+	}](t, rec).Code
+}
+
+// signup creates a user through the api and signs it in.
+func (ts *testServer) signup(username string) string {
+	ts.t.Helper()
+	ts.expect(http.StatusCreated, request{method: http.MethodPost, path: "/api/auth/signup/", body: map[string]string{
+		"username":  username,
+		"password":  testPassword,
+		"firstName": "Test",
+		"lastName":  "User",
+	}})
+	return ts.signin(username)
+}
+
+func (ts *testServer) signin(username string) string {
+	ts.t.Helper()
+	rec := ts.expect(http.StatusCreated, request{method: http.MethodPost, path: "/api/auth/signin/", body: map[string]string{
+		"username": username,
+		"password": testPassword,
+	}})
+	return decode[user.UserSignInResp](ts.t, rec).Token
+}
+
+// admin stores an admin directly, the api cannot create the first one.
+func (ts *testServer) admin(username string) string {
+	ts.t.Helper()
+	u, err := user.NewFromReg(context.Background(), &user.UserSignUpReq{
+		Username:  username,
+		Password:  testPassword,
+		FirstName: "Admin",
+		LastName:  "User",
+	})
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	u.IsAdmin = true
+	if err := ts.db.InsertUser(context.Background(), u); err != nil {
+		ts.t.Fatal(err)
+	}
+	return ts.signin(username)
+}
+
+// dueDate is a due date the server accepts.
+func (ts *testServer) dueDate() string {
+	return ts.clock.Now().Add(48 * time.Hour).UTC().Format(time.RFC3339)
+}
+
+// addTodo creates a todo through the api and returns its id.
+func (ts *testServer) addTodo(token, username, title string) int64 {
+	ts.t.Helper()
+	rec := ts.expect(http.StatusCreated, request{method: http.MethodPost, path: todosURL(username), token: token, body: map[string]string{
+		"title":       title,
+		"description": "Some details",
+		"dueDate":     ts.dueDate(),
+	}})
+	return decode[struct {
+		ID int64 `json:"todo_id"`
+	}](ts.t, rec).ID
+}
+
+func todosURL(username string) string {
+	return "/api/user/" + username + "/todo/"
+}
+
+func todoURL(username string, id int64) string {
+	return fmt.Sprintf("/api/user/%s/todo/%d/", username, id)
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/events"
+	"github.com/xenitane/todo-app-be-oe/internals/logging"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"golang.org/x/net/websocket"
+)
+
+const streamKeepAlive = 15 * time.Second
+
+func (s *Server) RegisterStreamRoutes(g *echo.Group) {
+	userGroup := g.Group("/:username")
+	userGroup.GET("/", s.HandleTodoEventStream)
+	userGroup.GET("/ws/", s.HandleTodoEventSocket)
+}
+
+// authorizeStream checks that the caller may watch the todos of the user in
+// the path and subscribes to that user's events.
+func (s *Server) authorizeStream(c echo.Context) (<-chan events.Event, func(), error) {
+	claims, err := getClaims(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if claims.Username != c.Param("username") && !claims.IsAdmin {
+		return nil, nil, &echo.HTTPError{
+			Code:    http.StatusUnauthorized,
+			Message: "you dont have access",
+		}
+	}
+	u, err := s.db.GetUserByUserName(c.Request().Context(), c.Param("username"))
+	if err != nil {
+		return nil, nil, &echo.HTTPError{
+			Code:     http.StatusNotFound,
+			Message:  "this user does not exist",
+			Internal: err,
+		}
+	}
+	ch, cancel := s.events.Subscribe(u.Username)
+	return ch, cancel, nil
+}
+
+func (s *Server) HandleTodoEventStream(c echo.Context) error {
+	ch, cancel, err := s.authorizeStream(c)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	// the stream outlives the server wide write timeout
+	rc := http.NewResponseController(c.Response().Writer)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+		return err
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-s.stopping:
+			return nil
+		case <-ticker.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+		case e, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+	}
+}
+
+func (s *Server) HandleTodoEventSocket(c echo.Context) error {
+	ch, cancel, err := s.authorizeStream(c)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	// websocket.Server without a Handshake accepts any origin, in line with
+	// the CORS policy of the rest of the api
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		// the client never sends anything meaningful, reading only tells us
+		// when it goes away
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+		}()
+
+		ticker := time.NewTicker(streamKeepAlive)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-closed:
+				return
+			case <-s.stopping:
+				return
+			case <-ticker.C:
+				ws.PayloadType = websocket.PingFrame
+				_, err := ws.Write(nil)
+				ws.PayloadType = websocket.TextFrame
+				if err != nil {
+					return
+				}
+			case e, ok := <-ch:
+				if !ok {
+					return
+				}
+				ws.SetWriteDeadline(time.Now().Add(streamKeepAlive))
+				if err := websocket.JSON.Send(ws, e); err != nil {
+					return
+				}
+			}
+		}
+	}}.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// publishTodoEvent tells every open stream about a change. The change itself
+// has already been stored, so a failure is logged rather than returned, and
+// the event is published even when the client has gone away.
+func (s *Server) publishTodoEvent(ctx context.Context, kind, username string, t *todo.Todo) {
+	if err := s.events.Publish(context.WithoutCancel(ctx), events.Event{
+		Type:     kind,
+		Username: username,
+		Todo:     t,
+	}); err != nil {
+		logging.FromContext(ctx).ErrorContext(ctx, "failed to publish event", slog.String("kind", kind), slog.String("err", err.Error()))
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xenitane/todo-app-be-oe/internals/events"
+	"golang.org/x/net/websocket"
+)
+
+func TestTodoEventStream(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("streamer")
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/api/stream/streamer/", token: ts.signup("streamsnoop")})
+
+	srv := httptest.NewServer(ts.http.Handler)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/stream/streamer/?access_token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("the stream is served as %q", ct)
+	}
+
+	// the subscription is in place once the headers are sent
+	ts.addTodo(token, "streamer", "Streamed todo")
+
+	lines := bufio.NewScanner(res.Body)
+	for lines.Scan() {
+		if lines.Text() != "event: "+events.TodoCreated {
+			continue
+		}
+		if lines.Scan(); !strings.Contains(lines.Text(), "Streamed todo") {
+			t.Errorf("the event carries %q", lines.Text())
+		}
+		return
+	}
+	t.Fatalf("the stream ended without the event: %v", lines.Err())
+}
+
+func TestTodoEventSocket(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("streamer")
+
+	srv := httptest.NewServer(ts.http.Handler)
+	defer srv.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/stream/streamer/ws/?access_token="+token, "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// the subscription happens before the handshake, so it is in place
+	ts.addTodo(token, "streamer", "Socket todo")
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var e events.Event
+	if err := websocket.JSON.Receive(ws, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != events.TodoCreated || e.Username != "streamer" || e.Todo == nil || e.Todo.Title != "Socket todo" {
+		t.Errorf("received %+v", e)
+	}
+}
+
+func TestStreamTokenNotLogged(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	ts := newTestServer(t)
+	ts.signup("streamer")
+	token := ts.signup("streamsnoop")
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/api/stream/streamer/?access_token=" + token})
+
+	if strings.Contains(logs.String(), token) {
+		t.Errorf("the jwt was logged: %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "access_token=REDACTED") {
+		t.Errorf("the request was not logged with the token redacted: %s", logs.String())
+	}
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/database"
+	"github.com/xenitane/todo-app-be-oe/internals/events"
+	"github.com/xenitane/todo-app-be-oe/internals/logging"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+func (s *Server) RegisterSyncRoutes(g *echo.Group) {
+	g.GET("/", s.HandleGetTodoChanges)
+	g.POST("/", s.HandleSyncTodos)
+}
+
+// HandleGetTodoChanges returns the todos changed since the change token in
+// the since query parameter. An empty token returns everything.
+func (s *Server) HandleGetTodoChanges(c echo.Context) error {
+	claims, err := getClaims(c)
+	if err != nil {
+		return err
+	}
+	if claims.Username != c.Param("username") && !claims.IsAdmin {
+		return &echo.HTTPError{
+			Code:    http.StatusUnauthorized,
+			Message: "you dont have access",
+		}
+	}
+	u, err := s.db.GetUserByUserName(c.Request().Context(), c.Param("username"))
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusNotFound,
+			Message:  "this user does not exist",
+			Internal: err,
+		}
+	}
+	since, err := parseChangeToken(c.QueryParam("since"))
+	if err != nil {
+		return err
+	}
+	return s.respondWithChanges(c, u, since, []todo.SyncResult{})
+}
+
+// HandleSyncTodos applies the mutations an offline client has queued, in
+// order, and then answers like HandleGetTodoChanges. A mutation that fails
+// does not stop the ones after it; its result says why it was not applied.
+func (s *Server) HandleSyncTodos(c echo.Context) error {
+	claims, err := getClaims(c)
+	if err != nil {
+		return err
+	}
+	if claims.Username != c.Param("username") {
+		return &echo.HTTPError{
+			Code:    http.StatusUnauthorized,
+			Message: "You don't have permissions for this method",
+		}
+	}
+	u, err := s.db.GetUserByUserName(c.Request().Context(), c.Param("username"))
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusNotFound,
+			Message:  "this user does not exist",
+			Internal: err,
+		}
+	}
+	syncReq := new(todo.SyncReq)
+	if err := c.Bind(syncReq); err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusUnprocessableEntity,
+			Message:  "error binding request body",
+			Internal: err,
+		}
+	}
+	if err := s.v.Struct(syncReq); err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusUnprocessableEntity,
+			Message:  "invalid request body",
+			Internal: err,
+		}
+	}
+	since, err := parseChangeToken(syncReq.Since)
+	if err != nil {
+		return err
+	}
+
+	results := make([]todo.SyncResult, 0, len(syncReq.Mutations))
+	for i := range syncReq.Mutations {
+		results = append(results, s.applySyncMutation(c, u, &syncReq.Mutations[i]))
+	}
+	return s.respondWithChanges(c, u, since, results)
+}
+
+func (s *Server) respondWithChanges(c echo.Context, u *user.User, since int64, results []todo.SyncResult) error {
+	cs, err := s.db.GetTodoChangesForUser(c.Request().Context(), u.UserId, since)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "internal server error",
+			Internal: err,
+		}
+	}
+	return c.JSON(http.StatusOK, todo.SyncResp{
+		Token:   strconv.FormatInt(cs.Token, 10),
+		Todos:   cs.Todos,
+		Deleted: cs.Deleted,
+		Results: results,
+	})
+}
+
+func parseChangeToken(token string) (int64, error) {
+	if token == "" {
+		return 0, nil
+	}
+	since, err := strconv.ParseInt(token, 10, 64)
+	if err != nil || since < 0 {
+		return 0, &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Message:  "invalid change token",
+			Internal: err,
+		}
+	}
+	return since, nil
+}
+
+// applySyncMutation applies m and reports how it went. A mutation failing
+// the rules of its route is rejected with the violations it got.
+func (s *Server) applySyncMutation(c echo.Context, u *user.User, m *todo.SyncMutation) todo.SyncResult {
+	ctx := c.Request().Context()
+	res := todo.SyncResult{
+		Op:       m.Op,
+		ClientID: m.ClientID,
+		TodoID:   m.TodoID,
+	}
+	if m.Todo != nil {
+		m.Todo.Title = strings.TrimSpace(m.Todo.Title)
+		m.Todo.Description = strings.TrimSpace(m.Todo.Description)
+	}
+	if m.Changes != nil {
+		m.Changes.Trim()
+	}
+	if err := s.v.Struct(m); err != nil {
+		p := s.problems.New(&echo.HTTPError{Code: http.StatusUnprocessableEntity, Internal: err}, c)
+		res.Status = todo.SyncRejected
+		res.Error = err.Error()
+		res.Violations = p.Violations
+		return res
+	}
+
+	switch m.Op {
+	case todo.SyncOpCreate:
+		t, tid, created, err := s.syncCreate(ctx, u, m)
+		if err != nil {
+			return syncFailure(ctx, res, err)
+		}
+		if created {
+			s.metrics.TodosCreated.Inc()
+			s.publishTodoEvent(ctx, events.TodoCreated, u.Username, t)
+		}
+		res.TodoID = tid
+		res.Status = todo.SyncApplied
+		res.Todo = t
+
+	case todo.SyncOpUpdate:
+		t, err := s.db.GetTodoByIDForUser(ctx, m.TodoID, u.UserId)
+		if err != nil {
+			return syncFailure(ctx, res, err)
+		}
+		if t.Version != m.BaseVersion {
+			res.Status = todo.SyncConflict
+			res.Todo = t
+			return res
+		}
+		wasCompleted := t.Status == todo.StatusCompleted
+		if t.Apply(m.Changes) {
+			if err := s.db.UpdateTodoByIdForUser(ctx, t); err != nil {
+				return s.syncConflictOrFailure(ctx, res, u, err)
+			}
+			if !wasCompleted && t.Status == todo.StatusCompleted {
+				s.metrics.TodosCompleted.Inc()
+			}
+			s.publishTodoEvent(ctx, events.TodoUpdated, u.Username, t)
+		}
+		res.Status = todo.SyncApplied
+		res.Todo = t
+
+	case todo.SyncOpDelete:
+		if err := s.db.DeleteTodoByIDForUser(ctx, m.TodoID, u.UserId, m.BaseVersion); err != nil {
+			return s.syncConflictOrFailure(ctx, res, u, err)
+		}
+		s.publishTodoEvent(ctx, events.TodoDeleted, u.Username, &todo.Todo{TodoId: m.TodoID})
+		res.Status = todo.SyncApplied
+	}
+	return res
+}
+
+// syncCreate creates the todo of a create mutation, unless the client sent
+// it before, and returns it with its id. A create sent again returns the
+// todo it created, nil when that todo was deleted since.
+func (s *Server) syncCreate(ctx context.Context, u *user.User, m *todo.SyncMutation) (t *todo.Todo, tid int64, created bool, err error) {
+	err = s.db.WithTx(ctx, func(tx database.Store) error {
+		t, created = nil, false
+		var err error
+		tid, err = tx.GetClientTodoID(ctx, u.UserId, m.ClientID)
+		if err == nil {
+			t, err = tx.GetTodoByIDForUser(ctx, tid, u.UserId)
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		t = todo.NewFromAdd(m.Todo, u.UserId)
+		if err := tx.InsertTodo(ctx, t); err != nil {
+			return err
+		}
+		tid, created = t.TodoId, true
+		return tx.InsertClientTodoID(ctx, u.UserId, m.ClientID, t.TodoId)
+	})
+	return t, tid, created, err
+}
+
+func (s *Server) syncConflictOrFailure(ctx context.Context, res todo.SyncResult, u *user.User, err error) todo.SyncResult {
+	if !errors.Is(err, database.ErrVersionConflict) {
+		return syncFailure(ctx, res, err)
+	}
+	t, err := s.db.GetTodoByIDForUser(ctx, res.TodoID, u.UserId)
+	if err != nil {
+		return syncFailure(ctx, res, err)
+	}
+	res.Status = todo.SyncConflict
+	res.Todo = t
+	return res
+}
+
+func syncFailure(ctx context.Context, res todo.SyncResult, err error) todo.SyncResult {
+	if errors.Is(err, sql.ErrNoRows) {
+		res.Status = todo.SyncNotFound
+		return res
+	}
+	logging.FromContext(ctx).ErrorContext(ctx, "sync mutation failed", slog.String("err", err.Error()))
+	res.Status = todo.SyncRejected
+	res.Error = "internal server error"
+	return res
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+func syncURL(username string) string {
+	return "/api/user/" + username + "/sync/"
+}
+
+func TestGetTodoChanges(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("syncer")
+	ts.addTodo(token, "syncer", "Kept todo")
+	deleted := ts.addTodo(token, "syncer", "Deleted todo")
+
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: syncURL("syncer"), token: token})
+	full := decode[todo.SyncResp](t, rec)
+	if len(full.Todos) != 2 || len(full.Deleted) != 0 || full.Token == "" {
+		t.Fatalf("full sync = %+v", full)
+	}
+
+	ts.expect(http.StatusOK, request{method: http.MethodDelete, path: todoURL("syncer", deleted), token: token})
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: syncURL("syncer") + "?since=" + full.Token, token: token})
+	changes := decode[todo.SyncResp](t, rec)
+	if len(changes.Todos) != 0 || len(changes.Deleted) != 1 || changes.Deleted[0] != deleted {
+		t.Errorf("changes = %+v, want the delete of %d", changes, deleted)
+	}
+
+	ts.expect(http.StatusBadRequest, request{method: http.MethodGet, path: syncURL("syncer") + "?since=nope", token: token})
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: syncURL("syncer"), token: ts.signup("syncsnoop")})
+}
+
+func TestSyncTodos(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("syncer")
+	stale := ts.addTodo(token, "syncer", "Changed elsewhere")
+	ts.expect(http.StatusOK, request{method: http.MethodPatch, path: todoURL("syncer", stale), token: token, body: map[string]any{
+		"status": 1,
+	}})
+
+	rec := ts.expect(http.StatusOK, request{method: http.MethodPost, path: syncURL("syncer"), token: token, body: map[string]any{
+		"mutations": []map[string]any{
+			{"op": "create", "clientId": "tmp-1", "todo": map[string]string{"title": "Made offline", "description": "Some details", "dueDate": ts.dueDate()}},
+			{"op": "update", "todoId": stale, "baseVersion": 1, "changes": map[string]any{"status": 2}},
+			{"op": "delete", "todoId": 999, "baseVersion": 1},
+		},
+	}})
+	resp := decode[todo.SyncResp](t, rec)
+	if len(resp.Results) != 3 {
+		t.Fatalf("results = %+v", resp.Results)
+	}
+	if r := resp.Results[0]; r.Status != todo.SyncApplied || r.ClientID != "tmp-1" || r.TodoID == 0 {
+		t.Errorf("create result = %+v", r)
+	}
+	if r := resp.Results[1]; r.Status != todo.SyncConflict || r.Todo == nil || r.Todo.Status != 1 {
+		t.Errorf("update result = %+v, want a conflict with the server copy", r)
+	}
+	if r := resp.Results[2]; r.Status != todo.SyncNotFound {
+		t.Errorf("delete result = %+v", r)
+	}
+	if len(resp.Todos) != 2 {
+		t.Errorf("the full sync after the mutations has %d todos, want 2", len(resp.Todos))
+	}
+}
+
+func TestSyncCreateSentAgain(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("syncer")
+	body := map[string]any{
+		"mutations": []map[string]any{
+			{"op": "create", "clientId": "tmp-1", "todo": map[string]string{"title": "Made offline", "description": "Some details", "dueDate": ts.dueDate()}},
+		},
+	}
+
+	rec := ts.expect(http.StatusOK, request{method: http.MethodPost, path: syncURL("syncer"), token: token, body: body})
+	first := decode[todo.SyncResp](t, rec).Results[0]
+	// the client lost the answer and sends its queue again
+	rec = ts.expect(http.StatusOK, request{method: http.MethodPost, path: syncURL("syncer"), token: token, body: body})
+	resp := decode[todo.SyncResp](t, rec)
+	if r := resp.Results[0]; r.Status != todo.SyncApplied || r.TodoID != first.TodoID || r.Todo == nil || r.Todo.TodoId != first.TodoID {
+		t.Errorf("the create sent again = %+v, want the todo %d", r, first.TodoID)
+	}
+	if len(resp.Todos) != 1 {
+		t.Errorf("the user has %d todos, want the one created", len(resp.Todos))
+	}
+
+	// the todo deleted since is not created again
+	ts.expect(http.StatusOK, request{method: http.MethodDelete, path: todoURL("syncer", first.TodoID), token: token})
+	rec = ts.expect(http.StatusOK, request{method: http.MethodPost, path: syncURL("syncer"), token: token, body: body})
+	resp = decode[todo.SyncResp](t, rec)
+	if r := resp.Results[0]; r.Status != todo.SyncApplied || r.TodoID != first.TodoID || r.Todo != nil || len(resp.Todos) != 0 {
+		t.Errorf("the create of a deleted todo sent again = %+v with the todos %+v", r, resp.Todos)
+	}
+}
+
+func TestSyncRejectsInvalidChanges(t *testing.T) {
+	ts := newProductionTestServer(t)
+	token := ts.signup("syncer")
+	id := ts.addTodo(token, "syncer", "Changed offline")
+
+	rec := ts.expect(http.StatusOK, request{method: http.MethodPost, path: syncURL("syncer"), token: token, body: map[string]any{
+		"mutations": []map[string]any{
+			{"op": "update", "todoId": id, "baseVersion": 1, "changes": map[string]any{"title": "ab", "status": 2}},
+			{"op": "update", "todoId": id, "baseVersion": 1, "changes": map[string]any{"title": strings.Repeat("é", 30)}},
+		},
+	}})
+	resp := decode[todo.SyncResp](t, rec)
+	if len(resp.Results) != 2 {
+		t.Fatalf("results = %+v", resp.Results)
+	}
+	if r := resp.Results[0]; r.Status != todo.SyncRejected || len(r.Violations) != 1 || r.Violations[0].Field != "changes.title" {
+		t.Errorf("invalid update result = %+v, want it rejected for its title", r)
+	}
+	// the rejected mutation left the todo as it was
+	if r := resp.Results[1]; r.Status != todo.SyncApplied || r.Todo == nil || r.Todo.Title != strings.Repeat("é", 30) || r.Todo.Status != 0 || r.Todo.Version != 2 {
+		t.Errorf("valid update result = %+v", r)
+	}
+}
@@ -1,21 +1,26 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"net/http"
-	"reflect"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/database"
+	"github.com/xenitane/todo-app-be-oe/internals/events"
 	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
 	"github.com/xenitane/todo-app-be-oe/internals/todo"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
 )
 
 func (s *Server) RegisterTodoRoutes(g *echo.Group) {
 	g.GET("/", s.HandleGetAllTodosOfUser)
-	g.POST("/", s.HandleAddTodoForUser)
+	g.POST("/", s.HandleAddTodoForUser, s.idempotent)
+	g.GET("/search/", s.HandleSearchTodosOfUser)
+	g.POST("/batch/", s.HandleTodoBatch, s.idempotent)
 	todoGroup := g.Group("/:todo")
 	todoGroup.GET("/", s.HandleGetTodoByIDForUser)
 	todoGroup.PATCH("/", s.HandleUpdateTodoByIDForUser)
@@ -43,7 +48,7 @@ func (s *Server) HandleGetAllTodosOfUser(c echo.Context) error {
 			Message: "you dont have access",
 		}
 	}
-	u, err := s.db.GetUserByUserName(c.Param("username"))
+	u, err := s.db.GetUserByUserName(c.Request().Context(), c.Param("username"))
 	if err != nil {
 		return &echo.HTTPError{
 			Code:     http.StatusNotFound,
@@ -52,7 +57,7 @@ func (s *Server) HandleGetAllTodosOfUser(c echo.Context) error {
 		}
 	}
 
-	todos, err := s.db.GetAllTodosForUser(u.UserId)
+	todos, err := s.db.GetAllTodosForUser(c.Request().Context(), u.UserId)
 	if err != nil {
 		return &echo.HTTPError{
 			Code:     http.StatusInternalServerError,
@@ -85,7 +90,7 @@ func (s *Server) HandleAddTodoForUser(c echo.Context) error {
 			Message: "You don't have permissions for this method",
 		}
 	}
-	u, err := s.db.GetUserByUserName(c.Param("username"))
+	u, err := s.db.GetUserByUserName(c.Request().Context(), c.Param("username"))
 	if err != nil {
 		return &echo.HTTPError{
 			Code:     http.StatusNotFound,
@@ -101,26 +106,36 @@ func (s *Server) HandleAddTodoForUser(c echo.Context) error {
 			Internal: err,
 		}
 	}
+	todo, err := s.addTodo(c.Request().Context(), u, todoAddReq)
+	if err != nil {
+		return err
+	}
+	c.JSON(http.StatusCreated, todo)
+	return nil
+}
+
+// addTodo validates the request and adds the todo it describes for u.
+func (s *Server) addTodo(ctx context.Context, u *user.User, todoAddReq *todo.TodoAddReq) (*todo.Todo, error) {
 	todoAddReq.Title = strings.TrimSpace(todoAddReq.Title)
 	todoAddReq.Description = strings.TrimSpace(todoAddReq.Description)
 	if err := s.v.Struct(todoAddReq); err != nil {
-		return &echo.HTTPError{
+		return nil, &echo.HTTPError{
 			Code:     http.StatusUnprocessableEntity,
 			Message:  "invalid request body",
 			Internal: err,
 		}
 	}
-	todo := todo.NewFromAdd(todoAddReq, u.UserId)
-	if err := s.db.InsertTodo(todo); err != nil {
-		return &echo.HTTPError{
+	t := todo.NewFromAdd(todoAddReq, u.UserId)
+	if err := s.db.InsertTodo(ctx, t); err != nil {
+		return nil, &echo.HTTPError{
 			Internal: err,
 			Message:  "internal server error",
 			Code:     http.StatusInternalServerError,
 		}
 	}
-	todo.CreatedAt = time.Now()
-	c.JSON(http.StatusCreated, todo)
-	return nil
+	s.metrics.TodosCreated.Inc()
+	s.publishTodoEvent(ctx, events.TodoCreated, u.Username, t)
+	return t, nil
 }
 
 func (s *Server) HandleGetTodoByIDForUser(c echo.Context) error {
@@ -144,7 +159,7 @@ func (s *Server) HandleGetTodoByIDForUser(c echo.Context) error {
 			Message: "you dont have access",
 		}
 	}
-	u, err := s.db.GetUserByUserName(c.Param("username"))
+	u, err := s.db.GetUserByUserName(c.Request().Context(), c.Param("username"))
 	if err != nil {
 		return &echo.HTTPError{
 			Code:     http.StatusNotFound,
@@ -160,7 +175,7 @@ func (s *Server) HandleGetTodoByIDForUser(c echo.Context) error {
 			Message:  "invalid todo id format",
 		}
 	}
-	todo, err := s.db.GetTodoByIDForUser(todoId, u.UserId)
+	todo, err := s.db.GetTodoByIDForUser(c.Request().Context(), todoId, u.UserId)
 	if err != nil {
 		return &echo.HTTPError{
 			Code:     http.StatusNotFound,
@@ -168,8 +183,7 @@ func (s *Server) HandleGetTodoByIDForUser(c echo.Context) error {
 			Internal: err,
 		}
 	}
-	c.JSON(http.StatusOK, todo)
-	return nil
+	return respondVersioned(c, http.StatusOK, todo.Version, todo)
 }
 
 func (s *Server) HandleUpdateTodoByIDForUser(c echo.Context) error {
@@ -193,7 +207,7 @@ func (s *Server) HandleUpdateTodoByIDForUser(c echo.Context) error {
 			Message: "You don't have permissions for this method",
 		}
 	}
-	u, err := s.db.GetUserByUserName(c.Param("username"))
+	u, err := s.db.GetUserByUserName(c.Request().Context(), c.Param("username"))
 	if err != nil {
 		return &echo.HTTPError{
 			Code:     http.StatusNotFound,
@@ -201,14 +215,6 @@ func (s *Server) HandleUpdateTodoByIDForUser(c echo.Context) error {
 			Internal: err,
 		}
 	}
-	todoUpdateReq := new(todo.TodoUpdateReq)
-	if err := c.Bind(todoUpdateReq); err != nil {
-		return &echo.HTTPError{
-			Code:     http.StatusUnprocessableEntity,
-			Message:  "error binding request body",
-			Internal: err,
-		}
-	}
 	todoId, err := strconv.ParseInt(c.Param("todo"), 10, 64)
 	if err != nil {
 		return &echo.HTTPError{
@@ -217,7 +223,7 @@ func (s *Server) HandleUpdateTodoByIDForUser(c echo.Context) error {
 			Message:  "invalid todo id format",
 		}
 	}
-	todo, err := s.db.GetTodoByIDForUser(todoId, u.UserId)
+	t, err := s.db.GetTodoByIDForUser(c.Request().Context(), todoId, u.UserId)
 	if err != nil {
 		return &echo.HTTPError{
 			Code:     http.StatusNotFound,
@@ -225,45 +231,80 @@ func (s *Server) HandleUpdateTodoByIDForUser(c echo.Context) error {
 			Internal: err,
 		}
 	}
-	flag := false
-	if todoUpdateReq.Title != nil {
-		*todoUpdateReq.Title = strings.TrimSpace(*todoUpdateReq.Title)
-		tlen := len(*todoUpdateReq.Title)
-		if tlen > 3 && tlen < 51 && *todoUpdateReq.Title != todo.Title {
-			flag = true
-			todo.Title = *todoUpdateReq.Title
-		}
+	if err := checkIfMatch(c, t.Version); err != nil {
+		return err
+	}
+	patched := new(todo.TodoPatch)
+	if err := patchDocument(c, todo.NewPatch(t), patched); err != nil {
+		return err
 	}
-	if todoUpdateReq.Description != nil {
-		*todoUpdateReq.Description = strings.TrimSpace(*todoUpdateReq.Description)
-		dlen := len(*todoUpdateReq.Description)
-		if dlen < 321 && todo.Description != *todoUpdateReq.Description {
-			flag = true
-			todo.Description = *todoUpdateReq.Description
+	patched.Trim()
+	if patched.DueDate != nil && patched.DueDate.Equal(t.DueDate) {
+		// a due date that has passed may stay as it is
+		err = s.v.StructExcept(patched, "DueDate")
+	} else {
+		err = s.v.Struct(patched)
+	}
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusUnprocessableEntity,
+			Message:  "invalid request body",
+			Internal: err,
 		}
 	}
-	if todoUpdateReq.Status != nil && *todoUpdateReq.Status >= 0 && *todoUpdateReq.Status < 3 && todo.Status != *todoUpdateReq.Status {
-		todo.Status = *todoUpdateReq.Status
-		flag = true
+	wasCompleted := t.Status == todo.StatusCompleted
+	if patched.Apply(t) {
+		if err := s.storeTodoUpdate(c.Request().Context(), u, t, wasCompleted); err != nil {
+			if errors.Is(err, database.ErrVersionConflict) {
+				return conflictError(c, err)
+			}
+			return err
+		}
 	}
-	if todoUpdateReq.DueDate != nil && !todoUpdateReq.DueDate.Before(time.Now().Round(0)) && reflect.DeepEqual(todo.DueDate, *todoUpdateReq.DueDate) {
-		todo.DueDate = *todoUpdateReq.DueDate
-		flag = true
+	return respondVersioned(c, http.StatusOK, t.Version, t)
+}
+
+// updateTodo checks the update request, applies it to t, a todo of u, and
+// stores it. A write that lost a race returns database.ErrVersionConflict as
+// is.
+func (s *Server) updateTodo(ctx context.Context, u *user.User, t *todo.Todo, todoUpdateReq *todo.TodoUpdateReq) error {
+	todoUpdateReq.Trim()
+	if err := s.v.Struct(todoUpdateReq); err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusUnprocessableEntity,
+			Message:  "invalid request body",
+			Internal: err,
+		}
 	}
+	wasCompleted := t.Status == todo.StatusCompleted
+	flag := t.Apply(todoUpdateReq)
 	if !flag {
 		return &echo.HTTPError{
 			Code:    http.StatusUnprocessableEntity,
 			Message: "invalid request body",
 		}
 	}
-	if err := s.db.UpdateTodoByIdForUser(todo); err != nil {
+	return s.storeTodoUpdate(ctx, u, t, wasCompleted)
+}
+
+// storeTodoUpdate stores t, a todo of u with changes applied, and tells
+// about it. A write that lost a race returns database.ErrVersionConflict as
+// is.
+func (s *Server) storeTodoUpdate(ctx context.Context, u *user.User, t *todo.Todo, wasCompleted bool) error {
+	if err := s.db.UpdateTodoByIdForUser(ctx, t); err != nil {
+		if errors.Is(err, database.ErrVersionConflict) {
+			return err
+		}
 		return &echo.HTTPError{
 			Internal: err,
 			Message:  "internal server error",
 			Code:     http.StatusInternalServerError,
 		}
 	}
-	c.JSON(http.StatusCreated, todo)
+	if !wasCompleted && t.Status == todo.StatusCompleted {
+		s.metrics.TodosCompleted.Inc()
+	}
+	s.publishTodoEvent(ctx, events.TodoUpdated, u.Username, t)
 	return nil
 }
 
@@ -288,7 +329,7 @@ func (s *Server) HandleDeleteTodoByIDForUser(c echo.Context) error {
 			Message: "you dont have access",
 		}
 	}
-	u, err := s.db.GetUserByUserName(c.Param("username"))
+	u, err := s.db.GetUserByUserName(c.Request().Context(), c.Param("username"))
 	if err != nil {
 		return &echo.HTTPError{
 			Code:     http.StatusNotFound,
@@ -304,7 +345,26 @@ func (s *Server) HandleDeleteTodoByIDForUser(c echo.Context) error {
 			Message:  "invalid todo id format",
 		}
 	}
-	err = s.db.DeleteTodoByIDForUser(todoId, u.UserId)
+	// without If-Match the delete is unconditional
+	var version int64
+	if c.Request().Header.Get(headerIfMatch) != "" {
+		t, err := s.db.GetTodoByIDForUser(c.Request().Context(), todoId, u.UserId)
+		if err != nil {
+			return &echo.HTTPError{
+				Code:     http.StatusNotFound,
+				Message:  "this user has no todo with this the given id",
+				Internal: err,
+			}
+		}
+		if err := checkIfMatch(c, t.Version); err != nil {
+			return err
+		}
+		version = t.Version
+	}
+	err = s.db.DeleteTodoByIDForUser(c.Request().Context(), todoId, u.UserId, version)
+	if errors.Is(err, database.ErrVersionConflict) {
+		return conflictError(c, err)
+	}
 	if err != nil {
 		return &echo.HTTPError{
 			Code:     http.StatusNotFound,
@@ -312,6 +372,7 @@ func (s *Server) HandleDeleteTodoByIDForUser(c echo.Context) error {
 			Internal: err,
 		}
 	}
+	s.publishTodoEvent(c.Request().Context(), events.TodoDeleted, u.Username, &todo.Todo{TodoId: todoId})
 
 	return nil
 }
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+func TestTodoLifecycle(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("todoowner")
+
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: todosURL("todoowner")})
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: todosURL("todoowner"), token: token})
+	if todos := decode[[]todo.Todo](t, rec); len(todos) != 0 {
+		t.Errorf("a new user has %d todos", len(todos))
+	}
+
+	id := ts.addTodo(token, "todoowner", "Write the tests")
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: todoURL("todoowner", id), token: token})
+	td := decode[todo.Todo](t, rec)
+	if td.Title != "Write the tests" || td.Status != 0 || td.Version != 1 {
+		t.Errorf("fetched %+v", td)
+	}
+	if got := rec.Header().Get(headerETag); got != `"1"` {
+		t.Errorf("ETag = %q, want \"1\"", got)
+	}
+	ts.expect(http.StatusNotModified, request{method: http.MethodGet, path: todoURL("todoowner", id), token: token, headers: map[string]string{
+		headerIfNoneMatch: `"1"`,
+	}})
+
+	rec = ts.expect(http.StatusOK, request{method: http.MethodPatch, path: todoURL("todoowner", id), token: token, body: map[string]any{
+		"status": todo.StatusCompleted,
+	}})
+	if td := decode[todo.Todo](t, rec); td.Status != todo.StatusCompleted || td.Version != 2 {
+		t.Errorf("patched %+v", td)
+	}
+
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: todosURL("todoowner"), token: token})
+	if todos := decode[[]todo.Todo](t, rec); len(todos) != 1 || todos[0].TodoId != id {
+		t.Errorf("listed %+v", todos)
+	}
+
+	ts.expect(http.StatusPreconditionFailed, request{method: http.MethodDelete, path: todoURL("todoowner", id), token: token, headers: map[string]string{
+		headerIfMatch: `"1"`,
+	}})
+	ts.expect(http.StatusOK, request{method: http.MethodDelete, path: todoURL("todoowner", id), token: token, headers: map[string]string{
+		headerIfMatch: `"2"`,
+	}})
+	ts.expect(http.StatusNotFound, request{method: http.MethodGet, path: todoURL("todoowner", id), token: token})
+	ts.expect(http.StatusNotFound, request{method: http.MethodDelete, path: todoURL("todoowner", id), token: token})
+}
+
+func TestTodoAccess(t *testing.T) {
+	ts := newTestServer(t)
+	owner := ts.signup("todoowner")
+	other := ts.signup("snooping")
+	admin := ts.admin("theadmin")
+	id := ts.addTodo(owner, "todoowner", "Private todo")
+
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: todoURL("todoowner", id), token: other})
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodPatch, path: todoURL("todoowner", id), token: other, body: map[string]any{
+		"status": 1,
+	}})
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodDelete, path: todoURL("todoowner", id), token: other})
+	ts.expect(http.StatusOK, request{method: http.MethodGet, path: todoURL("todoowner", id), token: admin})
+
+	// the todo is not in the path of another user
+	ts.expect(http.StatusNotFound, request{method: http.MethodGet, path: todoURL("snooping", id), token: other})
+}
+
+func TestPatchTodoValidation(t *testing.T) {
+	ts := newProductionTestServer(t)
+	token := ts.signup("todoowner")
+	id := ts.addTodo(token, "todoowner", "Write the tests")
+
+	// titles are counted in characters, not bytes
+	title := strings.Repeat("é", 30)
+	rec := ts.expect(http.StatusOK, request{method: http.MethodPatch, path: todoURL("todoowner", id), token: token, body: map[string]any{
+		"title": title,
+	}})
+	if td := decode[todo.Todo](t, rec); td.Title != title || td.Version != 2 {
+		t.Errorf("patched %+v, want the title %q", td, title)
+	}
+
+	rec = ts.expect(http.StatusUnprocessableEntity, request{method: http.MethodPatch, path: todoURL("todoowner", id), token: token, body: map[string]any{
+		"title":  "ab",
+		"status": todo.StatusCompleted,
+	}})
+	p := decode[xenmw.Problem](t, rec)
+	if p.Code != "validation_failed" || len(p.Violations) != 1 || p.Violations[0].Field != "title" {
+		t.Errorf("answered %+v, want the title reported", p)
+	}
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: todoURL("todoowner", id), token: token})
+	if td := decode[todo.Todo](t, rec); td.Status == todo.StatusCompleted || td.Version != 2 {
+		t.Errorf("the invalid patch stored %+v", td)
+	}
+}
+
+func TestAddTodoValidation(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("todoowner")
+
+	rec := ts.expect(http.StatusBadRequest, request{method: http.MethodPost, path: todosURL("todoowner"), token: token, body: map[string]string{
+		"title":       "abc",
+		"description": "Some details",
+		"dueDate":     ts.dueDate(),
+	}})
+	if code := problemCode(t, rec); code != "validation_failed" {
+		t.Errorf("problem code = %q, want validation_failed", code)
+	}
+
+	// due dates are checked against the clock of the server
+	past := ts.clock.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	ts.expect(http.StatusUnprocessableEntity, request{method: http.MethodPost, path: todosURL("todoowner"), token: token, body: map[string]string{
+		"title":       "Too late",
+		"description": "Some details",
+		"dueDate":     past,
+	}})
+	ts.clock.Set(ts.clock.Now().Add(-2 * time.Hour))
+	ts.expect(http.StatusCreated, request{method: http.MethodPost, path: todosURL("todoowner"), token: token, body: map[string]string{
+		"title":       "Just in time",
+		"description": "Some details",
+		"dueDate":     past,
+	}})
+}
+
+func TestAddTodoIsIdempotent(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("todoowner")
+	r := request{
+		method:  http.MethodPost,
+		path:    todosURL("todoowner"),
+		token:   token,
+		headers: map[string]string{"Idempotency-Key": "add-1"},
+		body: map[string]string{
+			"title":       "Only once",
+			"description": "Some details",
+			"dueDate":     ts.dueDate(),
+		},
+	}
+	ts.expect(http.StatusCreated, r)
+	ts.expect(http.StatusCreated, r)
+
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: todosURL("todoowner"), token: token})
+	if todos := decode[[]todo.Todo](t, rec); len(todos) != 1 {
+		t.Errorf("the retry created %d todos, want 1", len(todos))
+	}
+}
+
+func TestAddTodoIsIdempotentAcrossReplicas(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("todoowner")
+	r := request{
+		method:  http.MethodPost,
+		path:    todosURL("todoowner"),
+		token:   token,
+		headers: map[string]string{"Idempotency-Key": "add-1"},
+		body: map[string]string{
+			"title":       "Only once",
+			"description": "Some details",
+			"dueDate":     ts.dueDate(),
+		},
+	}
+	ts.expect(http.StatusCreated, r)
+	// the retry reaches another replica
+	rec := ts.replica().expect(http.StatusCreated, r)
+	if rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("the retry was not replayed")
+	}
+
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: todosURL("todoowner"), token: token})
+	if todos := decode[[]todo.Todo](t, rec); len(todos) != 1 {
+		t.Errorf("the retry created %d todos, want 1", len(todos))
+	}
+}
+
+func TestSearchTodosOfUser(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("searcher")
+	other := ts.signup("othersearcher")
+	milk := ts.addTodo(token, "searcher", "Buy milk")
+	ts.addTodo(token, "searcher", "Walk the dog")
+	ts.addTodo(other, "othersearcher", "Buy milk too")
+
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: todosURL("searcher") + "search/?q=milk", token: token})
+	results := decode[[]todo.SearchResult](t, rec)
+	if len(results) != 1 || results[0].TodoId != milk || results[0].TitleHighlight != "Buy <mark>milk</mark>" {
+		t.Errorf("found %+v", results)
+	}
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: todosURL("searcher") + "search/?q=milk", token: other})
+}
+
+type testBatchResp struct {
+	Applied bool `json:"applied"`
+	Results []struct {
+		Op     string         `json:"op"`
+		Status int            `json:"status"`
+		Todo   *todo.Todo     `json:"todo"`
+		Error  *xenmw.Problem `json:"error"`
+	} `json:"results"`
+}
+
+func TestBatch(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("batcher")
+	updated := ts.addTodo(token, "batcher", "Update me")
+	deleted := ts.addTodo(token, "batcher", "Delete me")
+
+	rec := ts.expect(http.StatusOK, request{method: http.MethodPost, path: todosURL("batcher") + "batch/", token: token, body: map[string]any{
+		"ops": []map[string]any{
+			{"op": "create", "todo": map[string]string{"title": "Created in a batch", "description": "Some details", "dueDate": ts.dueDate()}},
+			{"op": "update", "todoId": updated, "changes": map[string]any{"status": 1}},
+			{"op": "delete", "todoId": deleted, "version": 1},
+			{"op": "delete", "todoId": 999},
+		},
+	}})
+	resp := decode[testBatchResp](t, rec)
+	var statuses []int
+	for _, r := range resp.Results {
+		statuses = append(statuses, r.Status)
+	}
+	if want := []int{http.StatusCreated, http.StatusOK, http.StatusNoContent, http.StatusNotFound}; fmt.Sprint(statuses) != fmt.Sprint(want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: todosURL("batcher"), token: token})
+	if todos := decode[[]todo.Todo](t, rec); len(todos) != 2 {
+		t.Errorf("%d todos after the batch, want 2", len(todos))
+	}
+}
+
+func TestBatchValidation(t *testing.T) {
+	// past the spec validation, to the checks of the handler
+	ts := newProductionTestServer(t)
+	token := ts.signup("batcher")
+	id := ts.addTodo(token, "batcher", "Keep me")
+
+	rec := ts.expect(http.StatusOK, request{method: http.MethodPost, path: todosURL("batcher") + "batch/", token: token, body: map[string]any{
+		"ops": []map[string]any{
+			{"op": "update", "todoId": id, "changes": map[string]any{"title": "Keep me"}},
+			{"op": "update", "todoId": id, "changes": map[string]any{"title": "ab"}},
+		},
+	}})
+	resp := decode[testBatchResp](t, rec)
+	if len(resp.Results) != 2 {
+		t.Fatalf("results = %+v", resp.Results)
+	}
+	if r := resp.Results[0]; r.Status != http.StatusOK || r.Todo == nil || r.Todo.Version != 1 {
+		t.Errorf("the update changing nothing answered %+v", r)
+	}
+	r := resp.Results[1]
+	if r.Status != http.StatusUnprocessableEntity || r.Error == nil || len(r.Error.Violations) != 1 || r.Error.Violations[0].Field != "ops[1].changes.title" {
+		t.Errorf("the invalid update answered %+v, want a violation of ops[1].changes.title", r)
+	}
+}
+
+func TestAtomicBatch(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("batcher")
+	kept := ts.addTodo(token, "batcher", "Keep me")
+
+	rec := ts.expect(http.StatusNotFound, request{method: http.MethodPost, path: todosURL("batcher") + "batch/", token: token, body: map[string]any{
+		"atomic": true,
+		"ops": []map[string]any{
+			{"op": "create", "todo": map[string]string{"title": "Rolled back", "description": "Some details", "dueDate": ts.dueDate()}},
+			{"op": "delete", "todoId": kept},
+			{"op": "delete", "todoId": 999},
+		},
+	}})
+	resp := decode[testBatchResp](t, rec)
+	if resp.Applied || len(resp.Results) != 3 || resp.Results[0].Status != http.StatusFailedDependency || resp.Results[2].Status != http.StatusNotFound {
+		t.Errorf("batch answered %+v", resp)
+	}
+
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: todosURL("batcher"), token: token})
+	if todos := decode[[]todo.Todo](t, rec); len(todos) != 1 || todos[0].TodoId != kept {
+		t.Errorf("the failed batch was not rolled back: %+v", todos)
+	}
+
+	rec = ts.expect(http.StatusOK, request{method: http.MethodPost, path: todosURL("batcher") + "batch/", token: token, body: map[string]any{
+		"atomic": true,
+		"ops": []map[string]any{
+			{"op": "create", "todo": map[string]string{"title": "Committed", "description": "Some details", "dueDate": ts.dueDate()}},
+			{"op": "delete", "todoId": kept},
+		},
+	}})
+	if resp := decode[testBatchResp](t, rec); !resp.Applied {
+		t.Errorf("batch answered %+v", resp)
+	}
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: todosURL("batcher"), token: token})
+	if todos := decode[[]todo.Todo](t, rec); len(todos) != 1 || todos[0].Title != "Committed" {
+		t.Errorf("the batch was not committed: %+v", todos)
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/events"
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+const trashPurgeInterval = time.Hour
+
+func (s *Server) RegisterTrashRoutes(g *echo.Group) {
+	g.GET("/", s.HandleGetTrash)
+	g.DELETE("/", s.HandleEmptyTrash)
+	todoGroup := g.Group("/:todo")
+	todoGroup.POST("/restore/", s.HandleRestoreTodo)
+	todoGroup.DELETE("/", s.HandlePurgeTodo)
+}
+
+// pathOwner authorizes the caller for the data of the user in the path, such
+// as its trash. Only the owner may modify it, admins may look at it.
+func (s *Server) pathOwner(c echo.Context, write bool) (*user.User, error) {
+	claims, err := getClaims(c)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Username != c.Param("username") && (write || !claims.IsAdmin) {
+		return nil, &echo.HTTPError{
+			Code:    http.StatusUnauthorized,
+			Message: "you dont have access",
+		}
+	}
+	u, err := s.db.GetUserByUserName(c.Request().Context(), c.Param("username"))
+	if err != nil {
+		return nil, &echo.HTTPError{
+			Code:     http.StatusNotFound,
+			Message:  "this user does not exist",
+			Internal: err,
+		}
+	}
+	return u, nil
+}
+
+func (s *Server) HandleGetTrash(c echo.Context) error {
+	u, err := s.pathOwner(c, false)
+	if err != nil {
+		return err
+	}
+	todos, err := s.db.GetTrashedTodosForUser(c.Request().Context(), u.UserId)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "internal server error",
+			Internal: err,
+		}
+	}
+	return c.JSON(http.StatusOK, todos)
+}
+
+func (s *Server) HandleEmptyTrash(c echo.Context) error {
+	u, err := s.pathOwner(c, true)
+	if err != nil {
+		return err
+	}
+	purged, err := s.db.PurgeTrashForUser(c.Request().Context(), u.UserId)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "internal server error",
+			Internal: err,
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]int64{
+		"purged": purged,
+	})
+}
+
+func (s *Server) HandleRestoreTodo(c echo.Context) error {
+	u, err := s.pathOwner(c, true)
+	if err != nil {
+		return err
+	}
+	todoId, err := strconv.ParseInt(c.Param("todo"), 10, 64)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Internal: err,
+			Message:  "invalid todo id format",
+		}
+	}
+	todo, err := s.db.RestoreTodoByIDForUser(c.Request().Context(), todoId, u.UserId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &echo.HTTPError{
+				Code:     http.StatusNotFound,
+				Message:  "there is no todo with the given id in the trash",
+				Internal: err,
+			}
+		}
+		return &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "internal server error",
+			Internal: err,
+		}
+	}
+	s.publishTodoEvent(c.Request().Context(), events.TodoRestored, u.Username, todo)
+	return respondVersioned(c, http.StatusOK, todo.Version, todo)
+}
+
+func (s *Server) HandlePurgeTodo(c echo.Context) error {
+	u, err := s.pathOwner(c, true)
+	if err != nil {
+		return err
+	}
+	todoId, err := strconv.ParseInt(c.Param("todo"), 10, 64)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Internal: err,
+			Message:  "invalid todo id format",
+		}
+	}
+	if err := s.db.PurgeTodoByIDForUser(c.Request().Context(), todoId, u.UserId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &echo.HTTPError{
+				Code:     http.StatusNotFound,
+				Message:  "there is no todo with the given id in the trash",
+				Internal: err,
+			}
+		}
+		return &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "internal server error",
+			Internal: err,
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// purgeTrash permanently deletes todos that outlived the trash retention,
+// once at start and then every trashPurgeInterval until ctx is done.
+func (s *Server) purgeTrash(ctx context.Context) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := s.db.PurgeTrashedTodosOlderThan(ctx, s.trashRetention)
+		if err != nil {
+			s.logger.ErrorContext(ctx, "failed to purge trash", slog.String("err", err.Error()))
+		} else if purged > 0 {
+			s.logger.InfoContext(ctx, "purged the trash", slog.Int64("todos", purged))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
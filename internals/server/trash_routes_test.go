@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/xenitane/todo-app-be-oe/internals/todo"
+)
+
+func trashURL(username string) string {
+	return "/api/user/" + username + "/trash/"
+}
+
+func TestTrash(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("trashowner")
+	other := ts.signup("trashsnoop")
+	admin := ts.admin("theadmin")
+	restored := ts.addTodo(token, "trashowner", "Restore me")
+	purged := ts.addTodo(token, "trashowner", "Purge me")
+	emptied := ts.addTodo(token, "trashowner", "Empty me")
+	for _, id := range []int64{restored, purged, emptied} {
+		ts.expect(http.StatusOK, request{method: http.MethodDelete, path: todoURL("trashowner", id), token: token})
+	}
+
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: trashURL("trashowner"), token: token})
+	if trash := decode[[]todo.Todo](t, rec); len(trash) != 3 || trash[0].DeletedAt == nil {
+		t.Errorf("the trash holds %+v", trash)
+	}
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: trashURL("trashowner"), token: other})
+	// admins may look but not touch
+	ts.expect(http.StatusOK, request{method: http.MethodGet, path: trashURL("trashowner"), token: admin})
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodDelete, path: trashURL("trashowner"), token: admin})
+
+	rec = ts.expect(http.StatusOK, request{method: http.MethodPost, path: fmt.Sprintf("%s%d/restore/", trashURL("trashowner"), restored), token: token})
+	if td := decode[todo.Todo](t, rec); td.TodoId != restored || td.DeletedAt != nil {
+		t.Errorf("restored %+v", td)
+	}
+	ts.expect(http.StatusOK, request{method: http.MethodGet, path: todoURL("trashowner", restored), token: token})
+	ts.expect(http.StatusNotFound, request{method: http.MethodPost, path: fmt.Sprintf("%s%d/restore/", trashURL("trashowner"), restored), token: token})
+
+	ts.expect(http.StatusNoContent, request{method: http.MethodDelete, path: fmt.Sprintf("%s%d/", trashURL("trashowner"), purged), token: token})
+	ts.expect(http.StatusNotFound, request{method: http.MethodDelete, path: fmt.Sprintf("%s%d/", trashURL("trashowner"), purged), token: token})
+
+	rec = ts.expect(http.StatusOK, request{method: http.MethodDelete, path: trashURL("trashowner"), token: token})
+	if got := decode[map[string]int64](t, rec)["purged"]; got != 1 {
+		t.Errorf("emptying the trash purged %d todos, want 1", got)
+	}
+	rec = ts.expect(http.StatusOK, request{method: http.MethodGet, path: trashURL("trashowner"), token: token})
+	if trash := decode[[]todo.Todo](t, rec); len(trash) != 0 {
+		t.Errorf("the emptied trash holds %+v", trash)
+	}
+}
@@ -1,11 +1,14 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
+	"github.com/xenitane/todo-app-be-oe/internals/database"
 	xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
 	"github.com/xenitane/todo-app-be-oe/internals/user"
 )
@@ -16,6 +19,9 @@ func (s *Server) RegisterUserRoutes(g *echo.Group) {
 	userGroup.GET("/", s.HandleUserByUserName)
 	userGroup.PATCH("/", s.HandleUpdateUser)
 	s.RegisterTodoRoutes(userGroup.Group("/todo"))
+	s.RegisterSyncRoutes(userGroup.Group("/sync"))
+	s.RegisterTrashRoutes(userGroup.Group("/trash"))
+	s.RegisterArchiveRoutes(userGroup)
 }
 
 func (s *Server) HandleAllUsers(c echo.Context) error {
@@ -39,7 +45,7 @@ func (s *Server) HandleAllUsers(c echo.Context) error {
 			Message: "you are not admin",
 		}
 	}
-	users, err := s.db.GetAllUsers()
+	users, err := s.db.GetAllUsers(c.Request().Context())
 	if err != nil {
 		return err
 	}
@@ -68,7 +74,7 @@ func (s *Server) HandleUserByUserName(c echo.Context) error {
 			Message: "you don't have permission",
 		}
 	}
-	user, err := s.db.GetUserByUserName(c.Param("username"))
+	user, err := s.db.GetUserByUserName(c.Request().Context(), c.Param("username"))
 	if err != nil {
 		return &echo.HTTPError{
 			Code:     http.StatusNotFound,
@@ -76,8 +82,7 @@ func (s *Server) HandleUserByUserName(c echo.Context) error {
 			Internal: err,
 		}
 	}
-	c.JSON(http.StatusOK, user)
-	return nil
+	return respondVersioned(c, http.StatusOK, user.Version, user)
 }
 
 func (s *Server) HandleUpdateUser(c echo.Context) error {
@@ -101,7 +106,7 @@ func (s *Server) HandleUpdateUser(c echo.Context) error {
 			Message: "you don't have permission",
 		}
 	}
-	u, err := s.db.GetUserByUserName(c.Param("username"))
+	u, err := s.db.GetUserByUserName(c.Request().Context(), c.Param("username"))
 	if err != nil {
 		return &echo.HTTPError{
 			Code:     http.StatusNotFound,
@@ -109,19 +114,41 @@ func (s *Server) HandleUpdateUser(c echo.Context) error {
 			Internal: err,
 		}
 	}
-	userUpdateReq := new(user.UserUpdateReq)
-	if err := c.Bind(userUpdateReq); err != nil {
+	if err := checkIfMatch(c, u.Version); err != nil {
+		return err
+	}
+	patched := new(user.UserPatch)
+	if err := patchDocument(c, user.NewPatch(u), patched); err != nil {
+		return err
+	}
+	patched.Trim()
+	if err := s.v.Struct(patched); err != nil {
 		return &echo.HTTPError{
 			Code:     http.StatusUnprocessableEntity,
-			Message:  "error binding request body",
+			Message:  "invalid request body",
 			Internal: err,
 		}
 	}
+	if changes := patched.Changes(u); changes != nil {
+		if err := s.updateUser(c.Request().Context(), claims, u, changes); err != nil {
+			if errors.Is(err, database.ErrVersionConflict) {
+				return conflictError(c, err)
+			}
+			return err
+		}
+	}
+
+	return respondVersioned(c, http.StatusOK, u.Version, u)
+}
+
+// updateUser applies the update request of the caller to u and stores it.
+// A write that lost a race returns database.ErrVersionConflict as is.
+func (s *Server) updateUser(ctx context.Context, claims *xenmw.JWTCustomClaims, u *user.User, userUpdateReq *user.UserUpdateReq) error {
 	flag := false
 	if userUpdateReq.FirstName != nil {
 		*userUpdateReq.FirstName = strings.TrimSpace(*userUpdateReq.FirstName)
 		lenNewFN := len(*userUpdateReq.FirstName)
-		if lenNewFN > 3 && lenNewFN < 51 && *userUpdateReq.FirstName != u.FirstName {
+		if lenNewFN > 3 && lenNewFN < 51 && s.v.Var(*userUpdateReq.FirstName, "alpha") == nil && *userUpdateReq.FirstName != u.FirstName {
 			flag = true
 			u.FirstName = *userUpdateReq.FirstName
 		}
@@ -129,12 +156,12 @@ func (s *Server) HandleUpdateUser(c echo.Context) error {
 	if userUpdateReq.LastName != nil {
 		*userUpdateReq.LastName = strings.TrimSpace(*userUpdateReq.LastName)
 		lenNewLN := len(*userUpdateReq.LastName)
-		if lenNewLN > 3 && lenNewLN < 51 && *userUpdateReq.LastName != u.LastName {
+		if lenNewLN > 3 && lenNewLN < 51 && s.v.Var(*userUpdateReq.LastName, "alpha") == nil && *userUpdateReq.LastName != u.LastName {
 			flag = true
 			u.LastName = *userUpdateReq.LastName
 		}
 	}
-	if userUpdateReq.Password != nil && !u.MatchPassword(*userUpdateReq.Password) {
+	if userUpdateReq.Password != nil && !u.MatchPassword(ctx, *userUpdateReq.Password) {
 		lenNewPW := len(*userUpdateReq.Password)
 		if lenNewPW < 8 || lenNewPW > 72 {
 			return &echo.HTTPError{
@@ -142,7 +169,7 @@ func (s *Server) HandleUpdateUser(c echo.Context) error {
 				Message: "password length not appropriate",
 			}
 		}
-		if err := u.UpdatePassword(*userUpdateReq.Password); err != nil {
+		if err := u.UpdatePassword(ctx, *userUpdateReq.Password); err != nil {
 			return &echo.HTTPError{
 				Code:     http.StatusInternalServerError,
 				Message:  "some issue with your password",
@@ -165,6 +192,10 @@ func (s *Server) HandleUpdateUser(c echo.Context) error {
 				Message: "you cannot demote yourself",
 			}
 		}
+		// the tokens carry the admin rights they were issued with
+		if u.IsAdmin != *userUpdateReq.IsAdmin {
+			u.TokenVersion++
+		}
 		u.IsAdmin = *userUpdateReq.IsAdmin
 		flag = true
 	}
@@ -175,15 +206,15 @@ func (s *Server) HandleUpdateUser(c echo.Context) error {
 			Message: "invalid request body",
 		}
 	}
-	if err := s.db.UpadteUser(u); err != nil {
+	if err := s.db.UpadteUser(ctx, u); err != nil {
+		if errors.Is(err, database.ErrVersionConflict) {
+			return err
+		}
 		return &echo.HTTPError{
 			Code:     http.StatusInternalServerError,
 			Message:  "internal server error",
 			Internal: err,
 		}
 	}
-
-	c.JSON(http.StatusOK, u)
-
 	return nil
 }
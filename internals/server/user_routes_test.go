@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/xenitane/todo-app-be-oe/internals/user"
+)
+
+func TestAllUsers(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("regular")
+	admin := ts.admin("theadmin")
+
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/api/user/"})
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/api/user/", token: token})
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/api/user/", token: admin})
+	if users := decode[[]user.User](t, rec); len(users) != 2 {
+		t.Errorf("listed %d users, want 2", len(users))
+	}
+}
+
+func TestUserByUserName(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("someone")
+	other := ts.signup("someoneelse")
+	admin := ts.admin("theadmin")
+
+	rec := ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/api/user/someone/", token: token})
+	if u := decode[user.User](t, rec); u.Username != "someone" {
+		t.Errorf("fetched %+v", u)
+	}
+	if got := rec.Header().Get(headerETag); got != `"1"` {
+		t.Errorf("ETag = %q, want \"1\"", got)
+	}
+	ts.expect(http.StatusNotModified, request{method: http.MethodGet, path: "/api/user/someone/", token: token, headers: map[string]string{
+		headerIfNoneMatch: `"1"`,
+	}})
+
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/api/user/someone/", token: other})
+	ts.expect(http.StatusOK, request{method: http.MethodGet, path: "/api/user/someone/", token: admin})
+	ts.expect(http.StatusNotFound, request{method: http.MethodGet, path: "/api/user/nobodyhere/", token: admin})
+}
+
+func TestUpdateUser(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("patched")
+
+	rec := ts.expect(http.StatusOK, request{method: http.MethodPatch, path: "/api/user/patched/", token: token, body: map[string]any{
+		"firstName": "Renamed",
+	}})
+	u := decode[user.User](t, rec)
+	if u.FirstName != "Renamed" || u.Version != 2 {
+		t.Errorf("patched %+v", u)
+	}
+
+	// the names follow the rules of signing up
+	ts.expect(http.StatusUnprocessableEntity, request{method: http.MethodPatch, path: "/api/user/patched/", token: token, body: map[string]any{
+		"lastName": "=cmd|calc",
+	}})
+
+	// a stale precondition
+	ts.expect(http.StatusPreconditionFailed, request{method: http.MethodPatch, path: "/api/user/patched/", token: token, body: map[string]any{
+		"lastName": "Stale",
+	}, headers: map[string]string{headerIfMatch: `"1"`}})
+
+	// a json patch whose test fails
+	ts.expect(http.StatusConflict, request{
+		method:  http.MethodPatch,
+		path:    "/api/user/patched/",
+		token:   token,
+		body:    `[{"op": "test", "path": "/firstName", "value": "Other"}, {"op": "replace", "path": "/firstName", "value": "Another"}]`,
+		headers: map[string]string{"Content-Type": "application/json-patch+json"},
+	})
+
+	// the password changes and signing in needs the new one
+	ts.expect(http.StatusOK, request{method: http.MethodPatch, path: "/api/user/patched/", token: token, body: map[string]any{
+		"password": "a new password",
+	}})
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodPost, path: "/api/auth/signin/", body: map[string]string{
+		"username": "patched",
+		"password": testPassword,
+	}})
+	// which signs the user out
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodGet, path: "/api/user/patched/", token: token})
+}
+
+func TestPromoteUser(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signup("promoted")
+	admin := ts.admin("theadmin")
+
+	ts.expect(http.StatusUnauthorized, request{method: http.MethodPatch, path: "/api/user/promoted/", token: token, body: map[string]any{
+		"isAdmin": true,
+	}})
+	rec := ts.expect(http.StatusOK, request{method: http.MethodPatch, path: "/api/user/promoted/", token: admin, body: map[string]any{
+		"isAdmin": true,
+	}})
+	if u := decode[user.User](t, rec); !u.IsAdmin {
+		t.Error("the user was not promoted")
+	}
+	ts.expect(http.StatusTeapot, request{method: http.MethodPatch, path: "/api/user/theadmin/", token: admin, body: map[string]any{
+		"isAdmin": false,
+	}})
+}
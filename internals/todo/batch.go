@@ -0,0 +1,38 @@
+package todo
+
+const (
+	BatchOpCreate = "create"
+	BatchOpUpdate = "update"
+	BatchOpDelete = "delete"
+)
+
+// BatchOp is one operation of a batch. Updates and deletes may carry the
+// version they expect the todo to be at, like an If-Match header.
+type BatchOp struct {
+	Op      string         `json:"op" validate:"required,oneof=create update delete"`
+	TodoID  int64          `json:"todoId" validate:"required_unless=Op create"`
+	Version *int64         `json:"version"`
+	Todo    *TodoAddReq    `json:"todo" validate:"required_if=Op create"`
+	Changes *TodoUpdateReq `json:"changes" validate:"required_if=Op update"`
+}
+
+// BatchReq runs its operations in order. Atomic batches are all or nothing,
+// the others apply every operation that succeeds.
+type BatchReq struct {
+	Atomic bool      `json:"atomic"`
+	Ops    []BatchOp `json:"ops" validate:"required,min=1,max=200"`
+}
+
+// BatchWrite is a checked operation of an atomic batch, ready to be stored.
+// Creates and updates carry the todo to store, an update stores it if it is
+// still at Todo.Version. Deletes are conditional on a non zero Version.
+// Completes marks updates setting the todo completed, Unchanged those that
+// change nothing and are not stored.
+type BatchWrite struct {
+	Op        string
+	Todo      *Todo
+	TodoID    int64
+	Version   int64
+	Completes bool
+	Unchanged bool
+}
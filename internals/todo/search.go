@@ -0,0 +1,29 @@
+package todo
+
+import "time"
+
+// SearchReq is the query string of a todo search. Terms match as prefixes,
+// "quoted phrases" match as phrases and terms prefixed with - exclude.
+type SearchReq struct {
+	Query     string     `query:"q" validate:"required,max=200"`
+	Status    *int16     `query:"status" validate:"omitempty,min=0,max=2"`
+	DueBefore *time.Time `query:"dueBefore"`
+	DueAfter  *time.Time `query:"dueAfter"`
+	Limit     int        `query:"limit" validate:"min=0,max=100"`
+	Offset    int        `query:"offset" validate:"min=0"`
+}
+
+// SearchQuery is a search as handed to the database. An OwnerID of 0
+// searches the todos of every user.
+type SearchQuery struct {
+	SearchReq
+	OwnerID int64
+}
+
+type SearchResult struct {
+	*Todo
+	Username             string  `json:"username,omitempty"`
+	Rank                 float32 `json:"rank"`
+	TitleHighlight       string  `json:"titleHighlight"`
+	DescriptionHighlight string  `json:"descriptionHighlight"`
+}
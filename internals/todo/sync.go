@@ -0,0 +1,59 @@
+package todo
+
+import xenmw "github.com/xenitane/todo-app-be-oe/internals/middleware"
+
+const (
+	SyncOpCreate = "create"
+	SyncOpUpdate = "update"
+	SyncOpDelete = "delete"
+
+	SyncApplied  = "applied"
+	SyncConflict = "conflict"
+	SyncRejected = "rejected"
+	SyncNotFound = "not_found"
+)
+
+// ChangeSet is what changed for a user after a change token.
+type ChangeSet struct {
+	Token   int64
+	Todos   []*Todo
+	Deleted []int64
+}
+
+// SyncMutation is a change made by an offline client. Creates carry a client
+// chosen id so the client can map it to the id assigned by the server, a
+// create sent again with the same id returns the todo it created; updates
+// and deletes carry the version the client based them on.
+type SyncMutation struct {
+	Op          string         `json:"op" validate:"required,oneof=create update delete"`
+	ClientID    string         `json:"clientId" validate:"required_if=Op create,max=100"`
+	TodoID      int64          `json:"todoId" validate:"required_unless=Op create"`
+	BaseVersion int64          `json:"baseVersion" validate:"required_unless=Op create"`
+	Todo        *TodoAddReq    `json:"todo" validate:"required_if=Op create"`
+	Changes     *TodoUpdateReq `json:"changes" validate:"required_if=Op update"`
+}
+
+type SyncReq struct {
+	Since     string         `json:"since"`
+	Mutations []SyncMutation `json:"mutations" validate:"max=100"`
+}
+
+// SyncResult reports what happened to one mutation. On a conflict Todo is
+// the current server copy, on success the stored one. Rejected mutations
+// list the rules they broke.
+type SyncResult struct {
+	Op         string            `json:"op"`
+	ClientID   string            `json:"clientId,omitempty"`
+	TodoID     int64             `json:"todoId,omitempty"`
+	Status     string            `json:"status"`
+	Error      string            `json:"error,omitempty"`
+	Violations []xenmw.Violation `json:"violations,omitempty"`
+	Todo       *Todo             `json:"todo,omitempty"`
+}
+
+type SyncResp struct {
+	Token   string       `json:"token"`
+	Todos   []*Todo      `json:"todos"`
+	Deleted []int64      `json:"deleted"`
+	Results []SyncResult `json:"results"`
+}
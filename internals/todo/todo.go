@@ -1,9 +1,14 @@
 package todo
 
 import (
+	"strings"
 	"time"
 )
 
+// StatusCompleted is the status of a done todo, the others are pending (0)
+// and in progress (1).
+const StatusCompleted int16 = 2
+
 type TodoAddReq struct {
 	Title       string    `json:"title" validate:"required,min=4,max=50"`
 	Description string    `json:"description" validate:"required,min=0,max=320"`
@@ -11,20 +16,102 @@ type TodoAddReq struct {
 }
 
 type Todo struct {
-	TodoId      int64     `json:"todo_id"`
-	OwnerId     int64     `json:"-"`
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	Status      int16     `json:"status"`
-	DueDate     time.Time `json:"dueDate"`
-	CreatedAt   time.Time `json:"createdAt"`
+	TodoId      int64      `json:"todo_id"`
+	OwnerId     int64      `json:"-"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Status      int16      `json:"status"`
+	DueDate     time.Time  `json:"dueDate"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	Version     int64      `json:"version"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	DeletedAt   *time.Time `json:"deletedAt,omitempty"`
+}
+
+// TodoCount counts the todos of a user by status.
+type TodoCount struct {
+	OwnerId    int64 `json:"-"`
+	Total      int64 `json:"total"`
+	Pending    int64 `json:"pending"`
+	InProgress int64 `json:"inProgress"`
+	Completed  int64 `json:"completed"`
+}
+
+// TodoImport is a todo imported from an archive, with the id it has in the
+// account the archive was exported from.
+type TodoImport struct {
+	SourceID int64
+	Todo     *Todo
 }
 
+// TodoUpdateReq holds the fields to change, the rules are those of
+// TodoPatch for the fields that are set.
 type TodoUpdateReq struct {
-	Title       *string    `json:"title"`
-	Description *string    `json:"description"`
-	Status      *int16     `json:"status"`
-	DueDate     *time.Time `json:"dueDate"`
+	Title       *string    `json:"title" validate:"omitnil,min=4,max=50"`
+	Description *string    `json:"description" validate:"omitnil,max=320"`
+	Status      *int16     `json:"status" validate:"omitnil,min=0,max=2"`
+	DueDate     *time.Time `json:"dueDate" validate:"omitnil,not-stale"`
+}
+
+// Trim trims the text fields, before the request is validated.
+func (u *TodoUpdateReq) Trim() {
+	if u.Title != nil {
+		*u.Title = strings.TrimSpace(*u.Title)
+	}
+	if u.Description != nil {
+		*u.Description = strings.TrimSpace(*u.Description)
+	}
+}
+
+// TodoPatch holds the writable fields of a todo, it is the document merge
+// and json patches of a todo apply to.
+type TodoPatch struct {
+	Title       *string    `json:"title" validate:"required,min=4,max=50"`
+	Description *string    `json:"description" validate:"omitempty,max=320"`
+	Status      *int16     `json:"status" validate:"required,min=0,max=2"`
+	DueDate     *time.Time `json:"dueDate" validate:"required,not-stale"`
+}
+
+func NewPatch(t *Todo) *TodoPatch {
+	return &TodoPatch{
+		Title:       &t.Title,
+		Description: &t.Description,
+		Status:      &t.Status,
+		DueDate:     &t.DueDate,
+	}
+}
+
+// Trim trims the text fields, before the document is validated.
+func (p *TodoPatch) Trim() {
+	if p.Title != nil {
+		*p.Title = strings.TrimSpace(*p.Title)
+	}
+	if p.Description != nil {
+		*p.Description = strings.TrimSpace(*p.Description)
+	}
+}
+
+// Apply copies the fields of the patched document, once validated, onto t
+// and reports whether any of them differed. A null description clears it.
+func (p *TodoPatch) Apply(t *Todo) bool {
+	changed := false
+	if p.Title != nil && *p.Title != t.Title {
+		t.Title, changed = *p.Title, true
+	}
+	description := ""
+	if p.Description != nil {
+		description = *p.Description
+	}
+	if description != t.Description {
+		t.Description, changed = description, true
+	}
+	if p.Status != nil && *p.Status != t.Status {
+		t.Status, changed = *p.Status, true
+	}
+	if p.DueDate != nil && !p.DueDate.Equal(t.DueDate) {
+		t.DueDate, changed = *p.DueDate, true
+	}
+	return changed
 }
 
 func NewFromAdd(t *TodoAddReq, ownerID int64) *Todo {
@@ -36,3 +123,26 @@ func NewFromAdd(t *TodoAddReq, ownerID int64) *Todo {
 		DueDate:     t.DueDate,
 	}
 }
+
+// Apply copies the fields of the update request, once validated, that
+// differ from the todo into it. It reports whether anything changed.
+func (t *Todo) Apply(u *TodoUpdateReq) bool {
+	flag := false
+	if u.Title != nil && *u.Title != t.Title {
+		t.Title = *u.Title
+		flag = true
+	}
+	if u.Description != nil && *u.Description != t.Description {
+		t.Description = *u.Description
+		flag = true
+	}
+	if u.Status != nil && *u.Status != t.Status {
+		t.Status = *u.Status
+		flag = true
+	}
+	if u.DueDate != nil && !t.DueDate.Equal(*u.DueDate) {
+		t.DueDate = *u.DueDate
+		flag = true
+	}
+	return flag
+}
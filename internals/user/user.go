@@ -1,8 +1,11 @@
 package user
 
 import (
+	"context"
+	"strings"
 	"time"
 
+	"github.com/xenitane/todo-app-be-oe/internals/tracing"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -13,11 +16,23 @@ type UserSignUpReq struct {
 	LastName  string `json:"lastName" validate:"required,min=4,max=50,alpha"`
 }
 
+// Trim trims the names, before the request is validated.
+func (r *UserSignUpReq) Trim() {
+	r.Username = strings.TrimSpace(r.Username)
+	r.FirstName = strings.TrimSpace(r.FirstName)
+	r.LastName = strings.TrimSpace(r.LastName)
+}
+
 type UserSignInReq struct {
 	Username string `json:"username" validate:"required"`
 	Password string `json:"password" validate:"required"`
 }
 
+type UserSignInResp struct {
+	User  *User  `json:"user"`
+	Token string `json:"token"`
+}
+
 type UserUpdateReq struct {
 	FirstName *string `json:"firstName"`
 	LastName  *string `json:"lastName"`
@@ -25,6 +40,59 @@ type UserUpdateReq struct {
 	IsAdmin   *bool   `json:"isAdmin"`
 }
 
+// UserPatch holds the writable fields of a user, it is the document merge
+// and json patches of a user apply to. The names follow the rules of
+// UserSignUpReq. The password is write only, it is
+// absent from the document until a patch sets it.
+type UserPatch struct {
+	FirstName *string `json:"firstName" validate:"required,min=4,max=50,alpha"`
+	LastName  *string `json:"lastName" validate:"required,min=4,max=50,alpha"`
+	IsAdmin   *bool   `json:"isAdmin" validate:"required"`
+	Password  *string `json:"password,omitempty" validate:"omitempty,min=8,max=72"`
+}
+
+func NewPatch(u *User) *UserPatch {
+	return &UserPatch{
+		FirstName: &u.FirstName,
+		LastName:  &u.LastName,
+		IsAdmin:   &u.IsAdmin,
+	}
+}
+
+// Trim trims the names, before the document is validated.
+func (p *UserPatch) Trim() {
+	if p.FirstName != nil {
+		*p.FirstName = strings.TrimSpace(*p.FirstName)
+	}
+	if p.LastName != nil {
+		*p.LastName = strings.TrimSpace(*p.LastName)
+	}
+}
+
+// Changes returns the update request of the fields of the patched document
+// that differ from u, nil when none does. Setting the password counts as a
+// change.
+func (p *UserPatch) Changes(u *User) *UserUpdateReq {
+	r := new(UserUpdateReq)
+	changed := false
+	if p.FirstName != nil && *p.FirstName != u.FirstName {
+		r.FirstName, changed = p.FirstName, true
+	}
+	if p.LastName != nil && *p.LastName != u.LastName {
+		r.LastName, changed = p.LastName, true
+	}
+	if p.IsAdmin != nil && *p.IsAdmin != u.IsAdmin {
+		r.IsAdmin, changed = p.IsAdmin, true
+	}
+	if p.Password != nil {
+		r.Password, changed = p.Password, true
+	}
+	if !changed {
+		return nil
+	}
+	return r
+}
+
 type User struct {
 	UserId    int64     `json:"-"`
 	Password  string    `json:"-"`
@@ -33,10 +101,16 @@ type User struct {
 	LastName  string    `json:"lastName"`
 	IsAdmin   bool      `json:"isAdmin"`
 	CreatedAt time.Time `json:"createdAt"`
+	Version   int64     `json:"version"`
+	// Disabled users cannot sign in and their tokens are refused
+	Disabled bool `json:"-"`
+	// TokenVersion is carried by the tokens issued to the user, bumping it
+	// revokes every one of them
+	TokenVersion int64 `json:"-"`
 }
 
-func NewFromReg(u *UserSignUpReq) (*User, error) {
-	hashedPasswordBytes, err := bcrypt.GenerateFromPassword([]byte(u.Password), 7)
+func NewFromReg(ctx context.Context, u *UserSignUpReq) (*User, error) {
+	hashedPassword, err := hashPassword(ctx, u.Password)
 	if err != nil {
 		return nil, err
 	}
@@ -44,19 +118,32 @@ func NewFromReg(u *UserSignUpReq) (*User, error) {
 		FirstName: u.FirstName,
 		LastName:  u.LastName,
 		Username:  u.Username,
-		Password:  string(hashedPasswordBytes),
+		Password:  hashedPassword,
+		Version:   1,
 	}, nil
 }
 
-func (u *User) MatchPassword(password string) bool {
+func (u *User) MatchPassword(ctx context.Context, password string) bool {
+	_, span := tracing.Start(ctx, "user.MatchPassword")
+	defer span.End()
 	return nil == bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
 }
 
-func (u *User) UpdatePassword(password string) error {
-	hashedPasswordBytes, err := bcrypt.GenerateFromPassword([]byte(password), 7)
+// UpdatePassword sets the password and revokes the tokens issued before.
+func (u *User) UpdatePassword(ctx context.Context, password string) error {
+	hashedPassword, err := hashPassword(ctx, password)
 	if err != nil {
 		return err
 	}
-	u.Password = string(hashedPasswordBytes)
+	u.Password = hashedPassword
+	u.TokenVersion++
 	return nil
 }
+
+// hashPassword is traced, bcrypt is slow on purpose.
+func hashPassword(ctx context.Context, password string) (string, error) {
+	_, span := tracing.Start(ctx, "user.HashPassword")
+	hashedPasswordBytes, err := bcrypt.GenerateFromPassword([]byte(password), 7)
+	tracing.End(span, err)
+	return string(hashedPasswordBytes), err
+}